@@ -24,13 +24,13 @@ func FAIReboot(job *xml.Hash) {
     // If the system is in incoming, delete it because faimond-ldap does not
     // cope well with incomplete LDAP objects and tries to boot them from local disk.
     dnparts := strings.SplitN(sys.Text("dn"),",", 2)
-    if len(dnparts) > 1 && strings.HasPrefix(dnparts[1], config.IncomingOU) { delete_system = true }
+    if len(dnparts) > 1 && strings.HasPrefix(dnparts[1], config.IncomingOU()) { delete_system = true }
   }
   
   db.SystemForceFAIState(macaddress, faistate)
   
   if delete_system { 
-    util.Log(1, "INFO! System %v is in %v => Deleting LDAP entry", macaddress, config.IncomingOU)
+    util.Log(1, "INFO! System %v is in %v => Deleting LDAP entry", macaddress, config.IncomingOU())
     err = db.SystemReplace(sys, nil) 
     if err != nil {
       util.Log(0, "ERROR! LDAP error while deleting %v: %v", macaddress, err)
@@ -23,7 +23,6 @@ package action
 import ( 
          "time"
          "strings"
-         "strconv"
          
          "../db"
          "../xml"
@@ -107,7 +106,7 @@ func Init() { // not init() because we need to call it from go-susi.go
             
             if done { 
               util.Log(1, "INFO! No further processing required => Removing job: %v", job)
-              db.JobsRemoveLocal(xml.FilterSimple("id", job.Text("id")), false) 
+              db.JobsCompleteLocal(xml.FilterSimple("id", job.Text("id")), false) 
             }
           }
         })
@@ -151,32 +150,15 @@ func Init() { // not init() because we need to call it from go-susi.go
           periodic := job.Text("periodic")
           if periodic != "none" && periodic != "" {
             t := util.ParseTimestamp(job.Text("timestamp"))
-            p := strings.Split(periodic, "_")
-            if len(p) != 2 {
-              util.Log(0, "ERROR! Illegal <periodic>: %v", periodic)
-              return
-            }
-            period, err := strconv.ParseUint(p[0], 10, 64)
-            if err != nil || period == 0 {
-              util.Log(0, "ERROR! Illegal <periodic>: %v: %v", periodic, err)
-              return
-            }
-            
             for {
-              switch p[1] {
-                case "seconds": t = t.Add(time.Duration(period) * time.Second)
-                case "minutes": t = t.Add(time.Duration(period) * time.Minute)
-                case "hours":   t = t.Add(time.Duration(period) * time.Hour)
-                case "days":    t = t.AddDate(0,0,int(period))
-                case "weeks":   t = t.AddDate(0,0,int(period*7))
-                case "months":  t = t.AddDate(0,int(period),0)
-                case "years":   t = t.AddDate(int(period),0,0)
-                default:
-                     util.Log(0, "ERROR! Unknown periodic unit: %v", p[1])
-                     return
+              var err error
+              t, err = db.PeriodicNext(periodic, t)
+              if err != nil {
+                util.Log(0, "ERROR! %v", err)
+                return
               }
-              // Check condition AFTER the switch to make sure we add
-              // at least 1 periodic unit, even if we are still before the
+              // Check condition AFTER PeriodicNext() to make sure we add
+              // at least 1 period, even if we are still before the
               // original timestamp. This can happen if a job launches
               // early because of <tminus>.
               if !t.Before(time.Now()) { break }
@@ -234,11 +216,11 @@ func Forward(job *xml.Hash) bool {
   
   // remove job with stop_periodic=true after setting progress="forward" to suppress forcing "localboot"
   db.JobsModifyLocal(xml.FilterSimple("id", job.Text("id")), xml.NewHash("job","progress","forward"))
-  db.JobsRemoveLocal(xml.FilterSimple("id", job.Text("id")), true)
+  db.JobsCompleteLocal(xml.FilterSimple("id", job.Text("id")), true)
   
   if !message.Peer(siserver).IsGoSusi() {
     // Wait if the peer is not a go-susi, to prevent the fju caused by 
-    // db.JobsRemoveLocal() above from killing the forwarded job; which 
+    // db.JobsCompleteLocal() above from killing the forwarded job; which 
     // might otherwise happen because gosa-si uses macaddress+headertag to
     // identify jobs and therefore cannot differentiate between the old and
     // the new job.
@@ -272,7 +254,7 @@ func Forward(job *xml.Hash) bool {
   
   go util.WithPanicHandler(func(){
     util.Log(2, "DEBUG! Forwarding to %v: %v", siserver, request)
-    conn, _ := security.SendLnTo(siserver, request, config.ModuleKey["[GOsaPackages]"], true)
+    conn, _ := security.SendLnTo(siserver, request, config.ModuleKey()["[GOsaPackages]"], true)
     if conn != nil {
       conn.Close()
       return
@@ -59,7 +59,7 @@ func Wake(job *xml.Hash) {
       // Now spam all networks with our WOL packet.
       for _, network := range db.SystemNetworksKnown() {
         util.Log(1, "INFO! Spamming network %v with Wake-On-LAN for MAC %v", network, macaddress)
-        if err := util.Wake(macaddress, network); err != nil { 
+        if err := message.WakeOnLAN(macaddress, network); err != nil { 
           util.Log(0, "ERROR! Could not send Wake-On-LAN for MAC %v to %v: %v", macaddress,network,err)
         }
       }
@@ -32,6 +32,8 @@ import (
          "regexp"
          "strings"
          "strconv"
+         "sync"
+         "sync/atomic"
          "crypto/aes"
          "crypto/tls"
          "crypto/x509"
@@ -44,11 +46,368 @@ import (
 // The initialization vector for the AES encryption of GOsa messages.
 var InitializationVector = []byte(util.Md5sum("GONICUS GmbH")[0:aes.BlockSize])
 
-// The keys used to address different gosa-si modules.
-var ModuleKeys = []string{"dummy-key"}
+// The settings that Reload() can change while the program is running.
+// Other goroutines read them with the accessor function of the same name
+// (e.g. Timeout()) which returns the value from Current(). A Reloadable is
+// never modified after it has been published, so that it can be read
+// without locking. See Modify().
+type Reloadable struct {
+  // The keys used to address different gosa-si modules.
+  ModuleKeys []string
 
-// Maps a module name surrounded by brackets (such as "[ServerPackages]") to its key.
-var ModuleKey = map[string]string{}
+  // Maps a module name surrounded by brackets (such as "[ServerPackages]") to its key.
+  ModuleKey map[string]string
+
+  // Path(s) of the CA certificate(s) used to authenticate all other certificates.
+  CACertPath []string
+
+  // The parsed CA certificate(s).
+  CACert []*x509.Certificate
+
+  // Path(s) of certificate revocation lists (PEM or DER) issued by the CA(s)
+  // from CACertPath. Certificates listed in one of them are rejected.
+  CRLPath []string
+
+  // How often the files from CRLPath are re-read.
+  CRLReloadInterval time.Duration
+
+  // Path of the certificate go-susi will present to the other party when
+  // connecting with TLS.
+  CertPath string
+
+  // Path of the key corresponding to the certificate in CertPath.
+  CertKeyPath string
+
+  // Called by db.HooksExecute() to generate the kernel db.
+  KernelListHookPath string
+
+  // Called by db.HooksExecute() to generate the packages db.
+  PackageListHookPath string
+
+  // Called when a job_send_user_msg job is executed.
+  UserMessageHookPath string
+
+  // Called whenever a new_foo_config message is received.
+  NewConfigHookPath string
+
+  // Called whenever a trigger_action_foo message is received.
+  TriggerActionHookPath string
+
+  // Called when a registered message is received that is part of a
+  // successful registration. The hook will not be called for
+  // spurious registered messages.
+  RegisteredHookPath string
+
+  // Called when a set_activated_for_installation message is received.
+  ActivatedHookPath string
+
+  // Called whenever a local job is added, changes its status or progress,
+  // is forwarded or removed. "" means no hook.
+  JobEventHookPath string
+
+  // File to which the job events (see JobEventHookPath) are appended.
+  // "" means no event log.
+  JobEventLogPath string
+
+  // File to which an entry is appended for every state-changing request
+  // (e.g. job_trigger_action_reinstall or sibridge's "kill"). "" means no audit trail.
+  AuditTrailPath string
+
+  // Called when a detect_hardware message is received.
+  // Writes to its standard output the system's hardware configuration
+  // in LDIF format.
+  DetectHardwareHookPath string
+
+  // Path to a hook whose output will be read and converted to
+  // CLMSG_* messages.
+  FAIProgressHookPath string
+
+  // Path to a hook called when "TASKEND savelog" is seen in the output
+  // from the FAIProgressHookPath program. The output from the hook is
+  // sent to the server as CLMSG_save_fai_log message.
+  FAISavelogHookPath string
+
+  // Path to a hook called when "TASKEND audit" is seen in the output
+  // from the FAIProgressHookPath program. The output from the hook is
+  // sent to the server as CLMSG_save_fai_log message.
+  FAIAuditHookPath string
+
+  // Maximum running time of a hook run via db.HookRun(). When it is exceeded,
+  // the hook and all processes it has started are killed. 0 means no limit.
+  // HookTimeouts overrides this for individual hooks.
+  HookTimeout time.Duration
+
+  // Maps the name of a hook's config option (e.g. "package-list-hook", or
+  // "tftp-hook" for hooks from the [tftp] section) to its timeout. Hooks
+  // not listed here use HookTimeout.
+  HookTimeouts map[string]time.Duration
+
+  // Maximum number of hooks db.HookRun() runs at the same time. Further
+  // hooks wait until one of the running hooks has finished. 0 means no limit.
+  HookMaxParallel int
+
+  // Maximum number of bytes db.HookRun() accepts from a hook's stdout (and
+  // separately from its stderr) before killing it. 0 means no limit.
+  HookMaxOutput int64
+
+  // Path where log files from CLMSG_save_fai_log are stored.
+  // Within this directory go-susi creates sub-directories named
+  // after the clients' MAC addresses and symlinks named after the
+  // clients' plain names.
+  FAILogPath string
+
+  // IPv4 address of the TFTP server the ProxyDHCP server sends to PXE clients.
+  // "" means IP.
+  ProxyDHCPServer string
+
+  // text/template that produces the name of the boot file the ProxyDHCP server
+  // sends to a PXE client. See tftp.ProxyDHCPListenAndServe().
+  // The default sends pxelinux.0 to BIOS clients (the pxelinux config takes
+  // care of faiState) and efi32/syslinux.efi or efi64/syslinux.efi to UEFI
+  // clients that should not boot locally (syslinux.efi has no reliable
+  // LOCALBOOT, so these clients get no answer and boot from disk). Other
+  // architectures get no answer.
+  ProxyDHCPFilename string
+
+  // TFTPRegexes and TFTPReplies are lists of equal length.
+  // They correspond to the request_re and reply arguments of
+  // tftp.ListenAndServe(). See there for a detailed explanation.
+  TFTPRegexes []*regexp.Regexp
+  TFTPReplies []string
+
+  // Maps the address (IP:PORT) of a peer server to the SHA-256 fingerprint
+  // (lowercase hex digits) of the certificate it must present. Host names
+  // from the config file are resolved when the config is read, so that
+  // looking up a peer does not require DNS. Peers not listed here are
+  // pinned to the certificate they present on first contact.
+  PeerFingerprints map[string]string
+
+  // Maximum time permitted for a read or write transmission. If this time
+  // is exceeded, the transmission is aborted.
+  Timeout time.Duration
+
+  // Maximum time permitted for STARTTLS and TLS handshake.
+  TimeoutTLS time.Duration
+
+  // Config used for TLS handshake when go-susi is acting as the
+  // server, i.e. the other party initiated the connection.
+  TLSServerConfig *tls.Config
+
+  // Config used for TLS handshake when go-susi is acting as the
+  // client, i.e. it initiates the connection.
+  TLSClientConfig *tls.Config
+
+  // This is set to false if the config file specifies at least one module key.
+  TLSRequired bool
+
+  // Encryption used for non-TLS traffic with other go-susis that support it.
+  // "aes-256-gcm" means that go-susi announces support for authenticated
+  // encryption (see security.GosaSeal()) and uses it with parties that announce
+  // it, too. "legacy" means that go-susi always uses the old gosa-si encryption
+  // when sending. Received messages are accepted in either format.
+  // Both formats derive the key directly from the module key, so the
+  // module keys must be long random strings.
+  Encryption string
+
+  // Maps a module key (see ModuleKey) to its replay protection mode:
+  //   "off":     <msgtime> and <msgnonce> are ignored.
+  //   "check":   If a message has <msgtime> and <msgnonce>, it is rejected
+  //              if it is stale or its nonce has been seen before.
+  //   "require": Like "check", but messages without <msgtime> and <msgnonce>
+  //              are rejected, too.
+  // Only applies to messages received without TLS.
+  ReplayProtection map[string]string
+
+  // Replay protection mode for all keys not in ReplayProtection, such as
+  // the keys of peers and clients from the databases.
+  ReplayProtectionDefault string
+
+  // A message whose <msgtime> differs from the current time by more than
+  // this is rejected as stale (unless replay protection is "off").
+  ReplayWindow time.Duration
+
+  // If an address has been refused this many connections within an hour
+  // because it exceeded its ConnPerHour or ConnParallel limit, it is banned
+  // for BanDuration. 0 means that addresses are never banned.
+  BanThreshold int
+
+  // How long a ban caused by BanThreshold lasts.
+  BanDuration time.Duration
+
+  // Addresses in these networks are never banned. The loopback addresses,
+  // our own IP and the servers from ServerIPsFromConfigFile are exempt, too.
+  BanAllowlist []*net.IPNet
+
+  // Headertags of jobs that may only be launched within their target's
+  // maintenance window. Empty if there is no [maintenance] section in
+  // the config file, which means that no job is ever deferred.
+  MaintenanceJobs []string
+
+  // Maintenance windows from the [maintenance] section. The keys are
+  // "default", "group:<cn of object group>" and "unit:<gosaUnitTag>".
+  // The values use the syntax understood by db.ParseMaintenanceWindows().
+  MaintenanceWindows map[string]string
+
+  // Maps a headertag to the maximum number of local jobs with that headertag
+  // that may be in status "processing" (with progress below 100) at the same time.
+  // Jobs that exceed the limit are queued. Headertags not in the map are unlimited.
+  ThrottleLimits map[string]int
+
+  // Like ThrottleLimits, but the limit applies to the jobs whose targets are in
+  // the same subnet (see ThrottleSubnetPrefix).
+  ThrottleSubnetLimits map[string]int
+
+  // Prefix length of the subnets for ThrottleSubnetLimits (IPv4 only;
+  // IPv6 addresses are grouped into /64 subnets).
+  ThrottleSubnetPrefix int
+
+  // LDAP attribute (lowercase) that contains maintenance windows on system
+  // objects, object groups and gosaAdministrativeUnit objects.
+  // Empty string means that maintenance windows are not read from LDAP.
+  MaintenanceLDAPAttribute string
+
+  // true => add peer servers from DNS to serverdb.
+  DNSLookup bool
+
+  // (R)DN of ou where new systems are put. If it ends with a "," then
+  // LDAPBase will be appended.
+  IncomingOU string
+}
+
+// Holds the current *Reloadable. See Current() and Modify().
+var reloadable atomic.Value
+
+// Serializes Modify().
+var reloadableMutex sync.Mutex
+
+func init() {
+  reloadable.Store(&Reloadable{
+    ModuleKeys:               []string{"dummy-key"},
+    ModuleKey:                map[string]string{},
+    CACertPath:               []string{"/etc/gosa-si/ca.cert"},
+    CRLPath:                  []string{},
+    CRLReloadInterval:        1 * time.Hour,
+    CertPath:                 "/etc/gosa-si/si.cert",
+    CertKeyPath:              "/etc/gosa-si/si.key",
+    KernelListHookPath:       "/usr/lib/go-susi/generate_kernel_list",
+    PackageListHookPath:      "/usr/lib/go-susi/generate_package_list",
+    UserMessageHookPath:      "/usr/lib/go-susi/send_user_msg",
+    NewConfigHookPath:        "/usr/lib/go-susi/update_config_files",
+    TriggerActionHookPath:    "/usr/lib/go-susi/trigger_action",
+    RegisteredHookPath:       "/usr/lib/go-susi/registered",
+    ActivatedHookPath:        "/usr/lib/go-susi/activated",
+    JobEventHookPath:         "",
+    JobEventLogPath:          "",
+    AuditTrailPath:           "",
+    DetectHardwareHookPath:   "/usr/lib/go-susi/detect_hardware",
+    FAIProgressHookPath:      "/usr/lib/go-susi/fai_progress",
+    FAISavelogHookPath:       "/usr/lib/go-susi/fai_savelog",
+    FAIAuditHookPath:         "/usr/lib/go-susi/fai_audit",
+    HookTimeout:              10*time.Minute,
+    HookTimeouts:             defaultHookTimeouts(),
+    HookMaxParallel:          16,
+    HookMaxOutput:            16*1024*1024,
+    FAILogPath:               "/var/log/fai",
+    ProxyDHCPServer:          "",
+    ProxyDHCPFilename:        `{{if eq .Firmware "bios"}}pxelinux.0{{else if and (or (eq .Firmware "efi32") (eq .Firmware "efi64")) (ne (bootaction .FAIState) "localboot")}}{{.Firmware}}/syslinux.efi{{end}}`,
+    TFTPRegexes:              []*regexp.Regexp{},
+    TFTPReplies:              []string{},
+    PeerFingerprints:         map[string]string{},
+    Timeout:                  5 * time.Minute,
+    TimeoutTLS:               1 * time.Second,
+    TLSRequired:              true,
+    Encryption:               "aes-256-gcm",
+    ReplayProtection:         map[string]string{},
+    ReplayProtectionDefault:  "check",
+    ReplayWindow:             5*time.Minute,
+    BanThreshold:             100,
+    BanDuration:              24 * time.Hour,
+    BanAllowlist:             []*net.IPNet{},
+    MaintenanceJobs:          []string{},
+    MaintenanceWindows:       map[string]string{},
+    ThrottleLimits:           map[string]int{},
+    ThrottleSubnetLimits:     map[string]int{},
+    ThrottleSubnetPrefix:     24,
+    MaintenanceLDAPAttribute: "gotomaintenancewindow",
+    DNSLookup:                true,
+    IncomingOU:               "ou=incoming,",
+  })
+}
+
+// Returns the current settings that Reload() can change. The returned
+// Reloadable and its slices and maps MUST NOT be modified. Use this instead
+// of the individual accessor functions if several settings must be from
+// the same configuration.
+func Current() *Reloadable {
+  return reloadable.Load().(*Reloadable)
+}
+
+// Calls f with a copy of Current() and publishes the result as the new
+// current settings. Goroutines that have obtained the old settings keep
+// using them, so f MUST NOT modify the slices and maps it finds in the
+// copy but has to replace them with new ones.
+func Modify(f func(r *Reloadable)) {
+  reloadableMutex.Lock()
+  defer reloadableMutex.Unlock()
+  r := *Current()
+  f(&r)
+  reloadable.Store(&r)
+}
+
+// Accessors for the settings from Current(). See Reloadable for their
+// documentation.
+func ModuleKeys() []string { return Current().ModuleKeys }
+func ModuleKey() map[string]string { return Current().ModuleKey }
+func CACertPath() []string { return Current().CACertPath }
+func CACert() []*x509.Certificate { return Current().CACert }
+func CRLPath() []string { return Current().CRLPath }
+func CRLReloadInterval() time.Duration { return Current().CRLReloadInterval }
+func CertPath() string { return Current().CertPath }
+func CertKeyPath() string { return Current().CertKeyPath }
+func KernelListHookPath() string { return Current().KernelListHookPath }
+func PackageListHookPath() string { return Current().PackageListHookPath }
+func UserMessageHookPath() string { return Current().UserMessageHookPath }
+func NewConfigHookPath() string { return Current().NewConfigHookPath }
+func TriggerActionHookPath() string { return Current().TriggerActionHookPath }
+func RegisteredHookPath() string { return Current().RegisteredHookPath }
+func ActivatedHookPath() string { return Current().ActivatedHookPath }
+func JobEventHookPath() string { return Current().JobEventHookPath }
+func JobEventLogPath() string { return Current().JobEventLogPath }
+func AuditTrailPath() string { return Current().AuditTrailPath }
+func DetectHardwareHookPath() string { return Current().DetectHardwareHookPath }
+func FAIProgressHookPath() string { return Current().FAIProgressHookPath }
+func FAISavelogHookPath() string { return Current().FAISavelogHookPath }
+func FAIAuditHookPath() string { return Current().FAIAuditHookPath }
+func HookTimeout() time.Duration { return Current().HookTimeout }
+func HookTimeouts() map[string]time.Duration { return Current().HookTimeouts }
+func HookMaxParallel() int { return Current().HookMaxParallel }
+func HookMaxOutput() int64 { return Current().HookMaxOutput }
+func FAILogPath() string { return Current().FAILogPath }
+func ProxyDHCPServer() string { return Current().ProxyDHCPServer }
+func ProxyDHCPFilename() string { return Current().ProxyDHCPFilename }
+func TFTPRegexes() []*regexp.Regexp { return Current().TFTPRegexes }
+func TFTPReplies() []string { return Current().TFTPReplies }
+func PeerFingerprints() map[string]string { return Current().PeerFingerprints }
+func Timeout() time.Duration { return Current().Timeout }
+func TimeoutTLS() time.Duration { return Current().TimeoutTLS }
+func TLSServerConfig() *tls.Config { return Current().TLSServerConfig }
+func TLSClientConfig() *tls.Config { return Current().TLSClientConfig }
+func TLSRequired() bool { return Current().TLSRequired }
+func Encryption() string { return Current().Encryption }
+func ReplayProtection() map[string]string { return Current().ReplayProtection }
+func ReplayProtectionDefault() string { return Current().ReplayProtectionDefault }
+func ReplayWindow() time.Duration { return Current().ReplayWindow }
+func BanThreshold() int { return Current().BanThreshold }
+func BanDuration() time.Duration { return Current().BanDuration }
+func BanAllowlist() []*net.IPNet { return Current().BanAllowlist }
+func MaintenanceJobs() []string { return Current().MaintenanceJobs }
+func MaintenanceWindows() map[string]string { return Current().MaintenanceWindows }
+func ThrottleLimits() map[string]int { return Current().ThrottleLimits }
+func ThrottleSubnetLimits() map[string]int { return Current().ThrottleSubnetLimits }
+func ThrottleSubnetPrefix() int { return Current().ThrottleSubnetPrefix }
+func MaintenanceLDAPAttribute() string { return Current().MaintenanceLDAPAttribute }
+func DNSLookup() bool { return Current().DNSLookup }
+func IncomingOU() string { return Current().IncomingOU }
 
 // The address to listen on. "127.0.0.1:<port>" listens only for connections from
 // the local machine. ":<port>" allows connections from anywhere.
@@ -78,19 +437,6 @@ var ClientConfigPath = "/etc/gosa-si/client.conf"
 // If empty, no extra info will be added to here_i_am.
 var ExtraInfoFilePath = ""
 
-// Path(s) of the CA certificate(s) used to authenticate all other certificates.
-var CACertPath = []string{"/etc/gosa-si/ca.cert"}
-
-// The parsed CA certificate(s).
-var CACert []*x509.Certificate
-
-// Path of the certificate go-susi will present to the other party when
-// connecting with TLS.
-var CertPath = "/etc/gosa-si/si.cert"
-
-// Path of the key corresponding to the certificate in CertPath.
-var CertKeyPath = "/etc/gosa-si/si.key"
-
 // Path to config file with additional DNs of OUs for finding servers.
 var ServersOUConfigPath = "/etc/gosa/ou=servers.conf"
 
@@ -103,62 +449,37 @@ var ServerDBPath = "/var/lib/go-susi/serverdb.xml"
 // Path to database of clients (foreign and our own).
 var ClientDBPath = "/var/lib/go-susi/clientdb.xml"
 
+// Path to database of banned IP addresses.
+var BanDBPath = "/var/lib/go-susi/bandb.xml"
+
 // Directory where package-list-hook should store its cache.
 var PackageCacheDir = "/var/lib/go-susi"
 
-// Called by db.HooksExecute() to generate the kernel db.
-var KernelListHookPath = "/usr/lib/go-susi/generate_kernel_list"
-
-// Called by db.HooksExecute() to generate the packages db.
-var PackageListHookPath = "/usr/lib/go-susi/generate_package_list"
-
-// Called when a job_send_user_msg job is executed.
-var UserMessageHookPath = "/usr/lib/go-susi/send_user_msg"
-
-// Called whenever a new_foo_config message is received.
-var NewConfigHookPath = "/usr/lib/go-susi/update_config_files"
-
-// Called whenever a trigger_action_foo message is received.
-var TriggerActionHookPath = "/usr/lib/go-susi/trigger_action"
-
-// Called when a registered message is received that is part of a
-// successful registration. The hook will not be called for
-// spurious registered messages.
-var RegisteredHookPath = "/usr/lib/go-susi/registered"
-
-// Called when a set_activated_for_installation message is received.
-var ActivatedHookPath = "/usr/lib/go-susi/activated"
-
-// Called when a detect_hardware message is received.
-// Writes to its standard output the system's hardware configuration
-// in LDIF format.
-var DetectHardwareHookPath = "/usr/lib/go-susi/detect_hardware"
+// Port for accepting FAI status updates sent via /usr/lib/fai/subroutines:sendmon()
+var FAIMonPort = "disabled"
 
-// Path to a hook whose output will be read and converted to
-// CLMSG_* messages.
-var FAIProgressHookPath = "/usr/lib/go-susi/fai_progress"
+// UDP Port for receiving TFTP requests
+var TFTPPort = "69"
 
-// Path to a hook called when "TASKEND savelog" is seen in the output
-// from the FAIProgressHookPath program. The output from the hook is
-// sent to the server as CLMSG_save_fai_log message.
-var FAISavelogHookPath = "/usr/lib/go-susi/fai_savelog"
+// TCP Port for serving the TFTP mappings via HTTP (iPXE, UEFI HTTP boot).
+// "disabled" means no HTTP boot server.
+var HTTPBootPort = "disabled"
 
-// Path to a hook called when "TASKEND audit" is seen in the output
-// from the FAIProgressHookPath program. The output from the hook is
-// sent to the server as CLMSG_save_fai_log message.
-var FAIAuditHookPath = "/usr/lib/go-susi/fai_audit"
+// UDP Port for answering PXE clients as ProxyDHCP server (usually "4011").
+// "disabled" means no ProxyDHCP server. See tftp.ProxyDHCPListenAndServe().
+var ProxyDHCPPort = "disabled"
 
-// Path where log files from CLMSG_save_fai_log are stored.
-// Within this directory go-susi creates sub-directories named
-// after the clients' MAC addresses and symlinks named after the
-// clients' plain names.
-var FAILogPath = "/var/log/fai"
+// UDP Port for answering broadcast DHCPDISCOVERs from PXE clients as ProxyDHCP
+// server. Only used if ProxyDHCPPort is not "disabled". "disabled" means that
+// only requests on ProxyDHCPPort are answered.
+var ProxyDHCPBroadcastPort = "67"
 
-// Port for accepting FAI status updates sent via /usr/lib/fai/subroutines:sendmon()
-var FAIMonPort = "disabled"
+// TCP Port for serving Prometheus metrics via HTTP. "disabled" means no metrics.
+var MetricsPort = "disabled"
 
-// UDP Port for receiving TFTP requests
-var TFTPPort = "69"
+// TCP Port for the HTTPS/JSON API. "disabled" means no API listener.
+// The API requires TLS, so it is only available if a certificate is configured.
+var APIPort = "disabled"
 
 // Potential ports for clients. This list is used for 2 purposes:
 //   1) to distinguish between standard clients and test clients
@@ -166,12 +487,6 @@ var TFTPPort = "69"
 // NOTE: The server port is appended to this list by ReadConfig().
 var ClientPorts = []string{"20083"}
 
-// TFTPRegexes and TFTPReplies are lists of equal length.
-// They correspond to the request_re and reply arguments of
-// tftp.ListenAndServe(). See there for a detailed explanation.
-var TFTPRegexes = []*regexp.Regexp{}
-var TFTPReplies = []string{}
-
 // Temporary directory only accessible by the user running go-susi.
 // Used e.g. for storing password files. Deleted in config.Shutdown().
 var TempDir = ""
@@ -252,24 +567,6 @@ var HIAMaxInfoSize = 4096
 // no further connections will be accepted on the socket.
 var MaxConnections int32 = 512
 
-// Maximum time permitted for a read or write transmission. If this time
-// is exceeded, the transmission is aborted.
-var Timeout = 5 * time.Minute
-
-// Maximum time permitted for STARTTLS and TLS handshake.
-var TimeoutTLS = 1 * time.Second
-
-// Config used for TLS handshake when go-susi is acting as the
-// server, i.e. the other party initiated the connection.
-var TLSServerConfig *tls.Config
-
-// Config used for TLS handshake when go-susi is acting as the
-// client, i.e. it initiates the connection.
-var TLSClientConfig *tls.Config
-
-// This is set to false if the config file specifies at least one module key.
-var TLSRequired = true
-
 // Maximum time allowed for detect-hardware-hook. If the hook does not complete
 // in this time, a standard detected_hardware message will be sent to the server.
 var DetectHardwareTimeout = 30 * time.Second
@@ -320,6 +617,24 @@ var MaxPeerDowntime = 7 * 24 * time.Hour
 // to make sure its derived wait time is still enough.
 var GosaQueryJobdbMaxDelay = 4*time.Second
 
+// The maximum number of job events waiting to be passed to the
+// job-event-hook and the job event log. If the hook can not keep up,
+// further events are dropped until the backlog has been worked off.
+var JobEventQueueMax = 10000
+
+// The number of goroutines per ProxyDHCP port that answer PXE requests.
+// Each request may require an LDAP lookup, so the number is bounded.
+var ProxyDHCPWorkers = 8
+
+// The maximum number of PXE requests per ProxyDHCP port waiting for one of
+// the ProxyDHCPWorkers. Further requests are dropped. PXE clients repeat
+// unanswered requests, so this only delays clients during a flood.
+var ProxyDHCPQueueMax = 64
+
+// Module keys shorter than this cause a warning when the config is read,
+// because they can be guessed from captured messages.
+const MinModuleKeyLength = 20
+
 // The interval between calls to db.groomJobDB() to clean up stale jobs.
 var JobDBGroomInterval = 1*time.Hour
 
@@ -347,9 +662,6 @@ var CNAutoSuffix = "_"
 // If true, existing data in /var/lib/go-susi will be discarded.
 var FreshDatabase = false
 
-// true => add peer servers from DNS to serverdb.
-var DNSLookup = true
-
 // List of domains, each starting with a dot, that will be
 // appended in turn to short names that DNS can't resolve.
 var LookupDomains = []string{}
@@ -378,6 +690,21 @@ var LDAPUser = ""
 // File containing the password of the user for reading from LDAP.
 var LDAPUserPasswordFile string
 
+// "native" to use go-susi's built-in LDAP client, "cli" to fork
+// ldapsearch/ldapmodify for every LDAP operation.
+var LDAPClient = "native"
+
+// If true, the native LDAP client issues StartTLS on ldap:// connections.
+var LDAPStartTLS = false
+
+// If non-empty, the native LDAP client only accepts LDAP server certificates
+// signed by the CA in this file. Otherwise the system's CAs are used.
+var LDAPCACertPath = ""
+
+// Maximum number of idle connections the native LDAP client keeps open
+// (separately for LDAPUser and LDAPAdmin).
+var LDAPPoolSize = 4
+
 // The unit tag for this server. If "", unit tags are not used.
 var UnitTag = ""
 
@@ -394,10 +721,6 @@ var Department = ""
 // the dn of the ou=fai that contains all the FAI classes
 var FAIBase = ""
 
-// (R)DN of ou where new systems are put. If it ends with a "," then
-// LDAPBase will be appended.
-var IncomingOU = "ou=incoming,"
-
 // db.FAIClasses() will not return entries older than this.
 // See also FAIClassesCacheYoungAge
 var FAIClassesMaxAge = 30 * time.Second
@@ -418,11 +741,6 @@ var PrintHelp = false
 // true if "--stats" is passed on the command line
 var PrintStats = false
 
-const re_1xx = "(1([0-9]?[0-9]?))"
-const re_2xx = "(2([6-9]|([0-4][0-9]?)|(5[0-5]?))?)"
-const re_xx  = "([3-9][0-9]?)"
-const ip_part = "(0|"+re_1xx+"|"+re_2xx+"|"+re_xx+")"
-var ipRegexp = regexp.MustCompile("^"+ip_part+"([.]"+ip_part+"){3}$")
 var macAddressRegexp = regexp.MustCompile("^[0-9A-Fa-f]{2}(:[0-9A-Fa-f]{2}){5}$")
 // valid as per RFC 1123. Originally, RFC 952 specified that hostname segments could not start with a digit.
 var hostnameRegexp = regexp.MustCompile("^([A-Za-z0-9]|[A-Za-z0-9][A-Za-z0-9-]*[A-Za-z0-9])$")
@@ -471,12 +789,15 @@ func ReadArgs(args []string) {
       JobDBPath = testdir + "/jobdb.xml"
       ServerDBPath = testdir + "/serverdb.xml"
       ClientDBPath = testdir + "/clientdb.xml"
-      CACertPath = []string{testdir + "/ca.cert"}
-      CertPath = testdir + "/si.cert"
-      CertKeyPath = testdir + "/si.key"
-
+      BanDBPath = testdir + "/bandb.xml"
       PackageCacheDir = testdir
-      FAILogPath = testdir
+      Modify(func(r *Reloadable) {
+        r.AuditTrailPath = testdir + "/audit-trail.log"
+        r.CACertPath = []string{testdir + "/ca.cert"}
+        r.CertPath = testdir + "/si.cert"
+        r.CertKeyPath = testdir + "/si.key"
+        r.FAILogPath = testdir
+      })
       
     } else if arg == "-c" {
       i++
@@ -506,14 +827,23 @@ func ReadArgs(args []string) {
 // Parses the relevant configuration files and sets 
 // the config variables accordingly.
 func ReadConfig() {
+  conf, tftp_mappings := readConfigFiles()
+  readStartupConfig(conf)
+  Modify(func(r *Reloadable) { readReloadableConfig(r, conf, tftp_mappings) })
+  startupConf = map[string]string{}
+  for _, name := range startupSettings {
+    startupConf[name] = configValue(conf, name)
+  }
+}
+
+// Reads the config files and returns their contents as a map from section
+// name to a map from key to value. The [tftp] mappings are returned
+// separately as a deque of alternating patterns and replies, because
+// their order matters.
+func readConfigFiles() (map[string]map[string]string, *deque.Deque) {
   conf := map[string]map[string]string{"":map[string]string{}}
   
-  var tftp_mappings deque.Deque
-  
-  // [general]/pxelinux-cfg-hook is deprecated and only supported for
-  // backwards compatibility. It will be converted to patterns later.
-  // That's why this is a local variable and not a global one.
-  pxeLinuxCfgHookPath := "/usr/lib/go-susi/generate_pxelinux_cfg"
+  tftp_mappings := &deque.Deque{}
   
   for _, configfile := range []string{ClientConfigPath, ServerConfigPath} {
     if configfile == "" { continue }
@@ -568,128 +898,291 @@ func ReadConfig() {
     }
   }
   
+  return conf, tftp_mappings
+}
+
+// Sets the settings in r that can be changed while the program is
+// running (see Reload()) from conf and tftp_mappings as returned by
+// readConfigFiles().
+func readReloadableConfig(r *Reloadable, conf map[string]map[string]string, tftp_mappings *deque.Deque) {
+  // [general]/pxelinux-cfg-hook is deprecated and only supported for
+  // backwards compatibility. It will be converted to patterns later.
+  // That's why this is a local variable and not a global one.
+  pxeLinuxCfgHookPath := "/usr/lib/go-susi/generate_pxelinux_cfg"
+  
+  // NOTE: r is a copy of the current settings (see Modify()), so slices
+  // and maps must be replaced, not modified, because other goroutines
+  // may still be using the old ones.
+  module_keys := []string{"dummy-key"}
+  module_key := map[string]string{}
+  replay_protection := map[string]string{}
+  hook_timeouts := defaultHookTimeouts()
   for sectionname, section := range conf {
     if sectkey, ok := section["key"]; ok {
-      ModuleKeys = append(ModuleKeys, sectkey)
-      ModuleKey[sectionname] = sectkey
+      module_keys = append(module_keys, sectkey)
+      module_key[sectionname] = sectkey
+      if mode, ok := section["replay-protection"]; ok {
+        if readReplayProtection(sectionname+"/replay-protection", mode, &mode) {
+          replay_protection[sectkey] = mode
+        }
+      }
     }
   }
+  r.ModuleKeys = module_keys
+  r.ModuleKey = module_key
+  r.ReplayProtection = replay_protection
   
-  TLSRequired = len(ModuleKey) == 0
+  r.TLSRequired = len(r.ModuleKey) == 0
   
   if general, ok := conf["[general]"]; ok {
-    if logfile, ok := general["log-file"]; ok {
-      LogFilePath = logfile
-    }
     if failogdir, ok := general["fai-log-dir"]; ok {
-      FAILogPath = failogdir
+      r.FAILogPath = failogdir
     }
     if kernel_list_hook, ok := general["kernel-list-hook"]; ok {
-      KernelListHookPath = kernel_list_hook
+      r.KernelListHookPath = kernel_list_hook
     }
     if package_list_hook, ok := general["package-list-hook"]; ok {
-      PackageListHookPath = package_list_hook
+      r.PackageListHookPath = package_list_hook
     }
     if user_msg_hook, ok := general["user-msg-hook"]; ok {
-      UserMessageHookPath = user_msg_hook
+      r.UserMessageHookPath = user_msg_hook
     }
     if pxelinux_cfg_hook, ok := general["pxelinux-cfg-hook"]; ok {
       pxeLinuxCfgHookPath = pxelinux_cfg_hook
     }
     if new_config_hook, ok := general["new-config-hook"]; ok {
-      NewConfigHookPath = new_config_hook
+      r.NewConfigHookPath = new_config_hook
     }
     if trigger_action_hook, ok := general["trigger-action-hook"]; ok {
-      TriggerActionHookPath = trigger_action_hook
+      r.TriggerActionHookPath = trigger_action_hook
     }
     if registered_hook, ok := general["registered-hook"]; ok {
-      RegisteredHookPath = registered_hook
+      r.RegisteredHookPath = registered_hook
     }
     if activated_hook, ok := general["activated-hook"]; ok {
-      ActivatedHookPath = activated_hook
+      r.ActivatedHookPath = activated_hook
+    }
+    if job_event_hook, ok := general["job-event-hook"]; ok {
+      r.JobEventHookPath = job_event_hook
+    }
+    if job_event_log, ok := general["job-event-log"]; ok {
+      r.JobEventLogPath = job_event_log
+    }
+    if audit_trail, ok := general["audit-trail"]; ok {
+      r.AuditTrailPath = audit_trail
     }
     if detect_hardware_hook, ok := general["detect-hardware-hook"]; ok {
-      DetectHardwareHookPath = detect_hardware_hook
+      r.DetectHardwareHookPath = detect_hardware_hook
     }
     if fai_progress, ok := general["fai-progress-hook"]; ok {
-      FAIProgressHookPath = fai_progress
+      r.FAIProgressHookPath = fai_progress
     }
     if fai_savelog, ok := general["fai-savelog-hook"]; ok {
-      FAISavelogHookPath = fai_savelog
+      r.FAISavelogHookPath = fai_savelog
     }
     if fai_audit, ok := general["fai-audit-hook"]; ok {
-      FAIAuditHookPath = fai_audit
+      r.FAIAuditHookPath = fai_audit
+    }
+    if timeout, ok := general["timeout"]; ok {
+      readDuration("[general]/timeout", timeout, &r.Timeout)
+    }
+    if timeout, ok := general["hook-timeout"]; ok {
+      readHookTimeout("[general]/hook-timeout", timeout, &r.HookTimeout)
+    }
+    for key, value := range general {
+      if strings.HasSuffix(key, "-hook-timeout") {
+        var timeout time.Duration
+        if readHookTimeout("[general]/"+key, value, &timeout) {
+          hook_timeouts[strings.TrimSuffix(key, "-timeout")] = timeout
+        }
+      }
+    }
+    if parallel, ok := general["hook-max-parallel"]; ok {
+      n, err := strconv.Atoi(strings.TrimSpace(parallel))
+      if err != nil || n < 0 {
+        util.Log(0, "ERROR! ReadConfig: [general]/hook-max-parallel: Illegal value \"%v\"", parallel)
+      } else {
+        r.HookMaxParallel = n
+      }
+    }
+    if output, ok := general["hook-max-output"]; ok {
+      n, err := strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+      if err != nil || n < 0 {
+        util.Log(0, "ERROR! ReadConfig: [general]/hook-max-output: Illegal value \"%v\"", output)
+      } else {
+        r.HookMaxOutput = n
+      }
+    }
+    if mode, ok := general["replay-protection"]; ok {
+      readReplayProtection("[general]/replay-protection", mode, &r.ReplayProtectionDefault)
+    }
+    if window, ok := general["replay-window"]; ok {
+      readDuration("[general]/replay-window", window, &r.ReplayWindow)
+    }
+    if encryption, ok := general["encryption"]; ok {
+      encryption = strings.TrimSpace(encryption)
+      if encryption != "aes-256-gcm" && encryption != "legacy" {
+        util.Log(0, "ERROR! ReadConfig: [general]/encryption must be \"aes-256-gcm\" or \"legacy\", not \"%v\"", encryption)
+      } else {
+        r.Encryption = encryption
+      }
     }
   }
+  // The AES key is derived from the module key without key stretching
+  // (see security.GosaSeal()), so a short key can be guessed offline from
+  // a single captured message.
+  for _, key := range r.ModuleKeys {
+    if len(key) < MinModuleKeyLength {
+      util.Log(0, "WARNING! [SECURITY] A module key has fewer than %v characters. Use long random keys.", MinModuleKeyLength)
+      break
+    }
+  }
+  r.HookTimeouts = hook_timeouts
   
-  if server, ok:= conf["[server]"]; ok {
-    
-    if dnslookup, ok := server["dns-lookup"]; ok {
+  // [ServerPackages]/dns-lookup takes precedence over [server]/dns-lookup.
+  dns_lookup := r.DNSLookup
+  for _, section := range []string{"[server]", "[ServerPackages]"} {
+    if dnslookup, ok := conf[section]["dns-lookup"]; ok {
       dnslookup = strings.TrimSpace(dnslookup)
       if dnslookup != "false" && dnslookup != "true" {
-        util.Log(0, "ERROR! ReadConfig: [server]/dns-lookup must be \"true\" or \"false\", not \"%v\"", dnslookup)
+        util.Log(0, "ERROR! ReadConfig: %v/dns-lookup must be \"true\" or \"false\", not \"%v\"", section, dnslookup)
       }
-      DNSLookup = (dnslookup == "true")
-    }
-    
-    if port,ok := server["port"]; ok {
-      port = strings.TrimSpace(port)
-      i := strings.Index(ServerSourceAddress,":")
-      ServerSourceAddress = ServerSourceAddress[:i+1] + port
-      i = strings.Index(ServerListenAddress,":")
-      ServerListenAddress = ServerListenAddress[:i+1] + port
+      dns_lookup = (dnslookup == "true")
     }
-    
-    if ip,ok := server["ip"]; ok { PreferredServer = ip }
-    if uri, ok := server["ldap-uri"]; ok { LDAPURI = uri }
-    if base,ok := server["ldap-base"]; ok { LDAPBase = base }
-    if newsysbase,ok := server["new-systems-base"]; ok { IncomingOU = newsysbase }
-    if IncomingOU[len(IncomingOU)-1] == ',' { IncomingOU += LDAPBase }
-    if admin,ok:= server["ldap-admin-dn"]; ok { LDAPAdmin = admin }
+  }
+  r.DNSLookup = dns_lookup
+  
+  if server, ok:= conf["[server]"]; ok {
+    incoming := r.IncomingOU
+    if newsysbase,ok := server["new-systems-base"]; ok { incoming = newsysbase }
+    if incoming[len(incoming)-1] == ',' { incoming += LDAPBase }
+    r.IncomingOU = incoming
     if pw  ,ok := server["ldap-admin-password"]; ok { 
       err := ioutil.WriteFile(LDAPAdminPasswordFile, []byte(pw), 0600)
       if err != nil { util.Log(0, "ERROR! Could not write admin password to file: %v", err) }
     }
-    if user,ok := server["ldap-user-dn"]; ok { LDAPUser = user }
     if pw  ,ok := server["ldap-user-password"]; ok { 
       err := ioutil.WriteFile(LDAPUserPasswordFile, []byte(pw), 0600)
       if err != nil { util.Log(0, "ERROR! Could not write user password to file: %v", err) } 
     }
   }
   
-  if client, ok:= conf["[client]"]; ok {
-    if port,ok := client["port"]; ok {
-      ClientPorts = strings.Fields(strings.Replace(port,","," ",-1))
+  if tftp, ok:= conf["[tftp]"]; ok {
+    if server,ok := tftp["proxydhcp-server"]; ok {
+      r.ProxyDHCPServer = server
     }
-    if einfo,ok := client["extra-info-file"]; ok {
-      ExtraInfoFilePath = einfo
+    if filename,ok := tftp["proxydhcp-filename"]; ok {
+      r.ProxyDHCPFilename = filename
     }
   }
   
-  if faimon, ok:= conf["[faimon]"]; ok {
-    if port,ok := faimon["port"]; ok {
-      FAIMonPort = port
+  maintenance_jobs := []string{}
+  maintenance_windows := map[string]string{}
+  if maintenance, ok:= conf["[maintenance]"]; ok {
+    maintenance_jobs = []string{"trigger_action_reinstall","trigger_action_update","trigger_action_reboot","trigger_action_halt"}
+    for key, value := range maintenance {
+      switch {
+        case key == "jobs": maintenance_jobs = strings.Fields(strings.Replace(value,","," ",-1))
+        case key == "ldap-attribute": r.MaintenanceLDAPAttribute = strings.ToLower(value)
+        case key == "default" || strings.HasPrefix(key, "group:") || strings.HasPrefix(key, "unit:"):
+          maintenance_windows[key] = value
+      }
     }
   }
+  r.MaintenanceJobs = maintenance_jobs
+  r.MaintenanceWindows = maintenance_windows
   
-  if tftp, ok:= conf["[tftp]"]; ok {
-    if port,ok := tftp["port"]; ok {
-      TFTPPort = port
+  throttle_limits := map[string]int{}
+  throttle_subnet_limits := map[string]int{}
+  if throttle, ok:= conf["[throttle]"]; ok {
+    for key, value := range throttle {
+      if key == "key" { continue } // module key, see above
+      n, err := strconv.Atoi(value)
+      if err != nil || n < 0 || (key == "subnet-prefix" && n > 32) || (key != "subnet-prefix" && n == 0) {
+        util.Log(0, "ERROR! ReadConfig: [throttle]/%v: Illegal value \"%v\"", key, value)
+        continue
+      }
+      switch {
+        case key == "subnet-prefix": r.ThrottleSubnetPrefix = n
+        case strings.HasSuffix(key, "/subnet"): throttle_subnet_limits[key[0:len(key)-7]] = n
+        default: throttle_limits[key] = n
+      }
     }
   }
+  r.ThrottleLimits = throttle_limits
+  r.ThrottleSubnetLimits = throttle_subnet_limits
   
   if tlsconf, ok:= conf["[tls]"]; ok {
     if cacert,ok := tlsconf["ca-certificate"]; ok {
-      CACertPath = []string{cacert}
+      r.CACertPath = []string{cacert}
     }
     if cert,ok := tlsconf["certificate"]; ok {
-      CertPath = cert
+      r.CertPath = cert
     }
     if certkey,ok := tlsconf["keyfile"]; ok {
-      CertKeyPath = certkey
+      r.CertKeyPath = certkey
+    }
+    if crl,ok := tlsconf["crl"]; ok {
+      r.CRLPath = strings.Fields(crl)
+    }
+    if reload,ok := tlsconf["crl-reload-interval"]; ok {
+      readDuration("[tls]/crl-reload-interval", reload, &r.CRLReloadInterval)
+    }
+    if timeout,ok := tlsconf["handshake-timeout"]; ok {
+      readDuration("[tls]/handshake-timeout", timeout, &r.TimeoutTLS)
     }
   }
   
+  peer_fingerprints := map[string]string{}
+  if peers, ok:= conf["[peer-certificates]"]; ok {
+    for addr, fingerprint := range peers {
+      if addr == "key" { continue } // module key, see above
+      fingerprint = strings.ToLower(strings.Replace(fingerprint, ":", "", -1))
+      if len(fingerprint) != 64 || strings.Trim(fingerprint, "0123456789abcdef") != "" {
+        util.Log(0, "ERROR! ReadConfig: [peer-certificates]/%v: Illegal SHA-256 fingerprint \"%v\"", addr, peers[addr])
+        continue
+      }
+      resolved, err := util.Resolve(addr, IP)
+      if err != nil {
+        util.Log(0, "ERROR! ReadConfig: [peer-certificates]/%v: %v", addr, err)
+        continue
+      }
+      peer_fingerprints[resolved] = fingerprint
+    }
+  }
+  r.PeerFingerprints = peer_fingerprints
+  
+  ban_allowlist := []*net.IPNet{}
+  if ban, ok:= conf["[ban]"]; ok {
+    if threshold, ok := ban["threshold"]; ok {
+      n, err := strconv.Atoi(threshold)
+      if err != nil || n < 0 {
+        util.Log(0, "ERROR! ReadConfig: [ban]/threshold: Illegal value \"%v\"", threshold)
+      } else {
+        r.BanThreshold = n
+      }
+    }
+    if duration, ok := ban["duration"]; ok {
+      readDuration("[ban]/duration", duration, &r.BanDuration)
+    }
+    if allow, ok := ban["allow"]; ok {
+      for _, addr := range strings.Fields(strings.Replace(allow,","," ",-1)) {
+        _, network, err := net.ParseCIDR(addr)
+        if err != nil {
+          ip := net.ParseIP(addr)
+          if ip == nil {
+            util.Log(0, "ERROR! ReadConfig: [ban]/allow: Illegal address \"%v\"", addr)
+            continue
+          }
+          if ip4 := ip.To4(); ip4 != nil { ip = ip4 }
+          network = &net.IPNet{IP:ip, Mask:net.CIDRMask(8*len(ip), 8*len(ip))}
+        }
+        ban_allowlist = append(ban_allowlist, network)
+      }
+    }
+  }
+  r.BanAllowlist = ban_allowlist
+  
   // Backwards compatibility: Convert [general]/pxelinux-cfg-hook to patterns
   // as described in manual.
   if pxeLinuxCfgHookPath != "" {
@@ -699,6 +1192,8 @@ func ReadConfig() {
     tftp_mappings.Insert("/^pxelinux.cfg/[0-9a-f]{8}(-[0-9a-f]{4}){3}-[0-9a-f]{12}$")
   }
   
+  tftp_regexes := []*regexp.Regexp{}
+  tftp_replies := []string{}
   for !tftp_mappings.IsEmpty() {
     file := tftp_mappings.Pop().(string)
     pattern := tftp_mappings.Pop().(string)
@@ -710,25 +1205,104 @@ func ReadConfig() {
     if err != nil {
       util.Log(0, "ERROR! ReadConfig: In section [tftp]: Error compiling regex \"%v\": %v", pattern, err)
     } else {
-      TFTPRegexes = append(TFTPRegexes, re)
-      TFTPReplies = append(TFTPReplies, file)
+      tftp_regexes = append(tftp_regexes, re)
+      tftp_replies = append(tftp_replies, file)
+    }
+  }
+  r.TFTPRegexes = tftp_regexes
+  r.TFTPReplies = tftp_replies
+}
+
+// Sets the config variables that are only evaluated at program start
+// (see startupSettings) from conf as returned by readConfigFiles().
+func readStartupConfig(conf map[string]map[string]string) {
+  if general, ok := conf["[general]"]; ok {
+    if logfile, ok := general["log-file"]; ok {
+      LogFilePath = logfile
+    }
+  }
+  
+  if server, ok:= conf["[server]"]; ok {
+    if port,ok := server["port"]; ok {
+      port = strings.TrimSpace(port)
+      host, _, _ := net.SplitHostPort(ServerSourceAddress)
+      ServerSourceAddress = net.JoinHostPort(host, port)
+      host, _, _ = net.SplitHostPort(ServerListenAddress)
+      ServerListenAddress = net.JoinHostPort(host, port)
+    }
+    
+    if ip,ok := server["ip"]; ok { PreferredServer = ip }
+    if uri, ok := server["ldap-uri"]; ok { LDAPURI = uri }
+    if base,ok := server["ldap-base"]; ok { LDAPBase = base }
+    if admin,ok:= server["ldap-admin-dn"]; ok { LDAPAdmin = admin }
+    if user,ok := server["ldap-user-dn"]; ok { LDAPUser = user }
+    if client,ok := server["ldap-client"]; ok {
+      client = strings.TrimSpace(client)
+      if client == "native" || client == "cli" {
+        LDAPClient = client
+      } else {
+        util.Log(0, "ERROR! ldap-client must be \"native\" or \"cli\", not \"%v\"", client)
+      }
+    }
+    if starttls,ok := server["ldap-starttls"]; ok { LDAPStartTLS = (strings.TrimSpace(starttls) == "true") }
+    if cacert,ok := server["ldap-ca-certificate"]; ok { LDAPCACertPath = strings.TrimSpace(cacert) }
+    if poolsize,ok := server["ldap-pool-size"]; ok {
+      size, err := strconv.Atoi(strings.TrimSpace(poolsize))
+      if err != nil || size < 1 {
+        util.Log(0, "ERROR! ldap-pool-size must be a positive integer, not \"%v\"", poolsize)
+      } else {
+        LDAPPoolSize = size
+      }
+    }
+  }
+  
+  
+  if client, ok:= conf["[client]"]; ok {
+    if port,ok := client["port"]; ok {
+      ClientPorts = strings.Fields(strings.Replace(port,","," ",-1))
+    }
+    if einfo,ok := client["extra-info-file"]; ok {
+      ExtraInfoFilePath = einfo
+    }
+  }
+  
+  if faimon, ok:= conf["[faimon]"]; ok {
+    if port,ok := faimon["port"]; ok {
+      FAIMonPort = port
+    }
+  }
+  
+  if tftp, ok:= conf["[tftp]"]; ok {
+    if port,ok := tftp["port"]; ok {
+      TFTPPort = port
+    }
+    if port,ok := tftp["http-port"]; ok {
+      HTTPBootPort = port
+    }
+    if port,ok := tftp["proxydhcp-port"]; ok {
+      ProxyDHCPPort = port
+    }
+    if port,ok := tftp["proxydhcp-broadcast-port"]; ok {
+      ProxyDHCPBroadcastPort = port
+    }
+  }
+  
+  if metrics, ok:= conf["[metrics]"]; ok {
+    if port,ok := metrics["port"]; ok {
+      MetricsPort = port
+    }
+  }
+  
+  if api, ok:= conf["[api]"]; ok {
+    if port,ok := api["port"]; ok {
+      APIPort = port
     }
   }
   
-  // The [ServerPackages] section must be evaluated AFTER the [server]
-  // section, because the manual says that [ServerPackages]/dns-lookup takes
-  // precedence over [server]/dns-lookup.
   if serverpackages, ok := conf["[ServerPackages]"]; ok {
     if addresses, ok := serverpackages["address"]; ok && addresses != "" {
       PeerServers = append(PeerServers, strings.Fields(strings.Replace(addresses,","," ",-1))...)
     }
-    if dnslookup, ok := serverpackages["dns-lookup"]; ok {
-      dnslookup = strings.TrimSpace(dnslookup)
-      if dnslookup != "false" && dnslookup != "true" {
-        util.Log(0, "ERROR! ReadConfig: [ServerPackages]/dns-lookup must be \"true\" or \"false\", not \"%v\"", dnslookup)
-      }
-      DNSLookup = (dnslookup == "true")
-    }
     if lookupdomains, ok := serverpackages["domains"]; ok {
       for _, dom := range strings.Fields(strings.Replace(lookupdomains,","," ",-1)) {
         if dom[0] != '.' { dom = "." + dom }
@@ -750,7 +1324,7 @@ func ReadConfig() {
     }
     if myip, ok := network["my-ip"]; ok {
       myip = strings.ToLower(myip)
-      if !ipRegexp.MatchString(myip) {
+      if net.ParseIP(myip) == nil {
         IP = ""
         IPDetect = parseNetworkDetectRuleset(myip)
       } else {
@@ -786,10 +1360,12 @@ func ReadConfig() {
     RunServer = false
   }
   
-  ClientPorts = append(ClientPorts, ServerListenAddress[strings.Index(ServerListenAddress,":")+1:])
+  ClientPorts = append(ClientPorts, ServerPort())
   
-  if PreferredServer != "" && strings.Index(PreferredServer,":") < 0 {
-    PreferredServer += ServerListenAddress[strings.Index(ServerListenAddress,":"):]
+  if PreferredServer != "" {
+    if _, _, err := net.SplitHostPort(PreferredServer); err != nil {
+      PreferredServer = net.JoinHostPort(strings.Trim(PreferredServer, "[]"), ServerPort())
+    }
   }
   
   serversInConfigFile := make([]string, len(PeerServers))
@@ -866,19 +1442,26 @@ func FillInNetworkDetectionDefaults() {
   }
 }
 
-func ReadCertificates() {  
+// Loads the CA certificate(s), this server's certificate and key from the
+// configured paths and publishes the resulting TLS configurations.
+func ReadCertificates() {
+  Modify(readCertificates)
+}
+
+func readCertificates(r *Reloadable) {
   have_something_valid := false
   certpool := x509.NewCertPool()
-  tlscert, err := tls.LoadX509KeyPair(CertPath, CertKeyPath)
+  cacerts := []*x509.Certificate{}
+  tlscert, err := tls.LoadX509KeyPair(r.CertPath, r.CertKeyPath)
   if err != nil {
     util.Log(0, "ERROR! tls.LoadX509KeyPair: %v", err)
   } else {
     tlscert.Leaf, err = x509.ParseCertificate(tlscert.Certificate[0])
     if err != nil {
-      util.Log(0, "ERROR! x509.ParseCertificate(%v): %v", CertPath, err)
+      util.Log(0, "ERROR! x509.ParseCertificate(%v): %v", r.CertPath, err)
     } else {
         
-      for _, cacert_path := range CACertPath {
+      for _, cacert_path := range r.CACertPath {
         root_ca, err := ioutil.ReadFile(cacert_path)
         if err != nil {
           util.Log(0, "ERROR! ReadFile: %v", err)
@@ -890,7 +1473,7 @@ func ReadCertificates() {
             util.Log(0, "ERROR! x509.ParseCertificate(%v): %v", cacert_path, err)
           } else {
           
-            CACert = append(CACert, cacert)
+            cacerts = append(cacerts, cacert)
             
             if !certpool.AppendCertsFromPEM(root_ca) {
               util.Log(0, "ERROR! AppendCertsFromPEM: %v", err)
@@ -904,7 +1487,8 @@ func ReadCertificates() {
   }
 
   if have_something_valid {
-    TLSClientConfig = &tls.Config{Certificates:[]tls.Certificate{tlscert},
+    r.CACert = cacerts
+    r.TLSClientConfig = &tls.Config{Certificates:[]tls.Certificate{tlscert},
                                   RootCAs:certpool,
                                   NextProtos:[]string{},
                                   ClientAuth:tls.RequireAnyClientCert,
@@ -921,7 +1505,7 @@ func ReadCertificates() {
                                   InsecureSkipVerify:true,
                                   }
     
-    TLSServerConfig = &tls.Config{Certificates:[]tls.Certificate{tlscert},
+    r.TLSServerConfig = &tls.Config{Certificates:[]tls.Certificate{tlscert},
                                   RootCAs:certpool,
                                   NextProtos:[]string{},
                                   ClientAuth:tls.RequireAnyClientCert,
@@ -937,11 +1521,125 @@ func ReadCertificates() {
                                   // types).
                                   InsecureSkipVerify:true,
                                   }
+  } else if r.TLSServerConfig != nil {
+    util.Log(0, "ERROR! Could not read new certificates => Continuing to use the old ones")
   } else {
     util.Log(0, "WARNING! TLS is DISABLED!")
   }
 }
 
+// Parses value with time.ParseDuration() and stores the result in *target.
+// name is the config file key, used for the error message if value is not
+// a positive duration.
+func readDuration(name, value string, target *time.Duration) {
+  d, err := time.ParseDuration(strings.TrimSpace(value))
+  if err != nil || d <= 0 {
+    util.Log(0, "ERROR! ReadConfig: %v: Illegal value \"%v\"", name, value)
+    return
+  }
+  *target = d
+}
+
+// Like readDuration() but also accepts "0" (no timeout). If value is
+// illegal, an error is logged, *target is not changed and false is returned.
+func readHookTimeout(name, value string, target *time.Duration) bool {
+  value = strings.TrimSpace(value)
+  if value == "0" {
+    *target = 0
+    return true
+  }
+  d, err := time.ParseDuration(value)
+  if err != nil || d <= 0 {
+    util.Log(0, "ERROR! ReadConfig: %v: Illegal value \"%v\"", name, value)
+    return false
+  }
+  *target = d
+  return true
+}
+
+// Returns the built-in timeouts for HookTimeouts.
+func defaultHookTimeouts() map[string]time.Duration {
+  return map[string]time.Duration{"package-list-hook":2*time.Hour, "tftp-hook":30*time.Second}
+}
+
+// Parses value as a replay protection mode (see ReplayProtection) and stores
+// it in *target. If value is not a valid mode, an error is logged, *target is
+// not changed and false is returned.
+func readReplayProtection(name, value string, target *string) bool {
+  mode := strings.TrimSpace(value)
+  if mode != "off" && mode != "check" && mode != "require" {
+    util.Log(0, "ERROR! ReadConfig: %v must be \"off\", \"check\" or \"require\", not \"%v\"", name, value)
+    return false
+  }
+  *target = mode
+  return true
+}
+
+// Settings that are only evaluated at program start (see readStartupConfig()).
+// Reload() does not touch the config variables derived from them and logs a
+// warning for each of them whose value in the config files has changed.
+var startupSettings = []string{
+  "[general]/log-file",
+  "[server]/port",
+  "[server]/ip",
+  "[server]/ldap-uri",
+  "[server]/ldap-base",
+  "[server]/ldap-admin-dn",
+  "[server]/ldap-user-dn",
+  "[server]/ldap-client",
+  "[server]/ldap-starttls",
+  "[server]/ldap-ca-certificate",
+  "[server]/ldap-pool-size",
+  "[client]/port",
+  "[client]/extra-info-file",
+  "[faimon]/port",
+  "[tftp]/port",
+  "[tftp]/http-port",
+  "[tftp]/proxydhcp-port",
+  "[tftp]/proxydhcp-broadcast-port",
+  "[metrics]/port",
+  "[api]/port",
+  "[ServerPackages]/address",
+  "[ServerPackages]/domains",
+  "[network]/my-mac",
+  "[network]/my-ip",
+  "[network]/my-hostname",
+  "[network]/my-domain",
+}
+
+// Maps each entry of startupSettings to its value in the config files
+// as read by ReadConfig().
+var startupConf map[string]string
+
+// Returns the value of name ("[section]/key") in conf or "" if it is not set.
+func configValue(conf map[string]map[string]string, name string) string {
+  i := strings.Index(name, "]/")
+  return conf[name[0:i+1]][name[i+2:]]
+}
+
+// Re-reads the config files and certificates while the program is running.
+// Settings such as hooks, module keys, [tftp] mappings, timeouts and 
+// certificates take effect immediately. Settings that are only evaluated at
+// program start (see startupSettings) are not touched. A warning is logged
+// for each of them that has been changed in the config files.
+// NOTE: Removing a setting from the config file does not reset it to its
+// default value.
+// The new settings are published as a whole, so readers see either the old
+// or the new values, never a mix.
+func Reload() {
+  conf, tftp_mappings := readConfigFiles()
+  
+  for _, name := range startupSettings {
+    if value := configValue(conf, name); value != startupConf[name] {
+      util.Log(0, "WARNING! Reload: Changing %v requires a restart => Keeping old value \"%v\" instead of \"%v\"", name, startupConf[name], value)
+    }
+  }
+  
+  Modify(func(r *Reloadable) { readReloadableConfig(r, conf, tftp_mappings) })
+  ReadCertificates()
+  util.Log(1, "INFO! Configuration and certificates have been reloaded")
+}
+
 var ndrRegexp = regexp.MustCompile("(?:([-+]?[1-9][0-9]*):)?([a-z]+)(!?~)(.*)")
 
 type NetDetRule struct {
@@ -1083,20 +1781,20 @@ func ReadNetwork() {
 
         // find the best IP address for that interface
         var ip net.IP
-        var broadcast net.IP
+        var broadcast string
         for _, addr := range addrs {
           ip2, ipnet, err2 := net.ParseCIDR(addr.String())
           if err2 == nil {
             if ip == nil || (ip.IsLoopback() && !ip2.IsLoopback()) ||
              (ip.To4() == nil && ip2.To4() != nil) {
               ip = ip2
-              broadcast = MakeBroadcast(ip2, ipnet.Mask)
+              broadcast = MakeBroadcast(ip2, ipnet.Mask, net_iface.Name)
             }
           }
         }
         if ip != nil {
           iface["ip"] = ip.String()
-          iface["broadcast"] = broadcast.String()
+          iface["broadcast"] = broadcast
         } else {
           err = fmt.Errorf("Could not determine IP for interface %v/%v", iface["ifname"], iface["mac"])
         }
@@ -1160,7 +1858,7 @@ func ReadNetwork() {
   IP = determineNetworkID(ifaces, "ip", IP, IPDetect)
   Broadcast = determineNetworkID(ifaces, "broadcast", "", IPDetect)
   
-  ServerSourceAddress = IP + ServerListenAddress[strings.Index(ServerListenAddress,":"):]
+  ServerSourceAddress = net.JoinHostPort(IP, ServerPort())
   
   util.Log(1, "INFO! Hostname: %v  Domain: %v  MAC: %v  Listener: %v  Broadcast: %v", Hostname, Domain, MAC, ServerSourceAddress, Broadcast)
   
@@ -1177,8 +1875,16 @@ func ReadNetwork() {
 }
 
 // Returns the broadcast address of ip with network mask.
-func MakeBroadcast(ip net.IP, mask net.IPMask) net.IP {
+// IPv6 has no broadcast, so for an IPv6 address the all-nodes
+// multicast address ff02::1 is returned. Because this is a link-local
+// address, the name ifname of the interface ip belongs to is appended
+// as zone (e.g. "ff02::1%eth0").
+func MakeBroadcast(ip net.IP, mask net.IPMask, ifname string) string {
   if len(ip) == 0 || len(mask) == 0 { panic("Can't...make...broadcast...Must...panic...") }
+  if ip.To4() == nil {
+    if ifname == "" { return net.IPv6linklocalallnodes.String() }
+    return net.IPv6linklocalallnodes.String() + "%" + ifname
+  }
   if len(mask) == net.IPv6len && len(ip) == net.IPv4len {
     mask = mask[12:]
   }
@@ -1190,12 +1896,12 @@ func MakeBroadcast(ip net.IP, mask net.IPMask) net.IP {
   if n != len(mask) {
     copy(out, ip)
     out[len(out)-1] = 255
-    return out
+    return out.String()
   }
   for i := 0; i < n; i++ {
     out[i] = ip[i] | ^mask[i]
   }
-  return out
+  return out.String()
 }
 
 
@@ -1221,9 +1927,16 @@ func ServersFromDNS() []string {
   return servers
 }
 
+// Returns the port part of ServerListenAddress.
+func ServerPort() string {
+  _, port, err := net.SplitHostPort(ServerListenAddress)
+  if err != nil { return "20081" }
+  return port
+}
+
 // Constructs a standard environment for hook execution and returns it.
 func HookEnvironment() []string {
-  env := []string{"MAC="+MAC, "IPADDRESS="+IP, "SERVERPORT="+ServerListenAddress[strings.Index(ServerListenAddress,":")+1:],
+  env := []string{"MAC="+MAC, "IPADDRESS="+IP, "SERVERPORT="+ServerPort(),
                   "HOSTNAME="+Hostname, "FQDN="+Hostname+"."+Domain }
   return env
 }
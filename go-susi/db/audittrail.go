@@ -0,0 +1,114 @@
+/*
+Copyright (c) 2026 go-susi contributors
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+// API for the various databases used by go-susi.
+package db
+
+import (
+         "io"
+         "os"
+         "net"
+         "sync"
+         "time"
+         "bufio"
+
+         "../xml"
+         "github.com/mbenkmann/golib/util"
+         "../config"
+       )
+
+// Serializes access to config.AuditTrailPath() within this process.
+var auditTrailMutex sync.Mutex
+
+// Returns a new audit trail entry for a request with the given header
+// received from peer. subject is the subject of the peer's certificate
+// ("" if the peer did not use TLS). The caller adds the other elements
+// and passes the entry to AuditTrailAdd(). Format of an entry:
+//   <entry>
+//     <timestamp>20131016120000</timestamp>
+//     <peer>172.16.2.3</peer>
+//     <subject>CN=gosa.example.com,O=Example</subject>
+//     <header>job_trigger_action_reinstall</header>
+//     <target>00:0c:29:50:a3:52</target>   (0 or more, the affected machines)
+//     <where>...</where>            (optional, for requests that select jobs)
+//     <argument>...</argument>      (optional, e.g. the release for ".release")
+//     <outcome>ok</outcome>         "ok", "denied" or "error: <message>"
+//     <claimed>...</claimed>        (only for gosa_add_audit_trail_entry, the
+//                                    unverified <entry> sent by the peer)
+//   </entry>
+func NewAuditTrailEntry(peer net.IP, subject, header string) *xml.Hash {
+  entry := xml.NewHash("entry", "timestamp", util.MakeTimestamp(time.Now()))
+  if peer == nil {
+    entry.Add("peer")
+  } else {
+    entry.Add("peer", peer.String())
+  }
+  entry.Add("subject", subject)
+  entry.Add("header", header)
+  return entry
+}
+
+// Appends entry (see NewAuditTrailEntry()) as a single line to
+// config.AuditTrailPath(). Does nothing if config.AuditTrailPath() is "".
+func AuditTrailAdd(entry *xml.Hash) {
+  if config.AuditTrailPath() == "" { return }
+  util.Log(1, "INFO! Audit trail: %v", entry)
+  auditTrailMutex.Lock()
+  defer auditTrailMutex.Unlock()
+  err := appendXMLLine(config.AuditTrailPath(), entry)
+  if err != nil {
+    util.Log(0, "ERROR! Could not write audit trail %v: %v", config.AuditTrailPath(), err)
+  }
+}
+
+// Returns all entries from config.AuditTrailPath() that are accepted by filter,
+// in the order in which they were recorded, as children of an <audittrail>
+// element.
+func AuditTrailQuery(filter xml.HashFilter) *xml.Hash {
+  result := xml.NewHash("audittrail")
+  if config.AuditTrailPath() == "" { return result }
+
+  auditTrailMutex.Lock()
+  defer auditTrailMutex.Unlock()
+  file, err := os.Open(config.AuditTrailPath())
+  if err != nil {
+    if !os.IsNotExist(err) {
+      util.Log(0, "ERROR! Could not read audit trail: %v", err)
+    }
+    return result
+  }
+  defer file.Close()
+
+  in := bufio.NewReader(file)
+  for {
+    line, err := in.ReadString('\n')
+    if err != nil {
+      if err != io.EOF {
+        util.Log(0, "ERROR! Could not read audit trail %v: %v", config.AuditTrailPath(), err)
+      }
+      // An incomplete last line is an entry still being written
+      // by another process (e.g. sibridge).
+      break
+    }
+    entry, err := xml.StringToHash(line)
+    if err != nil {
+      util.Log(0, "ERROR! Broken line in audit trail %v: %v", config.AuditTrailPath(), err)
+      continue
+    }
+    if filter.Accepts(entry) {
+      result.AddWithOwnership(entry)
+    }
+  }
+  return result
+}
@@ -0,0 +1,47 @@
+/*
+Copyright (c) 2026 go-susi contributors
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+// API for the various databases used by go-susi.
+package db
+
+import (
+         "../xml"
+         "github.com/mbenkmann/golib/util"
+         "../config"
+         "../security"
+       )
+
+// The ban list. See security.BansInit() for the format.
+var banDB *xml.DB = xml.NewDB("bandb",nil,0)
+
+// Initializes banDB with data from the file config.BanDBPath and its
+// journal (see xml.JournalStorer) if they exist and passes it to
+// security.BansInit(), which activates banning.
+// Not an init() because main() needs to set up some things first.
+func BansInit() {
+  db_storer, xmldata := loadJournal("BansInit", "bandb", config.BanDBPath, config.FreshDatabase)
+  banDB = xml.NewDB("bandb", db_storer, config.DBPersistDelay)
+  if xmldata != nil {
+    banDB.Init(xmldata)
+  }
+  security.BansInit(banDB)
+}
+
+// Persists the banDB and prevents all further changes to it.
+// This function does not return until the database has been persisted.
+func BansShutdown() {
+  util.Log(1, "INFO! Shutting down ban database")
+  banDB.Shutdown()
+  util.Log(1, "INFO! Ban database has been saved")
+}
@@ -20,12 +20,9 @@ MA  02110-1301, USA.
 package db
 
 import (
-         "os"
          "sync"
          "time"
          "math/rand"
-         "regexp"
-         "strings"
          
          "../xml"
          "github.com/mbenkmann/golib/util"
@@ -73,27 +70,17 @@ var hiaDBMutex sync.Mutex
 // from this hash so that they are re-added to clientdb if they reply.
 var ClientsWeMayHave *xml.Hash = xml.NewHash("clientdb")
 
-// Initializes clientDB with data from the file config.ClientDBPath if it exists.
+// Initializes clientDB with data from the file config.ClientDBPath and its
+// journal (see xml.JournalStorer) if they exist.
 // See ClientsWeMayHave above for important info.
 // Not an init() because main() needs to set up some things first.
 func ClientsInit() {
-  db_storer := &LoggingFileStorer{xml.FileStorer{config.ClientDBPath}}
+  db_storer, xmldata := loadJournal("ClientsInit", "clientdb", config.ClientDBPath, config.FreshDatabase)
   var delay time.Duration = config.DBPersistDelay
   clientDB = xml.NewDB("clientdb", db_storer, delay)
-  if !config.FreshDatabase {
-    xmldata, err := xml.FileToHash(config.ClientDBPath)
-    if err != nil {
-      if os.IsNotExist(err) { 
-        /* File does not exist is not an error that needs to be reported */ 
-      } else
-      {
-        util.Log(0, "ERROR! ClientsInit reading '%v': %v", config.ClientDBPath, err)
-      }
-    } else
-    {
-      clientDB.Init(xmldata)
-      ClientsWeMayHave = clientDB.Remove(xml.FilterSimple("source",config.ServerSourceAddress))
-    }
+  if xmldata != nil {
+    clientDB.Init(xmldata)
+    ClientsWeMayHave = clientDB.Remove(xml.FilterSimple("source",config.ServerSourceAddress))
   }
 }  
 
@@ -172,12 +159,7 @@ func ClientWithMAC(macaddress string) *xml.Hash {
 // if there are multiple clients with different ports known at that IP, it is
 // unspecified which of them will be returned.
 func ClientWithAddress(addr string) *xml.Hash { 
-  var filter xml.HashFilter
-  if strings.Index(addr, ":") >= 0 {
-    filter = xml.FilterSimple("client", addr)
-  } else {
-    filter = xml.FilterRegexp("client", "^"+regexp.QuoteMeta(addr+":")+"[0-9]+$")
-  }
+  filter := addressFilter("client", addr)
   return clientDB.Query(filter).First("xml")
 }
 
@@ -257,12 +239,7 @@ func ClientUpdate(client *xml.Hash) {
 // includes a port, only keys from that specific client will be returned.
 func ClientKeys(addr string) []string {
   result := make([]string, 0, 2)
-  var filter xml.HashFilter
-  if strings.Index(addr, ":") >= 0 {
-    filter = xml.FilterSimple("client", addr)
-  } else {
-    filter = xml.FilterRegexp("client", "^"+regexp.QuoteMeta(addr+":")+"[0-9]+$")
-  }
+  filter := addressFilter("client", addr)
   for client := clientDB.Query(filter).First("xml");
       client != nil;
       client = client.Next() {
@@ -0,0 +1,186 @@
+/*
+Copyright (c) 2026 go-susi contributors
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+// API for the various databases used by go-susi.
+package db
+
+import (
+         "io"
+         "fmt"
+         "sync"
+         "time"
+         "os/exec"
+         "syscall"
+         "sync/atomic"
+
+         "../xml"
+         "github.com/mbenkmann/golib/bytes"
+         "../config"
+       )
+
+// Number of hooks currently running and waiting for a slot
+// (see config.HookMaxParallel()). Protected by hookSlotsMutex.
+var hooksRunning int
+var hooksWaiting int
+var hookSlotsMutex sync.Mutex
+var hookSlotsFree = sync.NewCond(&hookSlotsMutex)
+
+// Returns the number of hooks currently running and the number of hooks
+// waiting because config.HookMaxParallel() hooks are already running.
+func HooksRunning() (running int, waiting int) {
+  hookSlotsMutex.Lock()
+  defer hookSlotsMutex.Unlock()
+  return hooksRunning, hooksWaiting
+}
+
+func acquireHookSlot() {
+  hookSlotsMutex.Lock()
+  defer hookSlotsMutex.Unlock()
+  hooksWaiting++
+  for config.HookMaxParallel() > 0 && hooksRunning >= config.HookMaxParallel() {
+    hookSlotsFree.Wait()
+  }
+  hooksWaiting--
+  hooksRunning++
+}
+
+func releaseHookSlot() {
+  hookSlotsMutex.Lock()
+  defer hookSlotsMutex.Unlock()
+  hooksRunning--
+  hookSlotsFree.Signal()
+}
+
+// An io.Writer that passes at most limit bytes to w. When more data is
+// written, kill() is called and an error is returned.
+type limitedWriter struct {
+  w io.Writer
+  limit int64
+  written int64
+  exceeded int32 // accessed atomically
+  kill func()
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+  if l.limit > 0 && l.written + int64(len(p)) > l.limit {
+    if atomic.CompareAndSwapInt32(&l.exceeded, 0, 1) { l.kill() }
+    return 0, fmt.Errorf("Output exceeds %v bytes", l.limit)
+  }
+  l.written += int64(len(p))
+  return l.w.Write(p)
+}
+
+// Returns true if l is not nil and has killed the hook because of too much output.
+func (l *limitedWriter) hasExceeded() bool {
+  return l != nil && atomic.LoadInt32(&l.exceeded) != 0
+}
+
+// Returns the timeout for the hook name (see HookRun()).
+func hookTimeout(name string) time.Duration {
+  if timeout, ok := config.HookTimeouts()[name]; ok { return timeout }
+  return config.HookTimeout()
+}
+
+// Runs cmd (which must not have been started yet) like cmd.Run() with
+// the following differences:
+//   * If config.HookMaxParallel() hooks are already running, HookRun() waits
+//     until one of them has finished.
+//   * The hook runs in its own process group. If it has not finished
+//     after the timeout for name (see config.HookTimeouts()), the whole
+//     process group is killed.
+//   * If the hook writes more than config.HookMaxOutput() bytes to
+//     cmd.Stdout or to cmd.Stderr (counted together if they are the
+//     same writer), the whole process group is killed.
+//   * The execution is recorded with HookExecuted() under cmd.Args[0].
+// name is the name of the configuration option for the hook, e.g.
+// "kernel-list-hook" or "tftp-hook" for hooks from the [tftp] section.
+func HookRun(name string, cmd *exec.Cmd) error {
+  acquireHookSlot()
+  defer releaseHookSlot()
+
+  start := time.Now()
+  if cmd.SysProcAttr == nil { cmd.SysProcAttr = &syscall.SysProcAttr{} }
+  cmd.SysProcAttr.Setpgid = true
+
+  kill := func() {
+    // cmd.Process.Pid is the process group id because of Setpgid
+    syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+  }
+
+  var output, erroutput *limitedWriter
+  if cmd.Stdout != nil {
+    output = &limitedWriter{w:cmd.Stdout, limit:config.HookMaxOutput(), kill:kill}
+    if cmd.Stderr == cmd.Stdout { cmd.Stderr = output }
+    cmd.Stdout = output
+  }
+  if cmd.Stderr != nil && cmd.Stderr != cmd.Stdout {
+    erroutput = &limitedWriter{w:cmd.Stderr, limit:config.HookMaxOutput(), kill:kill}
+    cmd.Stderr = erroutput
+  }
+
+  err := cmd.Start()
+  if err != nil {
+    HookExecuted(cmd.Args[0], time.Since(start), err)
+    return err
+  }
+
+  var timedout int32
+  timeout := hookTimeout(name)
+  if timeout > 0 {
+    timer := time.AfterFunc(timeout, func() {
+      atomic.StoreInt32(&timedout, 1)
+      kill()
+    })
+    defer timer.Stop()
+  }
+
+  err = cmd.Wait()
+  switch {
+    case atomic.LoadInt32(&timedout) != 0:
+      err = fmt.Errorf("Killed after timeout of %v", timeout)
+      hookKilled(cmd.Args[0], true)
+    case output.hasExceeded() || erroutput.hasExceeded():
+      err = fmt.Errorf("Killed because output exceeded %v bytes", config.HookMaxOutput())
+      hookKilled(cmd.Args[0], false)
+  }
+  HookExecuted(cmd.Args[0], time.Since(start), err)
+  return err
+}
+
+// Like HookRun() but returns the combined stdout and stderr of the hook
+// like cmd.CombinedOutput().
+func HookCombinedOutput(name string, cmd *exec.Cmd) (string, error) {
+  var out bytes.Buffer
+  defer out.Reset()
+  cmd.Stdout = &out
+  cmd.Stderr = &out
+  err := HookRun(name, cmd)
+  return out.String(), err
+}
+
+// Like HookRun() but converts the hook's stdout with xml.LdifToHash(itemtag,
+// casefold, ..., elementInfo...). As with passing an *exec.Cmd to
+// xml.LdifToHash(), output on stderr is treated as an error.
+func HookLdif(name string, cmd *exec.Cmd, itemtag string, casefold bool, elementInfo... *xml.ElementInfo) (*xml.Hash, error) {
+  var outbuf bytes.Buffer
+  defer outbuf.Reset()
+  var errbuf bytes.Buffer
+  defer errbuf.Reset()
+  cmd.Stdout = &outbuf
+  cmd.Stderr = &errbuf
+  err := HookRun(name, cmd)
+  if err == nil && errbuf.Len() != 0 { err = fmt.Errorf("%v", errbuf.String()) }
+  if err != nil { return xml.NewHash("xml"), err }
+  return xml.LdifToHash(itemtag, casefold, outbuf.Bytes(), elementInfo...)
+}
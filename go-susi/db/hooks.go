@@ -35,6 +35,67 @@ import (
          "github.com/mbenkmann/golib/bytes"
        )
 
+// Execution statistics for a hook program. See HookStats().
+type HookStat struct {
+  // Number of times the hook has been executed.
+  Count int64
+  // Number of executions that returned an error.
+  Failures int64
+  // Sum of the running times of all executions.
+  Total time.Duration
+  // Running time of the slowest execution.
+  Max time.Duration
+  // Number of executions killed because they exceeded their timeout.
+  Timeouts int64
+  // Number of executions killed because they produced too much output.
+  OutputExceeded int64
+}
+
+// Maps a hook's path to its statistics.
+var hookStats = map[string]*HookStat{}
+var hookStats_mutex sync.Mutex
+
+// Records the execution of the hook at path which took duration and
+// returned err (nil if successful).
+func HookExecuted(path string, duration time.Duration, err error) {
+  hookStats_mutex.Lock()
+  defer hookStats_mutex.Unlock()
+  stat, ok := hookStats[path]
+  if !ok {
+    stat = &HookStat{}
+    hookStats[path] = stat
+  }
+  stat.Count++
+  if err != nil { stat.Failures++ }
+  stat.Total += duration
+  if duration > stat.Max { stat.Max = duration }
+}
+
+// Records that the hook at path has been killed by HookRun() because
+// of a timeout (timeout==true) or because of too much output.
+func hookKilled(path string, timeout bool) {
+  hookStats_mutex.Lock()
+  defer hookStats_mutex.Unlock()
+  stat, ok := hookStats[path]
+  if !ok {
+    stat = &HookStat{}
+    hookStats[path] = stat
+  }
+  if timeout { stat.Timeouts++ } else { stat.OutputExceeded++ }
+}
+
+// Returns a copy of the execution statistics of all hooks recorded via
+// HookExecuted(), indexed by the hook's path.
+func HookStats() map[string]HookStat {
+  hookStats_mutex.Lock()
+  defer hookStats_mutex.Unlock()
+  result := make(map[string]HookStat, len(hookStats))
+  for path, stat := range hookStats {
+    result[path] = *stat
+  }
+  return result
+}
+
 // used to prevent the hooks from being started while they are still running,
 // e.g. because someone sends SIGUSR2 twice in quick succession.
 var hookMutex sync.Mutex
@@ -72,21 +133,21 @@ func runHooks(startup bool) {
   }
 }
 
-// Reads the output from the program config.KernelListHookPath (LDIF) and
+// Reads the output from the program config.KernelListHookPath() (LDIF) and
 // uses it to replace kerneldb.
 func KernelListHook() {
   start := time.Now()
-  util.Log(1, "INFO! Running kernel-list-hook %v", config.KernelListHookPath)
-  cmd := exec.Command(config.KernelListHookPath)
+  util.Log(1, "INFO! Running kernel-list-hook %v", config.KernelListHookPath())
+  cmd := exec.Command(config.KernelListHookPath())
   cmd.Env = append(config.HookEnvironment(), os.Environ()...)
   cmd.Env = append(cmd.Env, "PackageListCacheDir="+config.PackageCacheDir)
-  klist, err := xml.LdifToHash("kernel", true, cmd)
+  klist, err := HookLdif("kernel-list-hook", cmd, "kernel", true)
   if err != nil {
-    util.Log(0, "ERROR! kernel-list-hook %v: %v", config.KernelListHookPath, err)
+    util.Log(0, "ERROR! kernel-list-hook %v: %v", config.KernelListHookPath(), err)
     return
   }
   if klist.First("kernel") == nil {
-    util.Log(0, "ERROR! kernel-list-hook %v returned no data", config.KernelListHookPath)
+    util.Log(0, "ERROR! kernel-list-hook %v returned no data", config.KernelListHookPath())
     return
   }
   util.Log(1, "INFO! Finished kernel-list-hook. Running time: %v", time.Since(start))
@@ -100,21 +161,21 @@ func KernelListHook() {
     total++
     cn := kernel.Get("cn")
     if len(cn) == 0 {
-      util.Log(0, "ERROR! kernel-list-hook %v returned entry without cn: %v", config.KernelListHookPath, kernel)
+      util.Log(0, "ERROR! kernel-list-hook %v returned entry without cn: %v", config.KernelListHookPath(), kernel)
       continue
     }
     if len(cn) > 1 {
-      util.Log(0, "ERROR! kernel-list-hook %v returned entry with multiple cn values: %v", config.KernelListHookPath, kernel)
+      util.Log(0, "ERROR! kernel-list-hook %v returned entry with multiple cn values: %v", config.KernelListHookPath(), kernel)
       continue
     }
     
     release := kernel.Get("release")
     if len(release) == 0 {
-      util.Log(0, "ERROR! kernel-list-hook %v returned entry without release: %v", config.KernelListHookPath, kernel)
+      util.Log(0, "ERROR! kernel-list-hook %v returned entry without release: %v", config.KernelListHookPath(), kernel)
       continue
     }
     if len(release) > 1 {
-      util.Log(0, "ERROR! kernel-list-hook %v returned entry with multiple release values: %v", config.KernelListHookPath, kernel)
+      util.Log(0, "ERROR! kernel-list-hook %v returned entry with multiple release values: %v", config.KernelListHookPath(), kernel)
       continue
     }
     
@@ -125,7 +186,7 @@ func KernelListHook() {
   }
   
   if kerneldata.First("kernel") == nil {
-    util.Log(0, "ERROR! kernel-list-hook %v returned no valid entries", config.KernelListHookPath)
+    util.Log(0, "ERROR! kernel-list-hook %v returned no valid entries", config.KernelListHookPath())
   } else {
     util.Log(1, "INFO! kernel-list-hook: %v/%v entries accepted into database", accepted,total)
     kerneldb.Init(kerneldata)
@@ -143,7 +204,7 @@ var packageListFormat = []*xml.ElementInfo{
   &xml.ElementInfo{"templates","template",true},
 }
 
-// Reads the output from the program config.PackageListHookPath (LDIF) and
+// Reads the output from the program config.PackageListHookPath() (LDIF) and
 // uses it to replace packagedb.
 // debconf is passed as PackageListDebconf environment var to the hook.
 // See manual section on package-list-hook for more info.
@@ -151,7 +212,7 @@ func PackageListHook(debconf string) {
   start := time.Now()
   timestamp := util.MakeTimestamp(start)
 
-  cmd := exec.Command(config.PackageListHookPath)
+  cmd := exec.Command(config.PackageListHookPath())
   cmd.Env = append(config.HookEnvironment(), os.Environ()...)
   
   fairepos := []string{}
@@ -161,7 +222,7 @@ func PackageListHook(debconf string) {
   
   package_list_params := []string{"PackageListDebconf="+debconf, "PackageListCacheDir="+config.PackageCacheDir, "PackageListFAIrepository="+strings.Join(fairepos," ")}
   cmd.Env = append(cmd.Env, package_list_params...)
-  util.Log(1, "INFO! Running package-list-hook: %v %v", strings.Join(package_list_params, " "), config.PackageListHookPath)
+  util.Log(1, "INFO! Running package-list-hook: %v %v", strings.Join(package_list_params, " "), config.PackageListHookPath())
 
   var outbuf bytes.Buffer
   defer outbuf.Reset()
@@ -169,25 +230,25 @@ func PackageListHook(debconf string) {
   defer errbuf.Reset()
   cmd.Stdout = &outbuf
   cmd.Stderr = &errbuf
-  err := cmd.Run()
+  err := HookRun("package-list-hook", cmd)
   
   if err != nil {
-    util.Log(0, "ERROR! package-list-hook %v: %v (%v)", config.PackageListHookPath, err, errbuf.String())
+    util.Log(0, "ERROR! package-list-hook %v: %v (%v)", config.PackageListHookPath(), err, errbuf.String())
     return
   } else if errbuf.Len() != 0 {
     // if the command prints to stderr but does not return non-0 exit status (which
     // would result in err != nil), we just log a WARNING, but use the stdout data
     // anyway.
-    util.Log(0, "WARNING! package-list-hook %v: %v", config.PackageListHookPath, errbuf.String())
+    util.Log(0, "WARNING! package-list-hook %v: %v", config.PackageListHookPath(), errbuf.String())
   }
       
   plist, err := xml.LdifToHash("pkg", true, outbuf.Bytes(), packageListFormat...)
   if err != nil {
-    util.Log(0, "ERROR! package-list-hook %v: %v", config.PackageListHookPath, err)
+    util.Log(0, "ERROR! package-list-hook %v: %v", config.PackageListHookPath(), err)
     return
   }
   if plist.First("pkg") == nil {
-    util.Log(0, "ERROR! package-list-hook %v returned no data", config.PackageListHookPath)
+    util.Log(0, "ERROR! package-list-hook %v returned no data", config.PackageListHookPath())
     return
   }
   util.Log(1, "INFO! Finished package-list-hook. Running time: %v", time.Since(start))
@@ -207,7 +268,7 @@ func PackageListHook(debconf string) {
     
     release := p.First("distribution") // packageListFormat translates "release" => "distribution"
     if release == nil {
-      util.Log(0, "ERROR! package-list-hook %v returned entry without \"Release\": %v", config.PackageListHookPath, p)
+      util.Log(0, "ERROR! package-list-hook %v returned entry without \"Release\": %v", config.PackageListHookPath(), p)
       pkg.Remove()
       continue
     }
@@ -219,27 +280,27 @@ func PackageListHook(debconf string) {
     pkgname := p.Get("package")
     if len(pkgname) == 0 {
       if p.First("repository") == nil { // Release/Repository groups without Package are okay, so only log error if there is no Repository
-        util.Log(0, "ERROR! package-list-hook %v returned entry without \"Package\": %v", config.PackageListHookPath, p)
+        util.Log(0, "ERROR! package-list-hook %v returned entry without \"Package\": %v", config.PackageListHookPath(), p)
       }
       pkg.Remove()
       continue
     }
     
     if len(pkgname) > 1 {
-      util.Log(0, "ERROR! package-list-hook %v returned entry with multiple \"Package\" values: %v", config.PackageListHookPath, p)
+      util.Log(0, "ERROR! package-list-hook %v returned entry with multiple \"Package\" values: %v", config.PackageListHookPath(), p)
       pkg.Remove()
       continue
     }
 
     version := p.First("version")
     if version == nil {
-      util.Log(0, "WARNING! package-list-hook %v returned entry for \"%v\" without \"Version\". Assuming \"1.0\"", config.PackageListHookPath, pkgname[0])
+      util.Log(0, "WARNING! package-list-hook %v returned entry for \"%v\" without \"Version\". Assuming \"1.0\"", config.PackageListHookPath(), pkgname[0])
       p.Add("version", "1.0")
     }
     
     section := p.First("section")
     if section == nil {
-      util.Log(0, "WARNING! package-list-hook %v returned entry for \"%v\" without \"Section\". Assuming \"main\"", config.PackageListHookPath, pkgname[0])
+      util.Log(0, "WARNING! package-list-hook %v returned entry for \"%v\" without \"Section\". Assuming \"main\"", config.PackageListHookPath(), pkgname[0])
       p.Add("section", "main")
     }
     
@@ -258,7 +319,7 @@ func PackageListHook(debconf string) {
   }
   
   if accepted == 0 {
-    util.Log(0, "ERROR! package-list-hook %v returned no valid entries", config.PackageListHookPath)
+    util.Log(0, "ERROR! package-list-hook %v returned no valid entries", config.PackageListHookPath())
   } else {
     util.Log(1, "INFO! package-list-hook: %v/%v entries accepted into database. Processing time: %v", accepted,total, time.Since(start))
     packagedb.Init(plist)
@@ -21,10 +21,11 @@ MA  02110-1301, USA.
 package db
 
 import (
-         "os"
          "fmt"
          "net"
          "time"
+         "regexp"
+         "math/big"
          "strconv"
          "strings"
          "encoding/base64"
@@ -58,6 +59,23 @@ import (
 //       ...
 //     </job>
 //   </jobdb>
+//
+// <depends_on> is a comma-separated list of ids of local jobs that must have
+// completed successfully before the job is launched. Ids are removed from the
+// list as the respective jobs complete. If one of them fails or is cancelled,
+// the job is cancelled, too. See jobsResolveDependents(). job_trigger_action
+// rejects ids that do not name an existing local job.
+// <sequence> is a name. A new job with a <sequence> depends on the most recently
+// added local job with the same <sequence> (if it still exists).
+// A local job listed in config.MaintenanceJobs() whose time has come outside of
+// its target's maintenance window gets status "deferred", a <result> that
+// explains why and a <deferred_until> timestamp at which the window opens.
+// See jobsCheckMaintenanceWindows().
+// A local job that would exceed the limits from config.ThrottleLimits() or
+// config.ThrottleSubnetLimits() when launched gets status "queued" instead and
+// is launched when another job makes room. See jobsUpdateQueue().
+// Changes to local jobs are reported to config.JobEventHookPath() and
+// config.JobEventLogPath(). See jobEvent().
 var jobDB *xml.DB
 
 // When an action on the database requires sending updates to peers, they are
@@ -96,7 +114,7 @@ var ForeignJobUpdates = make(chan *xml.Hash, 16384)
 var MostRecentForwardModifyRequestTime = deque.New([]interface{}{time.Now().Add(-1*time.Hour)}, deque.DropFarEndIfOverflow)
 
 // Fields that can be updated via Jobs*Modify*()
-var updatableFields = []string{"progress", "status", "periodic", "timestamp", "tminus", "result"}
+var updatableFields = []string{"progress", "status", "periodic", "timestamp", "tminus", "result", "deferred_until"}
 
 // A packaged request to perform some action on the jobDB.
 // Most db.Job...() functions attach their core code to a jobDBRequest,
@@ -134,33 +152,25 @@ var PendingActions = deque.New()
 // The next number to use for <id> when storing a new local job.
 var nextID chan uint64
 
-// Initializes JobDB with data from the file config.JobDBPath if it exists and
+// Initializes JobDB with data from the file config.JobDBPath and its journal
+// (see xml.JournalStorer) if they exist and
 // starts the goroutine that runs handleJobDBRequests.
 // Not an init() because main() needs to set up some things first.
 func JobsInit() {
   if jobDB != nil { panic("JobsInit() called twice") }
-  jobdb_storer := &LoggingFileStorer{xml.FileStorer{config.JobDBPath}}
+  jobdb_storer, xmldata := loadJournal("JobsInit()", "jobdb", config.JobDBPath, config.FreshDatabase)
   var delay time.Duration = config.DBPersistDelay
   jobDB = xml.NewDB("jobdb", jobdb_storer, delay)
-  if !config.FreshDatabase {
-    xml, err := xml.FileToHash(config.JobDBPath)
-    if err != nil {
-      if os.IsNotExist(err) { 
-        /* File does not exist is not an error that needs to be reported */ 
-      } else
-      {
-        util.Log(0, "ERROR! JobsInit() reading '%v': %v", config.JobDBPath, err)
-      }
-    } else
-    {
-      jobDB.Init(xml)
-    }
+  if xmldata != nil {
+    jobDB.Init(xmldata)
   }
   
   // Remove all non-local jobs (they may be stale and new_server
   // causes full sync anyway)
   jobDB.Remove(xml.FilterNot(xml.FilterSimple("siserver",config.ServerSourceAddress)))
   
+  jobsCheckDependencies()
+  
   // The following loop goes through all jobs and does the following
   // * find the the greatest id number used in the db
   // * schedule processing of pending actions for all timestamps
@@ -171,10 +181,28 @@ func JobsInit() {
     if id > count { count = id }
     
     scheduleProcessPendingActions(job.Text("timestamp"), job.Text("tminus"))
+    if job.Text("status") == "deferred" {
+      scheduleProcessPendingActions(job.Text("deferred_until"), "")
+    }
   }
   nextID = util.Counter(count+1)
   
   go handleJobDBRequests()
+  go handleJobEvents()
+  
+  // Launch queued jobs if there is room for them (e.g. because the limits
+  // have been changed in the config file). This is done as a request to
+  // handleJobDBRequests() because jobsUpdateQueue() needs it to be running.
+  updatequeues := func(request *jobDBRequest) {
+    have_queue := map[string]bool{}
+    for _, headertag := range jobDB.ColumnValues("headertag") {
+      if !have_queue[headertag] {
+        jobsUpdateQueue(headertag)
+        have_queue[headertag] = true
+      }
+    }
+  }
+  jobDBRequests <- &jobDBRequest{ updatequeues, nil, nil, nil }
 }
 
 // Persists the jobDB and prevents all further changes to it.
@@ -307,8 +335,20 @@ func handleJobDBRequests() {
                wakeup  := xml.FilterSimple("status", "wakeup")
                waiting_or_wakeup := xml.FilterOr([]xml.HashFilter{waiting,wakeup})
                beforenow := xml.FilterRel("timestamp", now_ts, -1, 0)
-               filter := xml.FilterAnd([]xml.HashFilter{localjob,waiting_or_wakeup,beforenow})
+               unblocked := xml.FilterNot(jobBlocked)
+               restricted := jobRestricted()
+               unrestricted := xml.FilterNot(restricted)
+               filter := xml.FilterAnd([]xml.HashFilter{localjob,waiting_or_wakeup,beforenow,unblocked,unrestricted})
                JobsModifyLocal(filter, xml.NewHash("job","status","launch"))
+               
+               // Jobs subject to maintenance windows are launched or deferred by
+               // jobsCheckMaintenanceWindows() because that requires LDAP access.
+               if len(config.MaintenanceJobs()) > 0 {
+                 deferred := xml.FilterAnd([]xml.HashFilter{xml.FilterSimple("status","deferred"),xml.FilterRel("deferred_until", now_ts, -1, 0)})
+                 due := xml.FilterOr([]xml.HashFilter{xml.FilterAnd([]xml.HashFilter{waiting_or_wakeup,beforenow}),deferred})
+                 filter = xml.FilterAnd([]xml.HashFilter{localjob,due,unblocked,restricted})
+                 jobsStartMaintenanceCheck(jobDB.Query(filter))
+               }
 
                have_filter := map[string]bool{}
                time_filters := []xml.HashFilter{}
@@ -323,7 +363,7 @@ func handleJobDBRequests() {
                  }
                }
                tminus_filter := xml.FilterOr(time_filters)
-               filter = xml.FilterAnd([]xml.HashFilter{localjob,waiting,tminus_filter})
+               filter = xml.FilterAnd([]xml.HashFilter{localjob,waiting,tminus_filter,unblocked})
                /*
                Because jobDBRequests are processed sequentially in a single
                goroutine it is guaranteed that if the previous JobsModifyLocal()
@@ -504,10 +544,13 @@ func JobAddLocal(job *xml.Hash) {
     if plainname == "none" { 
       JobsUpdateNameForMAC(macaddress)
     }
+    jobsAddSequencePredecessor(request.Job)
     util.Log(1, "INFO! New job for me to execute: %v", request.Job)
     ClientUnthrottle(macaddress)
     JobUpdateXMLMessage(request.Job)
     jobDB.AddClone(request.Job)
+    jobEvent("added", request.Job, "", "")
+    jobsCheckPredecessors(request.Job)
     scheduleProcessPendingActions(request.Job.Text("timestamp"), request.Job.Text("tminus"))
     request.Job.Rename("answer1")
     fju := xml.NewHash("xml","header","foreign_job_updates")
@@ -532,22 +575,44 @@ func JobAddLocal(job *xml.Hash) {
 // and no follow-up job will be scheduled. If stop_periodic == false, a follow-up
 // job will be scheduled if the job is periodic.
 //
+// The removed jobs count as cancelled, so jobs that depend on them are
+// cancelled, too. Use JobsCompleteLocal() for jobs that have completed.
+//
 // NOTE: The filter must include the siserver==config.ServerSourceAddress check,
 // so that it only affects local jobs.
 func JobsRemoveLocal(filter xml.HashFilter, stop_periodic bool) {
+  jobsRemoveLocal(filter, stop_periodic, false)
+}
+
+// Like JobsRemoveLocal() but the removed jobs count as completed successfully
+// (including jobs that have been handed over to another server), so jobs
+// that depend on them are released.
+//
+// NOTE: The filter must include the siserver==config.ServerSourceAddress check,
+// so that it only affects local jobs.
+func JobsCompleteLocal(filter xml.HashFilter, stop_periodic bool) {
+  jobsRemoveLocal(filter, stop_periodic, true)
+}
+
+func jobsRemoveLocal(filter xml.HashFilter, stop_periodic bool, succeeded bool) {
   deljob := func(request *jobDBRequest) {
     jobdb_xml := jobDB.Remove(request.Filter)
     util.Log(1, "INFO! JobsRemoveLocal(stop_periodic=%v) removing job(s): %v", stop_periodic, jobdb_xml)
     fju := xml.NewHash("xml","header","foreign_job_updates")
     var count uint64 = 1
+    queues := map[string]bool{}
     for child := jobdb_xml.FirstChild(); child != nil; child = child.Next() {
         job := child.Remove()
+        if jobThrottled(job) { queues[job.Text("headertag")] = true }
+        // A job that has not been launched can not have completed.
+        jobsResolveDependents(job.Text("id"), succeeded && job.Text("status") == "processing")
         job.FirstOrAdd("status").SetText("done")
         if stop_periodic {
           job.FirstOrAdd("periodic").SetText("none")
         }
         job.RemoveFirst("original_id")
         JobUpdateXMLMessage(job)
+        jobEvent("removed", job, "", "")
         PendingActions.Push(job.Clone())
         job.Rename("answer"+strconv.FormatUint(count, 10))
         count++
@@ -560,6 +625,8 @@ func JobsRemoveLocal(filter xml.HashFilter, stop_periodic bool) {
       fju.Add("sync", "ordered")
       ForeignJobUpdates <- fju
     }
+    
+    for headertag := range queues { jobsUpdateQueue(headertag) }
   }
   jobDBRequests <- &jobDBRequest{ deljob, filter, nil, nil }
 }
@@ -602,12 +669,24 @@ func JobsModifyLocal(filter xml.HashFilter, update *xml.Hash) {
     util.Log(1, "INFO! JobsModifyLocal applying %v to %v", request.Job, jobdb_xml)
     fju := xml.NewHash("xml","header","foreign_job_updates")
     var count uint64 = 1
+    queues := map[string]bool{}
     for child := jobdb_xml.FirstChild(); child != nil; child = child.Next() {
         job := child.Remove()
         send_fju_for_this_job := true
         status_changed := false
+        old_status := job.Text("status")
+        old_progress := job.Text("progress")
+        update := request.Job
+        if jobThrottled(job) {
+          queues[job.Text("headertag")] = true
+          if update.Text("status") == "launch" && !jobsSlotAvailable(job) {
+            util.Log(1, "INFO! Too many %v jobs running => Queueing job: %v", job.Text("headertag"), job)
+            update = update.Clone()
+            update.First("status").SetText("queued")
+          }
+        }
         for _, field := range updatableFields {
-          x := request.Job.First(field)
+          x := update.First(field)
           if x != nil {
 
             status_changed = status_changed || (field == "status" && x.Text() != "")
@@ -646,6 +725,10 @@ func JobsModifyLocal(filter xml.HashFilter, update *xml.Hash) {
             if field == "timestamp" || field == "tminus" {
               scheduleProcessPendingActions(job.Text("timestamp"), job.Text("tminus"))
             }
+            
+            if field == "deferred_until" && x.Text() != "" {
+              scheduleProcessPendingActions(x.Text(), "")
+            }
           }
         }
         
@@ -660,6 +743,16 @@ func JobsModifyLocal(filter xml.HashFilter, update *xml.Hash) {
             util.Log(1, "INFO! Waking/Re-registering target machine of job: %v",job)
             PendingActions.Push(job.Clone()) 
           }
+          
+          if job.Text("status") == "error" {
+            jobsResolveDependents(job.Text("id"), false)
+          }
+        }
+        
+        if job.Text("progress") != old_progress && job.Text("progress") == "forward" {
+          jobEvent("forwarded", job, "", "")
+        } else if (job.Text("status") != old_status || job.Text("progress") != old_progress) && job.Text("progress") != "groom" {
+          jobEvent("changed", job, old_status, old_progress)
         }
         
         JobUpdateXMLMessage(job)
@@ -678,6 +771,8 @@ func JobsModifyLocal(filter xml.HashFilter, update *xml.Hash) {
       fju.Add("sync", "ordered")
       ForeignJobUpdates <- fju
     }
+    
+    for headertag := range queues { jobsUpdateQueue(headertag) }
   }
   
   jobDBRequests <- &jobDBRequest{ modifylocaljobs, filter, update.Clone(), nil }
@@ -856,18 +951,147 @@ func JobsSyncAll(target string, old *xml.Hash) {
   jobDBRequests <- &jobDBRequest{ syncall, nil, fju, nil }
 }
 
+// Accepts jobs that have a non-empty <depends_on>.
+var jobBlocked = xml.FilterRegexp("depends_on", "[^, ]")
+
+// Returns a filter that accepts local jobs whose <depends_on> contains id.
+func jobDependsOnFilter(id string) xml.HashFilter {
+  return xml.FilterAnd([]xml.HashFilter{
+           xml.FilterSimple("siserver", config.ServerSourceAddress),
+           xml.FilterRegexp("depends_on", "(^|,)"+regexp.QuoteMeta(id)+"(,|$)")})
+}
+
+// Splits a <depends_on> list into ids.
+func jobDependencies(depends_on string) []string {
+  ids := []string{}
+  for _, id := range strings.Split(depends_on, ",") {
+    id = strings.TrimSpace(id)
+    if id != "" { ids = append(ids, id) }
+  }
+  return ids
+}
+
+// If job has a <sequence>, adds the id of the most recently added local job
+// with the same <sequence> to job's <depends_on>.
+// MUST ONLY BE CALLED FROM handleJobDBRequests()!
+func jobsAddSequencePredecessor(job *xml.Hash) {
+  sequence := job.Text("sequence")
+  if sequence == "" { return }
+  
+  var pred uint64
+  found := false
+  filter := xml.FilterSimple("siserver", config.ServerSourceAddress, "sequence", sequence)
+  for child := jobDB.Query(filter).First("job"); child != nil; child = child.Next() {
+    id, err := strconv.ParseUint(child.Text("id"), 10, 64)
+    if err == nil && (!found || id > pred) { pred = id; found = true }
+  }
+  if !found { return }
+  
+  deps := append(jobDependencies(job.Text("depends_on")), strconv.FormatUint(pred, 10))
+  job.FirstOrAdd("depends_on").SetText(strings.Join(deps, ","))
+}
+
+// Checks the <depends_on> list of the newly added job. If one of the
+// predecessors has failed, job is cancelled. job_trigger_action has made
+// sure that all predecessors existed, so an id that no longer exists
+// belongs to a job that has been removed in the meantime. Because we can
+// not tell if it has completed successfully, job is cancelled in that case,
+// too, rather than launched before its time.
+// MUST ONLY BE CALLED FROM handleJobDBRequests()!
+func jobsCheckPredecessors(job *xml.Hash) {
+  for _, dep := range jobDependencies(job.Text("depends_on")) {
+    pred := jobDB.Query(xml.FilterSimple("siserver", config.ServerSourceAddress, "id", dep)).First("job")
+    if pred == nil {
+      util.Log(0, "WARNING! Job %v depends on job %v which does not exist => Cancelling job", job.Text("id"), dep)
+      JobsRemoveLocal(xml.FilterSimple("siserver", config.ServerSourceAddress, "id", job.Text("id")), true)
+      return
+    }
+    if pred.Text("status") == "error" {
+      jobsResolveDependents(dep, false)
+    }
+  }
+}
+
+// Called when the local job with the given id has completed or failed.
+// If succeeded is true, id is removed from the <depends_on> of all
+// local jobs that depend on it and those jobs are launched if they have
+// no other dependencies and their time has come. If succeeded is false,
+// all jobs that depend on id are cancelled (which recursively cancels
+// the jobs that depend on them).
+// MUST ONLY BE CALLED FROM handleJobDBRequests()!
+func jobsResolveDependents(id string, succeeded bool) {
+  if id == "" { return }
+  filter := jobDependsOnFilter(id)
+  dependents := jobDB.Query(filter)
+  if dependents.First("job") == nil { return }
+  
+  if !succeeded {
+    util.Log(1, "INFO! Job %v has failed or was cancelled => Cancelling dependent job(s): %v", id, dependents)
+    JobsRemoveLocal(filter, true)
+    return
+  }
+  
+  for job := dependents.First("job"); job != nil; job = job.Next() {
+    deps := []string{}
+    for _, dep := range jobDependencies(job.Text("depends_on")) {
+      if dep != id { deps = append(deps, dep) }
+    }
+    job.FirstOrAdd("depends_on").SetText(strings.Join(deps, ","))
+    if len(deps) == 0 {
+      util.Log(1, "INFO! Job %v has completed => Releasing job: %v", id, job)
+    }
+    jobDB.Replace(xml.FilterSimple("id", job.Text("id")), true, job)
+    scheduleProcessPendingActions(job.Text("timestamp"), job.Text("tminus"))
+  }
+}
+
+// Called by JobsInit() to cancel local jobs that depend on jobs that no
+// longer exist. Like jobsCheckPredecessors() we can not tell if the
+// predecessor has completed successfully (its dependents may have been
+// released already or their cancellation may not have been saved before
+// a crash), so the job must not be launched.
+func jobsCheckDependencies() {
+  exists := map[string]bool{}
+  localjobs := jobDB.Query(xml.FilterSimple("siserver", config.ServerSourceAddress))
+  for job := localjobs.First("job"); job != nil; job = job.Next() {
+    exists[job.Text("id")] = true
+  }
+  
+  for job := localjobs.First("job"); job != nil; job = job.Next() {
+    if !jobBlocked.Accepts(job) { continue }
+    for _, dep := range jobDependencies(job.Text("depends_on")) {
+      if !exists[dep] {
+        util.Log(0, "WARNING! Job %v depends on job %v which does not exist => Cancelling job", job.Text("id"), dep)
+        JobsRemoveLocal(xml.FilterSimple("siserver", config.ServerSourceAddress, "id", job.Text("id")), true)
+        break
+      }
+    }
+  }
+}
+
 // Creates a GUID from the ip:port address addr and the number num.
 // An illegal address will cause a panic.
 func JobGUID(addr string, num uint64) string {
   host, port, err := net.SplitHostPort(addr)
   if err != nil { panic(err) }
-  ip := net.ParseIP(host).To4()
-  if ip == nil { panic("Not an IPv4 address") }
+  ip := net.ParseIP(host)
+  if ip == nil { panic("Not an IP address") }
   p, err := strconv.ParseUint(port, 10, 64)
   if err != nil { panic(err) }
-  var n uint64 = uint64(ip[0]) + uint64(ip[1])<<8 + uint64(ip[2])<<16 + 
-                 uint64(ip[3])<<24 + p<<32
-  return strconv.FormatUint(num,10)+strconv.FormatUint(n,10)
+  if ip4 := ip.To4(); ip4 != nil {
+    var n uint64 = uint64(ip4[0]) + uint64(ip4[1])<<8 + uint64(ip4[2])<<16 + 
+                   uint64(ip4[3])<<24 + p<<32
+    return strconv.FormatUint(num,10)+strconv.FormatUint(n,10)
+  }
+  
+  // IPv6: Same scheme as for IPv4 but with all 16 bytes of the address,
+  // so that different addresses always give different GUIDs.
+  n := new(big.Int).SetUint64(p)
+  for i := len(ip)-1; i >= 0; i-- {
+    n.Lsh(n, 8)
+    n.Or(n, big.NewInt(int64(ip[i])))
+  }
+  return strconv.FormatUint(num,10)+n.String()
 }
 
 // Takes a job and adds or replaces the <xmlmessage> element with one that
@@ -897,6 +1121,12 @@ func groomJobDB() {
     macaddress := job.Text("macaddress")
     siserver := job.Text("siserver")
     
+    // jobs waiting for other jobs are supposed to be late
+    if siserver == config.ServerSourceAddress && jobBlocked.Accepts(job) { continue }
+    
+    // same for jobs waiting for their maintenance window or a free slot
+    if job.Text("status") == "deferred" || job.Text("status") == "queued" { continue }
+    
     if (job.Text("headertag") == "trigger_action_reinstall" || 
         job.Text("headertag") == "trigger_action_update") && job.Text("status") == "processing" {
         // job is update or install job that is (believed to be) currently running
@@ -0,0 +1,132 @@
+/*
+Copyright (c) 2026 go-susi contributors
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+// API for the various databases used by go-susi.
+package db
+
+import (
+         "os"
+         "time"
+         "os/exec"
+         "strings"
+         "sync/atomic"
+
+         "../xml"
+         "github.com/mbenkmann/golib/util"
+         "github.com/mbenkmann/golib/deque"
+         "../config"
+       )
+
+// Events concerning local jobs that still need to be passed to
+// config.JobEventHookPath() and appended to config.JobEventLogPath().
+// Format of the entries:
+//   <event>
+//     <timestamp>20131016120000</timestamp>
+//     <type>changed</type>          added, changed, forwarded or removed
+//     <old_status>waiting</old_status>      (only for type "changed")
+//     <old_progress>none</old_progress>     (only for type "changed")
+//     <job>...</job>                the job after the event
+//   </event>
+// The consumer of this queue is handleJobEvents().
+// It holds at most config.JobEventQueueMax events.
+var jobEvents = deque.New()
+
+// Number of events dropped because jobEvents was full. Use sync/atomic to access it.
+var JobEventsDropped int64
+
+// Queues an event of type typ for job (see jobEvents). old_status and
+// old_progress are only used for type "changed".
+// This function does not block and does not access the jobDB, so it can
+// be called from handleJobDBRequests().
+func jobEvent(typ string, job *xml.Hash, old_status, old_progress string) {
+  if config.JobEventHookPath() == "" && config.JobEventLogPath() == "" { return }
+  if jobEvents.Count() >= config.JobEventQueueMax {
+    // Log only now and then. The hook is stuck anyway, so the log must not
+    // be flooded.
+    if dropped := atomic.AddInt64(&JobEventsDropped, 1); dropped == 1 || dropped % 1000 == 0 {
+      util.Log(0, "ERROR! Job event queue full (%v events) => Dropping job events (%v so far)", config.JobEventQueueMax, dropped)
+    }
+    return
+  }
+  event := xml.NewHash("event", "timestamp", util.MakeTimestamp(time.Now()))
+  event.Add("type", typ)
+  if typ == "changed" {
+    event.Add("old_status", old_status)
+    event.Add("old_progress", old_progress)
+  }
+  j := job.Clone()
+  j.Rename("job")
+  event.AddWithOwnership(j)
+  jobEvents.Push(event)
+}
+
+// Passes the events from jobEvents to the job-event-hook and the job event log
+// one at a time in the order in which they occurred. Never returns.
+func handleJobEvents() {
+  for {
+    event := jobEvents.Next().(*xml.Hash)
+    util.WithPanicHandler(func(){
+      if config.JobEventLogPath() != "" { jobEventLog(event) }
+      if config.JobEventHookPath() != "" { jobEventHook(event) }
+    })
+  }
+}
+
+// Appends event as a single line to config.JobEventLogPath().
+func jobEventLog(event *xml.Hash) {
+  err := appendXMLLine(config.JobEventLogPath(), event)
+  if err != nil {
+    util.Log(0, "ERROR! Could not write job event log %v: %v", config.JobEventLogPath(), err)
+  }
+}
+
+// Appends x as a single line to the file at path, creating it if necessary.
+// Line breaks within x are encoded as character references.
+func appendXMLLine(path string, x *xml.Hash) error {
+  line := x.String()
+  line = strings.Replace(strings.Replace(line, "\r", "&#13;", -1), "\n", "&#10;", -1) + "\n"
+  file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+  if err == nil {
+    _, err = util.WriteAll(file, []byte(line))
+    err2 := file.Close()
+    if err == nil { err = err2 }
+  }
+  return err
+}
+
+// Calls config.JobEventHookPath() with the environment containing the event's
+// type as "event", the job's fields, old_status and old_progress (for event
+// type "changed") and the complete event as "xml".
+func jobEventHook(event *xml.Hash) {
+  start := time.Now()
+  env := config.HookEnvironment()
+  env = append(env, "event="+event.Text("type"))
+  job := event.First("job")
+  for _, tag := range job.Subtags() {
+    env = append(env, tag+"="+strings.Join(job.Get(tag),"\n"))
+  }
+  if event.First("old_status") != nil {
+    env = append(env, "old_status="+event.Text("old_status"), "old_progress="+event.Text("old_progress"))
+  }
+  cmd := exec.Command(config.JobEventHookPath())
+  env = append(env, "xml="+event.String())
+  cmd.Env = append(env, os.Environ()...)
+  util.Log(1, "INFO! Running job-event-hook %v with parameters %v", config.JobEventHookPath(), env)
+  out, err := HookCombinedOutput("job-event-hook", cmd)
+  if err != nil {
+    util.Log(0, "ERROR! job-event-hook %v: %v (%v)", config.JobEventHookPath(), err, out)
+    return
+  }
+  util.Log(1, "INFO! Finished job-event-hook. Running time: %v", time.Since(start))
+}
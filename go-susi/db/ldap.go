@@ -22,13 +22,18 @@ package db
 
 import (
          "fmt"
+         "sync"
          "time"
          "bytes"
          "os/exec"
          "strings"
+         "io/ioutil"
+         "crypto/tls"
+         "crypto/x509"
          "encoding/base64"
          
          "../xml"
+         "../ldap"
          "github.com/mbenkmann/golib/util"
          "../config"
        )
@@ -98,15 +103,163 @@ func LDAPFilterEscape(s string) string {
   return strings.Join(res,"")
 }
 
-func ldapSearch(query string, attr... string) *exec.Cmd {
+// Maximum time the native LDAP client waits for a connection or response.
+const ldapTimeout = 30*time.Second
+
+// Number of entries the native LDAP client requests per page.
+const ldapPageSize = 500
+
+// Connection pools of the native LDAP client for LDAPUser (reading) and
+// LDAPAdmin (writing). Created on first use.
+var ldapUserPool *ldap.Pool
+var ldapAdminPool *ldap.Pool
+var ldapPools_mutex sync.Mutex
+
+// Returns true if the native LDAP client is to be used rather than the
+// ldapsearch/ldapmodify programs.
+func ldapNative() bool {
+  return config.LDAPClient == "native" && ldap.SupportsURI(config.LDAPURI)
+}
+
+// Returns the connection pool for binding as dn with the password from
+// passwordfile, creating it if *pool is nil.
+func ldapPool(pool **ldap.Pool, dn, passwordfile string) *ldap.Pool {
+  ldapPools_mutex.Lock()
+  defer ldapPools_mutex.Unlock()
+  if *pool == nil {
+    *pool = ldap.NewPool(config.LDAPPoolSize, func() (*ldap.Conn, error) {
+      tlsconf, err := ldapTLSConfig()
+      if err != nil { return nil, err }
+      conn, err := ldap.Dial(config.LDAPURI, tlsconf, config.LDAPStartTLS, ldapTimeout)
+      if err != nil { return nil, err }
+      if dn != "" {
+        pw, err := ioutil.ReadFile(passwordfile)
+        if err == nil { err = conn.Bind(dn, string(pw)) }
+        if err != nil {
+          conn.Close()
+          return nil, err
+        }
+      }
+      return conn, nil
+    })
+  }
+  return *pool
+}
+
+func ldapTLSConfig() (*tls.Config, error) {
+  if config.LDAPCACertPath == "" { return nil, nil }
+  pem, err := ioutil.ReadFile(config.LDAPCACertPath)
+  if err != nil { return nil, err }
+  certpool := x509.NewCertPool()
+  if !certpool.AppendCertsFromPEM(pem) {
+    return nil, fmt.Errorf("No certificate found in %v", config.LDAPCACertPath)
+  }
+  return &tls.Config{RootCAs:certpool}, nil
+}
+
+// io.Reader that returns an error on the first Read().
+type ldapErrorReader struct {
+  err error
+}
+
+func (r *ldapErrorReader) Read(p []byte) (int, error) { return 0, r.err }
+
+// The result of ldapModify() when the native LDAP client is used.
+// Has the same CombinedOutput() method as *exec.Cmd.
+type ldapNativeModify struct {
+  ldif string
+}
+
+// Applies the changes and returns output similar to ldapmodify's.
+// Like ldapmodify, processing stops at the first failed change.
+func (m *ldapNativeModify) CombinedOutput() ([]byte, error) {
+  changes, err := ldap.ParseChanges(m.ldif)
+  if err != nil { return nil, err }
+  var out bytes.Buffer
+  // Pool.Do() may call the function a second time on a fresh connection.
+  // The changes applied before the first attempt failed must not be
+  // applied (and reported) again, so we continue with changes[done].
+  // If the first attempt failed after sending changes[done], the server
+  // may or may not have applied it. Sending it again could apply it twice,
+  // so in that case we give up with the error from the first attempt.
+  done := 0
+  started := -1
+  var sent_err error
+  err = ldapPool(&ldapAdminPool, config.LDAPAdmin, config.LDAPAdminPasswordFile).Do(func(conn *ldap.Conn) error {
+    if started == done { return sent_err }
+    // An idle connection from the pool may have been closed by the server.
+    // Find out with a harmless request, so that Pool.Do() can retry before
+    // any change has been sent. Errors from the server itself (e.g. if the
+    // root DSE is not readable) mean the connection is fine.
+    if _, err := conn.Search("", ldap.ScopeBase, "(objectClass=*)", []string{"1.1"}, 0); err != nil {
+      if _, ok := err.(*ldap.Error); !ok { return err }
+    }
+    for ; done < len(changes); done++ {
+      ch := changes[done]
+      started = done
+      switch ch.Type {
+        case "add":    fmt.Fprintf(&out, "adding new entry \"%v\"\n", ch.DN)
+        case "delete": fmt.Fprintf(&out, "deleting entry \"%v\"\n", ch.DN)
+        case "modify": fmt.Fprintf(&out, "modifying entry \"%v\"\n", ch.DN)
+        case "modrdn": fmt.Fprintf(&out, "modifying rdn of entry \"%v\"\n", ch.DN)
+      }
+      if sent_err = conn.Apply(ch); sent_err != nil { return sent_err }
+      out.WriteString("\n")
+    }
+    return nil
+  })
+  return out.Bytes(), err
+}
+
+// Runs ldapModify(ldif).CombinedOutput().
+// This function is public only for the sake of the unit tests. 
+// It's not meant to be used by application code.
+func LDAPModify(ldif string) ([]byte, error) {
+  return ldapModify(ldif).CombinedOutput()
+}
+
+// Closes the idle connections of the native LDAP client, so that the next
+// request connects to config.LDAPURI anew.
+// This function is public only for the sake of the unit tests. 
+// It's not meant to be used by application code.
+func LDAPClosePools() {
+  ldapPools_mutex.Lock()
+  defer ldapPools_mutex.Unlock()
+  for _, pool := range []*ldap.Pool{ldapUserPool, ldapAdminPool} {
+    if pool != nil { pool.Close() }
+  }
+}
+
+// Returns the result of the LDAP search as LDIF in a form that can be
+// passed to xml.LdifToHash(), i.e. either an *exec.Cmd that runs ldapsearch
+// or an io.Reader (the native LDAP client, see config.LDAPClient).
+func ldapSearch(query string, attr... string) interface{} {
   return ldapSearchBase(config.LDAPBase, query, attr...)
 }
 
-func ldapSearchBase(base string, query string, attr... string) *exec.Cmd {
+func ldapSearchBase(base string, query string, attr... string) interface{} {
   return ldapSearchBaseScope(base, "sub", query, attr...)
 }
 
-func ldapSearchBaseScope(base string, scope string, query string, attr... string) *exec.Cmd {  
+func ldapSearchBaseScope(base string, scope string, query string, attr... string) interface{} {  
+  if ldapNative() {
+    util.Log(1, "INFO! LDAP search %v (base: %v, scope: %v) %v", query, base, scope, attr)
+    ldapscope := ldap.ScopeSub
+    switch scope {
+      case "base": ldapscope = ldap.ScopeBase
+      case "one":  ldapscope = ldap.ScopeOne
+    }
+    var entries []*ldap.Entry
+    err := ldapPool(&ldapUserPool, config.LDAPUser, config.LDAPUserPasswordFile).Do(func(conn *ldap.Conn) (err error) {
+      entries, err = conn.Search(base, ldapscope, query, attr, ldapPageSize)
+      return err
+    })
+    if err != nil { return &ldapErrorReader{err} }
+    var ldif bytes.Buffer
+    ldap.WriteLDIF(&ldif, entries)
+    return &ldif
+  }
+  
   args := []string{"-x", "-LLL", "-H", config.LDAPURI, "-b", base, "-s", scope}
   if config.LDAPUser != "" { args = append(args,"-D",config.LDAPUser,"-y",config.LDAPUserPasswordFile) }
   args = append(args, query)
@@ -116,11 +269,13 @@ func ldapSearchBaseScope(base string, scope string, query string, attr... string
 }
 
 
-func ldapModifyAttribute(dn, modifytype, attrname string, attrvalues []string) *exec.Cmd {
-  args := []string{"-x", "-H", config.LDAPURI}
-  args = append(args,"-D",config.LDAPAdmin,"-y",config.LDAPAdminPasswordFile)
-  util.Log(1, "INFO! ldapmodify %v (%v %v -> %v for %v)",args, modifytype, attrname, attrvalues, dn)
-  cmd := exec.Command("ldapmodify", args...)
+// Anything that can run an LDAP modification like *exec.Cmd.
+type ldapModifier interface {
+  CombinedOutput() ([]byte, error)
+}
+
+func ldapModifyAttribute(dn, modifytype, attrname string, attrvalues []string) ldapModifier {
+  util.Log(1, "INFO! ldapmodify (%v %v -> %v for %v)", modifytype, attrname, attrvalues, dn)
   bufstr := bytes.NewBufferString(fmt.Sprintf(`dn:: %v
 changetype: modify
 %v: %v
@@ -133,14 +288,19 @@ changetype: modify
 `, attrname, base64.StdEncoding.EncodeToString([]byte(attrvalues[i]))))
   }
   
-  cmd.Stdin = bufstr
-  return cmd
+  return ldapModifyLDIF(bufstr.String())
+}
+
+func ldapModify(ldif string) ldapModifier {
+  util.Log(1, "INFO! ldapmodify (LDIF:\n%v)", ldif)
+  return ldapModifyLDIF(ldif)
 }
 
-func ldapModify(ldif string) *exec.Cmd {
+func ldapModifyLDIF(ldif string) ldapModifier {
+  if ldapNative() { return &ldapNativeModify{ldif} }
   args := []string{"-x", "-H", config.LDAPURI}
   args = append(args,"-D",config.LDAPAdmin,"-y",config.LDAPAdminPasswordFile)
-  util.Log(1, "INFO! ldapmodify %v (LDIF:\n%v)",args, ldif)
+  util.Log(2, "DEBUG! ldapmodify %v",args)
   cmd := exec.Command("ldapmodify", args...)
   bufstr := bytes.NewBufferString(ldif)
   cmd.Stdin = bufstr
@@ -20,6 +20,8 @@ MA  02110-1301, USA.
 package db
 
 import (
+         "os"
+         
          "../xml"
          "github.com/mbenkmann/golib/util"
        )
@@ -40,3 +42,62 @@ func (f *LoggingFileStorer) Store(data *xml.Hash) (err error) {
   return err
 }
 
+
+// A xml.JournalStorer that logs errors to the go-susi log
+type LoggingJournalStorer struct {
+  xml.JournalStorer
+}
+
+func (j *LoggingJournalStorer) Store(data *xml.Hash) (err error) {
+  util.WithPanicHandler(func (){
+    err = j.JournalStorer.Store(data)
+    if err != nil {
+      util.Log(0, "ERROR! Cannot store database: %v", err)
+    }
+  })
+  
+  return err
+}
+
+func (j *LoggingJournalStorer) Journal(removed *xml.Hash, added []*xml.Hash) (err error) {
+  err = j.JournalStorer.Journal(removed, added)
+  if err != nil {
+    util.Log(0, "ERROR! Cannot write to database journal %v: %v", j.JournalPath(), err)
+  }
+  return err
+}
+
+func (j *LoggingJournalStorer) Compact(data *xml.Hash) (err error) {
+  util.WithPanicHandler(func (){
+    err = j.JournalStorer.Compact(data)
+    if err != nil {
+      util.Log(0, "ERROR! Cannot compact database journal %v: %v", j.JournalPath(), err)
+    }
+  })
+  
+  return err
+}
+
+// Creates a LoggingJournalStorer for the database stored at path and
+// returns it together with the data from its snapshot and journal.
+// If fresh is true, any existing data is discarded.
+// Errors are logged with the prefix caller. If no data exists, the returned
+// Hash is nil.
+func loadJournal(caller, name, path string, fresh bool) (*LoggingJournalStorer, *xml.Hash) {
+  storer := &LoggingJournalStorer{xml.JournalStorer{Path:path}}
+  if fresh {
+    storer.Compact(xml.NewHash(name))
+    return storer, nil
+  }
+  
+  data, err := storer.Load(name)
+  if err != nil {
+    if os.IsNotExist(err) { 
+      /* File does not exist is not an error that needs to be reported */ 
+      return storer, nil
+    }
+    util.Log(0, "ERROR! %v reading '%v': %v", caller, path, err)
+    // Use whatever could be read. It is better than nothing.
+  }
+  return storer, data
+}
@@ -0,0 +1,340 @@
+/*
+Copyright (c) 2026 go-susi contributors
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+// API for the various databases used by go-susi.
+package db
+
+import (
+         "fmt"
+         "time"
+         "strconv"
+         "strings"
+
+         "../xml"
+         "../config"
+         "github.com/mbenkmann/golib/util"
+       )
+
+// A period of the week during which certain jobs (see config.MaintenanceJobs())
+// may be launched.
+type MaintenanceWindow struct {
+  // The original specification, e.g. "Mon-Fri 18:00-07:00"
+  Spec string
+  // Days[time.Sunday],... are true for the days on which the window opens.
+  Days [7]bool
+  // Minutes since midnight at which the window opens and closes.
+  // If End <= Start, the window closes on the following day.
+  Start, End int
+}
+
+var maintenanceDayNames = []string{"sun","mon","tue","wed","thu","fri","sat"}
+
+// Parses a list of maintenance windows separated by ";". Each window
+// consists of a list of days and an optional time range, e.g.
+//   Mon-Fri 18:00-07:00; Sat,Sun
+// Days are given as English names (only the first 3 letters are
+// significant), ranges of days ("Fri-Mon" wraps around) or "*" for every day.
+// If the end of the time range is not later than the start, the window closes
+// on the following day. A window without time range lasts the whole day,
+// a time range without days applies to every day.
+func ParseMaintenanceWindows(spec string) ([]MaintenanceWindow, error) {
+  windows := []MaintenanceWindow{}
+  for _, w := range strings.Split(spec, ";") {
+    w = strings.TrimSpace(w)
+    if w == "" { continue }
+
+    var win MaintenanceWindow
+    win.Spec = w
+    win.End = 24*60
+
+    days := w
+    if i := strings.LastIndexAny(w, " \t"); strings.Index(w[i+1:], ":") > 0 {
+      days = strings.TrimSpace(w[:i+1])
+      if days == "" { days = "*" }
+      times := strings.Split(w[i+1:], "-")
+      if len(times) != 2 { return nil, fmt.Errorf("Maintenance window \"%v\": Time range must have the form HH:MM-HH:MM", w) }
+      var err error
+      if win.Start, err = maintenanceMinutes(times[0]); err != nil { return nil, fmt.Errorf("Maintenance window \"%v\": %v", w, err) }
+      if win.End, err = maintenanceMinutes(times[1]); err != nil { return nil, fmt.Errorf("Maintenance window \"%v\": %v", w, err) }
+    }
+
+    for _, d := range strings.Split(days, ",") {
+      d = strings.TrimSpace(d)
+      if d == "*" {
+        for i := range win.Days { win.Days[i] = true }
+        continue
+      }
+      r := strings.Split(d, "-")
+      if len(r) > 2 { return nil, fmt.Errorf("Maintenance window \"%v\": Illegal day range \"%v\"", w, d) }
+      first, err := maintenanceDay(r[0])
+      if err != nil { return nil, fmt.Errorf("Maintenance window \"%v\": %v", w, err) }
+      last := first
+      if len(r) == 2 {
+        if last, err = maintenanceDay(r[1]); err != nil { return nil, fmt.Errorf("Maintenance window \"%v\": %v", w, err) }
+      }
+      for i := first; ; i = (i+1) % 7 {
+        win.Days[i] = true
+        if i == last { break }
+      }
+    }
+
+    windows = append(windows, win)
+  }
+  return windows, nil
+}
+
+func maintenanceDay(d string) (int, error) {
+  d = strings.ToLower(strings.TrimSpace(d))
+  if len(d) >= 3 {
+    for i, name := range maintenanceDayNames {
+      if d[0:3] == name { return i, nil }
+    }
+  }
+  return 0, fmt.Errorf("Unknown day \"%v\"", d)
+}
+
+func maintenanceMinutes(hhmm string) (int, error) {
+  hm := strings.Split(strings.TrimSpace(hhmm), ":")
+  if len(hm) == 2 {
+    h, err1 := strconv.Atoi(hm[0])
+    m, err2 := strconv.Atoi(hm[1])
+    if err1 == nil && err2 == nil && h >= 0 && m >= 0 && m < 60 && h*60+m <= 24*60 {
+      return h*60+m, nil
+    }
+  }
+  return 0, fmt.Errorf("Illegal time \"%v\"", hhmm)
+}
+
+// Returns the times at which w opens and closes on the day of t.
+func (w *MaintenanceWindow) on(t time.Time) (start, end time.Time) {
+  y, m, d := t.Date()
+  start = time.Date(y, m, d, 0, w.Start, 0, 0, t.Location())
+  if w.End > w.Start {
+    end = time.Date(y, m, d, 0, w.End, 0, 0, t.Location())
+  } else {
+    end = time.Date(y, m, d+1, 0, w.End, 0, 0, t.Location())
+  }
+  return
+}
+
+// Returns true if t lies within one of the windows.
+func MaintenanceWindowOpen(windows []MaintenanceWindow, t time.Time) bool {
+  for i := range windows {
+    for _, day := range []time.Time{t, t.AddDate(0,0,-1)} {
+      if !windows[i].Days[day.Weekday()] { continue }
+      start, end := windows[i].on(day)
+      if !t.Before(start) && t.Before(end) { return true }
+    }
+  }
+  return false
+}
+
+// Returns the earliest time not before t that lies within one of the windows.
+// If there is no such time (i.e. windows is empty), the zero time is returned.
+func MaintenanceWindowNext(windows []MaintenanceWindow, t time.Time) time.Time {
+  if MaintenanceWindowOpen(windows, t) { return t }
+  var next time.Time
+  for i := range windows {
+    for n := 0; n <= 7; n++ {
+      day := t.AddDate(0,0,n)
+      if !windows[i].Days[day.Weekday()] { continue }
+      start, _ := windows[i].on(day)
+      if start.After(t) && (next.IsZero() || start.Before(next)) { next = start }
+    }
+  }
+  return next
+}
+
+// Returns the maintenance windows that apply to the system with the given
+// MAC address and a description of where they come from. If no maintenance
+// windows apply, the returned list is empty. The first of the following
+// sources that defines maintenance windows is used:
+//   1. the system object's config.MaintenanceLDAPAttribute()
+//   2. the config.MaintenanceLDAPAttribute() of the object groups the system is
+//      a member of and the respective "group:<cn>" entries from config.MaintenanceWindows()
+//   3. the config.MaintenanceLDAPAttribute() of the gosaAdministrativeUnit
+//      with the system's gosaUnitTag and the "unit:<gosaUnitTag>" entry
+//      from config.MaintenanceWindows()
+//   4. the "default" entry from config.MaintenanceWindows()
+// If a source has several windows, the job may be launched in any of them.
+//
+// ATTENTION! This function accesses LDAP and may therefore take a while.
+// If possible you should use it asynchronously.
+func MaintenanceWindowsFor(macaddress string) ([]MaintenanceWindow, string) {
+  attr := config.MaintenanceLDAPAttribute()
+  specs := []string{}
+
+  system, err := SystemGetAllDataForMAC(macaddress, false)
+  if err != nil {
+    util.Log(1, "INFO! Using default maintenance window for %v: %v", macaddress, err)
+  } else {
+    if attr != "" {
+      if specs = system.Get(attr); len(specs) > 0 {
+        return maintenanceWindowsFrom(system.Text("dn"), specs)
+      }
+    }
+
+    groups := SystemGetGroupsWithMember(system.Text("dn"))
+    names := []string{}
+    for group := groups.First("xml"); group != nil; group = group.Next() {
+      var gspecs []string
+      if attr != "" { gspecs = group.Get(attr) }
+      if spec, ok := config.MaintenanceWindows()["group:"+group.Text("cn")]; ok {
+        gspecs = append(gspecs, spec)
+      }
+      if len(gspecs) > 0 {
+        specs = append(specs, gspecs...)
+        names = append(names, group.Text("cn"))
+      }
+    }
+    if len(specs) > 0 {
+      return maintenanceWindowsFrom("object group "+strings.Join(names, ","), specs)
+    }
+
+    if unittag := system.Text("gosaunittag"); unittag != "" {
+      if attr != "" {
+        unit, err := xml.LdifToHash("xml", true, ldapSearch(fmt.Sprintf("(&(objectClass=gosaAdministrativeUnit)(gosaUnitTag=%v))", LDAPFilterEscape(unittag)), attr))
+        if err != nil {
+          util.Log(0, "ERROR! LDAP error while looking for gosaAdministrativeUnit with gosaUnitTag %v: %v", unittag, err)
+        } else {
+          for u := unit.First("xml"); u != nil; u = u.Next() {
+            specs = append(specs, u.Get(attr)...)
+          }
+        }
+      }
+      if spec, ok := config.MaintenanceWindows()["unit:"+unittag]; ok {
+        specs = append(specs, spec)
+      }
+      if len(specs) > 0 {
+        return maintenanceWindowsFrom("unit "+unittag, specs)
+      }
+    }
+  }
+
+  if spec, ok := config.MaintenanceWindows()["default"]; ok {
+    return maintenanceWindowsFrom("default", []string{spec})
+  }
+
+  return []MaintenanceWindow{}, ""
+}
+
+// Parses specs and returns the windows with source as description.
+// Broken specs are logged and skipped.
+func maintenanceWindowsFrom(source string, specs []string) ([]MaintenanceWindow, string) {
+  windows := []MaintenanceWindow{}
+  for _, spec := range specs {
+    w, err := ParseMaintenanceWindows(spec)
+    if err != nil {
+      util.Log(0, "ERROR! Maintenance window of %v: %v", source, err)
+      continue
+    }
+    windows = append(windows, w...)
+  }
+  return windows, source
+}
+
+// Returns a filter that accepts jobs that may only be launched within their
+// target's maintenance window.
+func jobRestricted() xml.HashFilter {
+  filters := []xml.HashFilter{}
+  for _, headertag := range config.MaintenanceJobs() {
+    filters = append(filters, xml.FilterSimple("headertag", headertag))
+  }
+  return xml.FilterOr(filters)
+}
+
+// The ids of the jobs that a running jobsCheckMaintenanceWindows() has not
+// finished checking, yet. Only accessed by handleJobDBRequests().
+var maintenanceChecking = map[string]bool{}
+
+// Starts jobsCheckMaintenanceWindows() in a new goroutine for those jobs
+// from jobdb_xml that are not already being checked by an earlier call.
+// Without this, every pass of handleJobDBRequests() during a slow LDAP
+// lookup would start another goroutine for the same jobs.
+// MUST ONLY BE CALLED FROM handleJobDBRequests()!
+func jobsStartMaintenanceCheck(jobdb_xml *xml.Hash) {
+  unchecked := xml.NewHash("jobdb")
+  for job := jobdb_xml.First("job"); job != nil; job = job.Next() {
+    if !maintenanceChecking[job.Text("id")] {
+      maintenanceChecking[job.Text("id")] = true
+      unchecked.AddClone(job)
+    }
+  }
+  if unchecked.First("job") != nil {
+    go util.WithPanicHandler(func(){ jobsCheckMaintenanceWindows(unchecked) })
+  }
+}
+
+// Checks for each of the local jobs in jobdb_xml (which are either due or
+// "deferred" with a <deferred_until> that has come) if its target's maintenance
+// window is open. If it is, the job is launched. Otherwise the job is put into
+// status "deferred" with <deferred_until> set to the next opening of the window
+// and a <result> that tells why.
+//
+// ATTENTION! This function accesses LDAP and may therefore take a while.
+// It is called as a goroutine by jobsStartMaintenanceCheck().
+func jobsCheckMaintenanceWindows(jobdb_xml *xml.Hash) {
+  for job := jobdb_xml.First("job"); job != nil; job = job.Next() {
+    util.WithPanicHandler(func(){ jobsCheckMaintenanceWindow(job) })
+  }
+}
+
+// Performs the check described at jobsCheckMaintenanceWindows() for job.
+func jobsCheckMaintenanceWindow(job *xml.Hash) {
+  // The job is released from maintenanceChecking by a request queued after
+  // the JobsModifyLocal() below, so that no check of the job can start
+  // before the modification has been performed.
+  id := job.Text("id")
+  release := func(request *jobDBRequest) { delete(maintenanceChecking, id) }
+  defer func(){ jobDBRequests <- &jobDBRequest{ release, nil, nil, nil } }()
+
+  // Recheck the status to avoid clobbering changes made in the meantime.
+  filter := xml.FilterAnd([]xml.HashFilter{
+              xml.FilterSimple("siserver", config.ServerSourceAddress, "id", job.Text("id")),
+              xml.FilterOr([]xml.HashFilter{xml.FilterSimple("status","waiting"),
+                                            xml.FilterSimple("status","wakeup"),
+                                            xml.FilterSimple("status","deferred")})})
+
+  now := time.Now()
+  update := xml.NewHash("job")
+  if job.Text("status") == "deferred" {
+    update.Add("result", "none")
+    update.Add("deferred_until")
+  }
+
+  // A deferred job's <timestamp> may have been moved into the future.
+  if job.Text("timestamp") > util.MakeTimestamp(now) {
+    update.Add("status", "waiting")
+    JobsModifyLocal(filter, update)
+    return
+  }
+
+  windows, source := MaintenanceWindowsFor(job.Text("macaddress"))
+  if len(windows) == 0 || MaintenanceWindowOpen(windows, now) {
+    update.Add("status", "launch")
+    JobsModifyLocal(filter, update)
+    return
+  }
+
+  next := MaintenanceWindowNext(windows, now)
+  specs := []string{}
+  for i := range windows { specs = append(specs, windows[i].Spec) }
+  update = xml.NewHash("job", "status", "deferred")
+  update.Add("deferred_until", util.MakeTimestamp(next))
+  update.Add("result", fmt.Sprintf("Outside maintenance window (%v: %v). Deferred until %v", source, strings.Join(specs, "; "), next.Format("2006-01-02 15:04")))
+  if job.Text("status") != "deferred" || job.Text("deferred_until") != update.Text("deferred_until") {
+    util.Log(1, "INFO! Deferring job %v for %v until %v (outside maintenance window)", job.Text("id"), job.Text("macaddress"), next)
+  }
+  JobsModifyLocal(filter, update)
+}
@@ -0,0 +1,242 @@
+/*
+Copyright (c) 2026 go-susi contributors
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+// API for the various databases used by go-susi.
+package db
+
+import (
+         "fmt"
+         "time"
+         "strconv"
+         "strings"
+       )
+
+// A parsed cron expression. See PeriodicNext().
+type cronSchedule struct {
+  minute, hour, dom, month, dow map[int]bool
+  // nth[d] != 0 means that day of week d only matches on its nth[d]-th
+  // occurrence within the month ("sun#1").
+  nth map[int]int
+  // true if the respective field is "*" (relevant for the dom/dow rule).
+  domStar, dowStar bool
+  loc *time.Location
+}
+
+var cronMacros = map[string]string{
+  "@yearly":   "0 0 1 1 *",
+  "@annually": "0 0 1 1 *",
+  "@monthly":  "0 0 1 * *",
+  "@weekly":   "0 0 * * 0",
+  "@daily":    "0 0 * * *",
+  "@midnight": "0 0 * * *",
+  "@hourly":   "0 * * * *",
+}
+
+var cronMonthNames = []string{"jan","feb","mar","apr","may","jun","jul","aug","sep","oct","nov","dec"}
+
+// Returns an error if periodic is not a valid <periodic> value.
+// See PeriodicNext() for the accepted formats.
+func PeriodicValid(periodic string) error {
+  if periodic == "" || periodic == "none" { return nil }
+  _, err := PeriodicNext(periodic, time.Now())
+  return err
+}
+
+// Returns the next time after t at which a job with the given <periodic>
+// is to be repeated. periodic is either
+//   N_unit   where N is a positive integer and unit is one of seconds, minutes,
+//            hours, days, weeks, months, years. The result is t + N units.
+// or a cron expression with the 5 fields minute, hour, day of month, month
+// and day of week, e.g.
+//   0 3 * * mon-fri      every weekday at 03:00
+//   30 2 * * sun#1       at 02:30 on the first Sunday of every month
+//   */15 * * * *         every 15 minutes
+// Fields support "*", lists, ranges and steps. Months and days of the week may
+// be given as English 3-letter names; 0 and 7 both mean Sunday. As with
+// cron, if both day of month and day of week are restricted, a day matches if
+// either matches. "d#n" matches the n-th day d of the month. The macros
+// @yearly, @monthly, @weekly, @daily and @hourly are supported, too.
+// A cron expression may be prefixed with "TZ=<zone> " (e.g. "TZ=Europe/Berlin"),
+// in which case it is evaluated in that time zone instead of the local one.
+func PeriodicNext(periodic string, t time.Time) (time.Time, error) {
+  if strings.IndexAny(periodic, " \t@") < 0 {
+    return periodicAdd(periodic, t)
+  }
+
+  cron, err := parseCron(periodic)
+  if err != nil { return t, err }
+  next, ok := cron.next(t)
+  if !ok { return t, fmt.Errorf("<periodic> \"%v\" never matches", periodic) }
+  return next, nil
+}
+
+func periodicAdd(periodic string, t time.Time) (time.Time, error) {
+  p := strings.Split(periodic, "_")
+  if len(p) != 2 {
+    return t, fmt.Errorf("Illegal <periodic>: %v", periodic)
+  }
+  period, err := strconv.ParseUint(p[0], 10, 64)
+  if err != nil || period == 0 {
+    return t, fmt.Errorf("Illegal <periodic>: %v: %v", periodic, err)
+  }
+
+  switch p[1] {
+    case "seconds": t = t.Add(time.Duration(period) * time.Second)
+    case "minutes": t = t.Add(time.Duration(period) * time.Minute)
+    case "hours":   t = t.Add(time.Duration(period) * time.Hour)
+    case "days":    t = t.AddDate(0,0,int(period))
+    case "weeks":   t = t.AddDate(0,0,int(period*7))
+    case "months":  t = t.AddDate(0,int(period),0)
+    case "years":   t = t.AddDate(int(period),0,0)
+    default:
+         return t, fmt.Errorf("Unknown periodic unit: %v", p[1])
+  }
+  return t, nil
+}
+
+func parseCron(periodic string) (*cronSchedule, error) {
+  cron := &cronSchedule{nth:map[int]int{}, loc:time.Local}
+
+  fields := strings.Fields(periodic)
+  if len(fields) > 0 && (strings.HasPrefix(fields[0], "TZ=") || strings.HasPrefix(fields[0], "CRON_TZ=")) {
+    loc, err := time.LoadLocation(fields[0][strings.Index(fields[0],"=")+1:])
+    if err != nil { return nil, fmt.Errorf("<periodic> \"%v\": %v", periodic, err) }
+    cron.loc = loc
+    fields = fields[1:]
+  }
+
+  if len(fields) == 1 {
+    if macro, ok := cronMacros[strings.ToLower(fields[0])]; ok {
+      fields = strings.Fields(macro)
+    }
+  }
+
+  if len(fields) != 5 {
+    return nil, fmt.Errorf("<periodic> \"%v\": cron expression must have 5 fields", periodic)
+  }
+
+  var err error
+  if cron.minute, err = parseCronField(fields[0], 0, 59, nil, nil); err != nil { return nil, fmt.Errorf("<periodic> \"%v\": minute: %v", periodic, err) }
+  if cron.hour, err = parseCronField(fields[1], 0, 23, nil, nil); err != nil { return nil, fmt.Errorf("<periodic> \"%v\": hour: %v", periodic, err) }
+  if cron.dom, err = parseCronField(fields[2], 1, 31, nil, nil); err != nil { return nil, fmt.Errorf("<periodic> \"%v\": day of month: %v", periodic, err) }
+  if cron.month, err = parseCronField(fields[3], 1, 12, cronMonthNames, nil); err != nil { return nil, fmt.Errorf("<periodic> \"%v\": month: %v", periodic, err) }
+  if cron.dow, err = parseCronField(fields[4], 0, 7, maintenanceDayNames, cron.nth); err != nil { return nil, fmt.Errorf("<periodic> \"%v\": day of week: %v", periodic, err) }
+  if cron.dow[7] { cron.dow[0] = true }
+  if n, ok := cron.nth[7]; ok { cron.nth[0] = n }
+  cron.domStar = fields[2] == "*"
+  cron.dowStar = fields[4] == "*"
+  return cron, nil
+}
+
+// Parses a single field of a cron expression into the set of matching values.
+// If names is non-nil, names[i] may be used for the value min+i.
+// If nth is non-nil, "value#n" is permitted and recorded in nth.
+func parseCronField(field string, min, max int, names []string, nth map[int]int) (map[int]bool, error) {
+  values := map[int]bool{}
+
+  value := func(s string) (int, error) {
+    for i, name := range names {
+      if strings.ToLower(s) == name { return min+i, nil }
+    }
+    n, err := strconv.Atoi(s)
+    if err != nil || n < min || n > max { return 0, fmt.Errorf("illegal value \"%v\"", s) }
+    return n, nil
+  }
+
+  for _, part := range strings.Split(field, ",") {
+    if nth != nil && strings.Index(part, "#") >= 0 {
+      p := strings.Split(part, "#")
+      d, err := value(p[0])
+      if err != nil { return nil, err }
+      n, err := strconv.Atoi(p[1])
+      if len(p) != 2 || err != nil || n < 1 || n > 5 { return nil, fmt.Errorf("illegal value \"%v\"", part) }
+      values[d] = true
+      nth[d] = n
+      continue
+    }
+
+    step := 1
+    if i := strings.Index(part, "/"); i >= 0 {
+      var err error
+      step, err = strconv.Atoi(part[i+1:])
+      if err != nil || step < 1 { return nil, fmt.Errorf("illegal step \"%v\"", part) }
+      part = part[0:i]
+    }
+
+    first, last := min, max
+    if part != "*" {
+      r := strings.Split(part, "-")
+      if len(r) > 2 { return nil, fmt.Errorf("illegal range \"%v\"", part) }
+      var err error
+      if first, err = value(r[0]); err != nil { return nil, err }
+      last = first
+      if len(r) == 2 {
+        if last, err = value(r[1]); err != nil { return nil, err }
+      } else if step > 1 {
+        last = max // "5/10" means "5-max/10"
+      }
+      if last < first { return nil, fmt.Errorf("illegal range \"%v\"", part) }
+    }
+
+    for i := first; i <= last; i += step { values[i] = true }
+  }
+  return values, nil
+}
+
+// Returns true if the day of t matches the day of month and day of week fields.
+func (cron *cronSchedule) dayMatches(t time.Time) bool {
+  wd := int(t.Weekday())
+  dow := cron.dow[wd]
+  if n := cron.nth[wd]; n != 0 {
+    dow = dow && (t.Day()-1)/7+1 == n
+  }
+  dom := cron.dom[t.Day()]
+  switch {
+    case cron.domStar && cron.dowStar: return true
+    case cron.domStar: return dow
+    case cron.dowStar: return dom
+  }
+  return dom || dow
+}
+
+// Returns the first time after t (at minute granularity) that matches cron.
+// The result is in the time zone of t. If there is no match within
+// the next 5 years, false is returned.
+func (cron *cronSchedule) next(t time.Time) (time.Time, bool) {
+  loc := t.Location()
+  n := t.In(cron.loc)
+  n = time.Date(n.Year(), n.Month(), n.Day(), n.Hour(), n.Minute()+1, 0, 0, cron.loc)
+  limit := n.AddDate(5,0,0)
+  // time.Date() may go backwards when the clocks are turned back (DST),
+  // so make sure that we always make progress.
+  advance := func(c time.Time) {
+    if !c.After(n) { c = n.Add(time.Minute) }
+    n = c
+  }
+  for n.Before(limit) {
+    switch {
+      case !cron.month[int(n.Month())]:
+        advance(time.Date(n.Year(), n.Month()+1, 1, 0, 0, 0, 0, cron.loc))
+      case !cron.dayMatches(n):
+        advance(time.Date(n.Year(), n.Month(), n.Day()+1, 0, 0, 0, 0, cron.loc))
+      case !cron.hour[n.Hour()]:
+        advance(time.Date(n.Year(), n.Month(), n.Day(), n.Hour()+1, 0, 0, 0, cron.loc))
+      case !cron.minute[n.Minute()]:
+        advance(time.Date(n.Year(), n.Month(), n.Day(), n.Hour(), n.Minute()+1, 0, 0, cron.loc))
+      default:
+        return n.In(loc), true
+    }
+  }
+  return t, false
+}
@@ -21,14 +21,17 @@ MA  02110-1301, USA.
 package db
 
 import (
-         "os"
+         "fmt"
          "net"
          "time"
          "regexp"
          "strings"
+         "sync"
+         "sync/atomic"
          
          "../xml"
          "../config"
+         "../security"
          "github.com/mbenkmann/golib/util"
        )
 
@@ -40,32 +43,26 @@ import (
 //    <macaddress>00:50:1e:20:c3:20</macaddress>  (optional)
 //    <key>currentserverkey</key>
 //    <key>previousserverkey</key>
+//    <fingerprint>...</fingerprint>  (optional, pinned peer certificate)
+//    <rejectedfingerprint>...</rejectedfingerprint>  (optional)
+//    <encryption>aes-256-gcm</encryption>  (optional, see ServerSealing())
 //  </xml>
+// See ServerCertificateCheck() for <fingerprint> and <rejectedfingerprint>.
 var serverDB *xml.DB = xml.NewDB("serverdb",nil,0)
 
-// Initializes serverDB with data from the file config.ServerDBPath if it exists,
+// Initializes serverDB with data from the file config.ServerDBPath and its
+// journal (see xml.JournalStorer) if they exist,
 // as well as the list of peer servers from DNS and [ServerPackages]/address.
 // Not an init() because main() needs to set up some things first.
 func ServersInit() {
-  db_storer := &LoggingFileStorer{xml.FileStorer{config.ServerDBPath}}
+  db_storer, xmldata := loadJournal("ServersInit", "serverdb", config.ServerDBPath, config.FreshDatabase)
   var delay time.Duration = config.DBPersistDelay
   serverDB = xml.NewDB("serverdb", db_storer, delay)
-  if !config.FreshDatabase {
-    xmldata, err := xml.FileToHash(config.ServerDBPath)
-    if err != nil {
-      if os.IsNotExist(err) { 
-        /* File does not exist is not an error that needs to be reported */ 
-      } else
-      {
-        util.Log(0, "ERROR! ServersInit reading '%v': %v", config.ServerDBPath, err)
-      }
-    } else
-    {
-      serverDB.Init(xmldata)
-    }
+  if xmldata != nil {
+    serverDB.Init(xmldata)
   }
   
-  if config.DNSLookup { 
+  if config.DNSLookup() { 
     addServersFromDNS() 
   } else {
     util.Log(1, "INFO! DNS lookup disabled. Will not add peer servers from DNS.")
@@ -112,7 +109,7 @@ func addServer(server string) {
     return
   }
 
-  source := ip + ":" + port
+  source := net.JoinHostPort(ip, port)
   
   // do not add our own address
   if source == config.ServerSourceAddress { return }
@@ -135,11 +132,11 @@ func addServer(server string) {
     } else {
       key = config.IP + ip
     }
-    key = config.ModuleKey["[ServerPackages]"] + strings.Replace(key, ".", "", -1)
+    key = config.ModuleKey()["[ServerPackages]"] + strings.Replace(key, ".", "", -1)
     server_xml := xml.NewHash("xml", "source", source)
     // If we have a TLS config, assume the peer does, too, and mark it as
     // such by storing an empty string as key.
-    if config.TLSClientConfig != nil { key = "" }
+    if config.TLSClientConfig() != nil { key = "" }
     server_xml.Add("key", key)
     ServerUpdate(server_xml)
   }
@@ -153,6 +150,10 @@ func addServer(server string) {
 //     <key>...</key>
 //     ...
 //   </xml>
+//
+// The <fingerprint> and <rejectedfingerprint> (see ServerCertificateCheck())
+// of the existing entry are kept. Those in server are ignored, because
+// server is usually a message from the peer itself.
 func ServerUpdate(server *xml.Hash) {
   source := server.Text("source")
   keys := ServerKeys(source)
@@ -161,6 +162,18 @@ func ServerUpdate(server *xml.Hash) {
     // we might still have pending messages encrypted with the previous key.
     server.Add("key", keys[0])
   }
+  for server.RemoveFirst("fingerprint") != nil {}
+  for server.RemoveFirst("rejectedfingerprint") != nil {}
+  serverCertificateMutex.Lock()
+  defer serverCertificateMutex.Unlock()
+  if old := serverDB.Query(xml.FilterSimple("source", source)).First("xml"); old != nil {
+    if fingerprint := old.Text("fingerprint"); fingerprint != "" {
+      server.Add("fingerprint", fingerprint)
+    }
+    if rejected := old.Text("rejectedfingerprint"); rejected != "" {
+      server.Add("rejectedfingerprint", rejected)
+    }
+  }
   util.Log(2, "DEBUG! ServerUpdate for %v: Keys are now %v", source, server.Get("key"))
   filter := xml.FilterSimple("source", source)
   if macaddress := server.Text("macaddress"); macaddress != "" {
@@ -186,12 +199,7 @@ func ServerRemove(addr string) *xml.Hash {
 // includes a port, only keys from that specific server will be returned.
 func ServerKeys(addr string) []string {
   result := make([]string, 0, 2)
-  var filter xml.HashFilter
-  if strings.Index(addr, ":") >= 0 {
-    filter = xml.FilterSimple("source", addr)
-  } else {
-    filter = xml.FilterRegexp("source", "^"+regexp.QuoteMeta(addr+":")+"[0-9]+$")
-  }
+  filter := addressFilter("source", addr)
   for server := serverDB.Query(filter).First("xml");
       server != nil;
       server = server.Next() {
@@ -200,6 +208,25 @@ func ServerKeys(addr string) []string {
   return result
 }
 
+// Returns true if the server identified by the given address (see ServerKeys()
+// for the format) has announced support for security.GosaSeal() and
+// config.Encryption() permits its use.
+func ServerSealing(addr string) bool {
+  server := serverDB.Query(addressFilter("source", addr)).First("xml")
+  return server != nil && security.SupportsSealing(server)
+}
+
+// Returns a filter that accepts entries whose element tag matches addr.
+// addr is either IP:PORT ([IPv6]:PORT for IPv6) or an IP without port, in
+// which case any port is accepted.
+func addressFilter(tag string, addr string) xml.HashFilter {
+  if _, _, err := net.SplitHostPort(addr); err == nil {
+    return xml.FilterSimple(tag, addr)
+  }
+  prefix := net.JoinHostPort(strings.Trim(addr, "[]"), "")
+  return xml.FilterRegexp(tag, "^"+regexp.QuoteMeta(prefix)+"[0-9]+$")
+}
+
 // Returns all server keys for all servers in the database.
 func ServerKeysForAllServers() []string {
   return serverDB.ColumnValues("key")
@@ -229,6 +256,95 @@ func ServerAddresses() []string {
   return serverDB.ColumnValues("source")
 }
 
+// Number of peer messages rejected by ServerCertificateCheck().
+var ServerCertificateMismatches int32
+
+// Makes reading and storing the <fingerprint> and <rejectedfingerprint> of
+// a serverDB entry atomic. Without it, 2 connections from a peer without
+// a pinned certificate could each pin their own certificate and both be
+// trusted. ServerUpdate() takes it, too, so that it can not undo a pin.
+var serverCertificateMutex sync.Mutex
+
+/*
+  Returns true if the certificate with the given SHA-256 fingerprint
+  (see security.CertificateFingerprint(); "" if the peer did not use TLS)
+  may be used by the peer server addr (IP:PORT).
+  The required fingerprint is taken from config.PeerFingerprints() or, if addr
+  is not listed there, from the <fingerprint> pinned in addr's entry.
+  If addr's entry has no <fingerprint>, the certificate is pinned (i.e.
+  trusted on first contact). If addr has neither an entry nor a configured
+  fingerprint, the message is rejected unless new_peer is true, in which
+  case the certificate is accepted but not pinned (because there is no
+  entry to pin it in yet). Peers that did not use TLS are accepted unless
+  a certificate is required for them.
+  A rejected certificate is logged, counted in ServerCertificateMismatches
+  and its fingerprint is stored as <rejectedfingerprint> in addr's entry
+  until an admin approves it with ServerCertificateApprove().
+*/
+func ServerCertificateCheck(addr, fingerprint string, new_peer bool) bool {
+  serverCertificateMutex.Lock()
+  defer serverCertificateMutex.Unlock()
+  filter := xml.FilterSimple("source", addr)
+  server := serverDB.Query(filter).First("xml")
+  required := config.PeerFingerprints()[addr]
+  if required == "" && server == nil && !new_peer {
+    util.Log(0, "ERROR! [SECURITY] Peer %v is neither in serverdb nor in [peer-certificates] => Rejecting message", addr)
+    return false
+  }
+  if required == "" && server != nil {
+    required = server.Text("fingerprint")
+    if required == "" && fingerprint != "" {
+      server.Add("fingerprint", fingerprint)
+      serverDB.Replace(filter, false, server)
+      util.Log(1, "INFO! [SECURITY] Pinned certificate %v for peer %v", fingerprint, addr)
+      return true
+    }
+  }
+  if fingerprint == required || required == "" { return true }
+  
+  atomic.AddInt32(&ServerCertificateMismatches, 1)
+  if fingerprint == "" {
+    util.Log(0, "ERROR! [SECURITY] Peer %v did not use TLS but certificate %v is pinned for it => Rejecting message", addr, required)
+    return false
+  }
+  util.Log(0, "ERROR! [SECURITY] Peer %v presented certificate %v but certificate %v is pinned for it => Rejecting message", addr, fingerprint, required)
+  if server != nil && server.Text("rejectedfingerprint") != fingerprint {
+    for server.RemoveFirst("rejectedfingerprint") != nil {}
+    server.Add("rejectedfingerprint", fingerprint)
+    serverDB.Replace(filter, false, server)
+  }
+  return false
+}
+
+// Pins the certificate last rejected by ServerCertificateCheck() for the peer
+// server addr (IP:PORT), so that it is accepted from now on. Returns an error
+// if there is no rejected certificate for addr or if addr's certificate is
+// configured in config.PeerFingerprints().
+func ServerCertificateApprove(addr string) error {
+  if config.PeerFingerprints()[addr] != "" {
+    return fmt.Errorf("Certificate of %v is configured in [peer-certificates]", addr)
+  }
+  serverCertificateMutex.Lock()
+  defer serverCertificateMutex.Unlock()
+  filter := xml.FilterSimple("source", addr)
+  server := serverDB.Query(filter).First("xml")
+  if server == nil || server.Text("rejectedfingerprint") == "" {
+    return fmt.Errorf("No rejected certificate for %v", addr)
+  }
+  fingerprint := server.RemoveFirst("rejectedfingerprint").Text()
+  for server.RemoveFirst("fingerprint") != nil {}
+  server.Add("fingerprint", fingerprint)
+  serverDB.Replace(filter, false, server)
+  util.Log(0, "WARNING! [SECURITY] Pinned approved certificate %v for peer %v", fingerprint, addr)
+  return nil
+}
+
+// Returns the number of peer servers with a rejected certificate awaiting
+// approval (see ServerCertificateApprove()).
+func ServerCertificatesRejected() int {
+  return len(serverDB.ColumnValues("rejectedfingerprint"))
+}
+
 // Returns the entry from the serverdb (format: <xml><source>...</xml>) of
 // the server with the given MAC address, or nil if the server is either not
 // in the serverDB or if its entry has no <macaddress> elememt.
@@ -34,6 +34,7 @@ import (
          "github.com/mbenkmann/golib/util"
          "github.com/mbenkmann/golib/deque"
          "../config"
+         "../security"
        )
 
 // Set of attributes that should not be copied by SystemFillInMissingData() even
@@ -98,9 +99,7 @@ func SystemPlainnameForMAC(macaddress string) string {
   // running on a non-standard port (test client)
   client := ClientWithMAC(macaddress)
   if client != nil {
-    ipport := strings.SplitN(client.Text("client"),":",2)
-    ip := ipport[0]
-    port := ipport[1]
+    ip, port, _ := net.SplitHostPort(client.Text("client"))
     for _, standard_port := range config.ClientPorts {
       if port == standard_port {
         name = SystemNameForIPAddress(ip)
@@ -1009,3 +1008,65 @@ base64.StdEncoding.EncodeToString([]byte(dn)),
 
   return nil
 }
+
+// Returns true if the system identified by macaddress is within scope
+// (see security.GosaTargetScope). If scope does not restrict the target
+// machines, true is returned without accessing LDAP. Systems that can not
+// be found in LDAP are not within a restricted scope.
+//
+// ATTENTION! This function accesses LDAP and may therefore take a while.
+// If possible you should use it asynchronously.
+func SystemInScope(macaddress string, scope *security.GosaTargetScope) bool {
+  if scope.Unrestricted() { return true }
+  system, err := SystemGetAllDataForMAC(macaddress, false)
+  if system == nil {
+    util.Log(1, "INFO! SystemInScope(%v): %v", macaddress, err)
+    return false
+  }
+  var groups *xml.Hash
+  if len(scope.ObjectGroup) > 0 {
+    groups = SystemGetGroupsWithMember(system.Text("dn"))
+  }
+  return SystemMatchesScope(system, groups, scope)
+}
+
+// Returns true if system (in the format returned by SystemGetAllDataForMAC())
+// is within scope (see security.GosaTargetScope). groups are the object
+// groups the system is a member of, in the format returned by
+// SystemGetGroupsWithMember(). groups may be nil if scope has no ObjectGroup
+// entries.
+func SystemMatchesScope(system *xml.Hash, groups *xml.Hash, scope *security.GosaTargetScope) bool {
+  if scope.Unrestricted() { return true }
+  
+  dn := normalizeDN(system.Text("dn"))
+  for _, suffix := range scope.DNSuffix {
+    suffix = normalizeDN(suffix)
+    if suffix != "" && (dn == suffix || strings.HasSuffix(dn, ","+suffix)) { return true }
+  }
+  
+  for _, tag := range system.Get("gosaunittag") {
+    for _, scopetag := range scope.UnitTag {
+      if tag != "" && tag == scopetag { return true }
+    }
+  }
+  
+  if groups != nil {
+    for group := groups.First("xml"); group != nil; group = group.Next() {
+      for _, og := range scope.ObjectGroup {
+        if og == "" { continue }
+        if strings.Contains(og, "=") {
+          if normalizeDN(og) == normalizeDN(group.Text("dn")) { return true }
+        } else if og == group.Text("cn") { return true }
+      }
+    }
+  }
+  
+  return false
+}
+
+// Returns dn in lowercase with whitespace around the components removed.
+func normalizeDN(dn string) string {
+  parts := strings.Split(strings.ToLower(dn), ",")
+  for i := range parts { parts[i] = strings.TrimSpace(parts[i]) }
+  return strings.Join(parts, ",")
+}
@@ -0,0 +1,152 @@
+/*
+Copyright (c) 2026 go-susi contributors
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+// API for the various databases used by go-susi.
+package db
+
+import (
+         "net"
+         "sort"
+         "strconv"
+
+         "../xml"
+         "../config"
+       )
+
+// Returns true if config.ThrottleLimits() or config.ThrottleSubnetLimits()
+// has a limit for the job's headertag.
+func jobThrottled(job *xml.Hash) bool {
+  headertag := job.Text("headertag")
+  return config.ThrottleLimits()[headertag] > 0 || config.ThrottleSubnetLimits()[headertag] > 0
+}
+
+// Returns the subnet (as used by config.ThrottleSubnetLimits()) of the job's
+// target or "" if the target's IP address is unknown.
+func jobSubnet(job *xml.Hash) string {
+  client := ClientWithMAC(job.Text("macaddress"))
+  if client == nil { return "" }
+  host, _, err := net.SplitHostPort(client.Text("client"))
+  if err != nil { return "" }
+  ip := net.ParseIP(host)
+  if ip == nil { return "" }
+  if ip4 := ip.To4(); ip4 != nil {
+    return ip4.Mask(net.CIDRMask(config.ThrottleSubnetPrefix(), 32)).String()
+  }
+  return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// Returns the number of local jobs with the given headertag that count
+// against its limit (i.e. are "processing" and have not reached progress 100)
+// in total and per subnet. Subnets are only determined if
+// config.ThrottleSubnetLimits() has a limit for headertag.
+// MUST ONLY BE CALLED FROM handleJobDBRequests()!
+func jobsRunning(headertag string) (total int, per_subnet map[string]int) {
+  per_subnet = map[string]int{}
+  filter := xml.FilterAnd([]xml.HashFilter{
+              xml.FilterSimple("siserver", config.ServerSourceAddress, "headertag", headertag, "status", "processing"),
+              xml.FilterNot(xml.FilterSimple("progress", "100"))})
+  for job := jobDB.Query(filter).First("job"); job != nil; job = job.Next() {
+    total++
+    if config.ThrottleSubnetLimits()[headertag] > 0 {
+      per_subnet[jobSubnet(job)]++
+    }
+  }
+  return
+}
+
+// Returns true if job may be launched without exceeding the limits
+// from config.ThrottleLimits() and config.ThrottleSubnetLimits().
+// MUST ONLY BE CALLED FROM handleJobDBRequests()!
+func jobsSlotAvailable(job *xml.Hash) bool {
+  if !jobThrottled(job) { return true }
+  headertag := job.Text("headertag")
+  total, per_subnet := jobsRunning(headertag)
+  if limit := config.ThrottleLimits()[headertag]; limit > 0 && total >= limit { return false }
+  if limit := config.ThrottleSubnetLimits()[headertag]; limit > 0 {
+    if subnet := jobSubnet(job); subnet != "" && per_subnet[subnet] >= limit { return false }
+  }
+  return true
+}
+
+type jobQueue []*xml.Hash
+
+func (q jobQueue) Len() int { return len(q) }
+func (q jobQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q jobQueue) Less(i, j int) bool {
+  ti, tj := q[i].Text("timestamp"), q[j].Text("timestamp")
+  if ti != tj { return ti < tj }
+  idi, _ := strconv.ParseUint(q[i].Text("id"), 10, 64)
+  idj, _ := strconv.ParseUint(q[j].Text("id"), 10, 64)
+  return idi < idj
+}
+
+// Returns a filter for the local jobs in status "queued" with the given headertag.
+func jobsQueuedFilter(headertag string) xml.HashFilter {
+  return xml.FilterSimple("siserver", config.ServerSourceAddress, "headertag", headertag, "status", "queued")
+}
+
+// Returns the jobs from queued (the result of a query with jobsQueuedFilter())
+// in the order in which they will be launched.
+func jobsQueue(queued *xml.Hash) jobQueue {
+  queue := jobQueue{}
+  for job := queued.First("job"); job != nil; job = job.Next() {
+    queue = append(queue, job)
+  }
+  sort.Sort(queue)
+  return queue
+}
+
+// Launches as many of the local jobs in status "queued" with the given
+// headertag as the limits permit, in order of their timestamps.
+// Called whenever a job with the headertag has been queued, removed or
+// modified, so that a job that reaches progress 100 or is done makes
+// room for the next job in the queue.
+// The jobs that remain queued are not touched. Their position in the
+// queue is determined when it is needed (see JobsQueuePositions()).
+// MUST ONLY BE CALLED FROM handleJobDBRequests()!
+func jobsUpdateQueue(headertag string) {
+  queue := jobsQueue(jobDB.Query(jobsQueuedFilter(headertag)))
+  if len(queue) == 0 { return }
+
+  limit := config.ThrottleLimits()[headertag]
+  subnet_limit := config.ThrottleSubnetLimits()[headertag]
+  total, per_subnet := jobsRunning(headertag)
+  for _, job := range queue {
+    // Without a subnet limit no later job can be launched either.
+    if limit > 0 && total >= limit { break }
+    subnet := ""
+    if subnet_limit > 0 {
+      subnet = jobSubnet(job)
+      if subnet != "" && per_subnet[subnet] >= subnet_limit { continue }
+    }
+    total++
+    per_subnet[subnet]++
+    // The status check makes sure that a job is not launched twice if
+    // jobsUpdateQueue() is called again before the launch has been performed.
+    filter := xml.FilterSimple("siserver", config.ServerSourceAddress, "id", job.Text("id"), "status", "queued")
+    update := xml.NewHash("job", "status", "launch")
+    update.Add("result", "none")
+    JobsModifyLocal(filter, update)
+  }
+}
+
+// Returns a map from the id of each local job in status "queued" with the
+// given headertag to its position in the queue (starting at 1).
+func JobsQueuePositions(headertag string) map[string]int {
+  positions := map[string]int{}
+  for i, job := range jobsQueue(JobsQuery(jobsQueuedFilter(headertag))) {
+    positions[job.Text("id")] = i+1
+  }
+  return positions
+}
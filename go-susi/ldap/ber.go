@@ -0,0 +1,174 @@
+/* Copyright (C) 2026 go-susi contributors
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this file (originally named ber.go) and associated documentation files
+ * (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// Minimal LDAP v3 client (RFC 4511) with connection pooling, StartTLS,
+// LDAPS and paged results.
+package ldap
+
+import (
+         "io"
+         "fmt"
+       )
+
+// BER tags used by LDAP. Only single-byte tags are supported because
+// LDAP does not use anything else.
+const (
+  tagBoolean     = 0x01
+  tagInteger     = 0x02
+  tagOctetString = 0x04
+  tagEnumerated  = 0x0a
+  tagSequence    = 0x30
+  tagSet         = 0x31
+
+  classApplication = 0x40
+  classContext     = 0x80
+  constructed      = 0x20
+)
+
+// Maximum length of a BER element accepted by berRead(). The length comes
+// from the server, so it has to be checked before allocating the buffer.
+// A single LDAP message (e.g. one search result entry) is never that large.
+const maxBERLength = 16*1024*1024
+
+// A decoded BER element. For constructed elements children contains the
+// decoded contents, for primitive elements data contains the raw contents.
+type berPacket struct {
+  tag byte
+  data []byte
+  children []*berPacket
+}
+
+// Returns the BER encoding of a single element with the given tag and contents.
+func berEncode(tag byte, contents ...[]byte) []byte {
+  length := 0
+  for _, c := range contents { length += len(c) }
+
+  result := make([]byte, 0, length+6)
+  result = append(result, tag)
+  if length < 128 {
+    result = append(result, byte(length))
+  } else {
+    lenbytes := []byte{}
+    for l := length; l > 0; l >>= 8 {
+      lenbytes = append([]byte{byte(l)}, lenbytes...)
+    }
+    result = append(result, 0x80|byte(len(lenbytes)))
+    result = append(result, lenbytes...)
+  }
+  for _, c := range contents { result = append(result, c...) }
+  return result
+}
+
+func berInt(tag byte, i int64) []byte {
+  // minimal two's complement encoding
+  b := []byte{byte(i)}
+  for {
+    i >>= 8
+    if (i == 0 && b[0] & 0x80 == 0) || (i == -1 && b[0] & 0x80 != 0) { break }
+    b = append([]byte{byte(i)}, b...)
+  }
+  return berEncode(tag, b)
+}
+
+func berString(tag byte, s string) []byte {
+  return berEncode(tag, []byte(s))
+}
+
+func berBool(tag byte, b bool) []byte {
+  if b { return berEncode(tag, []byte{0xff}) }
+  return berEncode(tag, []byte{0x00})
+}
+
+// Reads one complete BER element from r.
+func berRead(r io.Reader) (*berPacket, error) {
+  head := []byte{0,0}
+  if _, err := io.ReadFull(r, head); err != nil { return nil, err }
+
+  length := int64(head[1])
+  if length & 0x80 != 0 {
+    n := length & 0x7f
+    if n == 0 || n > 4 { return nil, fmt.Errorf("LDAP: unsupported BER length encoding") }
+    lenbytes := make([]byte, n)
+    if _, err := io.ReadFull(r, lenbytes); err != nil { return nil, err }
+    length = berLongLength(lenbytes)
+  }
+  if length < 0 || length > maxBERLength {
+    return nil, fmt.Errorf("LDAP: BER element too large (%v bytes)", length)
+  }
+
+  data := make([]byte, length)
+  if _, err := io.ReadFull(r, data); err != nil { return nil, err }
+  return berParse(head[0], data)
+}
+
+// Returns the length encoded in the (at most 4) bytes of a long-form BER
+// length. The result is computed in int64 so that it can not become
+// negative on 32-bit platforms where int has only 32 bits.
+func berLongLength(lenbytes []byte) int64 {
+  var length int64
+  for _, b := range lenbytes { length = length<<8 | int64(b) }
+  return length
+}
+
+func berParse(tag byte, data []byte) (*berPacket, error) {
+  p := &berPacket{tag:tag, data:data}
+  if tag & constructed == 0 { return p, nil }
+
+  for len(data) > 0 {
+    if len(data) < 2 { return nil, fmt.Errorf("LDAP: truncated BER element") }
+    ctag := data[0]
+    length := int64(data[1])
+    hdr := 2
+    if length & 0x80 != 0 {
+      n := int(length & 0x7f)
+      if n == 0 || n > 4 || len(data) < 2+n { return nil, fmt.Errorf("LDAP: unsupported BER length encoding") }
+      length = berLongLength(data[2:2+n])
+      hdr += n
+    }
+    // Compare against the remaining data rather than computing hdr+length,
+    // which could overflow int on 32-bit platforms.
+    if length < 0 || length > int64(len(data)-hdr) { return nil, fmt.Errorf("LDAP: truncated BER element") }
+    end := hdr+int(length)
+    child, err := berParse(ctag, data[hdr:end])
+    if err != nil { return nil, err }
+    p.children = append(p.children, child)
+    data = data[end:]
+  }
+  return p, nil
+}
+
+// Returns the value of a primitive INTEGER or ENUMERATED element.
+func (p *berPacket) int() int64 {
+  if len(p.data) == 0 { return 0 }
+  var i int64
+  if p.data[0] & 0x80 != 0 { i = -1 }
+  for _, b := range p.data { i = i<<8 | int64(b) }
+  return i
+}
+
+func (p *berPacket) str() string { return string(p.data) }
+
+// Returns the i-th child or an empty dummy packet if there is no such child,
+// so that malformed messages from the server can not cause a panic.
+func (p *berPacket) child(i int) *berPacket {
+  if i < len(p.children) { return p.children[i] }
+  return &berPacket{}
+}
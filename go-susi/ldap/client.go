@@ -0,0 +1,439 @@
+/* Copyright (C) 2026 go-susi contributors
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this file (originally named client.go) and associated documentation files
+ * (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package ldap
+
+import (
+         "fmt"
+         "net"
+         "time"
+         "bufio"
+         "strings"
+         "crypto/tls"
+       )
+
+// Search scopes.
+const (
+  ScopeBase = 0
+  ScopeOne  = 1
+  ScopeSub  = 2
+)
+
+// Operations for Modification.Op.
+const (
+  ModAdd     = 0
+  ModDelete  = 1
+  ModReplace = 2
+)
+
+// Result codes from RFC 4511 that are of interest to callers.
+const (
+  Success                 = 0
+  OperationsError         = 1
+  ProtocolError           = 2
+  TimeLimitExceeded       = 3
+  SizeLimitExceeded       = 4
+  AuthMethodNotSupported  = 7
+  StrongerAuthRequired    = 8
+  Referral                = 10
+  AdminLimitExceeded      = 11
+  UnavailableCriticalExtension = 12
+  ConfidentialityRequired = 13
+  NoSuchAttribute         = 16
+  UndefinedAttributeType  = 17
+  InappropriateMatching   = 18
+  ConstraintViolation     = 19
+  AttributeOrValueExists  = 20
+  InvalidAttributeSyntax  = 21
+  NoSuchObject            = 32
+  InvalidDNSyntax         = 34
+  InvalidCredentials      = 49
+  InsufficientAccessRights = 50
+  Busy                    = 51
+  Unavailable             = 52
+  UnwillingToPerform      = 53
+  NamingViolation         = 64
+  ObjectClassViolation    = 65
+  NotAllowedOnNonLeaf     = 66
+  NotAllowedOnRDN         = 67
+  EntryAlreadyExists      = 68
+  Other                   = 80
+)
+
+var resultCodeNames = map[int]string{
+  Success: "Success",
+  OperationsError: "Operations error",
+  ProtocolError: "Protocol error",
+  TimeLimitExceeded: "Time limit exceeded",
+  SizeLimitExceeded: "Size limit exceeded",
+  AuthMethodNotSupported: "Authentication method not supported",
+  StrongerAuthRequired: "Stronger authentication required",
+  Referral: "Referral",
+  AdminLimitExceeded: "Administrative limit exceeded",
+  UnavailableCriticalExtension: "Critical extension is unavailable",
+  ConfidentialityRequired: "Confidentiality required",
+  NoSuchAttribute: "No such attribute",
+  UndefinedAttributeType: "Undefined attribute type",
+  InappropriateMatching: "Inappropriate matching",
+  ConstraintViolation: "Constraint violation",
+  AttributeOrValueExists: "Type or value exists",
+  InvalidAttributeSyntax: "Invalid syntax",
+  NoSuchObject: "No such object",
+  InvalidDNSyntax: "Invalid DN syntax",
+  InvalidCredentials: "Invalid credentials",
+  InsufficientAccessRights: "Insufficient access",
+  Busy: "Server is busy",
+  Unavailable: "Server is unavailable",
+  UnwillingToPerform: "Server is unwilling to perform",
+  NamingViolation: "Naming violation",
+  ObjectClassViolation: "Object class violation",
+  NotAllowedOnNonLeaf: "Operation not allowed on non-leaf",
+  NotAllowedOnRDN: "Operation not allowed on RDN",
+  EntryAlreadyExists: "Already exists",
+  Other: "Other (e.g., implementation specific) error",
+}
+
+// An error result returned by the LDAP server. Errors that are not of this
+// type are network or protocol errors after which the connection should
+// not be used anymore.
+type Error struct {
+  // The resultCode from the server's response. See the constants above.
+  Code int
+  MatchedDN string
+  Message string
+}
+
+func (e *Error) Error() string {
+  name := resultCodeNames[e.Code]
+  if name == "" { name = "Unknown error" }
+  if e.Message == "" {
+    return fmt.Sprintf("LDAP result code %v (%v)", e.Code, name)
+  }
+  return fmt.Sprintf("LDAP result code %v (%v): %v", e.Code, name, e.Message)
+}
+
+// An LDAP object returned by Search().
+type Entry struct {
+  DN string
+  Attributes []*Attribute
+}
+
+// An attribute of an Entry with its values.
+type Attribute struct {
+  Name string
+  Values [][]byte
+}
+
+// A single change to be performed by Modify().
+type Modification struct {
+  // ModAdd, ModDelete or ModReplace
+  Op int
+  Attribute
+}
+
+// A connection to an LDAP server. A Conn must not be used by
+// multiple goroutines at the same time.
+type Conn struct {
+  conn net.Conn
+  reader *bufio.Reader
+  msgid int64
+  // Maximum time to wait for a response from the server. 0 means no limit.
+  Timeout time.Duration
+}
+
+const startTLSOID = "1.3.6.1.4.1.1466.20037"
+const pagedResultsOID = "1.2.840.113556.1.4.319"
+
+// Connects to the LDAP server at uri which must have the form
+// ldap://host[:port] or ldaps://host[:port]. uri may contain multiple
+// whitespace-separated URIs, in which case they are tried in order.
+// If tlsconf is nil and TLS is required, a default configuration that verifies
+// the server certificate against the system's CAs is used.
+// If starttls is true, StartTLS is performed on ldap:// connections.
+// timeout limits connecting and each request (see Conn.Timeout). 0 means
+// no limit.
+func Dial(uri string, tlsconf *tls.Config, starttls bool, timeout time.Duration) (*Conn, error) {
+  var err error = fmt.Errorf("LDAP: no URI given")
+  for _, u := range strings.Fields(uri) {
+    var c *Conn
+    c, err = dial(u, tlsconf, starttls, timeout)
+    if err == nil { return c, nil }
+  }
+  return nil, err
+}
+
+// Returns true if Dial() understands the scheme of all URIs in uri.
+func SupportsURI(uri string) bool {
+  fields := strings.Fields(uri)
+  if len(fields) == 0 { return false }
+  for _, u := range fields {
+    u = strings.ToLower(u)
+    if !strings.HasPrefix(u, "ldap://") && !strings.HasPrefix(u, "ldaps://") { return false }
+  }
+  return true
+}
+
+func dial(uri string, tlsconf *tls.Config, starttls bool, timeout time.Duration) (*Conn, error) {
+  ldaps := false
+  hostport := ""
+  switch {
+    case strings.HasPrefix(strings.ToLower(uri), "ldap://"):  hostport = uri[7:]
+    case strings.HasPrefix(strings.ToLower(uri), "ldaps://"): hostport = uri[8:]; ldaps = true
+    default: return nil, fmt.Errorf("LDAP: unsupported URI \"%v\"", uri)
+  }
+  if i := strings.IndexByte(hostport, '/'); i >= 0 { hostport = hostport[:i] }
+  if hostport == "" { hostport = "localhost" }
+  host, port, err := net.SplitHostPort(hostport)
+  if err != nil {
+    host = strings.Trim(hostport, "[]")
+    port = "389"
+    if ldaps { port = "636" }
+  }
+
+  if tlsconf == nil { tlsconf = &tls.Config{} }
+  if tlsconf.ServerName == "" {
+    tc := tlsconf.Clone()
+    tc.ServerName = host
+    tlsconf = tc
+  }
+
+  conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), timeout)
+  if err != nil { return nil, err }
+
+  if ldaps {
+    tlsconn := tls.Client(conn, tlsconf)
+    tlsconn.SetDeadline(deadline(timeout))
+    if err = tlsconn.Handshake(); err != nil {
+      conn.Close()
+      return nil, err
+    }
+    conn = tlsconn
+  }
+
+  c := &Conn{conn:conn, reader:bufio.NewReader(conn), Timeout:timeout}
+
+  if starttls && !ldaps {
+    resp, err := c.request(berEncode(classApplication|constructed|23, berString(classContext|0, startTLSOID)), 24)
+    if err != nil {
+      c.Close()
+      return nil, err
+    }
+    if err = resultError(resp); err != nil {
+      c.Close()
+      return nil, err
+    }
+    tlsconn := tls.Client(conn, tlsconf)
+    tlsconn.SetDeadline(deadline(timeout))
+    if err = tlsconn.Handshake(); err != nil {
+      conn.Close()
+      return nil, err
+    }
+    c.conn = tlsconn
+    c.reader = bufio.NewReader(tlsconn)
+  }
+
+  return c, nil
+}
+
+// Returns the deadline for an operation that may take timeout. For timeout 0
+// this is the zero time, i.e. no deadline, rather than now.
+func deadline(timeout time.Duration) time.Time {
+  if timeout <= 0 { return time.Time{} }
+  return time.Now().Add(timeout)
+}
+
+// Closes the connection (after sending an UnbindRequest).
+func (c *Conn) Close() {
+  c.msgid++
+  c.conn.SetDeadline(deadline(c.Timeout))
+  c.conn.Write(berEncode(tagSequence, berInt(tagInteger, c.msgid), []byte{classApplication|2, 0}))
+  c.conn.Close()
+}
+
+// Sends op (with optional controls) and returns the protocolOp from the first
+// response that has the tag [APPLICATION resptag].
+func (c *Conn) request(op []byte, resptag byte, controls ...[]byte) (*berPacket, error) {
+  err := c.send(op, controls...)
+  if err != nil { return nil, err }
+  msg, err := c.receive()
+  if err != nil { return nil, err }
+  resp := msg.child(1)
+  if resp.tag & 0x1f != resptag { return nil, fmt.Errorf("LDAP: unexpected response type %v", resp.tag & 0x1f) }
+  return resp, nil
+}
+
+func (c *Conn) send(op []byte, controls ...[]byte) error {
+  c.msgid++
+  parts := [][]byte{berInt(tagInteger, c.msgid), op}
+  if len(controls) > 0 { parts = append(parts, berEncode(classContext|constructed|0, controls...)) }
+  c.conn.SetDeadline(deadline(c.Timeout))
+  _, err := c.conn.Write(berEncode(tagSequence, parts...))
+  return err
+}
+
+// Reads the next LDAPMessage for the current message id.
+func (c *Conn) receive() (*berPacket, error) {
+  for {
+    c.conn.SetDeadline(deadline(c.Timeout))
+    msg, err := berRead(c.reader)
+    if err != nil { return nil, err }
+    if msg.tag != tagSequence || len(msg.children) < 2 { return nil, fmt.Errorf("LDAP: malformed message from server") }
+    id := msg.children[0].int()
+    if id == 0 { // unsolicited notification, e.g. notice of disconnection
+      return nil, fmt.Errorf("LDAP: server sent notice of disconnection")
+    }
+    if id == c.msgid { return msg, nil }
+  }
+}
+
+// Converts an LDAPResult into an *Error (or nil if the result code is Success).
+func resultError(resp *berPacket) error {
+  code := int(resp.child(0).int())
+  if code == Success { return nil }
+  return &Error{Code:code, MatchedDN:resp.child(1).str(), Message:resp.child(2).str()}
+}
+
+// Performs a simple bind. If dn is "", this is an anonymous bind.
+func (c *Conn) Bind(dn, password string) error {
+  op := berEncode(classApplication|constructed|0, berInt(tagInteger, 3), berString(tagOctetString, dn), berString(classContext|0, password))
+  resp, err := c.request(op, 1)
+  if err != nil { return err }
+  return resultError(resp)
+}
+
+// Searches the subtree at base with the given scope (ScopeBase, ScopeOne, ScopeSub)
+// and filter (see CompileFilter()). If attrs is empty, all user attributes are returned.
+// If pagesize > 0 the Simple Paged Results control (RFC 2696) is used to fetch
+// the results in pages of that size.
+func (c *Conn) Search(base string, scope int, filter string, attrs []string, pagesize int) ([]*Entry, error) {
+  ber_filter, err := CompileFilter(filter)
+  if err != nil { return nil, err }
+
+  attrlist := make([][]byte, len(attrs))
+  for i := range attrs { attrlist[i] = berString(tagOctetString, attrs[i]) }
+
+  op := berEncode(classApplication|constructed|3,
+                  berString(tagOctetString, base),
+                  berInt(tagEnumerated, int64(scope)),
+                  berInt(tagEnumerated, 0), // neverDerefAliases
+                  berInt(tagInteger, 0), // no size limit
+                  berInt(tagInteger, 0), // no time limit
+                  berBool(tagBoolean, false),
+                  ber_filter,
+                  berEncode(tagSequence, attrlist...))
+
+  entries := []*Entry{}
+  cookie := []byte{}
+  for {
+    controls := [][]byte{}
+    if pagesize > 0 {
+      value := berEncode(tagSequence, berInt(tagInteger, int64(pagesize)), berEncode(tagOctetString, cookie))
+      controls = append(controls, berEncode(tagSequence, berString(tagOctetString, pagedResultsOID), berEncode(tagOctetString, value)))
+    }
+
+    if err = c.send(op, controls...); err != nil { return nil, err }
+
+    for {
+      msg, err := c.receive()
+      if err != nil { return nil, err }
+      resp := msg.child(1)
+      switch resp.tag {
+        case classApplication|constructed|4: // SearchResultEntry
+          entry := &Entry{DN:resp.child(0).str()}
+          for _, a := range resp.child(1).children {
+            attr := &Attribute{Name:a.child(0).str()}
+            for _, v := range a.child(1).children { attr.Values = append(attr.Values, v.data) }
+            entry.Attributes = append(entry.Attributes, attr)
+          }
+          entries = append(entries, entry)
+          continue
+
+        case classApplication|constructed|19: // SearchResultReference
+          continue
+
+        case classApplication|constructed|5: // SearchResultDone
+          if err = resultError(resp); err != nil { return entries, err }
+          cookie = pagedResultsCookie(msg.child(2))
+          if pagesize <= 0 || len(cookie) == 0 { return entries, nil }
+
+        default:
+          return nil, fmt.Errorf("LDAP: unexpected response type %v to search request", resp.tag & 0x1f)
+      }
+      break
+    }
+  }
+}
+
+// Extracts the cookie from the paged results control in controls.
+func pagedResultsCookie(controls *berPacket) []byte {
+  for _, ctrl := range controls.children {
+    if ctrl.child(0).str() != pagedResultsOID || len(ctrl.children) < 2 { continue }
+    value := ctrl.children[len(ctrl.children)-1]
+    p, err := berParse(tagSequence|0, value.data)
+    if err != nil || len(p.children) != 1 { return nil }
+    return p.children[0].child(1).data
+  }
+  return nil
+}
+
+func berAttribute(tag byte, a *Attribute) []byte {
+  values := make([][]byte, len(a.Values))
+  for i := range a.Values { values[i] = berEncode(tagOctetString, a.Values[i]) }
+  return berEncode(tag, berString(tagOctetString, a.Name), berEncode(tagSet, values...))
+}
+
+// Applies the list of modifications to the object dn.
+func (c *Conn) Modify(dn string, mods []*Modification) error {
+  changes := make([][]byte, len(mods))
+  for i, m := range mods {
+    changes[i] = berEncode(tagSequence, berInt(tagEnumerated, int64(m.Op)), berAttribute(tagSequence, &m.Attribute))
+  }
+  op := berEncode(classApplication|constructed|6, berString(tagOctetString, dn), berEncode(tagSequence, changes...))
+  resp, err := c.request(op, 7)
+  if err != nil { return err }
+  return resultError(resp)
+}
+
+// Creates a new object dn with the given attributes.
+func (c *Conn) Add(dn string, attrs []*Attribute) error {
+  list := make([][]byte, len(attrs))
+  for i, a := range attrs { list[i] = berAttribute(tagSequence, a) }
+  op := berEncode(classApplication|constructed|8, berString(tagOctetString, dn), berEncode(tagSequence, list...))
+  resp, err := c.request(op, 9)
+  if err != nil { return err }
+  return resultError(resp)
+}
+
+// Deletes the leaf object dn.
+func (c *Conn) Delete(dn string) error {
+  resp, err := c.request(berString(classApplication|10, dn), 11)
+  if err != nil { return err }
+  return resultError(resp)
+}
+
+// Renames dn to newrdn and (if newsuperior != "") moves it below newsuperior.
+func (c *Conn) ModifyDN(dn, newrdn string, deleteoldrdn bool, newsuperior string) error {
+  parts := [][]byte{berString(tagOctetString, dn), berString(tagOctetString, newrdn), berBool(tagBoolean, deleteoldrdn)}
+  if newsuperior != "" { parts = append(parts, berString(classContext|0, newsuperior)) }
+  resp, err := c.request(berEncode(classApplication|constructed|12, parts...), 13)
+  if err != nil { return err }
+  return resultError(resp)
+}
@@ -0,0 +1,174 @@
+/* Copyright (C) 2026 go-susi contributors
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this file (originally named filter.go) and associated documentation files
+ * (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package ldap
+
+import (
+         "fmt"
+         "strings"
+       )
+
+// Compiles a string filter as described in RFC 4515 into its BER encoding.
+// Like ldapsearch this function accepts a filter that is not surrounded by
+// parentheses (e.g. "objectClass=*").
+func CompileFilter(filter string) ([]byte, error) {
+  filter = strings.TrimSpace(filter)
+  if filter == "" { filter = "(objectClass=*)" }
+  if filter[0] != '(' { filter = "(" + filter + ")" }
+
+  ber, rest, err := compileFilter(filter)
+  if err != nil { return nil, err }
+  if rest != "" { return nil, fmt.Errorf("LDAP filter \"%v\": unexpected trailing characters \"%v\"", filter, rest) }
+  return ber, nil
+}
+
+// Compiles the parenthesized filter at the beginning of f and returns its
+// BER encoding and the remainder of f.
+func compileFilter(f string) (ber []byte, rest string, err error) {
+  if len(f) < 2 || f[0] != '(' { return nil, "", fmt.Errorf("LDAP filter: expected \"(\" at \"%v\"", f) }
+  f = f[1:]
+
+  switch f[0] {
+    case '&', '|':
+      tag := byte(classContext|constructed|0)
+      if f[0] == '|' { tag = classContext|constructed|1 }
+      f = f[1:]
+      parts := [][]byte{}
+      for len(f) > 0 && f[0] == '(' {
+        var sub []byte
+        sub, f, err = compileFilter(f)
+        if err != nil { return nil, "", err }
+        parts = append(parts, sub)
+      }
+      if len(f) == 0 || f[0] != ')' { return nil, "", fmt.Errorf("LDAP filter: missing \")\"") }
+      return berEncode(tag, parts...), f[1:], nil
+
+    case '!':
+      var sub []byte
+      sub, f, err = compileFilter(f[1:])
+      if err != nil { return nil, "", err }
+      if len(f) == 0 || f[0] != ')' { return nil, "", fmt.Errorf("LDAP filter: missing \")\"") }
+      return berEncode(classContext|constructed|2, sub), f[1:], nil
+  }
+
+  end := strings.IndexByte(f, ')')
+  if end < 0 { return nil, "", fmt.Errorf("LDAP filter: missing \")\"") }
+  item := f[:end]
+  rest = f[end+1:]
+  ber, err = compileItem(item)
+  return ber, rest, err
+}
+
+// Compiles a simple filter item without the surrounding parentheses.
+func compileItem(item string) ([]byte, error) {
+  eq := strings.IndexByte(item, '=')
+  if eq < 1 { return nil, fmt.Errorf("LDAP filter: \"%v\" is not a valid filter item", item) }
+
+  attr := item[:eq]
+  value := item[eq+1:]
+  var op byte = '='
+  switch attr[len(attr)-1] {
+    case '>', '<', '~', ':': op = attr[len(attr)-1]
+                             attr = attr[:len(attr)-1]
+  }
+  if attr == "" && op != ':' { return nil, fmt.Errorf("LDAP filter: \"%v\" has no attribute", item) }
+
+  switch op {
+    case '>', '<', '~':
+      v, err := unescapeFilterValue(value)
+      if err != nil { return nil, err }
+      tag := byte(classContext|constructed|5)
+      if op == '<' { tag = classContext|constructed|6 }
+      if op == '~' { tag = classContext|constructed|8 }
+      return berEncode(tag, berString(tagOctetString, attr), berString(tagOctetString, v)), nil
+
+    case ':':
+      // extensible match: [attr][:dn][:rule]:=value
+      parts := strings.Split(attr, ":")
+      contents := [][]byte{}
+      dnattrs := false
+      rule := ""
+      typ := parts[0]
+      for _, p := range parts[1:] {
+        if p == "dn" { dnattrs = true } else if p != "" { rule = p }
+      }
+      v, err := unescapeFilterValue(value)
+      if err != nil { return nil, err }
+      if rule != "" { contents = append(contents, berString(classContext|1, rule)) }
+      if typ != ""  { contents = append(contents, berString(classContext|2, typ)) }
+      if rule == "" && typ == "" { return nil, fmt.Errorf("LDAP filter: \"%v\" needs attribute or matching rule", item) }
+      contents = append(contents, berString(classContext|3, v))
+      if dnattrs { contents = append(contents, berBool(classContext|4, true)) }
+      return berEncode(classContext|constructed|9, contents...), nil
+  }
+
+  if value == "*" {
+    return berString(classContext|7, attr), nil // present
+  }
+
+  if strings.IndexByte(value, '*') < 0 {
+    v, err := unescapeFilterValue(value)
+    if err != nil { return nil, err }
+    return berEncode(classContext|constructed|3, berString(tagOctetString, attr), berString(tagOctetString, v)), nil
+  }
+
+  // substrings
+  pieces := strings.Split(value, "*")
+  subs := [][]byte{}
+  for i, piece := range pieces {
+    if piece == "" { continue }
+    v, err := unescapeFilterValue(piece)
+    if err != nil { return nil, err }
+    var tag byte = classContext|1 // any
+    if i == 0 { tag = classContext|0 } // initial
+    if i == len(pieces)-1 { tag = classContext|2 } // final
+    subs = append(subs, berString(tag, v))
+  }
+  return berEncode(classContext|constructed|4, berString(tagOctetString, attr), berEncode(tagSequence, subs...)), nil
+}
+
+// Replaces \XX escapes in a filter value with the respective bytes.
+func unescapeFilterValue(v string) (string, error) {
+  if strings.IndexByte(v, '\\') < 0 { return v, nil }
+  result := make([]byte, 0, len(v))
+  for i := 0; i < len(v); i++ {
+    if v[i] != '\\' {
+      result = append(result, v[i])
+      continue
+    }
+    if i+2 >= len(v) { return "", fmt.Errorf("LDAP filter: incomplete escape sequence in \"%v\"", v) }
+    hi, ok1 := hexval(v[i+1])
+    lo, ok2 := hexval(v[i+2])
+    if !ok1 || !ok2 { return "", fmt.Errorf("LDAP filter: illegal escape sequence in \"%v\"", v) }
+    result = append(result, hi<<4 | lo)
+    i += 2
+  }
+  return string(result), nil
+}
+
+func hexval(c byte) (byte, bool) {
+  switch {
+    case c >= '0' && c <= '9': return c - '0', true
+    case c >= 'a' && c <= 'f': return c - 'a' + 10, true
+    case c >= 'A' && c <= 'F': return c - 'A' + 10, true
+  }
+  return 0, false
+}
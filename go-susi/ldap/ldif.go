@@ -0,0 +1,217 @@
+/* Copyright (C) 2026 go-susi contributors
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this file (originally named ldif.go) and associated documentation files
+ * (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+
+package ldap
+
+import (
+         "io"
+         "fmt"
+         "strings"
+         "encoding/base64"
+       )
+
+// Writes entries to w in LDIF format (RFC 2849) the same way
+// "ldapsearch -LLL" does, i.e. values that are not safe strings
+// are base64 encoded.
+func WriteLDIF(w io.Writer, entries []*Entry) error {
+  for i, entry := range entries {
+    if i > 0 {
+      if _, err := io.WriteString(w, "\n"); err != nil { return err }
+    }
+    if _, err := io.WriteString(w, ldifLine("dn", []byte(entry.DN))); err != nil { return err }
+    for _, attr := range entry.Attributes {
+      for _, value := range attr.Values {
+        if _, err := io.WriteString(w, ldifLine(attr.Name, value)); err != nil { return err }
+      }
+    }
+  }
+  return nil
+}
+
+func ldifLine(name string, value []byte) string {
+  if isSafeString(value) {
+    return name + ": " + string(value) + "\n"
+  }
+  return name + ":: " + base64.StdEncoding.EncodeToString(value) + "\n"
+}
+
+// Returns true if value is a SAFE-STRING according to RFC 2849 that
+// also has no trailing space.
+func isSafeString(value []byte) bool {
+  if len(value) == 0 { return true }
+  if value[0] == ' ' || value[0] == ':' || value[0] == '<' || value[len(value)-1] == ' ' { return false }
+  for _, b := range value {
+    if b == 0 || b == '\n' || b == '\r' || b >= 128 { return false }
+  }
+  return true
+}
+
+// A change record from an LDIF file.
+type Change struct {
+  DN string
+  // "add", "delete", "modify" or "modrdn"
+  Type string
+  // for Type "add"
+  Attributes []*Attribute
+  // for Type "modify"
+  Modifications []*Modification
+  // for Type "modrdn"
+  NewRDN string
+  DeleteOldRDN bool
+  NewSuperior string
+}
+
+// Parses LDIF change records as understood by ldapmodify.
+// Records without changetype are treated as "add" (like ldapmodify -a).
+func ParseChanges(ldif string) ([]*Change, error) {
+  // unfold continuation lines
+  lines := []string{}
+  for _, line := range strings.Split(strings.Replace(ldif, "\r\n", "\n", -1), "\n") {
+    if len(line) > 0 && line[0] == ' ' && len(lines) > 0 && lines[len(lines)-1] != "" {
+      lines[len(lines)-1] += line[1:]
+    } else {
+      lines = append(lines, line)
+    }
+  }
+  lines = append(lines, "") // make sure the last record is terminated
+
+  changes := []*Change{}
+  var record [][2]string
+  for _, line := range lines {
+    if strings.HasPrefix(line, "#") { continue }
+    if line != "" {
+      name, value, err := parseLDIFLine(line)
+      if err != nil { return nil, err }
+      if len(record) == 0 && name == "version" { continue }
+      record = append(record, [2]string{name, value})
+      continue
+    }
+
+    if len(record) == 0 { continue }
+    change, err := parseChangeRecord(record)
+    if err != nil { return nil, err }
+    changes = append(changes, change)
+    record = nil
+  }
+
+  return changes, nil
+}
+
+func parseLDIFLine(line string) (name, value string, err error) {
+  if line == "-" { return "-", "", nil }
+  colon := strings.IndexByte(line, ':')
+  if colon < 1 { return "", "", fmt.Errorf("LDIF: invalid line \"%v\"", line) }
+  name = line[:colon]
+  value = line[colon+1:]
+  if strings.HasPrefix(value, ":") {
+    decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[1:]))
+    if err != nil { return "", "", fmt.Errorf("LDIF: invalid base64 value for \"%v\": %v", name, err) }
+    return name, string(decoded), nil
+  }
+  if strings.HasPrefix(value, "<") {
+    return "", "", fmt.Errorf("LDIF: URL values are not supported (\"%v\")", name)
+  }
+  return name, strings.TrimLeft(value, " "), nil
+}
+
+func parseChangeRecord(record [][2]string) (*Change, error) {
+  if !strings.EqualFold(record[0][0], "dn") { return nil, fmt.Errorf("LDIF: record does not start with dn: \"%v\"", record[0][0]) }
+  change := &Change{DN:record[0][1], Type:"add"}
+  record = record[1:]
+  if len(record) > 0 && strings.EqualFold(record[0][0], "changetype") {
+    change.Type = strings.ToLower(strings.TrimSpace(record[0][1]))
+    record = record[1:]
+  }
+
+  switch change.Type {
+    case "add":
+      change.Attributes = appendValues(change.Attributes, record)
+
+    case "delete":
+      if len(record) != 0 { return nil, fmt.Errorf("LDIF: unexpected \"%v\" in delete record for %v", record[0][0], change.DN) }
+
+    case "modify":
+      for len(record) > 0 {
+        op := strings.ToLower(record[0][0])
+        mod := &Modification{Attribute:Attribute{Name:strings.TrimSpace(record[0][1])}}
+        switch op {
+          case "add":     mod.Op = ModAdd
+          case "delete":  mod.Op = ModDelete
+          case "replace": mod.Op = ModReplace
+          default: return nil, fmt.Errorf("LDIF: unknown modify operation \"%v\" for %v", op, change.DN)
+        }
+        record = record[1:]
+        for len(record) > 0 && record[0][0] != "-" {
+          if !strings.EqualFold(record[0][0], mod.Name) {
+            return nil, fmt.Errorf("LDIF: attribute \"%v\" does not match \"%v: %v\" for %v", record[0][0], op, mod.Name, change.DN)
+          }
+          mod.Values = append(mod.Values, []byte(record[0][1]))
+          record = record[1:]
+        }
+        if len(record) > 0 { record = record[1:] } // skip "-"
+        change.Modifications = append(change.Modifications, mod)
+      }
+
+    case "modrdn", "moddn":
+      change.Type = "modrdn"
+      for _, nv := range record {
+        switch strings.ToLower(nv[0]) {
+          case "newrdn":       change.NewRDN = nv[1]
+          case "deleteoldrdn": change.DeleteOldRDN = strings.TrimSpace(nv[1]) == "1"
+          case "newsuperior":  change.NewSuperior = nv[1]
+          default: return nil, fmt.Errorf("LDIF: unexpected \"%v\" in modrdn record for %v", nv[0], change.DN)
+        }
+      }
+
+    default:
+      return nil, fmt.Errorf("LDIF: unknown changetype \"%v\" for %v", change.Type, change.DN)
+  }
+
+  return change, nil
+}
+
+// Appends the (name,value) pairs to attrs, merging values of the same attribute.
+func appendValues(attrs []*Attribute, record [][2]string) []*Attribute {
+  for _, nv := range record {
+    var attr *Attribute
+    for _, a := range attrs {
+      if strings.EqualFold(a.Name, nv[0]) { attr = a; break }
+    }
+    if attr == nil {
+      attr = &Attribute{Name:nv[0]}
+      attrs = append(attrs, attr)
+    }
+    attr.Values = append(attr.Values, []byte(nv[1]))
+  }
+  return attrs
+}
+
+// Performs the change described by ch.
+func (c *Conn) Apply(ch *Change) error {
+  switch ch.Type {
+    case "add":    return c.Add(ch.DN, ch.Attributes)
+    case "delete": return c.Delete(ch.DN)
+    case "modify": return c.Modify(ch.DN, ch.Modifications)
+    case "modrdn": return c.ModifyDN(ch.DN, ch.NewRDN, ch.DeleteOldRDN, ch.NewSuperior)
+  }
+  return fmt.Errorf("LDAP: unknown change type \"%v\"", ch.Type)
+}
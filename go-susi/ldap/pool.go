@@ -0,0 +1,81 @@
+/* Copyright (C) 2026 go-susi contributors
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this file (originally named pool.go) and associated documentation files
+ * (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+
+package ldap
+
+// A pool of connections to the same LDAP server with the same bind identity.
+type Pool struct {
+  dial func() (*Conn, error)
+  idle chan *Conn
+}
+
+// Returns a new pool that keeps up to size idle connections around for reuse.
+// dial is called whenever a new connection is needed. It must return a
+// connection that is ready to use (i.e. bound, if necessary).
+func NewPool(size int, dial func() (*Conn, error)) *Pool {
+  if size < 1 { size = 1 }
+  return &Pool{dial:dial, idle:make(chan *Conn, size)}
+}
+
+// Calls f with a connection from the pool (or a new one if no idle connection
+// is available) and returns f's result. If f fails with a network error
+// (i.e. any error that is not an *Error) on a connection that has been idle in
+// the pool (the server may have closed it in the meantime), f is retried once
+// with a fresh connection. Connections that had a network error are discarded.
+// Because of the retry, f must not repeat work that succeeded during the
+// first call, e.g. it should remember which changes it has already applied.
+func (p *Pool) Do(f func(*Conn) error) error {
+  for attempt := 0; ; attempt++ {
+    var conn *Conn
+    reused := false
+    select {
+      case conn = <-p.idle: reused = true
+      default:
+        var err error
+        conn, err = p.dial()
+        if err != nil { return err }
+    }
+
+    err := f(conn)
+    if _, ok := err.(*Error); err != nil && !ok {
+      conn.conn.Close()
+      if reused && attempt == 0 { continue }
+      return err
+    }
+
+    select {
+      case p.idle <- conn:
+      default: conn.Close()
+    }
+    return err
+  }
+}
+
+// Closes all idle connections. The pool remains usable.
+func (p *Pool) Close() {
+  for {
+    select {
+      case conn := <-p.idle: conn.Close()
+      default: return
+    }
+  }
+}
@@ -37,6 +37,7 @@ import (
           "strings"
           "syscall"
           "sync/atomic"
+          "net/http"
           "crypto/tls"
           
           "../db"
@@ -52,7 +53,6 @@ import (
        )
 
 //import _ "net/http/pprof"
-//import "net/http"
 
 // Set to true when a signal is received that triggers go-susi shutdown.
 var Shutdown = false
@@ -113,8 +113,9 @@ warranty; not even for MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
   
   config.ReadConfig()
   config.ReadCertificates() // after config.ReadConfig()
+  security.ReadCRLs() // after config.ReadCertificates()
   
-  if config.TLSRequired && config.TLSServerConfig == nil {
+  if config.TLSRequired() && config.TLSServerConfig() == nil {
     util.Log(0, "ERROR! No cert, no keys => no service")
     util.LoggersFlush(5*time.Second)
     os.Exit(1)
@@ -163,22 +164,22 @@ warranty; not even for MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
 
   config.ReadNetwork() // after config.ReadConfig()
   
-  if config.TLSServerConfig != nil {
-    util.Log(1, "INFO! [SECURITY] CA certificate:\n%v", security.CertificateInfo(config.CACert[0]))
-    util.Log(1, "INFO! [SECURITY] My certificate:\n%v", security.CertificateInfo(config.TLSServerConfig.Certificates[0].Leaf))
+  if config.TLSServerConfig() != nil {
+    util.Log(1, "INFO! [SECURITY] CA certificate:\n%v", security.CertificateInfo(config.CACert()[0]))
+    util.Log(1, "INFO! [SECURITY] My certificate:\n%v", security.CertificateInfo(config.TLSServerConfig().Certificates[0].Leaf))
   }
 
   // ATTENTION! DO NOT MOVE THE FOLLOWING CODE FURTHER DOWN!
   // We want to try listening on our socket as early in the program as possible,
   // so that we can bail out if another go-susi instance is already running
   // before potentially damaging the databases.
-  tcp_addr, err := net.ResolveTCPAddr("tcp4", config.ServerListenAddress)
+  tcp_addr, err := net.ResolveTCPAddr("tcp", config.ServerListenAddress)
   if err != nil {
     util.Log(0, "ERROR! ResolveTCPAddr: %v", err)
     util.LoggersFlush(5*time.Second)
     os.Exit(1)
   }
-  listener, err := net.ListenTCP("tcp4", tcp_addr)
+  listener, err := net.ListenTCP("tcp", tcp_addr)
   if err != nil {
     util.Log(0, "ERROR! ListenTCP: %v", err)
     util.LoggersFlush(5*time.Second)
@@ -202,6 +203,7 @@ warranty; not even for MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
     db.ServersInit() // after config.ReadNetwork()
     db.JobsInit() // after config.ReadConfig()
     db.ClientsInit() // after config.ReadConfig()
+    db.BansInit() // after config.ReadConfig()
     db.HooksExecute(true) // after config.ReadConfig()
     action.Init()
   }  
@@ -214,11 +216,15 @@ warranty; not even for MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
   
   util.Log(1, "INFO! Intercepting these signals: %v", signals_to_watch)
   
-  util.Log(1, "INFO! Accepting gosa-si protocol connections on TCP port %v", strings.SplitN(config.ServerSourceAddress,":",2)[1]);
+  util.Log(1, "INFO! Accepting gosa-si protocol connections on TCP port %v", config.ServerPort());
   go acceptConnections(listener, tcp_connections)
   
   go util.WithPanicHandler(faiProgressWatch)
   
+  // If no CRL is configured, reloadConfig() starts the updater when
+  // one is added.
+  if len(config.CRLPath()) > 0 { security.StartCRLUpdater() }
+  
   if config.RunServer {
     if config.FAIMonPort != "disabled" {
       util.Log(1, "INFO! Accepting FAI monitoring messages on TCP port %v", config.FAIMonPort)
@@ -226,7 +232,31 @@ warranty; not even for MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
     }
   
     util.Log(1, "INFO! Accepting TFTP requests on UDP port %v", config.TFTPPort)
-    go tftp.ListenAndServe(":"+config.TFTPPort, config.TFTPRegexes, config.TFTPReplies)
+    go tftp.ListenAndServe(":"+config.TFTPPort, config.TFTPRegexes(), config.TFTPReplies())
+    
+    if config.HTTPBootPort != "disabled" {
+      util.Log(1, "INFO! Accepting HTTP boot requests on TCP port %v", config.HTTPBootPort)
+      go tftp.HTTPListenAndServe(":"+config.HTTPBootPort)
+    }
+    
+    if config.ProxyDHCPPort != "disabled" {
+      util.Log(1, "INFO! Accepting PXE requests as ProxyDHCP server on UDP port %v", config.ProxyDHCPPort)
+      go tftp.ProxyDHCPListenAndServe(":"+config.ProxyDHCPPort, false)
+      if config.ProxyDHCPBroadcastPort != "disabled" {
+        util.Log(1, "INFO! Accepting PXE broadcasts as ProxyDHCP server on UDP port %v", config.ProxyDHCPBroadcastPort)
+        go tftp.ProxyDHCPListenAndServe(":"+config.ProxyDHCPBroadcastPort, true)
+      }
+    }
+
+    if config.MetricsPort != "disabled" {
+      util.Log(1, "INFO! Serving metrics on TCP port %v", config.MetricsPort)
+      go metrics(":"+config.MetricsPort)
+    }
+    
+    if config.APIPort != "disabled" {
+      util.Log(1, "INFO! Accepting HTTPS/JSON API requests on TCP port %v", config.APIPort)
+      go message.JSONAPIListenAndServe(":"+config.APIPort)
+    }
 
     go message.CheckPossibleClients()
     go message.Broadcast_new_server()
@@ -250,7 +280,10 @@ warranty; not even for MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
                     if sig == syscall.SIGUSR2 && config.RunServer { 
                       db.HooksExecute(false)
                     }
-                    if sig == syscall.SIGHUP || sig == syscall.SIGTERM || 
+                    if sig == syscall.SIGHUP {
+                      reloadConfig()
+                    }
+                    if sig == syscall.SIGTERM || 
                        sig == syscall.SIGQUIT || sig == syscall.SIGINT {
                        Shutdown = true
                        util.Log(0, "WARNING! Shutting down!")
@@ -261,9 +294,11 @@ warranty; not even for MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
                          go func(){ db.JobsShutdown(); wait<-true }()
                          go func(){ db.ServersShutdown(); wait<-true }()
                          go func(){ db.ClientsShutdown(); wait<-true }()
+                         go func(){ db.BansShutdown(); wait<-true }()
                          <-wait // for jobdb
                          <-wait // for serverdb
                          <-wait // for clientdb
+                         <-wait // for bandb
                        }
                        config.Shutdown()
                        util.Log(1, "INFO! Average request processing time: %v", time.Duration((atomic.LoadInt64(&message.RequestProcessingTime)+50)/100))
@@ -340,11 +375,11 @@ func handle_request(tcpconn *net.TCPConn) {
   conn = tcpconn
   n := 1
   
-  if config.TLSServerConfig != nil {
+  if config.TLSServerConfig() != nil {
     // If TLS is required, we need to see a STARTTLS before the timeout.
     // If TLS is optional we need to accept idle connections for backwards compatibility
-    if config.TLSRequired {
-      conn.SetDeadline(time.Now().Add(config.TimeoutTLS))
+    if config.TLSRequired() {
+      conn.SetDeadline(time.Now().Add(config.TimeoutTLS()))
     }
     
     for i := range starttls {
@@ -361,7 +396,7 @@ func handle_request(tcpconn *net.TCPConn) {
         conn.Read(readbuf[0:1]) // ignore error. It will pop up again further down the line.
       }
       if readbuf[0] != starttls[i] { 
-        if config.TLSRequired {
+        if config.TLSRequired() {
           util.Log(0, "ERROR! No STARTTLS from %v, but TLS is required", conn.RemoteAddr())
           util.WriteAll(conn, []byte(message.ErrorReply("STARTTLS is required to connect")))
           return
@@ -370,7 +405,7 @@ func handle_request(tcpconn *net.TCPConn) {
       }
       if readbuf[0] == '\n' {
         buf.Reset() // purge STARTTLS\n from buffer
-        conn = tls.Server(conn, config.TLSServerConfig)
+        conn = tls.Server(conn, config.TLSServerConfig())
       }
     }
   }
@@ -473,8 +508,8 @@ func handle_request(tcpconn *net.TCPConn) {
         if reply.Len() > 0 {
           util.Log(2, "DEBUG! Sending %v bytes reply to %v", reply.Len(), conn.RemoteAddr())
           
-          if config.Timeout >= 0 {
-            deadline := time.Now().Add(config.Timeout)
+          if config.Timeout() >= 0 {
+            deadline := time.Now().Add(config.Timeout())
             if totalDeadline.IsZero() || deadline.Before(totalDeadline) {
               conn.SetWriteDeadline(deadline)
             }
@@ -519,6 +554,18 @@ func setConfigUnitTag() {
   }
 }
 
+// Reloads configuration, certificates and CRLs and passes the new [tftp]
+// mappings to the TFTP server. Called on SIGHUP.
+func reloadConfig() {
+  util.Log(1, "INFO! Reloading configuration")
+  config.Reload()
+  security.ReadCRLs() // after config.Reload()
+  if len(config.CRLPath()) > 0 { security.StartCRLUpdater() }
+  if config.RunServer {
+    tftp.SetMappings(config.TFTPRegexes(), config.TFTPReplies())
+  }
+}
+
 func readExtraInfo(einfopath string) {
   if einfopath == "" { return }
   
@@ -561,14 +608,14 @@ func readExtraInfo(einfopath string) {
 func printStats() int {
   msg := "<xml><header>sistats</header></xml>"
 
-  conn, context := security.SendLnTo(config.ServerSourceAddress, msg, config.ModuleKey["[GOsaPackages]"], true)
+  conn, context := security.SendLnTo(config.ServerSourceAddress, msg, config.ModuleKey()["[GOsaPackages]"], true)
   if conn == nil { return 1 }
   defer conn.Close()
 
   reply,_ := util.ReadLn(conn, 10*time.Second)
   
   if !context.TLS {
-    reply = security.GosaDecrypt(reply, config.ModuleKey["[GOsaPackages]"])
+    reply = security.GosaDecrypt(reply, config.ModuleKey()["[GOsaPackages]"])
   }
   x,_ := xml.StringToHash(reply)
   x = x.First("answer1")
@@ -582,6 +629,26 @@ func printStats() int {
   return 0
 }
 
+// Serves runtime statistics in Prometheus text exposition format
+// at http://<listen_address>/metrics
+func metrics(listen_address string) {
+  mux := http.NewServeMux()
+  mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    writeMetrics(w)
+  })
+  err := http.ListenAndServe(listen_address, mux)
+  util.Log(0, "ERROR! Cannot serve metrics: %v", err)
+}
+
+func writeMetrics(w io.Writer) {
+  var maxtime time.Duration
+  for i := 0; i < RequestProcessingTimes.Count(); i++ {
+    if t := RequestProcessingTimes.At(i).(time.Duration); t > maxtime { maxtime = t }
+  }
+  message.WriteMetrics(w, atomic.LoadInt32(&ActiveConnections), maxtime)
+}
+
 func faimon(listen_address string) {
   listener, err := net.Listen("tcp", listen_address)
   if err != nil {
@@ -652,25 +719,29 @@ func faiConnection(conn *net.TCPConn) {
 }
 
 func faiProgressWatch() {
-  clientpackageskey := config.ModuleKey["[ClientPackages]"]
+  clientpackageskey := config.ModuleKey()["[ClientPackages]"]
   // If [ClientPackages]/key missing, take the last key in the list
   // (We don't take the 1st because that would be "dummy-key").
-  if clientpackageskey == "" { clientpackageskey = config.ModuleKeys[len(config.ModuleKeys)-1] }
+  if clientpackageskey == "" { clientpackageskey = config.ModuleKeys()[len(config.ModuleKeys())-1] }
   
-  util.Log(1, "INFO! Launching fai-progress-hook %v", config.FAIProgressHookPath)
+  util.Log(1, "INFO! Launching fai-progress-hook %v", config.FAIProgressHookPath())
+  // NOTE: This hook is deliberately not run via db.HookRun(), because it
+  // runs as long as go-susi does. It must neither be killed by the hook
+  // timeout or output limit nor permanently occupy one of the
+  // [general]/hook-max-parallel slots.
   env := config.HookEnvironment()
-  cmd := exec.Command(config.FAIProgressHookPath)
+  cmd := exec.Command(config.FAIProgressHookPath())
   cmd.Env = append(env, os.Environ()...)
 
   out, err := cmd.StdoutPipe()
   if err != nil {
-    util.Log(0, "ERROR! Could not get stdout pipe for %v: %v => FAI progress monitoring disabled", config.FAIProgressHookPath, err)
+    util.Log(0, "ERROR! Could not get stdout pipe for %v: %v => FAI progress monitoring disabled", config.FAIProgressHookPath(), err)
     return
   }
 
   err = cmd.Start()
   if err != nil {
-    util.Log(0, "ERROR! Could not launch %v: %v => FAI progress monitoring disabled", config.FAIProgressHookPath, err)
+    util.Log(0, "ERROR! Could not launch %v: %v => FAI progress monitoring disabled", config.FAIProgressHookPath(), err)
     return
   }
   
@@ -678,7 +749,7 @@ func faiProgressWatch() {
   for {
     line, err := reader.ReadString('\n')
     if err != nil {
-      util.Log(0, "ERROR! Error reading stdout from FAI progress monitor %v: %v => FAI progress monitoring disabled", config.FAIProgressHookPath, err)
+      util.Log(0, "ERROR! Error reading stdout from FAI progress monitor %v: %v => FAI progress monitoring disabled", config.FAIProgressHookPath(), err)
       return
     }
 
@@ -705,9 +776,9 @@ func faiProgressWatch() {
     go func(){security.SendLnTo(target, msg, clientpackageskey, false)}()
     
     if strings.HasPrefix(line, "TASKEND savelog") { 
-      message.Send_clmsg_save_fai_log(target, config.FAISavelogHookPath, "fai-savelog-hook")
+      message.Send_clmsg_save_fai_log(target, config.FAISavelogHookPath(), "fai-savelog-hook")
     } else if strings.HasPrefix(line, "TASKEND audit") { 
-      message.Send_clmsg_save_fai_log(target, config.FAIAuditHookPath, "fai-audit-hook")
+      message.Send_clmsg_save_fai_log(target, config.FAIAuditHookPath(), "fai-audit-hook")
     }
   }
 }
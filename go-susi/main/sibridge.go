@@ -311,6 +311,40 @@ Commands:
                     for an entry to be included in the list.
                     Example: "qaudit has pack bash 4.3"
 
+  trail:      Show the audit trail of state-changing requests (job triggers,
+              job deletions, "kill", ".release",...).
+              Argument types: Machine, "*", Date, Time
+              
+              Date and time specify the start of the period to show
+              (inclusive). Relative times go into the past (i.e. 10m
+              is 10 minutes before now). If no time is specified, it
+              will default to 7d.
+              If no machine is given (and there is no list of affected
+              machines from a previous command) or "*" is used, requests
+              affecting any machine are shown. If your certificate
+              restricts the target machines, "*" is not permitted and
+              only requests affecting the given machines are shown.
+  
+  connections: Show the connection limits state of the si-server.
+              Argument types: none
+              Lists all addresses that have connected within the last
+              hour or are banned, with the number of open connections,
+              the number of connections within the last hour (each with
+              the limit from the peer's certificate) and the number of
+              refused connections.
+  
+  unban:      Lift the ban on address(es).
+              Argument types: strings
+              Each string is an IP address. For IPv6 the ban applies to
+              the whole /64 and any address within it may be given.
+  
+  approve:    Accept the certificate that was rejected for peer server(s)
+              because it differs from the certificate pinned for them.
+              Argument types: strings
+              Each string is the address (host:port) of a peer server.
+              The rejected certificate is pinned, i.e. from now on only
+              this certificate is accepted from the peer.
+  
   query_jobdb, query_jobs, jobs: 
               Query jobs matching the arguments.
               Argument types: Machine, "*", Job type
@@ -354,6 +388,8 @@ var TimestampRE = regexp.MustCompile("^([0-9]{4})([0-9]{2})([0-9]{2})([0-9]{2})(
 
 var QueryAuditDefaultTime = -180*24*time.Hour
 
+var AuditTrailDefaultTime = -7*24*time.Hour
+
 const FIELD_SEP = "  "
 
 func main() {
@@ -390,14 +426,18 @@ func main() {
   config.Init()
   ReadConfig() // This is NOT config.ReadConfig() !!
   config.ReadCertificates() // after ReadConfig()
+  security.ReadCRLs() // after config.ReadCertificates()
+  if len(config.CRLPath()) > 0 {
+    go util.WithPanicHandler(security.CRLUpdater)
+  }
   
 
   config.ReadNetwork() // after config.ReadConfig()
-  config.Timeout = 30*time.Second
+  config.Modify(func(r *config.Reloadable) { r.Timeout = 30*time.Second })
   config.FAIBase = db.LDAPFAIBase()
   
   if check_reachable {
-    if config.TLSRequired && config.TLSServerConfig == nil {
+    if config.TLSRequired() && config.TLSServerConfig() == nil {
       util.Log(0, "ERROR! No cert, no keys => no service")
       cleanExit(1)
     }
@@ -426,7 +466,7 @@ func main() {
 
   // If we support TLS, check if the target does, too
   // and mark it in the serverdb if it does.
-  if config.TLSClientConfig != nil {
+  if config.TLSClientConfig() != nil {
     // do not log errors for failed TLS connection attempt
     util.LogLevel = -1
     conn, _ := security.SendLnTo(TargetAddress, "", "", true)
@@ -437,7 +477,7 @@ func main() {
       if err == nil {
         ip, port, err := net.SplitHostPort(server)
         if err == nil {
-          source := ip + ":" + port
+          source := net.JoinHostPort(ip, port)
           server_xml := xml.NewHash("xml", "source", source)
           server_xml.Add("key", "") // key=="" is marker for TLS-support
           db.ServerUpdate(server_xml)
@@ -493,17 +533,17 @@ func main() {
   
   // If requested, accept TCP connections
   if ListenForConnections {
-    if config.TLSServerConfig == nil {
+    if config.TLSServerConfig() == nil {
       util.Log(0, "ERROR! -l option requires TLS certificates to be configured")
       cleanExit(1)
     }
-    tcp_addr, err := net.ResolveTCPAddr("tcp4", config.ServerListenAddress)
+    tcp_addr, err := net.ResolveTCPAddr("tcp", config.ServerListenAddress)
     if err != nil {
       util.Log(0, "ERROR! ResolveTCPAddr: %v", err)
       cleanExit(1)
     }
 
-    listener, err := net.ListenTCP("tcp4", tcp_addr)
+    listener, err := net.ListenTCP("tcp", tcp_addr)
     if err != nil {
       util.Log(0, "ERROR! ListenTCP: %v", err)
       cleanExit(1)
@@ -566,7 +606,7 @@ func acceptConnections(listener *net.TCPListener, connections chan<- net.Conn) {
       if err != nil {
         util.Log(0, "ERROR! SetKeepAlive: %v", err)
       }
-      conn := tls.Server(tcpConn, config.TLSServerConfig)
+      conn := tls.Server(tcpConn, config.TLSServerConfig())
       connections <- conn
     }
   }
@@ -578,7 +618,7 @@ func handle_request(conn net.Conn, connectionTracker *deque.Deque) {
   defer connectionTracker.PopAt(0)
     // only call deregister if the remote address is a valid IP address.
     // This avoids error log entries for console connections
-  if net.ParseIP(strings.Split(conn.RemoteAddr().String(),":")[0]) != nil {
+  if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil && net.ParseIP(host) != nil {
     defer security.ConnectionLimitsDeregister(conn.RemoteAddr())
   }
   defer conn.Close()
@@ -593,6 +633,9 @@ func handle_request(conn net.Conn, connectionTracker *deque.Deque) {
                     security.ConnectionLimitsUpdate(context)
     default: context = &security.Context{}
              security.SetLegacyDefaults(context)
+             if raddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+               context.PeerID.IP = raddr.IP
+             }
   }
   
   var totalDeadline time.Time // zero value means "no deadline"
@@ -615,7 +658,7 @@ func handle_request(conn net.Conn, connectionTracker *deque.Deque) {
   // processMessage() so that each call can access the previous call's data
   jobs := []jobDescriptor{}
   
-  util.SendLn(conn, "# Enter \"help\" to get a list of commands.\n# Ctrl-D terminates the connection.\n", config.Timeout)
+  util.SendLn(conn, "# Enter \"help\" to get a list of commands.\n# Ctrl-D terminates the connection.\n", config.Timeout())
   
   repeat := time.Duration(0)
   repeat_command := ""
@@ -722,7 +765,7 @@ func handle_request(conn net.Conn, connectionTracker *deque.Deque) {
         
         if reply != "" {
           util.Log(2, "DEBUG! Sending reply to %v: %v", conn.RemoteAddr(), reply)
-          util.SendLn(conn, reply, config.Timeout)
+          util.SendLn(conn, reply, config.Timeout())
           bytesRemaining -= int64(len(reply))
         }
       }
@@ -734,8 +777,8 @@ var jobs      = []string{"update","softupdate","reboot","halt","install",  "rein
 // It's important that the jobs are at the beginning of the commands slice,
 // because we use that fact later to distinguish between commands that refer to
 // jobs and other commands.
-var commands  = append(jobs,                                                                                                                                                                     "help","x",      "examine", "query_jobdb","query_jobs","jobs", "delete_jobs","delete_jobdb_entry","qq","xx","kill", ".release", ".classes", ".debianrepository", ".repository", "raw", "encrypt", "decrypt", ".gocomment", ".description", "qaudit", "query_audit")
-var canonical = []string{"update","update"    ,"reboot","halt","reinstall","reinstall",  "wake","localboot","lock","activate","activate","send_user_msg","send_user_msg","send_user_msg","audit","help","examine","examine", "query",      "query",     "query","delete",     "delete"            ,"qq","xx","kill", ".release", ".classes", ".deb"             , ".deb"       , "raw", "encrypt", "decrypt", ".gocomment", ".description", "qaudit", "qaudit"     }
+var commands  = append(jobs,                                                                                                                                                                     "help","x",      "examine", "query_jobdb","query_jobs","jobs", "delete_jobs","delete_jobdb_entry","qq","xx","kill", ".release", ".classes", ".debianrepository", ".repository", "raw", "encrypt", "decrypt", ".gocomment", ".description", "qaudit", "query_audit", "trail", "connections", "unban", "approve")
+var canonical = []string{"update","update"    ,"reboot","halt","reinstall","reinstall",  "wake","localboot","lock","activate","activate","send_user_msg","send_user_msg","send_user_msg","audit","help","examine","examine", "query",      "query",     "query","delete",     "delete"            ,"qq","xx","kill", ".release", ".classes", ".deb"             , ".deb"       , "raw", "encrypt", "decrypt", ".gocomment", ".description", "qaudit", "qaudit"     , "trail", "connections", "unban", "approve"}
 
 type jobDescriptor struct {
   MAC string
@@ -857,8 +900,10 @@ func processMessage(msg string, joblist *[]jobDescriptor, context *security.Cont
   allowed := map[string]bool{"machine":true, "multiple_machines":true}
   if is_job_cmd { allowed["time"] = true }
   if cmd == "delete" { allowed["job"]=true }
-  if cmd == "delete" || cmd == "query" || cmd == "qaudit" || cmd == "qq" { allowed["*"]=true }
-  if cmd[0] == '.' || cmd == "raw" || cmd == "encrypt" || cmd == "decrypt" { allowed["substring"]=true; allowed["machine"]=false }
+  if cmd == "delete" || cmd == "query" || cmd == "qaudit" || cmd == "qq" || cmd == "trail" { allowed["*"]=true }
+  if cmd == "trail" { allowed["time"] = true }
+  if cmd[0] == '.' || cmd == "raw" || cmd == "encrypt" || cmd == "decrypt" || cmd == "unban" || cmd == "approve" { allowed["substring"]=true; allowed["machine"]=false }
+  if cmd == "connections" { allowed["machine"]=false }
   if cmd == "qaudit" {
     allowed["time"] = true
     allowed["substring"] = true
@@ -874,7 +919,7 @@ func processMessage(msg string, joblist *[]jobDescriptor, context *security.Cont
   for i=1; i < len(fields); i++ {
     template := jobDescriptor{}
     
-    if (allowed["time"] && parseTime(fields[i], &template, cmd=="qaudit")) ||
+    if (allowed["time"] && parseTime(fields[i], &template, cmd=="qaudit" || cmd=="trail")) ||
       // test machine names before jobs. Otherwise many valid machine names such as "rei" would
       // be interpreted as job types ("reinstall" in the example)
        (allowed["machine"] && parseMachine(strings.ToLower(fields[i]), &template)) ||
@@ -935,6 +980,9 @@ func processMessage(msg string, joblist *[]jobDescriptor, context *security.Cont
   if cmd == "qaudit" {
     default_time = default_time.Add(QueryAuditDefaultTime)
   }
+  if cmd == "trail" {
+    default_time = default_time.Add(AuditTrailDefaultTime)
+  }
   now := util.MakeTimestamp(default_time)
   template := jobDescriptor{Date:now[0:8], Time:now[8:]}
   *joblist = []jobDescriptor{}
@@ -965,6 +1013,41 @@ func processMessage(msg string, joblist *[]jobDescriptor, context *security.Cont
     }
   }
   
+  // "trail" without machines shows the requests for all machines.
+  if cmd == "trail" && len(*joblist) == 0 {
+    *joblist = append(*joblist, jobDescriptor{Name:"*", MAC:"*", IP:"0.0.0.0", Date:template.Date, Time:template.Time})
+  }
+  
+  // If the certificate restricts the target machines, drop all machines
+  // outside of the scope from the job list. Audit data is not restricted.
+  // The audit trail is, because it reveals who did what to which machine.
+  scope_errors := ""
+  if !context.Scope.Unrestricted() && cmd != "qaudit" {
+    in_scope := []jobDescriptor{}
+    for _, j := range *joblist {
+      if j.Name == "*" {
+        *joblist = []jobDescriptor{}
+        return "! \"*\" is not permitted because your certificate restricts the target machines", 0
+      }
+      if db.SystemInScope(j.MAC, &context.Scope) {
+        in_scope = append(in_scope, j)
+      } else {
+        scope_errors += "! " + j.Name + " (" + j.MAC + ") is outside of your certificate's target scope\n"
+        if cmd == "kill" || cmd == ".release" || cmd == ".classes" {
+          auditTrail(cmd, &j, j.Sub, "denied", context)
+        }
+      }
+    }
+    *joblist = in_scope
+
+    // For query, qq, delete and trail an empty machine list means "all
+    // machines". The server can not apply the scope because sibridge talks
+    // to it with the module key, so we must not send such a request.
+    if len(*joblist) == 0 && (cmd == "query" || cmd == "qq" || cmd == "delete" || cmd == "trail") {
+      return scope_errors + PERMISSION_DENIED, 0
+    }
+  }
+
   reply = ""
   repeat = 0
   
@@ -983,14 +1066,14 @@ func processMessage(msg string, joblist *[]jobDescriptor, context *security.Cont
       reply = PERMISSION_DENIED
     }
   } else if cmd == "xx" {
-    if context.Access.Query.QueryAll {
+    if context.Access.Query.QueryFAI || context.Access.Query.QueryAll {
       reply = commandExamine(joblist)
       repeat = 2*time.Second
     } else {
       reply = PERMISSION_DENIED
     }
   } else if cmd == "examine" {
-    if context.Access.Query.QueryAll {
+    if context.Access.Query.QueryFAI || context.Access.Query.QueryAll {
       reply = commandExamine(joblist)
     } else {
       reply = PERMISSION_DENIED
@@ -1002,12 +1085,37 @@ func processMessage(msg string, joblist *[]jobDescriptor, context *security.Cont
       reply = PERMISSION_DENIED
     }
   } else if cmd == "qaudit" {
-    if context.Access.Query.QueryAll {
+    if context.Access.Query.QueryAudit || context.Access.Query.QueryAll {
       reply = commandQueryAudit(subcmd, joblist)
     } else {
       reply = PERMISSION_DENIED
     }
     *joblist = []jobDescriptor{} // reset selected machines
+  } else if cmd == "trail" {
+    if context.Access.Query.QueryAudit || context.Access.Query.QueryAll {
+      reply = commandTrail(joblist)
+    } else {
+      reply = PERMISSION_DENIED
+    }
+    *joblist = []jobDescriptor{} // reset selected machines
+  } else if cmd == "connections" {
+    if context.Access.Query.QueryStats || context.Access.Query.QueryAll {
+      reply = commandConnections()
+    } else {
+      reply = PERMISSION_DENIED
+    }
+  } else if cmd == "unban" {
+    if context.Access.Misc.Debug {
+      reply = commandUnban(template.Sub)
+    } else {
+      reply = PERMISSION_DENIED
+    }
+  } else if cmd == "approve" {
+    if context.Access.Misc.Debug {
+      reply = commandApprove(template.Sub)
+    } else {
+      reply = PERMISSION_DENIED
+    }
   } else if cmd == "raw" {
     if context.Access.Misc.Debug {
       reply = commandRaw(template.Sub, 0)
@@ -1020,9 +1128,10 @@ func processMessage(msg string, joblist *[]jobDescriptor, context *security.Cont
     reply = commandRaw(template.Sub, 2)
   } else if cmd == "kill" {
     if context.Access.LDAPUpdate.DH && context.Access.DetectedHW.DN {
-      reply = commandKill(joblist)
+      reply = commandKill(joblist, context)
     } else {
       reply = PERMISSION_DENIED
+      auditTrailDenied(cmd, joblist, context)
     }
   } else if cmd == "copy" {
     if context.Access.LDAPUpdate.DH && context.Access.DetectedHW.DN { // we did this check earlier, but for completeness' sake we have it here, too.
@@ -1032,15 +1141,17 @@ func processMessage(msg string, joblist *[]jobDescriptor, context *security.Cont
     }
   } else if cmd == ".release" {
     if context.Access.LDAPUpdate.DH {
-      reply = commandRelease(joblist)
+      reply = commandRelease(joblist, context)
     } else {
       reply = PERMISSION_DENIED
+      auditTrailDenied(cmd, joblist, context)
     }
   } else if cmd == ".classes" {
     if context.Access.LDAPUpdate.DH {
-      reply = commandClasses(joblist)
+      reply = commandClasses(joblist, context)
     } else {
       reply = PERMISSION_DENIED
+      auditTrailDenied(cmd, joblist, context)
     }
   } else if cmd == ".deb" {
     if context.Access.LDAPUpdate.DH {
@@ -1070,7 +1181,7 @@ func processMessage(msg string, joblist *[]jobDescriptor, context *security.Cont
     *joblist = []jobDescriptor{} // reset selected machines
   }
   
-  return reply,repeat
+  return scope_errors + reply, repeat
 }
 
 func commandQueryAudit(subcmd string, joblist *[]jobDescriptor) (reply string) {
@@ -1123,7 +1234,7 @@ func commandQueryAuditPackages(joblist *[]jobDescriptor) (reply string) {
       augmentor = DummyAugmentor
     }
     
-    gosa_reply := <- message.Peer(TargetAddress).Ask(gosa_cmd, config.ModuleKey["[GOsaPackages]"])
+    gosa_reply := <- message.Peer(TargetAddress).Ask(gosa_cmd, config.ModuleKey()["[GOsaPackages]"])
     
     reply += parseGosaReplyGlobbed(gosa_reply, filter, augmentor)
   }
@@ -1170,7 +1281,7 @@ func commandQueryAuditSources(joblist *[]jobDescriptor) (reply string) {
       augmentor = DummyAugmentor
     }
     
-    gosa_reply := <- message.Peer(TargetAddress).Ask(gosa_cmd, config.ModuleKey["[GOsaPackages]"])
+    gosa_reply := <- message.Peer(TargetAddress).Ask(gosa_cmd, config.ModuleKey()["[GOsaPackages]"])
     reply += parseGosaReplyGlobbed(gosa_reply, &substrFilter, augmentor)
   }
   
@@ -1212,7 +1323,7 @@ func commandQueryAuditHardware(joblist *[]jobDescriptor) (reply string) {
       augmentor = DummyAugmentor
     }
     
-    gosa_reply := <- message.Peer(TargetAddress).Ask(gosa_cmd, config.ModuleKey["[GOsaPackages]"])
+    gosa_reply := <- message.Peer(TargetAddress).Ask(gosa_cmd, config.ModuleKey()["[GOsaPackages]"])
     reply += parseGosaReplyGlobbed(gosa_reply, &substrFilter, augmentor)
   }
   
@@ -1282,7 +1393,7 @@ func commandQueryAuditHas(joblist *[]jobDescriptor) string {
   
   filter := allSubstringsFilter(patterns)
   
-  gosa_reply := <- message.Peer(TargetAddress).Ask(gosa_cmd, config.ModuleKey["[GOsaPackages]"])
+  gosa_reply := <- message.Peer(TargetAddress).Ask(gosa_cmd, config.ModuleKey()["[GOsaPackages]"])
   return parseGosaReplyGlobbed(gosa_reply, &filter, DummyAugmentor)
 }
 
@@ -1307,7 +1418,7 @@ func commandQueryAuditUpdable(joblist *[]jobDescriptor) (reply string) {
   gosa_cmd := "<xml><header>gosa_query_audit</header><source>GOSA</source><target>GOSA</target><audit>packages</audit><tstart>"+tstart+"</tstart><tend>"+tend+"</tend><select>key</select><select>macaddress</select><select>update</select><where><clause><phrase><operator>ne</operator><update></update></phrase></clause></where></xml>"
   augmentor = DummyAugmentor
 
-  gosa_reply := <- message.Peer(TargetAddress).Ask(gosa_cmd, config.ModuleKey["[GOsaPackages]"])
+  gosa_reply := <- message.Peer(TargetAddress).Ask(gosa_cmd, config.ModuleKey()["[GOsaPackages]"])
     
   return parseGosaReplyGlobbed(gosa_reply, filter, augmentor)
 }
@@ -1332,7 +1443,7 @@ func commandQueryAuditBroken(joblist *[]jobDescriptor) (reply string) {
   gosa_cmd := "<xml><header>gosa_query_audit</header><source>GOSA</source><target>GOSA</target><audit>packages</audit><tstart>"+tstart+"</tstart><tend>"+tend+"</tend><select>key</select><select>status</select><select>macaddress</select><select>update</select><where><clause><phrase><operator>ne</operator><status>ii</status></phrase></clause></where></xml>"
   augmentor = DummyAugmentor
 
-  gosa_reply := <- message.Peer(TargetAddress).Ask(gosa_cmd, config.ModuleKey["[GOsaPackages]"])
+  gosa_reply := <- message.Peer(TargetAddress).Ask(gosa_cmd, config.ModuleKey()["[GOsaPackages]"])
     
   return parseGosaReplyGlobbed(gosa_reply, filter, augmentor)
 }
@@ -1354,7 +1465,7 @@ func commandQueryAuditMissing(joblist *[]jobDescriptor) (reply string) {
   var augmentor Augmentor = QAMissingAugmentor
   gosa_cmd := "<xml><header>gosa_query_audit</header><source>GOSA</source><target>GOSA</target><audit>packages</audit><tstart>"+tstart+"</tstart><tend>"+tend+"</tend><includeothers/><select>macaddress</select><select>status</select><select>lastaudit</select>"+where+"</xml>"
 
-  gosa_reply := <- message.Peer(TargetAddress).Ask(gosa_cmd, config.ModuleKey["[GOsaPackages]"])
+  gosa_reply := <- message.Peer(TargetAddress).Ask(gosa_cmd, config.ModuleKey()["[GOsaPackages]"])
     
   return parseGosaReplyGlobbed(gosa_reply, xml.FilterAll, augmentor)
 
@@ -1365,7 +1476,7 @@ func globMatch(pattern, s string) bool {
   return m
 }
 
-func commandRelease(joblist *[]jobDescriptor) (reply string) {
+func commandRelease(joblist *[]jobDescriptor, context *security.Context) (reply string) {
   db.FAIReleasesListUpdate()
   releases := db.FAIReleases()
   
@@ -1413,8 +1524,10 @@ func commandRelease(joblist *[]jobDescriptor) (reply string) {
     err := db.SystemSetStateMulti(j.MAC, "faiclass", []string{faiclass})
     if err != nil {
       reply += err.Error()
+      auditTrail(".release", &j, best_release, "error: "+err.Error(), context)
     } else {
       reply += "UPDATED " + j.Name + " ("+j.MAC+")"
+      auditTrail(".release", &j, best_release, "ok", context)
     }
     
     reply += "\n" + examine(&j)
@@ -1422,7 +1535,7 @@ func commandRelease(joblist *[]jobDescriptor) (reply string) {
   return reply
 }
 
-func commandClasses(joblist *[]jobDescriptor) (reply string) {
+func commandClasses(joblist *[]jobDescriptor, context *security.Context) (reply string) {
   mainloop:
   for _, j := range *joblist {
     if j.Name == "*" { continue }
@@ -1484,8 +1597,10 @@ func commandClasses(joblist *[]jobDescriptor) (reply string) {
     err := db.SystemSetStateMulti(j.MAC, "faiclass", []string{faiclass})
     if err != nil {
       reply += err.Error()
+      auditTrail(".classes", &j, faiclass, "error: "+err.Error(), context)
     } else {
       reply += "UPDATED " + j.Name + " ("+j.MAC+")"
+      auditTrail(".classes", &j, faiclass, "ok", context)
     }
     
     reply += "\n" + examine(&j)
@@ -1607,7 +1722,7 @@ func commandJob(joblist *[]jobDescriptor, context *security.Context) (reply stri
       case "send_user_msg":permitted = context.Access.Jobs.UserMsg || context.Access.Jobs.JobsAll
     }
     if permitted {
-      gosa_reply := <- message.Peer(TargetAddress).Ask(xmlmess, config.ModuleKey["[GOsaPackages]"])
+      gosa_reply := <- message.Peer(TargetAddress).Ask(xmlmess, config.ModuleKey()["[GOsaPackages]"])
       reply += parseGosaReply(gosa_reply)
     } else {
       reply += PERMISSION_DENIED
@@ -1635,7 +1750,7 @@ func examine(j *jobDescriptor) (reply string) {
     reachable := []chan int{make(chan int, 2),make(chan int, 2),make(chan int, 2)}
     for i := range ports {
       go func(port string, c chan int) {
-        conn, err := net.Dial("tcp", j.IP+":"+port)
+        conn, err := net.Dial("tcp", net.JoinHostPort(j.IP, port))
         if err != nil {
           c <- 0
         } else {
@@ -1706,7 +1821,7 @@ func examine(j *jobDescriptor) (reply string) {
     return reply
 }
 
-func commandKill(joblist *[]jobDescriptor) (reply string) {
+func commandKill(joblist *[]jobDescriptor, context *security.Context) (reply string) {
   for _, j := range *joblist {
     if j.Name == "*" { continue }
     
@@ -1714,19 +1829,112 @@ func commandKill(joblist *[]jobDescriptor) (reply string) {
     sys, err := db.SystemGetAllDataForMAC(j.MAC, false)
     if sys == nil { 
       reply += err.Error()
+      auditTrail("kill", &j, "", "error: "+err.Error(), context)
       continue 
     }
     
     err = db.SystemReplace(sys, nil)
     if err != nil {
       reply += err.Error()
+      auditTrail("kill", &j, sys.Text("dn"), "error: "+err.Error(), context)
     } else {
       reply += "DELETED " + sys.Text("dn")
+      auditTrail("kill", &j, sys.Text("dn"), "ok", context)
     }
   }
   return reply
 }
 
+// Records the command cmd affecting machine j in the audit trail.
+// arg is the command's argument (e.g. the new release), outcome is "ok",
+// "denied" or "error: <message>".
+// The entry is sent to the server at TargetAddress, so that it shows up in
+// the server's audit trail. Only if that fails, it is written to the local
+// config.AuditTrailPath().
+func auditTrail(cmd string, j *jobDescriptor, arg string, outcome string, context *security.Context) {
+  entry := db.NewAuditTrailEntry(context.PeerID.IP, context.Subject, cmd)
+  entry.Add("target", j.MAC)
+  if arg != "" { entry.Add("argument", arg) }
+  entry.Add("outcome", outcome)
+
+  gosa_cmd := xml.NewHash("xml", "header", "gosa_add_audit_trail_entry")
+  gosa_cmd.Add("source", "GOSA")
+  gosa_cmd.Add("target", "GOSA")
+  gosa_cmd.AddClone(entry)
+  gosa_reply := <- message.Peer(TargetAddress).Ask(gosa_cmd.String(), config.ModuleKey()["[GOsaPackages]"])
+  if result := parseGosaReply(gosa_reply); result != "OK" {
+    util.Log(0, "ERROR! Could not send audit trail entry to %v: %v", TargetAddress, result)
+    db.AuditTrailAdd(entry)
+  }
+}
+
+// Records the command cmd for all machines from joblist in the audit trail
+// with outcome "denied".
+func auditTrailDenied(cmd string, joblist *[]jobDescriptor, context *security.Context) {
+  for _, j := range *joblist {
+    if j.Name == "*" { continue }
+    auditTrail(cmd, &j, j.Sub, "denied", context)
+  }
+}
+
+// + 2013-10-16 12:00:00  kill  00:0c:29:50:a3:52  ok  172.16.2.3  CN=admin
+func commandTrail(joblist *[]jobDescriptor) (reply string) {
+  tstart := ""
+  machines := ""
+  all := false
+  for _, j := range *joblist {
+    if tstart == "" || j.Date+j.Time < tstart { tstart = j.Date+j.Time }
+    if j.Name == "*" {
+      all = true
+    } else {
+      machines += "<phrase><target>"+j.MAC+"</target></phrase>"
+    }
+  }
+  
+  where := "<clause><phrase><operator>ge</operator><timestamp>"+tstart+"</timestamp></phrase></clause>"
+  if !all && machines != "" {
+    where += "<clause><connector>or</connector>"+machines+"</clause>"
+  }
+  
+  gosa_cmd := "<xml><header>gosa_query_audit_trail</header><source>GOSA</source><target>GOSA</target><where>"+where+"</where></xml>"
+  gosa_reply := <- message.Peer(TargetAddress).Ask(gosa_cmd, config.ModuleKey()["[GOsaPackages]"])
+  return parseGosaReply(gosa_reply)
+}
+
+func commandConnections() (reply string) {
+  gosa_cmd := "<xml><header>gosa_query_connection_limits</header><source>GOSA</source><target>GOSA</target></xml>"
+  gosa_reply := <- message.Peer(TargetAddress).Ask(gosa_cmd, config.ModuleKey()["[GOsaPackages]"])
+  return parseGosaReply(gosa_reply)
+}
+
+func commandUnban(addresses string) (reply string) {
+  for _, ip := range strings.Fields(addresses) {
+    if reply != "" { reply += "\n" }
+    gosa_cmd := xml.NewHash("xml", "header", "gosa_lift_ban")
+    gosa_cmd.Add("source", "GOSA")
+    gosa_cmd.Add("target", "GOSA")
+    gosa_cmd.Add("ip", ip)
+    gosa_reply := <- message.Peer(TargetAddress).Ask(gosa_cmd.String(), config.ModuleKey()["[GOsaPackages]"])
+    reply += ip + ": " + parseGosaReply(gosa_reply)
+  }
+  if reply == "" { reply = "! Command unban requires an IP address" }
+  return reply
+}
+
+func commandApprove(peers string) (reply string) {
+  for _, peer := range strings.Fields(peers) {
+    if reply != "" { reply += "\n" }
+    gosa_cmd := xml.NewHash("xml", "header", "gosa_approve_peer_certificate")
+    gosa_cmd.Add("source", "GOSA")
+    gosa_cmd.Add("target", "GOSA")
+    gosa_cmd.Add("peer", peer)
+    gosa_reply := <- message.Peer(TargetAddress).Ask(gosa_cmd.String(), config.ModuleKey()["[GOsaPackages]"])
+    reply += peer + ": " + parseGosaReply(gosa_reply)
+  }
+  if reply == "" { reply = "! Command approve requires the address of a peer server" }
+  return reply
+}
+
 func commandCopy(template *xml.Hash, joblist *[]jobDescriptor) (reply string) {
   for _, j := range *joblist {
     if j.Name == "*" { continue }
@@ -1740,7 +1948,7 @@ func commandCopy(template *xml.Hash, joblist *[]jobDescriptor) (reply string) {
 
     newsys := sys.Clone()
     
-    if strings.HasSuffix(sys.Text("dn"), config.IncomingOU) {
+    if strings.HasSuffix(sys.Text("dn"), config.IncomingOU()) {
       newsys.RemoveFirst("dn") // so that a new one will be filled in from the template
     }
       
@@ -1842,7 +2050,7 @@ func commandGosa(header string, use_job_type bool, joblist *[]jobDescriptor) (re
   }
 
   gosa_cmd := "<xml><header>"+header+"</header><source>GOSA</source><target>GOSA</target><where>"+clauses+"</where></xml>"
-  reply = <- message.Peer(TargetAddress).Ask(gosa_cmd, config.ModuleKey["[GOsaPackages]"])
+  reply = <- message.Peer(TargetAddress).Ask(gosa_cmd, config.ModuleKey()["[GOsaPackages]"])
   return parseGosaReply(reply)
 }
 
@@ -1858,7 +2066,7 @@ func commandRaw(line string, mode int) (reply string) {
   gosa_cmd := strings.TrimSpace(line[len(key):])
 
   if key == "" { key = "GOsaPackages" }
-  module_key, is_module_key := config.ModuleKey["["+key+"]"]
+  module_key, is_module_key := config.ModuleKey()["["+key+"]"]
   if is_module_key { key = module_key }
   if mode == 0 {
     reply = <- message.Peer(TargetAddress).Ask(gosa_cmd, key)
@@ -1867,7 +2075,7 @@ func commandRaw(line string, mode int) (reply string) {
   } else if mode == 2 {
     reply = security.GosaDecrypt(gosa_cmd, key)
     if reply == "" {
-      for _, key := range config.ModuleKeys {
+      for _, key := range config.ModuleKeys() {
         reply = security.GosaDecrypt(gosa_cmd, key)
         if reply != "" { break }
       }
@@ -2095,6 +2303,8 @@ func parseGosaReplyGlobbed(reply_from_gosa string, filter xml.HashFilter, augmen
     
     switch header {
       case "query_jobdb": r = formatQueryJobdbAnswer(answer, x.Text("source"))
+      case "query_audit_trail": r = formatQueryAuditTrailAnswer(answer)
+      case "query_connection_limits": r = formatQueryConnectionLimitsAnswer(answer)
       default: 
                for _, augment := range augmentations {
                  augment.Answer(answer)
@@ -2202,13 +2412,15 @@ func  formatQueryJobdbAnswer(answer *xml.Hash, source string) []string {
   }
   periodic := answer.Text("periodic")
   if periodic == "none" { periodic = "" }
-  if periodic != "" {
+  if strings.IndexAny(periodic, " \t@") >= 0 {
+    periodic = " repeated at \"" + periodic + "\""
+  } else if periodic != "" {
     periodic = " repeated every " + strings.Replace(periodic, "_", " ",-1)
   }
   handler := ""
   siserver := answer.Text("siserver")
   if siserver != "localhost" && siserver != source {
-    siserver = strings.Split(siserver,":")[0]
+    if host, _, err := net.SplitHostPort(siserver); err == nil { siserver = host }
     handler = db.SystemNameForIPAddress(siserver)
     if handler == "none" { handler = siserver }
     handler = strings.Split(handler, ".")[0]
@@ -2217,11 +2429,44 @@ func  formatQueryJobdbAnswer(answer *xml.Hash, source string) []string {
   return []string{"==", fmt.Sprintf("%4v",status), fmt.Sprintf("%-9v",job), fmt.Sprintf("%v", TimestampRE.ReplaceAllString(answer.Text("timestamp"),"$3.$2 $4:$5:$6")), answer.Text("macaddress"), fmt.Sprintf("(%v)%v%v", answer.Text("plainname"),periodic,handler)}
 }
 
-const re_1xx = "(1([0-9]?[0-9]?))"
-const re_2xx = "(2([6-9]|([0-4][0-9]?)|(5[0-5]?))?)"
-const re_xx  = "([3-9][0-9]?)"
-const ip_part = "(0|"+re_1xx+"|"+re_2xx+"|"+re_xx+")"
-var ipRegexp = regexp.MustCompile("^"+ip_part+"([.]"+ip_part+"){3}$")
+func formatQueryAuditTrailAnswer(answer *xml.Hash) []string {
+  request := answer.Text("header")
+  if arg := answer.Text("argument"); arg != "" {
+    request += " \"" + arg + "\""
+  }
+  targets := strings.Join(answer.Get("target"), ",")
+  if targets == "" { targets = "-" }
+  outcome := answer.Text("outcome")
+  peer := answer.Text("peer")
+  subject := answer.Text("subject")
+  // An entry relayed by a sibridge. Show what it claims, marked as such.
+  if claimed := answer.First("claimed"); claimed != nil && outcome == "ok" {
+    request = claimed.Text("header")
+    if arg := claimed.Text("argument"); arg != "" {
+      request += " \"" + arg + "\""
+    }
+    outcome = claimed.Text("outcome")
+    peer = claimed.Text("peer") + " via " + peer
+    subject = claimed.Text("subject") + " via " + subject
+  }
+  return []string{"+", TimestampRE.ReplaceAllString(answer.Text("timestamp"),"$1-$2-$3 $4:$5:$6"), request, targets, outcome, peer, subject}
+}
+
+// 172.16.2.3  active 2/10  1h 17/60  refused 0  2013-10-16 12:00:00  BANNED until 2013-10-17 12:00:00 (...)
+func formatQueryConnectionLimitsAnswer(answer *xml.Hash) []string {
+  limit := func(n string) string { if n == "0" { return "-" }; return n }
+  last := "-"
+  if answer.Text("last") != "" {
+    last = TimestampRE.ReplaceAllString(answer.Text("last"),"$1-$2-$3 $4:$5:$6")
+  }
+  r := []string{answer.Text("ip"), "active "+answer.Text("active")+"/"+limit(answer.Text("connparallel")), "1h "+answer.Text("attempts")+"/"+limit(answer.Text("connperhour")), "refused "+answer.Text("refused"), last}
+  if answer.First("active") == nil { r = []string{answer.Text("ip"), "", "", "", last} }
+  if answer.First("banned") != nil {
+    r = append(r, "BANNED until "+TimestampRE.ReplaceAllString(answer.Text("banned"),"$1-$2-$3 $4:$5:$6")+" ("+answer.Text("reason")+")")
+  }
+  return r
+}
+
 var macAddressRegexp = regexp.MustCompile("^[0-9A-Fa-f]{2}(:[0-9A-Fa-f]{2}){5}$")
 
 func parseMachine(machine string, template *jobDescriptor) bool {
@@ -2236,7 +2481,7 @@ func parseMachine(machine string, template *jobDescriptor) bool {
     if name == "none" { return false }
     ip = db.SystemIPAddressForName(name)
     if ip == "none" { ip = "0.0.0.0" }
-  } else if ipRegexp.MatchString(machine) {
+  } else if net.ParseIP(machine) != nil {
     ip = machine
     name = db.SystemNameForIPAddress(ip)
     if name == "none" { return false }
@@ -2413,8 +2658,8 @@ func ReadArgs(args []string) {
       util.Log(0, "WARNING! ReadArgs: Ignoring empty command line argument")
     } else if arg[0] != '-' {
       TargetAddress = arg
-      if strings.Index(TargetAddress, ":") < 0 {
-        TargetAddress += ":20081"
+      if _, _, err := net.SplitHostPort(TargetAddress); err != nil {
+        TargetAddress = net.JoinHostPort(strings.Trim(TargetAddress, "[]"), "20081")
       }
     } else {
       util.Log(0, "ERROR! ReadArgs: Unknown command line switch: %v", arg)
@@ -2424,6 +2669,10 @@ func ReadArgs(args []string) {
 
 // unlike config.ReadConfig() this function reads /etc/gosa/gosa.conf
 func ReadConfig() {
+  // The settings are collected in r and published when we're done.
+  r := *config.Current()
+  defer config.Modify(func(c *config.Reloadable) { *c = r })
+  
   conf, _ := xml.FileToHash(config.ServerConfigPath)
   // Ignore parsing errors (such as "stray text outside tag").
   // The result is always valid even if it may be partial data.
@@ -2433,7 +2682,7 @@ func ReadConfig() {
     for tab := newdev.First("tab"); tab != nil; tab = tab.Next() {
       incoming := tab.Text("systemIncomingRDN")
       if incoming != "" {
-        config.IncomingOU = incoming
+        r.IncomingOU = incoming
       }
     }
   }
@@ -2451,13 +2700,16 @@ func ReadConfig() {
   locs := []string{}
   for loc := conf.First("location"); loc != nil; loc = loc.Next() {
     if x := loc.Text("caCertificate"); x != "" {
-      config.CACertPath = strings.Fields(x)
+      r.CACertPath = strings.Fields(x)
     }
     if x := loc.Text("certificate"); x != "" {
-      config.CertPath = x
+      r.CertPath = x
     }
     if x := loc.Text("keyfile"); x != "" {
-      config.CertKeyPath = x
+      r.CertKeyPath = x
+    }
+    if x := loc.Text("crl"); x != "" {
+      r.CRLPath = strings.Fields(x)
     }
     gosasi := strings.SplitN(loc.Text("gosaSupportURI"), "@", 2)
     key := ""
@@ -2465,7 +2717,7 @@ func ReadConfig() {
     locs = append(locs, server)
     if len(gosasi) > 1 { 
       key = gosasi[0]
-      config.ModuleKeys = append(config.ModuleKeys, key)
+      r.ModuleKeys = append(append([]string{}, r.ModuleKeys...), key)
     }
     server_resolved, err := util.Resolve(server, config.IP)
     if err != nil { server_resolved = server }
@@ -2476,7 +2728,11 @@ func ReadConfig() {
       found = true
       
       if key != "" {
-        config.ModuleKey["[GOsaPackages]"] = key
+        module_key := map[string]string{"[GOsaPackages]": key}
+        for name, k := range r.ModuleKey {
+          if name != "[GOsaPackages]" { module_key[name] = k }
+        }
+        r.ModuleKey = module_key
       }
       
       if ldap := loc.First("referral"); ldap != nil {
@@ -2502,11 +2758,11 @@ func ReadConfig() {
     util.Log(0, "ERROR! %v: No <location> section for %v (have: %v)", config.ServerConfigPath, TargetAddress, locs)
   }
 
-  if config.IncomingOU[len(config.IncomingOU)-1] == ',' {
-    config.IncomingOU += config.LDAPBase
+  if r.IncomingOU[len(r.IncomingOU)-1] == ',' {
+    r.IncomingOU += config.LDAPBase
   }
 
-  config.TLSRequired = len(config.ModuleKey) == 0
+  r.TLSRequired = len(r.ModuleKey) == 0
   
   config.FillInNetworkDetectionDefaults()
 }
@@ -0,0 +1,394 @@
+/*
+Copyright (c) 2026 go-susi contributors
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package main
+
+import (
+          "io/ioutil"
+          "os"
+          "fmt"
+          "time"
+          "reflect"
+          "strconv"
+          "strings"
+          "math/big"
+          "crypto"
+          "crypto/rand"
+          "crypto/ecdsa"
+          "crypto/elliptic"
+          "crypto/x509"
+          "encoding/pem"
+
+          "../config"
+          "../security"
+       )
+
+const VERSION_MESSAGE = `sicert %v (revision %v)
+Copyright (c) 2016 Landeshauptstadt München
+Author: Matthias S. Benkmann
+This is free software; see the source for copying conditions.  There is NO
+warranty; not even for MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.
+
+`
+
+const USAGE_MESSAGE = `USAGE: sicert ca <ca> [<subject> [<days>]]
+       sicert issue <ca> <spec> <name>
+       sicert renew <ca> <name> [<days>]
+       sicert show <file>...
+
+Creates and inspects certificates with the GOsa extensions.
+Certificates are stored in <name>.cert, keys in <name>.key (PEM).
+
+ca      creates a self-signed CA <ca>.cert with a new key <ca>.key.
+        Default <subject> is "CN=GOsa CA", default <days> is 3650.
+issue   issues <name>.cert signed by <ca> as described by the file <spec>.
+        If <name>.key does not exist, a new key is created.
+        Run "sicert --help" for the format of <spec>.
+renew   re-issues <name>.cert with the same key, subject and extensions
+        but a new serial number and validity period. If <days> is not
+        given, the new certificate is valid as long as the old one was.
+        If <name> is <ca>, the CA certificate is renewed. The old
+        certificate is kept as <name>.cert.old.
+show    prints the certificates in <file>s and the access rights
+        go-susi derives from them.
+
+--help       print this text and the spec format and exit
+--version    print version and exit
+`
+
+const HELP_MESSAGE = `Spec format:
+  [certificate]
+  subject = CN=gosa.example.com,O=Example     (CN, O, OU, L, ST, C)
+  type = peer                     server, client or peer (=both)
+  days = 365
+
+  [subjectAltName]
+  ip = 10.1.0.0                   trailing 0 bytes are wildcards
+  name = *.example.com
+  special = myserver              myserver, configfile, srvrecord, mypeer
+
+  [limits]                        GosaConnectionLimits
+  totalTime = 10m                 a duration
+  totalBytes = 1000000            also: messageBytes, connPerHour,
+                                  connParallel, maxLogFiles, maxAnswers
+  communicateWith = *.example.com:20081
+
+  [access]                        GosaAccessControl
+  misc = wake                     debug wake peer
+  query = queryJobs queryAudit    queryAll queryJobs queryAudit queryLogs
+                                  queryPackages queryStats queryFAI
+  jobs = wake lock unlock         jobsAll lock unlock shutdown wake abort
+                                  install update modifyJobs newSys userMsg
+                                  audit
+  incoming = ldap://ldap.example.com/ou=incoming,o=example
+  ldapUpdate = cn ip              cn ip mac dh
+  detectedHw = template           unprompted template dn cn ipHostNumber
+                                  macAddress
+
+  [scope]                         GosaTargetScope
+  dnSuffix = ou=school1,o=example
+  unitTag = school1
+  objectGroup = kiosk
+
+  Lines starting with "#" are comments. Keys that take lists (ip, name,
+  special, communicateWith, incoming and all keys in [scope]) may be
+  repeated to add more values. Missing sections and keys are omitted
+  from the certificate, so that go-susi's defaults apply.
+`
+
+func main() {
+  if len(os.Args) < 2 {
+    config.PrintVersion = true
+    config.PrintHelp = true
+  }
+
+  for _, arg := range os.Args[1:] {
+    if arg == "--help" { config.PrintHelp = true }
+    if arg == "--version" { config.PrintVersion = true }
+  }
+
+  if config.PrintVersion {
+    fmt.Printf(VERSION_MESSAGE, config.Version, config.Revision)
+  }
+
+  if config.PrintHelp {
+    fmt.Print(USAGE_MESSAGE)
+    if len(os.Args) >= 2 { fmt.Print("\n"+HELP_MESSAGE) }
+  }
+
+  if config.PrintVersion || config.PrintHelp { os.Exit(0) }
+
+  args := os.Args[2:]
+  var err error
+  switch os.Args[1] {
+    case "ca":    if len(args) < 1 || len(args) > 3 { usage() }
+                  subject := "CN=GOsa CA"
+                  if len(args) > 1 { subject = args[1] }
+                  days := "3650"
+                  if len(args) > 2 { days = args[2] }
+                  err = createCA(args[0], subject, days)
+    case "issue": if len(args) != 3 { usage() }
+                  err = issue(args[0], args[1], args[2])
+    case "renew": if len(args) < 2 || len(args) > 3 { usage() }
+                  days := ""
+                  if len(args) > 2 { days = args[2] }
+                  err = renew(args[0], args[1], days)
+    case "show":  if len(args) < 1 { usage() }
+                  for _, file := range args {
+                    if e := show(file); e != nil { err = e }
+                  }
+    default:      usage()
+  }
+
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "ERROR! %v\n", err)
+    os.Exit(1)
+  }
+}
+
+func usage() {
+  fmt.Fprint(os.Stderr, USAGE_MESSAGE)
+  os.Exit(1)
+}
+
+// Creates the self-signed CA certificate ca.cert and its key ca.key.
+func createCA(ca, subject, days string) error {
+  d, err := strconv.Atoi(days)
+  if err != nil || d <= 0 {
+    return fmt.Errorf("<days> must be a positive number, not \"%v\"", days)
+  }
+  name, err := security.ParseSubject(subject)
+  if err != nil { return err }
+
+  if _, err := os.Stat(ca+".cert"); err == nil {
+    return fmt.Errorf("%v.cert already exists. Use \"renew\" to replace it", ca)
+  }
+
+  key, err := keyFor(ca+".key")
+  if err != nil { return err }
+
+  template := &x509.Certificate{Subject:name, IsCA:true, BasicConstraintsValid:true, MaxPathLenZero:true,
+                                KeyUsage:x509.KeyUsageCertSign|x509.KeyUsageCRLSign}
+  template.NotBefore = time.Now().Add(-5*time.Minute)
+  template.NotAfter = template.NotBefore.AddDate(0, 0, d)
+  return createCertificate(ca+".cert", template, template, key, key)
+}
+
+// Issues name.cert signed by ca as described by the file spec.
+func issue(ca, spec, name string) error {
+  data, err := ioutil.ReadFile(spec)
+  if err != nil { return err }
+  template, err := security.CertificateTemplate(data)
+  if err != nil { return fmt.Errorf("%v: %v", spec, err) }
+
+  if _, err := os.Stat(name+".cert"); err == nil {
+    return fmt.Errorf("%v.cert already exists. Use \"renew\" to replace it", name)
+  }
+
+  cacert, cakey, err := readCA(ca)
+  if err != nil { return err }
+
+  key, err := keyFor(name+".key")
+  if err != nil { return err }
+
+  return createCertificate(name+".cert", template, cacert, key, cakey)
+}
+
+// Re-issues name.cert with the same key, subject and extensions.
+func renew(ca, name, days string) error {
+  old, err := readCertificate(name+".cert")
+  if err != nil { return err }
+  key, err := readKey(name+".key")
+  if err != nil { return err }
+
+  d := int(old.NotAfter.Sub(old.NotBefore) / (24*time.Hour))
+  if days != "" {
+    d, err = strconv.Atoi(days)
+    if err != nil || d <= 0 {
+      return fmt.Errorf("<days> must be a positive number, not \"%v\"", days)
+    }
+  }
+
+  template := &x509.Certificate{Subject:old.Subject, KeyUsage:old.KeyUsage,
+                                ExtKeyUsage:old.ExtKeyUsage, UnknownExtKeyUsage:old.UnknownExtKeyUsage,
+                                BasicConstraintsValid:old.BasicConstraintsValid, IsCA:old.IsCA,
+                                MaxPathLen:old.MaxPathLen, MaxPathLenZero:old.MaxPathLenZero}
+  template.NotBefore = time.Now().Add(-5*time.Minute)
+  template.NotAfter = template.NotBefore.AddDate(0, 0, d)
+  // x509.CreateCertificate() can't produce subjectAltName with registeredID
+  // or the GOsa extensions from the parsed fields, so copy them verbatim.
+  for _, ext := range old.Extensions {
+    if security.IsGosaExtension(ext.Id) {
+      template.ExtraExtensions = append(template.ExtraExtensions, ext)
+    }
+  }
+
+  var cacert *x509.Certificate
+  var cakey crypto.Signer
+  if ca == name {
+    cacert, cakey = template, key
+  } else {
+    cacert, cakey, err = readCA(ca)
+    if err != nil { return err }
+  }
+
+  err = os.Rename(name+".cert", name+".cert.old")
+  if err != nil { return err }
+  err = createCertificate(name+".cert", template, cacert, key, cakey)
+  if err != nil {
+    os.Rename(name+".cert.old", name+".cert")
+  }
+  return err
+}
+
+// Prints all certificates from file.
+func show(file string) error {
+  data, err := ioutil.ReadFile(file)
+  if err != nil { return err }
+  found := false
+  for {
+    var blk *pem.Block
+    blk, data = pem.Decode(data)
+    if blk == nil { break }
+    if blk.Type != "CERTIFICATE" { continue }
+    found = true
+    cert, err := x509.ParseCertificate(blk.Bytes)
+    if err != nil { return fmt.Errorf("%v: %v", file, err) }
+    fmt.Printf("==== %v ====\n", file)
+    fmt.Print(security.CertificateInfo(cert))
+    if cert.IsCA { continue }
+    context, err := security.CertificateContext(cert)
+    if err != nil {
+      fmt.Printf("REJECTED: %v\n", err)
+    } else {
+      fmt.Print(contextInfo(context))
+    }
+  }
+  if !found { return fmt.Errorf("%v: No certificate found", file) }
+  return nil
+}
+
+// Returns the identities, limits, access rights and scope from context
+// in human-readable form, one per line.
+func contextInfo(context *security.Context) string {
+  s := []string{}
+  s = append(s, fmt.Sprintf("Fingerprint: %v\n", context.Fingerprint))
+  s = append(s, fmt.Sprintf("AllowedIPs: %v\nAllowedNames: %v\n", context.PeerID.AllowedIPs, context.PeerID.AllowedNames))
+  limits := reflect.ValueOf(context.Limits)
+  for i := 0; i < limits.NumField(); i++ {
+    s = append(s, fmt.Sprintf("Limits.%v: %v\n", limits.Type().Field(i).Name, limits.Field(i).Interface()))
+  }
+  access := reflect.ValueOf(context.Access)
+  for i := 0; i < access.NumField(); i++ {
+    field := access.Field(i)
+    values := []string{}
+    if field.Kind() == reflect.Struct {
+      for k := 0; k < field.NumField(); k++ {
+        if field.Field(k).Bool() { values = append(values, field.Type().Field(k).Name) }
+      }
+    } else {
+      values = field.Interface().(security.GosaAccessLDAPIncoming)
+    }
+    s = append(s, fmt.Sprintf("Access.%v: %v\n", access.Type().Field(i).Name, strings.Join(values, " ")))
+  }
+  if context.Scope.Unrestricted() {
+    s = append(s, "Scope: unrestricted\n")
+  } else {
+    s = append(s, fmt.Sprintf("Scope.DNSuffix: %v\nScope.UnitTag: %v\nScope.ObjectGroup: %v\n", context.Scope.DNSuffix, context.Scope.UnitTag, context.Scope.ObjectGroup))
+  }
+  return strings.Join(s, "")
+}
+
+// Signs template with parentkey and writes the result to path after checking
+// that go-susi accepts its extensions.
+func createCertificate(path string, template, parent *x509.Certificate, key, parentkey crypto.Signer) error {
+  serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+  if err != nil { return err }
+  template.SerialNumber = serial
+
+  der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentkey)
+  if err != nil { return err }
+  cert, err := x509.ParseCertificate(der)
+  if err != nil { return err }
+  if !cert.IsCA {
+    if _, err = security.CertificateContext(cert); err != nil { return err }
+  }
+
+  err = writePEM(path, "CERTIFICATE", der, 0644)
+  if err != nil { return err }
+  fmt.Printf("Created %v\n", path)
+  return nil
+}
+
+// Reads ca.cert and ca.key.
+func readCA(ca string) (*x509.Certificate, crypto.Signer, error) {
+  cacert, err := readCertificate(ca+".cert")
+  if err != nil { return nil, nil, err }
+  if !cacert.IsCA { return nil, nil, fmt.Errorf("%v.cert is not a CA certificate", ca) }
+  cakey, err := readKey(ca+".key")
+  if err != nil { return nil, nil, err }
+  return cacert, cakey, nil
+}
+
+func readCertificate(path string) (*x509.Certificate, error) {
+  data, err := ioutil.ReadFile(path)
+  if err != nil { return nil, err }
+  blk, _ := pem.Decode(data)
+  if blk == nil || blk.Type != "CERTIFICATE" { return nil, fmt.Errorf("%v: No certificate found", path) }
+  return x509.ParseCertificate(blk.Bytes)
+}
+
+// Reads the private key from path. EC, PKCS#1 and PKCS#8 keys are supported.
+func readKey(path string) (crypto.Signer, error) {
+  data, err := ioutil.ReadFile(path)
+  if err != nil { return nil, err }
+  blk, _ := pem.Decode(data)
+  if blk == nil { return nil, fmt.Errorf("%v: No PEM data found", path) }
+  if key, err := x509.ParseECPrivateKey(blk.Bytes); err == nil { return key, nil }
+  if key, err := x509.ParsePKCS1PrivateKey(blk.Bytes); err == nil { return key, nil }
+  key, err := x509.ParsePKCS8PrivateKey(blk.Bytes)
+  if err != nil { return nil, fmt.Errorf("%v: %v", path, err) }
+  if signer, ok := key.(crypto.Signer); ok { return signer, nil }
+  return nil, fmt.Errorf("%v: Unsupported key type", path)
+}
+
+// Reads the private key from path or, if path does not exist, creates
+// a new ECDSA P-256 key and stores it at path.
+func keyFor(path string) (crypto.Signer, error) {
+  if _, err := os.Stat(path); err == nil {
+    return readKey(path)
+  }
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil { return nil, err }
+  der, err := x509.MarshalECPrivateKey(key)
+  if err != nil { return nil, err }
+  err = writePEM(path, "EC PRIVATE KEY", der, 0600)
+  if err != nil { return nil, err }
+  fmt.Printf("Created %v\n", path)
+  return key, nil
+}
+
+// Writes der as PEM block of type typ to path, which must not exist.
+func writePEM(path, typ string, der []byte, perm os.FileMode) error {
+  file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+  if err != nil { return err }
+  err = pem.Encode(file, &pem.Block{Type:typ, Bytes:der})
+  err2 := file.Close()
+  if err == nil { err = err2 }
+  if err != nil {
+    os.Remove(path)
+    return fmt.Errorf("%v: %v", path, err)
+  }
+  return nil
+}
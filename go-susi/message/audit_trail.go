@@ -0,0 +1,115 @@
+/*
+Copyright (c) 2026 go-susi contributors
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package message
+
+import (
+         "strings"
+
+         "../db"
+         "../xml"
+         "../security"
+       )
+
+// Returns true if messages with the given header change the state of
+// jobs or systems and therefore need to be recorded in the audit trail.
+func isAuditedMessage(header string) bool {
+  return strings.HasPrefix(header, "job_trigger_") ||
+         strings.HasPrefix(header, "gosa_trigger_") ||
+         header == "job_set_activated_for_installation" ||
+         header == "gosa_set_activated_for_installation" ||
+         header == "gosa_add_audit_trail_entry" ||
+         header == "gosa_delete_jobdb_entry" ||
+         header == "gosa_update_status_jobdb_entry" ||
+         header == "gosa_lift_ban" ||
+         header == "gosa_approve_peer_certificate" ||
+         header == "detected_hardware"
+}
+
+// What ProcessXMLMessage() found out about the processing of a message
+// that auditTrail() needs to determine the outcome.
+type auditInfo struct {
+  allowed bool     // false if handleServerMessage() has rejected the message
+  result *xml.Hash // value returned by the handler (nil if it returns none)
+}
+
+// Records the message xmlmsg received via context in the audit trail.
+func auditTrail(xmlmsg *xml.Hash, context *security.Context, audit *auditInfo) {
+  header := xmlmsg.Text("header")
+  entry := db.NewAuditTrailEntry(context.PeerID.IP, context.Subject, header)
+
+  targets := map[string]bool{}
+  auditTrailTargets(xmlmsg, targets, entry)
+  if where := xmlmsg.First("where"); where != nil {
+    entry.AddClone(where)
+  }
+  if header == "gosa_lift_ban" {
+    entry.Add("argument", xmlmsg.Text("ip"))
+  }
+  if header == "gosa_approve_peer_certificate" {
+    entry.Add("argument", xmlmsg.Text("peer"))
+  }
+  if header == "gosa_add_audit_trail_entry" {
+    auditTrailClaimed(xmlmsg.First("entry"), targets, entry)
+  }
+
+  outcome := "ok"
+  if !audit.allowed {
+    outcome = "denied"
+  } else if audit.result != nil && audit.result.First("error_string") != nil {
+    outcome = "error: " + audit.result.Text("error_string")
+  }
+  entry.Add("outcome", outcome)
+
+  db.AuditTrailAdd(entry)
+}
+
+// Adds the entry relayed with gosa_add_audit_trail_entry (claimed, may be
+// nil) to entry as <claimed>. Nothing in it is verified, so it is kept apart
+// from the elements the server determines itself. Only the claimed header
+// is copied as <argument> and the claimed <target>s are copied as <target>
+// so that queries by machine find the entry.
+func auditTrailClaimed(claimed *xml.Hash, targets map[string]bool, entry *xml.Hash) {
+  if claimed == nil { return }
+  claimed = claimed.Clone()
+  claimed.Rename("claimed")
+  entry.Add("argument", claimed.Text("header"))
+  for _, mac := range claimed.Get("target") {
+    mac = strings.ToLower(mac)
+    if mac != "" && !targets[mac] {
+      targets[mac] = true
+      entry.Add("target", mac)
+    }
+  }
+  entry.AddWithOwnership(claimed)
+}
+
+// Adds a <target> element to entry for every distinct <macaddress> found
+// anywhere within x. This covers the <macaddress> of job_trigger_* messages
+// as well as those in <detected_hardware> and in <where> clauses.
+func auditTrailTargets(x *xml.Hash, targets map[string]bool, entry *xml.Hash) {
+  for _, tag := range x.Subtags() {
+    for child := x.First(tag); child != nil; child = child.Next() {
+      if tag == "macaddress" {
+        mac := strings.ToLower(child.Text())
+        if mac != "" && !targets[mac] {
+          targets[mac] = true
+          entry.Add("target", mac)
+        }
+      } else {
+        auditTrailTargets(child, targets, entry)
+      }
+    }
+  }
+}
@@ -120,8 +120,8 @@ func (conn *ClientConnection) Tell(text string, ttl time.Duration) {
           // If sending to myself (e.g. new_ldap_config), fake a client object
           client = xml.NewHash("xml","source",config.ServerSourceAddress)
           key := "" // default to empty key which signals TLS
-          if config.TLSClientConfig == nil {
-            key = config.ModuleKey["[ClientPackages]"]
+          if config.TLSClientConfig() == nil {
+            key = config.ModuleKey()["[ClientPackages]"]
           }
           client.Add("key", key)
         } else {
@@ -161,7 +161,11 @@ func (conn *ClientConnection) Tell(text string, ttl time.Duration) {
             continue
           }
         } else { // non-TLS client
-          encrypted = security.GosaEncrypt(msg.Text, keys[0])
+          if security.SupportsSealing(client) {
+            encrypted = security.GosaSeal(security.Stamp(msg.Text), keys[0])
+          } else {
+            encrypted = security.GosaEncrypt(security.Stamp(msg.Text), keys[0])
+          }
           
           tcpConn, err = net.Dial("tcp", conn.addr)
           if err != nil {
@@ -183,7 +187,7 @@ func (conn *ClientConnection) Tell(text string, ttl time.Duration) {
         }
 
         util.Log(2, "DEBUG! Sending message to %v encrypted with key %v", conn.addr, keys[0])
-        err = util.SendLn(tcpConn, encrypted, config.Timeout) 
+        err = util.SendLn(tcpConn, encrypted, config.Timeout()) 
         tcpConn.Close()
         if err == nil { 
           util.Log(2, "DEBUG! Successfully sent message to %v: %v", conn.addr, msg.Text)
@@ -53,7 +53,7 @@ func clmsg_progress(xmlmsg *xml.Hash) {
   db.JobsModifyLocal(filter, xml.NewHash("job","progress",progress))
   if progress == "100" {
     util.Log(1, "INFO! Progress 100%% => Setting status \"done\" for client %v with MAC %v",xmlmsg.Text("source"), macaddress)
-    db.JobsModifyLocal(all_processing_jobs_for_mac, xml.NewHash("job","status","done"))
+    db.JobsCompleteLocal(all_processing_jobs_for_mac, false)
     // Setting faistate => "localboot" is done in action/process_act.go in reaction
     // to the removal of the job.
   }
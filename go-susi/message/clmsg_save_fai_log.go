@@ -20,6 +20,7 @@ MA  02110-1301, USA.
 package message
 
 import (
+         "io"
          "io/ioutil"
          "bufio"
          "os"
@@ -98,7 +99,7 @@ func clmsg_save_fai_log(buf *bytes.Buffer, context *security.Context) {
   
   timestamp := util.MakeTimestamp(time.Now())
   logname := action+"_"+timestamp[0:8]+"_"+timestamp[8:]
-  logdir := path.Join(config.FAILogPath, strings.ToLower(macaddress), logname)
+  logdir := path.Join(config.FAILogPath(), strings.ToLower(macaddress), logname)
   
   // NOTE: 1kB = 1000B, 1kiB = 1024B
   util.Log(1, "INFO! Storing %vkB of %v log files from %v in %v",len(data)/1000, action, macaddress, logdir)
@@ -112,7 +113,7 @@ func clmsg_save_fai_log(buf *bytes.Buffer, context *security.Context) {
   // Create convenience symlink with the system's name as alias for MAC address.
   go util.WithPanicHandler(func() {
     if plainname := db.SystemPlainnameForMAC(macaddress); plainname != "none" {
-      linkpath := path.Join(config.FAILogPath, strings.ToLower(plainname))
+      linkpath := path.Join(config.FAILogPath(), strings.ToLower(plainname))
       link_target, err := os.Readlink(linkpath)
       if err != nil && !os.IsNotExist(err.(*os.PathError).Err) {
         util.Log(0, "ERROR! %v exists but is not a symlink: %v", linkpath, err)
@@ -178,17 +179,18 @@ func clmsg_save_fai_log(buf *bytes.Buffer, context *security.Context) {
   }
 }
 
-// Executes program and reads from its standard output log files to transfer to
-// the target server. See fai-savelog-hook in the manual.
-// hookname is the name of the hook for use in log messages.
+// Executes program via db.HookRun() and reads from its standard output log
+// files to transfer to the target server. See fai-savelog-hook in the manual.
+// hookname is the name of the hook's configuration option (e.g.
+// "fai-savelog-hook"), which determines its timeout.
 func Send_clmsg_save_fai_log(target string, program string, hookname string) {
   var buffy bytes.Buffer
   defer buffy.Reset()
   
-  clientpackageskey := config.ModuleKey["[ClientPackages]"]
+  clientpackageskey := config.ModuleKey()["[ClientPackages]"]
   // If [ClientPackages]/key missing, take the last key in the list
   // (We don't take the 1st because that would be "dummy-key").
-  if clientpackageskey == "" { clientpackageskey = config.ModuleKeys[len(config.ModuleKeys)-1] }
+  if clientpackageskey == "" { clientpackageskey = config.ModuleKeys()[len(config.ModuleKeys())-1] }
   
   util.Log(1, "INFO! Launching %v %v", hookname, program)
   start := time.Now()
@@ -196,12 +198,11 @@ func Send_clmsg_save_fai_log(target string, program string, hookname string) {
   cmd := exec.Command(program)
   cmd.Env = append(env, os.Environ()...)
 
-  out, err := cmd.StdoutPipe()
-  if err != nil {
-    util.Log(0, "ERROR! Could not get stdout pipe for %v: %v", program, err)
-    return
-  }
+  // db.HookRun() does not return before the hook has finished, so the
+  // hook's stdout is read through a pipe that is closed when it has.
+  out, hookout := io.Pipe()
   defer out.Close()
+  cmd.Stdout = hookout
   
   in, err := cmd.StdinPipe()
   if err != nil {
@@ -210,11 +211,12 @@ func Send_clmsg_save_fai_log(target string, program string, hookname string) {
   }
   defer in.Close()
 
-  err = cmd.Start()
-  if err != nil {
-    util.Log(0, "ERROR! Could not launch %v: %v", program, err)
-    return
-  }
+  go func() {
+    if err := db.HookRun(hookname, cmd); err != nil {
+      util.Log(0, "ERROR! %v %v: %v", hookname, program, err)
+    }
+    hookout.Close()
+  }()
   
   buffy.WriteString("<xml><header>CLMSG_save_fai_log</header><source>")
   buffy.WriteString(config.ServerSourceAddress)
@@ -21,6 +21,7 @@ import (
          "os/exec"
          "strings"
          
+         "../db"
          "../xml"
          "github.com/mbenkmann/golib/util"
          "../config"
@@ -49,13 +50,13 @@ func detect_hardware(xmlmsg *xml.Hash) {
   for _, tag := range xmlmsg.Subtags() {
     env = append(env, tag+"="+strings.Join(xmlmsg.Get(tag),"\n"))
   }
-  cmd := exec.Command(config.DetectHardwareHookPath)
+  cmd := exec.Command(config.DetectHardwareHookPath())
   env = append(env, "xml="+xmlmsg.String())
   cmd.Env = append(env, os.Environ()...)
-  util.Log(1, "INFO! Running detect-hardware-hook %v with parameters %v", config.DetectHardwareHookPath, env)
-  hwlist, err := xml.LdifToHash("detected_hardware", false, cmd) // !!C'n'P WARNING: casefold=false!!
+  util.Log(1, "INFO! Running detect-hardware-hook %v with parameters %v", config.DetectHardwareHookPath(), env)
+  hwlist, err := db.HookLdif("detect-hardware-hook", cmd, "detected_hardware", false) // !!C'n'P WARNING: casefold=false!!
   if err != nil {
-    util.Log(0, "ERROR! detect-hardware-hook %v: %v", config.DetectHardwareHookPath, err)
+    util.Log(0, "ERROR! detect-hardware-hook %v: %v", config.DetectHardwareHookPath(), err)
     return
   }
   util.Log(1, "INFO! Finished detect-hardware-hook. Running time: %v", time.Since(start))
@@ -74,10 +75,10 @@ func sendDetectedHardwareReply(target string, c <-chan *xml.Hash) {
   hwlist.Add("header", "detected_hardware")
   hwlist.Add("source", config.ServerSourceAddress)
   hwlist.Add("target", target)
-  clientpackageskey := config.ModuleKey["[ClientPackages]"]
+  clientpackageskey := config.ModuleKey()["[ClientPackages]"]
   // If [ClientPackages]/key missing, take the last key in the list
   // (We don't take the 1st because that would be "dummy-key").
-  if clientpackageskey == "" { clientpackageskey = config.ModuleKeys[len(config.ModuleKeys)-1] }
+  if clientpackageskey == "" { clientpackageskey = config.ModuleKeys()[len(config.ModuleKeys())-1] }
   util.Log(1, "INFO! Sending detected_hardware to %v: %v", target, hwlist)
   security.SendLnTo(target, hwlist.String(), clientpackageskey, false)
 }
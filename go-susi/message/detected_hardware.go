@@ -21,6 +21,7 @@ MA  02110-1301, USA.
 package message
 
 import (
+         "net"
          "strings"
          
          "../db"
@@ -58,7 +59,7 @@ func detected_hardware(xmlmsg *xml.Hash) {
   // if <detected_hardware> does not have ipHostNumber, extract it from <source>
   ip := detected.Text("iphostnumber")
   if ip == "" {
-    ip = strings.SplitN(xmlmsg.Text("source"),":",2)[0]
+    ip, _, _ = net.SplitHostPort(xmlmsg.Text("source"))
     if ip != "" {
       detected.FirstOrAdd("iphostnumber").SetText(ip)
     }
@@ -142,8 +143,8 @@ func detected_hardware(xmlmsg *xml.Hash) {
     system.Add("faistate", "install")
   }
   if system.First("dn") == nil {
-    util.Log(1, "INFO! New system object will be created in %v", config.IncomingOU)
-    system.Add("dn","cn=%v,%v", system.Text("cn"), config.IncomingOU)
+    util.Log(1, "INFO! New system object will be created in %v", config.IncomingOU())
+    system.Add("dn","cn=%v,%v", system.Text("cn"), config.IncomingOU())
   }
   // I don't know what gotoSysStatus is good for. Let's see if things work
   // without it. If something breaks, activate these lines again and add a
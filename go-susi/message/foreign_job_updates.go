@@ -20,8 +20,9 @@ MA  02110-1301, USA.
 package message
 
 import (
-         "regexp"
+         "net"
          "strings"
+         "strconv"
          
          "../db"
          "../xml"
@@ -29,12 +30,14 @@ import (
          "../config"
        )
 
-const re_1xx = "(1([0-9]?[0-9]?))"
-const re_2xx = "(2([6-9]|([0-4][0-9]?)|(5[0-5]?))?)"
-const re_xx  = "([3-9][0-9]?)"
-const re_port = "(0|([1-6][0-9]{0,4})|([7-9][0-9]{0,3}))"
-const ip_part = "(0|"+re_1xx+"|"+re_2xx+"|"+re_xx+")"
-var addressRegexp = regexp.MustCompile("^"+ip_part+"([.]"+ip_part+"){3}:"+re_port+"$")
+// Returns true if addr is in IP:PORT format (with the IP in brackets if
+// it is an IPv6 address).
+func isIPPort(addr string) bool {
+  host, port, err := net.SplitHostPort(addr)
+  if err != nil || net.ParseIP(host) == nil { return false }
+  _, err = strconv.ParseUint(port, 10, 16)
+  return err == nil
+}
 
 // Handles the message "foreign_job_updates".
 //  xmlmsg: the decrypted and parsed message.
@@ -42,7 +45,7 @@ func foreign_job_updates(xmlmsg *xml.Hash) {
   source := xmlmsg.Text("source")
   sync   := xmlmsg.Text("sync")
   
-  if !addressRegexp.MatchString(source) {
+  if !isIPPort(source) {
     // We could try name lookup here, but non-numeric <source> fields
     // don't occur in the wild. So we just bail out with a message.
     util.Log(0, "ERROR! <source>%v</source> is not in IP:PORT format", source)
@@ -89,7 +92,7 @@ func foreign_job_updates(xmlmsg *xml.Hash) {
         xmlmess.SetText(strings.Join(strings.Fields(xmlmess.Text()),""))
       }
       
-      if !addressRegexp.MatchString(siserver) {
+      if !isIPPort(siserver) {
         // We could try name lookup here, but non-numeric <siserver> fields
         // don't occur in the wild. So we just bail out with a message.
         util.Log(0, "ERROR! <siserver>%v</siserver> is not in IP:PORT format", siserver)
@@ -150,7 +153,7 @@ func foreign_job_updates(xmlmsg *xml.Hash) {
           install_or_update := xml.FilterOr([]xml.HashFilter{xml.FilterSimple("headertag", "trigger_action_reinstall"),xml.FilterSimple("headertag", "trigger_action_update")})
           local_processing_install_or_update := xml.FilterAnd([]xml.HashFilter{local_processing, install_or_update})
           db.JobsModifyLocal(local_processing_install_or_update, xml.NewHash("job","progress","forward")) // to prevent faistate => localboot
-          db.JobsRemoveLocal(local_processing_install_or_update, true)
+          db.JobsCompleteLocal(local_processing_install_or_update, true)
         }
         
         // Because the job belongs to the sender, the <id> field corresponds to
@@ -0,0 +1,46 @@
+/*
+Copyright (c) 2026 go-susi contributors
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package message
+
+import (
+         "../db"
+         "../xml"
+         "github.com/mbenkmann/golib/util"
+         "../config"
+       )
+
+// Handles the message "gosa_approve_peer_certificate", which pins the
+// certificate last rejected for the peer server given in <peer> (IP:PORT),
+// see db.ServerCertificateApprove().
+//  xmlmsg: the decrypted and parsed message
+// Returns:
+//  unencrypted reply
+func gosa_approve_peer_certificate(xmlmsg *xml.Hash) *xml.Hash {
+  server, err := util.Resolve(xmlmsg.Text("peer"), config.IP)
+  if err == nil {
+    err = db.ServerCertificateApprove(server)
+  }
+  if err != nil {
+    util.Log(0, "ERROR! gosa_approve_peer_certificate: %v", err)
+    return ErrorReplyXML(err)
+  }
+  
+  answer := xml.NewHash("xml", "header", "answer")
+  answer.Add("source", config.ServerSourceAddress)
+  answer.Add("target", xmlmsg.Text("source"))
+  answer.Add("answer1", "0")
+  answer.Add("session_id", "1")
+  return answer
+}
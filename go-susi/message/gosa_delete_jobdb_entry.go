@@ -25,13 +25,15 @@ import (
          "../xml"
          "github.com/mbenkmann/golib/util"
          "../config"
+         "../security"
        )
 
 // Handles the message "gosa_delete_jobdb_entry".
 //  xmlmsg: the decrypted and parsed message
+//  context: the security context
 // Returns:
 //  unencrypted reply
-func gosa_delete_jobdb_entry(xmlmsg *xml.Hash) *xml.Hash {
+func gosa_delete_jobdb_entry(xmlmsg *xml.Hash, context *security.Context) *xml.Hash {
   where := xmlmsg.First("where")
   if where == nil { where = xml.NewHash("where") }
   filter, err := xml.WhereFilter(where)
@@ -40,7 +42,7 @@ func gosa_delete_jobdb_entry(xmlmsg *xml.Hash) *xml.Hash {
     return ErrorReplyXML(err)
   }
   
-  db.JobsRemove(filter)
+  db.JobsRemove(scopeFilter(filter, context, scopeCache{}, true))
   
   answer := xml.NewHash("xml", "header", "answer")
   answer.Add("source", config.ServerSourceAddress)
@@ -77,7 +77,7 @@ func gosa_get_log_file_by_date_and_mac(xmlmsg *xml.Hash) *xml.Hash {
     return ErrorReplyXML(emsg)
   }
   
-  f, err := os.Open(path.Join(config.FAILogPath, lmac, subdir, log_file)) 
+  f, err := os.Open(path.Join(config.FAILogPath(), lmac, subdir, log_file)) 
   if err != nil {
     emsg := fmt.Sprintf("gosa_get_log_file_by_date_and_mac: %v", err)
     util.Log(0, "ERROR! %v", emsg)
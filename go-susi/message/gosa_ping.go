@@ -70,7 +70,7 @@ func GosaPing(macaddress string) bool {
     // For this reason, see further below...
     go func() {
       for _, port := range config.ClientPorts {
-        conn, err := net.Dial("tcp", target+":"+port)
+        conn, err := net.Dial("tcp", net.JoinHostPort(target, port))
         if err == nil {
           conn.Close()
           reachable <- true
@@ -84,7 +84,7 @@ func GosaPing(macaddress string) bool {
     // at least one port is reachable.
     for _, port := range config.ClientPorts {
       go func(p string) {
-        conn, err := net.Dial("tcp", target+":"+p)
+        conn, err := net.Dial("tcp", net.JoinHostPort(target, p))
         if err == nil {
           conn.Close()
           reachable <- true
@@ -119,7 +119,7 @@ func gosa_query_audit(xmlmsg *xml.Hash, context *security.Context) *xml.Hash {
     }
   }
   
-  nonmatch, noaudit, unknown := db.AuditScanSubdirs(config.FAILogPath, timestamp1, timestamp2, fname, optimize_mac, optimize_contains,f, props, includeothers)
+  nonmatch, noaudit, unknown := db.AuditScanSubdirs(config.FAILogPath(), timestamp1, timestamp2, fname, optimize_mac, optimize_contains,f, props, includeothers)
   
   for _, nm2 := range nonmatch2 {
     if !match2[nm2.MAC] {
@@ -193,7 +193,7 @@ func gosa_query_audit_aggregate(xmlmsg *xml.Hash, context *security.Context) *xm
     }
   }
   
-  _, noaudit, unknown := db.AuditScanSubdirs(config.FAILogPath, timestamp1, timestamp2, fname, optimize_mac, optimize_contains,f, props, includeothers)
+  _, noaudit, unknown := db.AuditScanSubdirs(config.FAILogPath(), timestamp1, timestamp2, fname, optimize_mac, optimize_contains,f, props, includeothers)
   
   audit.Add("known", strconv.Itoa(len(known)))
   audit.Add("unknown", strconv.Itoa(unknown))
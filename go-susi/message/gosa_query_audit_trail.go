@@ -0,0 +1,84 @@
+/*
+Copyright (c) 2026 go-susi contributors
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package message
+
+import (
+         "strconv"
+
+         "../db"
+         "../xml"
+         "github.com/mbenkmann/golib/util"
+         "../config"
+         "../security"
+       )
+
+// Handles the message "gosa_query_audit_trail".
+//  xmlmsg: the decrypted and parsed message
+//  context: the security context
+// Returns:
+//  unencrypted reply
+func gosa_query_audit_trail(xmlmsg *xml.Hash, context *security.Context) *xml.Hash {
+  where := xmlmsg.First("where")
+  if where == nil { where = xml.NewHash("where") }
+  filter, err := xml.WhereFilter(where)
+  if err != nil {
+    util.Log(0, "ERROR! gosa_query_audit_trail: Error parsing <where>: %v", err)
+    return ErrorReplyXML(err)
+  }
+
+  filter = security.LimitFilter(filter, int64(context.Limits.MaxAnswers), context.PeerID.IP.String())
+
+  trail := db.AuditTrailQuery(filter)
+  reply := xml.NewHash("xml")
+  count := 0
+  for child := trail.FirstChild(); child != nil; child = child.Next() {
+    count++
+    answer := child.Remove()
+    answer.Rename("answer"+strconv.Itoa(count))
+    reply.AddWithOwnership(answer)
+  }
+
+  reply.Add("header", "query_audit_trail")
+  reply.Add("source", config.ServerSourceAddress)
+  reply.Add("target", xmlmsg.Text("source"))
+  reply.Add("session_id", "1")
+  return reply
+}
+
+// Handles the message "gosa_add_audit_trail_entry", which is sent by
+// sibridge to record the actions it performs itself (e.g. "kill") in the
+// server's audit trail. The <entry> element has the format described at
+// db.NewAuditTrailEntry(). The entry is not written here but by auditTrail()
+// like that of every other audited message, i.e. with timestamp, peer and
+// subject determined by the server. The relayed <entry> is stored within
+// it as <claimed>.
+//  xmlmsg: the decrypted and parsed message
+//  context: the security context
+// Returns:
+//  unencrypted reply
+func gosa_add_audit_trail_entry(xmlmsg *xml.Hash, context *security.Context) *xml.Hash {
+  entry := xmlmsg.First("entry")
+  if entry == nil || entry.Text("header") == "" {
+    util.Log(0, "ERROR! gosa_add_audit_trail_entry: Missing <entry> or <header>")
+    return ErrorReplyXML("Missing <entry> or <header>")
+  }
+
+  answer := xml.NewHash("xml", "header", "answer")
+  answer.Add("source", config.ServerSourceAddress)
+  answer.Add("target", xmlmsg.Text("source"))
+  answer.Add("answer1", "0")
+  answer.Add("session_id", "1")
+  return answer
+}
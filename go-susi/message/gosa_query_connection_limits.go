@@ -0,0 +1,73 @@
+/*
+Copyright (c) 2026 go-susi contributors
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package message
+
+import (
+         "fmt"
+         "net"
+         "strconv"
+
+         "../xml"
+         "github.com/mbenkmann/golib/util"
+         "../config"
+         "../security"
+       )
+
+// Handles the message "gosa_query_connection_limits".
+//  xmlmsg: the decrypted and parsed message
+// Returns:
+//  unencrypted reply with one <answerX> per address as described at
+//  security.ConnectionLimitsQuery()
+func gosa_query_connection_limits(xmlmsg *xml.Hash) *xml.Hash {
+  limits := security.ConnectionLimitsQuery()
+  reply := xml.NewHash("xml")
+  count := 0
+  for child := limits.FirstChild(); child != nil; child = child.Next() {
+    count++
+    answer := child.Remove()
+    answer.Rename("answer"+strconv.Itoa(count))
+    reply.AddWithOwnership(answer)
+  }
+
+  reply.Add("header", "query_connection_limits")
+  reply.Add("source", config.ServerSourceAddress)
+  reply.Add("target", xmlmsg.Text("source"))
+  reply.Add("session_id", "1")
+  return reply
+}
+
+// Handles the message "gosa_lift_ban", which removes the ban on the
+// address given in <ip>.
+//  xmlmsg: the decrypted and parsed message
+// Returns:
+//  unencrypted reply
+func gosa_lift_ban(xmlmsg *xml.Hash) *xml.Hash {
+  ip := net.ParseIP(xmlmsg.Text("ip"))
+  if ip == nil {
+    util.Log(0, "ERROR! gosa_lift_ban: Illegal <ip>: \"%v\"", xmlmsg.Text("ip"))
+    return ErrorReplyXML(fmt.Sprintf("Illegal <ip>: \"%v\"", xmlmsg.Text("ip")))
+  }
+  
+  if !security.BanLift(ip) {
+    return ErrorReplyXML(fmt.Sprintf("%v is not banned", ip))
+  }
+  
+  answer := xml.NewHash("xml", "header", "answer")
+  answer.Add("source", config.ServerSourceAddress)
+  answer.Add("target", xmlmsg.Text("source"))
+  answer.Add("answer1", "0")
+  answer.Add("session_id", "1")
+  return answer
+}
@@ -24,6 +24,7 @@ import (
          "net"
          "time"
          "strconv"
+         "strings"
          
          "../db"
          "../xml"
@@ -55,6 +56,7 @@ func gosa_query_jobdb(xmlmsg *xml.Hash, context *security.Context) *xml.Hash {
     time.Sleep(delay)
   }
   
+  filter = scopeFilter(filter, context, scopeCache{}, false)
   filter = security.LimitFilter(filter, int64(context.Limits.MaxAnswers), context.PeerID.IP.String())
 
   jobdb_xml := db.JobsQuery(filter)
@@ -88,6 +90,9 @@ func gosa_query_jobdb(xmlmsg *xml.Hash, context *security.Context) *xml.Hash {
   // maps IP:PORT to server name
   servername := map[string]string{}
   
+  // maps headertag to the positions of the queued jobs (see db.JobsQueuePositions())
+  queue_positions := map[string]map[string]int{}
+  
   for count := 0; count < answers.Count(); {
     answer := answers.At(count).(*xml.Hash)
     count++
@@ -127,6 +132,20 @@ func gosa_query_jobdb(xmlmsg *xml.Hash, context *security.Context) *xml.Hash {
         
         answer.FirstOrAdd("status").SetText("error")
         answer.FirstOrAdd("result").SetText("%v has been down for %v.",servername[siserver],downtime[siserver])
+      } else if answer.Text("status") == "waiting" && strings.Trim(answer.Text("depends_on"), ", ") != "" {
+        // Tell the user why the job is waiting. "deferred" jobs have
+        // the reason in <result> already.
+        answer.FirstOrAdd("result").SetText("Waiting for job(s) %v", answer.Text("depends_on"))
+      } else if answer.Text("status") == "queued" && siserver == config.ServerSourceAddress {
+        // The position is not stored in the job because it changes whenever
+        // a job ahead in the queue is launched.
+        headertag := answer.Text("headertag")
+        if queue_positions[headertag] == nil {
+          queue_positions[headertag] = db.JobsQueuePositions(headertag)
+        }
+        if position := queue_positions[headertag][answer.Text("id")]; position > 0 {
+          answer.FirstOrAdd("result").SetText("Queued at position %v (too many %v jobs running)", position, headertag)
+        }
       }
        
       answer.Rename("answer"+strconv.FormatUint(uint64(count), 10))
@@ -22,16 +22,20 @@ package message
 import (
          "../xml"
          "github.com/mbenkmann/golib/util"
+         "../security"
        )
 
 // Handles the message "gosa_set_activated_for_installation".
 //  xmlmsg: the decrypted and parsed message
-func gosa_set_activated_for_installation(xmlmsg *xml.Hash) {
+//  context: the security context
+// Returns:
+//  the result of gosa_trigger_action()/job_trigger_action(). It is only used
+//  for the audit trail. No reply is sent for this message.
+func gosa_set_activated_for_installation(xmlmsg *xml.Hash, context *security.Context) *xml.Hash {
   if xmlmsg.Text("header")[0:4] == "gosa" { 
     util.Log(2, "DEBUG! gosa_set_activated_for_installation -> gosa_trigger_action")
-    gosa_trigger_action(xmlmsg) 
-  } else {
-    util.Log(2, "DEBUG! job_set_activated_for_installation -> job_trigger_action")
-    job_trigger_action(xmlmsg) 
+    return gosa_trigger_action(xmlmsg, context)
   }
+  util.Log(2, "DEBUG! job_set_activated_for_installation -> job_trigger_action")
+  return job_trigger_action(xmlmsg, context)
 }
@@ -46,7 +46,7 @@ func gosa_show_log_by_mac(xmlmsg *xml.Hash) *xml.Hash {
   }
   
   lmac := strings.ToLower(macaddress)
-  logdir := path.Join(config.FAILogPath, lmac)
+  logdir := path.Join(config.FAILogPath(), lmac)
 
   names := []string{}
   
@@ -60,7 +60,7 @@ func gosa_show_log_files_by_date_and_mac(xmlmsg *xml.Hash) *xml.Hash {
   x := xml.NewHash("xml","header", header)
   x.Add(header)
   
-  logdir := path.Join(config.FAILogPath, lmac, subdir)
+  logdir := path.Join(config.FAILogPath(), lmac, subdir)
   
   util.Log(2, "DEBUG! Listing log files from %v", logdir)
   
@@ -24,16 +24,18 @@ import (
         
          "../xml"
          "github.com/mbenkmann/golib/util"
+         "../security"
        )
 
 // Handles all messages of the form "gosa_trigger_action_*".
 //  xmlmsg: the decrypted and parsed message
+//  context: the security context
 // Returns:
 //  unencrypted reply
-func gosa_trigger_action(xmlmsg *xml.Hash) *xml.Hash {
+func gosa_trigger_action(xmlmsg *xml.Hash, context *security.Context) *xml.Hash {
   util.Log(2, "DEBUG! gosa_trigger_action(%v) -> job_trigger_action", xmlmsg)
   // translate gosa_trigger_* to job_trigger_*
   header := "job_" + strings.SplitN(xmlmsg.Text("header"),"_",2)[1]
   xmlmsg.First("header").SetText(header)
-  return job_trigger_action(xmlmsg)
+  return job_trigger_action(xmlmsg, context)
 }
@@ -26,13 +26,15 @@ import (
          "../xml"
          "github.com/mbenkmann/golib/util"
          "../config"
+         "../security"
        )
 
 // Handles the message "gosa_update_status_jobdb_entry".
 //  xmlmsg: the decrypted and parsed message
+//  context: the security context
 // Returns:
 //  unencrypted reply
-func gosa_update_status_jobdb_entry(xmlmsg *xml.Hash) *xml.Hash {
+func gosa_update_status_jobdb_entry(xmlmsg *xml.Hash, context *security.Context) *xml.Hash {
   where := xmlmsg.First("where")
   if where == nil { where = xml.NewHash("where") }
   filter, err := xml.WhereFilter(where)
@@ -42,7 +44,19 @@ func gosa_update_status_jobdb_entry(xmlmsg *xml.Hash) *xml.Hash {
   }
   
   if update := xmlmsg.First("update"); update != nil {
-    db.JobsModify(filter, update)
+    for _, periodic := range update.Get("periodic") {
+      if err := db.PeriodicValid(periodic); err != nil {
+        util.Log(0, "ERROR! gosa_update_status_jobdb_entry: %v", err)
+        return ErrorReplyXML(err)
+      }
+    }
+    // The target of a job can not be changed. Reject the attempt rather
+    // than silently ignoring it.
+    if update.First("macaddress") != nil {
+      util.Log(0, "ERROR! gosa_update_status_jobdb_entry: <macaddress> can not be updated")
+      return ErrorReplyXML("gosa_update_status_jobdb_entry: <macaddress> can not be updated")
+    }
+    db.JobsModify(scopeFilter(filter, context, scopeCache{}, true), update)
   }
   
   answer := xml.NewHash("xml", "header", "answer")
@@ -20,6 +20,7 @@ MA  02110-1301, USA.
 package message
 
 import (
+         "net"
          "math/rand"
          "time"
          "strings"
@@ -42,6 +43,9 @@ var MissedRegistrations int32
 // sends a here_i_am message to target (HOST:PORT).
 func Send_here_i_am(target string) {
   security.SetMyServer(target)
+  // Registration always uses the old encryption, because target may be a
+  // gosa-si. The "registered" reply tells us if target supports GosaSeal().
+  security.SetSealing(target, false)
   here_i_am := xml.NewHash("xml", "header", "here_i_am")
   here_i_am.Add("here_i_am")
   here_i_am.Add("source", config.ServerSourceAddress)
@@ -50,6 +54,7 @@ func Send_here_i_am(target string) {
   here_i_am.Add("client_revision", config.Revision)
   here_i_am.Add("mac_address", config.MAC) //Yes, that's mac_address with "_"
   here_i_am.Add("broadcast", config.Broadcast)
+  security.AnnounceSealing(here_i_am)
   
   if Here_I_Am_Extra != nil {
     for info := Here_I_Am_Extra.FirstChild(); info != nil; info = info.Next() {
@@ -57,15 +62,15 @@ func Send_here_i_am(target string) {
     }
   }
   
-  clientpackageskey := config.ModuleKey["[ClientPackages]"]
+  clientpackageskey := config.ModuleKey()["[ClientPackages]"]
   // If [ClientPackages]/key missing, take the last key in the list
   // (We don't take the 1st because that would be "dummy-key").
-  if clientpackageskey == "" { clientpackageskey = config.ModuleKeys[len(config.ModuleKeys)-1] }
+  if clientpackageskey == "" { clientpackageskey = config.ModuleKeys()[len(config.ModuleKeys())-1] }
   
   // If we have a certificate, we only register at servers that support
   // TLS. The empty string key in the client database signals to the server
   // that it should use TLS when contacting us.
-  if config.TLSClientConfig != nil {
+  if config.TLSClientConfig() != nil {
     clientpackageskey = ""
   }
   
@@ -166,6 +171,9 @@ copy_end:
   if system != nil && system.Text("gotoldapserver") != "" {
     registered += "<ldap_available>true</ldap_available>"
   }
+  if security.SupportsSealing(xmlmsg) {
+    registered += "<encryption>"+security.SealEncryption+"</encryption>"
+  }
   registered += "</xml>"
   Client(client_addr).Tell(registered, config.RegisteredMessageTTL)
   atomic.AddInt32(&TotalRegistrations, 1)
@@ -202,7 +210,7 @@ copy_end:
                      install_or_update := xml.FilterOr([]xml.HashFilter{xml.FilterSimple("headertag", "trigger_action_reinstall"),xml.FilterSimple("headertag", "trigger_action_update")})
                      local_processing_install_or_update := xml.FilterAnd([]xml.HashFilter{local_processing, install_or_update})
                      db.JobsModifyLocal(local_processing_install_or_update, xml.NewHash("job","progress","groom")) // to prevent faistate => localboot
-                     db.JobsRemoveLocal(local_processing_install_or_update, false) // false => re-schedule if periodic
+                     db.JobsCompleteLocal(local_processing_install_or_update, false) // false => re-schedule if periodic
       case "reins",
            "insta": makeSureWeHaveAppropriateProcessingJob(macaddress, "trigger_action_reinstall", "none")
       case "updat",
@@ -211,10 +219,11 @@ copy_end:
     }
     
     // Update LDAP entry if cn != DNS name  or ipHostNumber != IP
-    client_addr := strings.SplitN(client_addr,":",2)
-    client_ip := client_addr[0]
-    client_port := ""
-    if len(client_addr) > 1 { client_port = client_addr[1] }
+    client_ip, client_port, err := net.SplitHostPort(client_addr)
+    if err != nil {
+      client_ip = client_addr
+      client_port = ""
+    }
     client_name := strings.ToLower(db.SystemNameForIPAddress(client_ip))
     new_name := strings.SplitN(client_name,".",2)[0]
     if config.FullQualifiedCN { new_name = client_name }
@@ -51,6 +51,9 @@ func job_send_user_msg(xmlmsg *xml.Hash) *xml.Hash {
   if timestamp == "" { timestamp = util.MakeTimestamp(time.Now()) }
   job.FirstOrAdd("timestamp").SetText(timestamp)
   for _, periodic := range xmlmsg.Get("periodic") {
+    if err := db.PeriodicValid(periodic); err != nil {
+      return ErrorReplyXML(err)
+    }
     job.FirstOrAdd("periodic").SetText(periodic) // last <periodic> wins if there are multiple
   }
   job.FirstOrAdd("headertag").SetText(strings.ToLower(xmlmsg.Text("header")[len("job_"):]))
@@ -69,17 +72,17 @@ func job_send_user_msg(xmlmsg *xml.Hash) *xml.Hash {
 
 func SendUserMsg(job *xml.Hash) {
   start := time.Now()
-  util.Log(1, "INFO! Running user-msg-hook %v", config.UserMessageHookPath)
+  util.Log(1, "INFO! Running user-msg-hook %v", config.UserMessageHookPath())
   env := config.HookEnvironment()
   for _, tag := range job.Subtags() {
     env = append(env, tag+"="+strings.Join(job.Get(tag),"\n"))
   }
-  cmd := exec.Command(config.UserMessageHookPath)
+  cmd := exec.Command(config.UserMessageHookPath())
   env = append(env, "xml="+job.String())
   cmd.Env = append(env, os.Environ()...)
-  out, err := cmd.CombinedOutput()
+  out, err := db.HookCombinedOutput("user-msg-hook", cmd)
   if err != nil {
-    util.Log(0, "ERROR! user-msg-hook %v: %v (%v)", config.UserMessageHookPath, err, string(out))
+    util.Log(0, "ERROR! user-msg-hook %v: %v (%v)", config.UserMessageHookPath(), err, out)
     return
   }
   util.Log(1, "INFO! Finished user-msg-hook. Running time: %v", time.Since(start))
@@ -29,15 +29,30 @@ import (
          "../xml"
          "github.com/mbenkmann/golib/util"
          "../config"
+         "../security"
        )
 
 var macAddressRegexp = regexp.MustCompile("^[0-9A-Fa-f]{2}(:[0-9A-Fa-f]{2}){5}$")
 
+var jobIdRegexp = regexp.MustCompile("^[0-9]+$")
+
 // Handles all messages of the form "job_trigger_action_*".
+// Besides the usual elements the message may contain
+//   <depends_on>id1,id2,...</depends_on>  the job will only be launched after
+//                                        the local jobs with these <id>s have
+//                                        completed successfully. Ids that do
+//                                        not name an existing local job are
+//                                        rejected with an error reply.
+//   <sequence>name</sequence>  the job will only be launched after the
+//                              previous job with the same <sequence> has
+//                              completed successfully.
+// <periodic> may be a cron expression (see db.PeriodicNext()).
+// See db.jobDB for details.
 //  xmlmsg: the decrypted and parsed message
+//  context: the security context
 // Returns:
 //  unencrypted reply
-func job_trigger_action(xmlmsg *xml.Hash) *xml.Hash {
+func job_trigger_action(xmlmsg *xml.Hash, context *security.Context) *xml.Hash {
   util.Log(2, "DEBUG! job_trigger_action(%v)", xmlmsg)
   job := xml.NewHash("job")
   job.Add("progress", "none")
@@ -50,6 +65,9 @@ func job_trigger_action(xmlmsg *xml.Hash) *xml.Hash {
   if !macAddressRegexp.MatchString(macaddress) {
     return ErrorReplyXML("job_trigger_action* with invalid or missing MAC address")
   }
+  if !targetInScope(macaddress, context, scopeCache{}) {
+    return ErrorReplyXML("job_trigger_action* for machine not permitted by certificate: "+macaddress)
+  }
   job.Add("macaddress", macaddress)
   job.Add("plainname", "none") // updated automatically
   timestamp := xmlmsg.Text("timestamp")
@@ -58,12 +76,40 @@ func job_trigger_action(xmlmsg *xml.Hash) *xml.Hash {
   if timestamp == "" { timestamp = util.MakeTimestamp(time.Now()) }
   job.Add("timestamp", timestamp)
   for _, periodic := range xmlmsg.Get("periodic") {
+    if err := db.PeriodicValid(periodic); err != nil {
+      return ErrorReplyXML(err)
+    }
     job.FirstOrAdd("periodic").SetText(periodic) // last <periodic> wins if there are multiple
   }
   tminus := xmlmsg.Text("tminus")
   if tminus != "" {
     job.Add("tminus", tminus)
   }
+  // <depends_on> may be given multiple times and/or as comma-separated list
+  depends_on := []string{}
+  for _, deps := range xmlmsg.Get("depends_on") {
+    for _, id := range strings.Split(deps, ",") {
+      id = strings.TrimSpace(id)
+      if id == "" { continue }
+      if !jobIdRegexp.MatchString(id) {
+        return ErrorReplyXML("job_trigger_action* with invalid <depends_on>: "+id)
+      }
+      depends_on = append(depends_on, id)
+    }
+  }
+  if len(depends_on) > 0 {
+    // A typo in <depends_on> must not silently launch the job immediately.
+    for _, id := range depends_on {
+      if db.JobsQuery(xml.FilterSimple("siserver", config.ServerSourceAddress, "id", id)).First("job") == nil {
+        return ErrorReplyXML("job_trigger_action* with <depends_on> that is not the id of a local job: "+id)
+      }
+    }
+    job.Add("depends_on", strings.Join(depends_on, ","))
+  }
+  sequence := strings.TrimSpace(xmlmsg.Text("sequence"))
+  if sequence != "" {
+    job.Add("sequence", sequence)
+  }
   job.Add("headertag", strings.ToLower(xmlmsg.Text("header")[len("job_"):]))
   job.Add("result", "none")
   job.Add("xmlmessage", base64.StdEncoding.EncodeToString([]byte(xmlmsg.String())))
@@ -30,6 +30,7 @@ import (
          "../xml"
          "github.com/mbenkmann/golib/util"
          "../config"
+         "../security"
        )
 
 // var macAddressRegexp is in job_trigger_action.go
@@ -37,9 +38,10 @@ import (
 
 // Handles the messages "job_trigger_activate_new" and "gosa_trigger_activate_new".
 //  xmlmsg: the decrypted and parsed message
+//  context: the security context
 // Returns:
 //  unencrypted reply
-func job_trigger_activate_new(xmlmsg *xml.Hash) *xml.Hash {
+func job_trigger_activate_new(xmlmsg *xml.Hash, context *security.Context) *xml.Hash {
   util.Log(2, "DEBUG! job_trigger_activate_new(%v)", xmlmsg)
    
   //====== determine MAC address ======
@@ -123,7 +125,7 @@ func job_trigger_activate_new(xmlmsg *xml.Hash) *xml.Hash {
   
   // ======== determine ou to put/move system into =========
   
-  ou := config.IncomingOU
+  ou := config.IncomingOU()
   base := xmlmsg.Text("base")
   if base == "" { 
     if template != nil {
@@ -131,7 +133,7 @@ func job_trigger_activate_new(xmlmsg *xml.Hash) *xml.Hash {
     } else {
       if existing_sys != nil {
         ou = strings.SplitN(existing_sys.Text("dn"),",",2)[1]
-      } // else { ou remains config.IncomingOU }
+      } // else { ou remains config.IncomingOU() }
     }
   } else { // if base != ""
     oclasses := []string{}
@@ -190,8 +192,6 @@ func job_trigger_activate_new(xmlmsg *xml.Hash) *xml.Hash {
 
   if existing_sys == nil && template != nil {
     db.SystemFillInMissingData(system, template)
-    // Add system to the same object groups template is member of (if any).
-    db.SystemAddToGroups(system.Text("dn"), db.SystemGetGroupsWithMember(template.Text("dn")))
   }
   
   if existing_sys == nil { system.RemoveFirst("iphostnumber") }
@@ -214,6 +214,31 @@ func job_trigger_activate_new(xmlmsg *xml.Hash) *xml.Hash {
   // gotoMode is always active
   system.FirstOrAdd("gotomode").SetText("active")
   
+  // ======== check target scope of the requester's certificate =========
+  
+  if !context.Scope.Unrestricted() {
+    // The system must be in scope before and after the change. Its object
+    // groups do not change, except that a new system joins the groups of
+    // its template.
+    groups := xml.NewHash("systemdb")
+    if existing_sys != nil {
+      groups = db.SystemGetGroupsWithMember(existing_sys.Text("dn"))
+    } else if template != nil {
+      groups = db.SystemGetGroupsWithMember(template.Text("dn"))
+    }
+    if (existing_sys != nil && !db.SystemMatchesScope(existing_sys, groups, &context.Scope)) ||
+       !db.SystemMatchesScope(system, groups, &context.Scope) {
+      emsg := fmt.Sprintf("job_trigger_activate_new(): %v (%v) is not permitted to target %v (%v)", context.PeerID.IP, context.Subject, macaddress, system.Text("dn"))
+      util.Log(0, "WARNING! [SECURITY] %v", emsg)
+      return ErrorReplyXML(emsg)
+    }
+  }
+  
+  if existing_sys == nil && template != nil {
+    // Add system to the same object groups template is member of (if any).
+    db.SystemAddToGroups(system.Text("dn"), db.SystemGetGroupsWithMember(template.Text("dn")))
+  }
+  
   // Update LDAP data or create new entry (if existing_sys==nil)
   err = db.SystemReplace(existing_sys, system)
   if err != nil {
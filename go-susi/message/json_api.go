@@ -0,0 +1,198 @@
+/*
+Copyright (c) 2026 go-susi contributors
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package message
+
+import (
+         "io"
+         "net"
+         "sync"
+         "time"
+         "regexp"
+         "net/http"
+         "crypto/tls"
+
+         "../xml"
+         "github.com/mbenkmann/golib/util"
+         "../config"
+         "../security"
+       )
+
+// The security context of each open API connection, indexed by
+// the connection's RemoteAddr().String().
+var jsonAPIContexts = map[string]*jsonAPIConn{}
+var jsonAPIContexts_mutex sync.Mutex
+
+type jsonAPIConn struct {
+  conn *tls.Conn
+  // nil until the first request on the connection has been received
+  context *security.Context
+}
+
+// Wraps a net.Listener to return TLS connections that have passed
+// the connection limit check.
+type jsonAPIListener struct {
+  net.Listener
+}
+
+func (l *jsonAPIListener) Accept() (net.Conn, error) {
+  for {
+    conn, err := l.Listener.Accept()
+    if err != nil { return nil, err }
+
+    if !security.ConnectionLimitsRegister(conn.RemoteAddr()) {
+      // do not log unless debugging to avoid logspam in case of an attack
+      util.Log(2, "DEBUG! [SECURITY] Rejecting API connection from %v", conn.RemoteAddr())
+      conn.Close()
+      continue
+    }
+
+    tlsconn := tls.Server(conn, config.TLSServerConfig())
+    jsonAPIContexts_mutex.Lock()
+    jsonAPIContexts[conn.RemoteAddr().String()] = &jsonAPIConn{conn:tlsconn}
+    jsonAPIContexts_mutex.Unlock()
+    return tlsconn, nil
+  }
+}
+
+func jsonAPIConnState(conn net.Conn, state http.ConnState) {
+  if state == http.StateClosed || state == http.StateHijacked {
+    jsonAPIContexts_mutex.Lock()
+    delete(jsonAPIContexts, conn.RemoteAddr().String())
+    jsonAPIContexts_mutex.Unlock()
+    security.ConnectionLimitsDeregister(conn.RemoteAddr())
+  }
+}
+
+// Returns the security context for the connection the request r was
+// received on or nil if the peer failed the security checks.
+func jsonAPIContextFor(r *http.Request) *security.Context {
+  jsonAPIContexts_mutex.Lock()
+  c, ok := jsonAPIContexts[r.RemoteAddr]
+  jsonAPIContexts_mutex.Unlock()
+  if !ok { return nil }
+
+  // Only one request per connection is processed at a time, so no
+  // locking is needed for c.context.
+  if c.context == nil {
+    c.context = security.ContextFor(c.conn)
+    // ContextFor() clears the deadlines the http.Server has set for reading
+    // the request body and writing the reply.
+    if config.Timeout() > 0 { c.conn.SetDeadline(time.Now().Add(config.Timeout())) }
+    if c.context == nil { return nil }
+    security.ConnectionLimitsUpdate(c.context)
+  }
+  return c.context
+}
+
+// Accepts HTTPS connections on listen_address and processes requests of
+// the form
+//   POST /<header>
+// where <header> is the header of a gosa-si message (e.g. gosa_query_jobdb)
+// and the request body is a JSON object with the remaining elements of the
+// message (see xml.JSONToHash()). The reply is returned as JSON object
+// (see xml.Hash.JSON()).
+// Peers must authenticate with a TLS client certificate and the
+// same access control bits apply as for the gosa-si protocol.
+func JSONAPIListenAndServe(listen_address string) {
+  if config.TLSServerConfig() == nil {
+    util.Log(0, "ERROR! HTTPS/JSON API requires a certificate => API disabled")
+    return
+  }
+
+  listener, err := net.Listen("tcp", listen_address)
+  if err != nil {
+    util.Log(0, "ERROR! Cannot start HTTPS/JSON API: %v", err)
+    return
+  }
+
+  // Like the gosa-si protocol listener, limit the time a peer may take for
+  // each transmission, so that slow or idle peers can not hold on to
+  // connections (and goroutines) forever. A negative config.Timeout() means
+  // no limit for both.
+  server := &http.Server{Handler:http.HandlerFunc(handleJSONRequest), ConnState:jsonAPIConnState,
+                         ReadHeaderTimeout:config.Timeout(), ReadTimeout:config.Timeout(),
+                         WriteTimeout:config.Timeout(), IdleTimeout:config.Timeout()}
+  err = server.Serve(&jsonAPIListener{listener})
+  util.Log(0, "ERROR! HTTPS/JSON API terminated: %v", err)
+}
+
+var jsonAPIHeaderRegexp = regexp.MustCompile("^/([A-Za-z0-9_]+)$")
+
+func handleJSONRequest(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Content-Type", "application/json")
+
+  context := jsonAPIContextFor(r)
+  if context == nil {
+    jsonAPIError(w, http.StatusForbidden, "Security checks failed")
+    return
+  }
+
+  if r.Method != "POST" {
+    jsonAPIError(w, http.StatusMethodNotAllowed, "Only POST is supported")
+    return
+  }
+
+  match := jsonAPIHeaderRegexp.FindStringSubmatch(r.URL.Path)
+  if match == nil {
+    jsonAPIError(w, http.StatusNotFound, "Request path must be /<message header>")
+    return
+  }
+  header := match[1]
+
+  var body io.Reader = r.Body
+  if context.Limits.MessageBytes > 0 {
+    body = http.MaxBytesReader(w, r.Body, context.Limits.MessageBytes)
+  }
+
+  x, err := xml.JSONToHash("xml", body)
+  if err != nil {
+    util.Log(0, "ERROR! HTTPS/JSON API request from %v: %v", r.RemoteAddr, err)
+    jsonAPIError(w, http.StatusBadRequest, err)
+    return
+  }
+
+  for x.RemoveFirst("header") != nil {}
+  x.Add("header", header)
+  if x.First("source") == nil { x.Add("source", "GOSA") }
+  if x.First("target") == nil { x.Add("target", "GOSA") }
+
+  util.Log(2, "DEBUG! HTTPS/JSON API request from %v: %v", r.RemoteAddr, x)
+
+  // context.TLS is true, so "dummy-key" means the reply is not encrypted
+  reply, _ := ProcessXMLMessage(x, context, "dummy-key")
+  defer reply.Reset()
+
+  if reply.Len() == 0 {
+    w.Write([]byte("{}"))
+    return
+  }
+
+  answer, err := xml.StringToHash(reply.String())
+  if err != nil {
+    util.Log(0, "ERROR! HTTPS/JSON API: Could not parse reply: %v", err)
+    jsonAPIError(w, http.StatusInternalServerError, err)
+    return
+  }
+
+  if answer.First("error_string") != nil {
+    w.WriteHeader(http.StatusBadRequest)
+  }
+  w.Write(answer.JSON())
+}
+
+func jsonAPIError(w http.ResponseWriter, status int, msg interface{}) {
+  w.WriteHeader(status)
+  w.Write(ErrorReplyXML(msg).JSON())
+}
@@ -0,0 +1,139 @@
+/*
+Copyright (c) 2026 go-susi contributors
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package message
+
+import (
+         "io"
+         "fmt"
+         "sort"
+         "time"
+         "strings"
+         "sync/atomic"
+
+         "../db"
+         "../xml"
+         "../tftp"
+         "../config"
+       )
+
+// Writes runtime statistics in Prometheus text exposition format to w.
+// active_connections and max_processing_time are maintained by the main
+// program, everything else is taken from the respective packages.
+func WriteMetrics(w io.Writer, active_connections int32, max_processing_time time.Duration) {
+  metric := func(name, typ, help string) {
+    fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, typ)
+  }
+  
+  metric("gosusi_active_connections", "gauge", "Number of currently open gosa-si protocol connections.")
+  fmt.Fprintf(w, "gosusi_active_connections %v\n", active_connections)
+  
+  metric("gosusi_request_processing_seconds_avg", "gauge", "Average processing time of the last 100 requests.")
+  fmt.Fprintf(w, "gosusi_request_processing_seconds_avg %v\n", (time.Duration(atomic.LoadInt64(&RequestProcessingTime))/100).Seconds())
+  metric("gosusi_request_processing_seconds_max", "gauge", "Maximum processing time of the last 100 requests.")
+  fmt.Fprintf(w, "gosusi_request_processing_seconds_max %v\n", max_processing_time.Seconds())
+  
+  metric("gosusi_registrations_total", "counter", "Number of here_i_am messages processed.")
+  fmt.Fprintf(w, "gosusi_registrations_total %v\n", atomic.LoadInt32(&TotalRegistrations))
+  metric("gosusi_registrations_missed_total", "counter", "Number of registrations that could not be completed in time.")
+  fmt.Fprintf(w, "gosusi_registrations_missed_total %v\n", atomic.LoadInt32(&MissedRegistrations))
+  
+  metric("gosusi_messages_replayed_total", "counter", "Number of messages rejected as replays.")
+  fmt.Fprintf(w, "gosusi_messages_replayed_total %v\n", atomic.LoadInt32(&ReplayedMessages))
+  metric("gosusi_messages_stale_total", "counter", "Number of messages rejected as stale or lacking <msgtime>/<msgnonce>.")
+  fmt.Fprintf(w, "gosusi_messages_stale_total %v\n", atomic.LoadInt32(&StaleMessages))
+  
+  metric("gosusi_tftp_requests_total", "counter", "Number of TFTP requests received.")
+  fmt.Fprintf(w, "gosusi_tftp_requests_total %v\n", atomic.LoadInt64(&tftp.RequestsTotal))
+  metric("gosusi_tftp_requests_served_total", "counter", "Number of TFTP requests served successfully.")
+  fmt.Fprintf(w, "gosusi_tftp_requests_served_total %v\n", atomic.LoadInt64(&tftp.RequestsServed))
+  metric("gosusi_http_boot_requests_total", "counter", "Number of HTTP boot requests received.")
+  fmt.Fprintf(w, "gosusi_http_boot_requests_total %v\n", atomic.LoadInt64(&tftp.HTTPRequestsTotal))
+  metric("gosusi_http_boot_requests_served_total", "counter", "Number of HTTP boot requests served successfully.")
+  fmt.Fprintf(w, "gosusi_http_boot_requests_served_total %v\n", atomic.LoadInt64(&tftp.HTTPRequestsServed))
+  metric("gosusi_proxydhcp_requests_total", "counter", "Number of PXE requests received by the ProxyDHCP server.")
+  fmt.Fprintf(w, "gosusi_proxydhcp_requests_total %v\n", atomic.LoadInt64(&tftp.ProxyDHCPRequestsTotal))
+  metric("gosusi_proxydhcp_requests_served_total", "counter", "Number of PXE requests answered by the ProxyDHCP server.")
+  fmt.Fprintf(w, "gosusi_proxydhcp_requests_served_total %v\n", atomic.LoadInt64(&tftp.ProxyDHCPRequestsServed))
+  metric("gosusi_proxydhcp_requests_dropped_total", "counter", "Number of PXE requests dropped because too many were waiting to be answered.")
+  fmt.Fprintf(w, "gosusi_proxydhcp_requests_dropped_total %v\n", atomic.LoadInt64(&tftp.ProxyDHCPRequestsDropped))
+  
+  metric("gosusi_job_events_dropped_total", "counter", "Number of job events dropped because the job-event-hook could not keep up.")
+  fmt.Fprintf(w, "gosusi_job_events_dropped_total %v\n", atomic.LoadInt64(&db.JobEventsDropped))
+  
+  if !config.RunServer { return }
+  
+  jobs := db.JobsQuery(xml.FilterAll)
+  counts := map[string]int{}
+  for job := jobs.FirstChild(); job != nil; job = job.Next() {
+    j := job.Element()
+    counts["status="+metricsLabel(j.Text("status"))+",headertag="+metricsLabel(j.Text("headertag"))]++
+  }
+  labels := make([]string, 0, len(counts))
+  for label := range counts { labels = append(labels, label) }
+  sort.Strings(labels)
+  metric("gosusi_jobs", "gauge", "Number of jobs in the jobdb.")
+  for _, label := range labels {
+    fmt.Fprintf(w, "gosusi_jobs{%v} %v\n", label, counts[label])
+  }
+  
+  metric("gosusi_peer_downtime_seconds", "gauge", "How long a peer has been unreachable (0 if it is up).")
+  for _, addr := range db.ServerAddresses() {
+    fmt.Fprintf(w, "gosusi_peer_downtime_seconds{peer=%v} %v\n", metricsLabel(addr), Peer(addr).Downtime().Seconds())
+  }
+  
+  stats := db.HookStats()
+  hooks := make([]string, 0, len(stats))
+  for hook := range stats { hooks = append(hooks, hook) }
+  sort.Strings(hooks)
+  metric("gosusi_hook_executions_total", "counter", "Number of hook executions.")
+  for _, hook := range hooks {
+    fmt.Fprintf(w, "gosusi_hook_executions_total{hook=%v} %v\n", metricsLabel(hook), stats[hook].Count)
+  }
+  metric("gosusi_hook_failures_total", "counter", "Number of hook executions that failed.")
+  for _, hook := range hooks {
+    fmt.Fprintf(w, "gosusi_hook_failures_total{hook=%v} %v\n", metricsLabel(hook), stats[hook].Failures)
+  }
+  metric("gosusi_hook_seconds_total", "counter", "Total running time of hook executions.")
+  for _, hook := range hooks {
+    fmt.Fprintf(w, "gosusi_hook_seconds_total{hook=%v} %v\n", metricsLabel(hook), stats[hook].Total.Seconds())
+  }
+  metric("gosusi_hook_seconds_max", "gauge", "Running time of the slowest hook execution.")
+  for _, hook := range hooks {
+    fmt.Fprintf(w, "gosusi_hook_seconds_max{hook=%v} %v\n", metricsLabel(hook), stats[hook].Max.Seconds())
+  }
+  metric("gosusi_hook_timeouts_total", "counter", "Number of hook executions killed because of a timeout.")
+  for _, hook := range hooks {
+    fmt.Fprintf(w, "gosusi_hook_timeouts_total{hook=%v} %v\n", metricsLabel(hook), stats[hook].Timeouts)
+  }
+  metric("gosusi_hook_output_exceeded_total", "counter", "Number of hook executions killed because of too much output.")
+  for _, hook := range hooks {
+    fmt.Fprintf(w, "gosusi_hook_output_exceeded_total{hook=%v} %v\n", metricsLabel(hook), stats[hook].OutputExceeded)
+  }
+  running, waiting := db.HooksRunning()
+  metric("gosusi_hooks_running", "gauge", "Number of hooks currently running.")
+  fmt.Fprintf(w, "gosusi_hooks_running %v\n", running)
+  metric("gosusi_hooks_waiting", "gauge", "Number of hooks waiting for hook-max-parallel.")
+  fmt.Fprintf(w, "gosusi_hooks_waiting %v\n", waiting)
+}
+
+// Escapes in the Prometheus text exposition format only use backslash
+// sequences for backslash, double quote and line feed. Everything else
+// (e.g. a tab or non-ASCII characters) is written as is.
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Returns s as a quoted label value for the Prometheus text exposition format.
+func metricsLabel(s string) string {
+  return `"` + metricsLabelEscaper.Replace(s) + `"`
+}
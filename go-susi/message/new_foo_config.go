@@ -24,12 +24,13 @@ import (
          "os/exec"
          "strings"
          
+         "../db"
          "../xml"
          "github.com/mbenkmann/golib/util"
          "../config"
        )
 
-// Handles all messages of the form "new_*_config" by calling config.NewConfigHookPath.
+// Handles all messages of the form "new_*_config" by calling config.NewConfigHookPath().
 //  xmlmsg: the decrypted and parsed message
 func new_foo_config(xmlmsg *xml.Hash) {
   target := xmlmsg.Text("target")
@@ -47,11 +48,11 @@ func new_foo_config(xmlmsg *xml.Hash) {
   }
   env = append(env, header+"=1")
     
-  cmd := exec.Command(config.NewConfigHookPath)
+  cmd := exec.Command(config.NewConfigHookPath())
   cmd.Env = append(env, os.Environ()...)
-  util.Log(1, "INFO! Running %v with parameters %v", config.NewConfigHookPath, env)
-  out, err := cmd.CombinedOutput()
+  util.Log(1, "INFO! Running %v with parameters %v", config.NewConfigHookPath(), env)
+  out, err := db.HookCombinedOutput("new-config-hook", cmd)
   if err != nil {
-    util.Log(0, "ERROR! Error executing %v: %v (%v)", config.NewConfigHookPath, err, string(out))
+    util.Log(0, "ERROR! Error executing %v: %v (%v)", config.NewConfigHookPath(), err, out)
   }
 }
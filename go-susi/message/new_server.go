@@ -26,6 +26,7 @@ import (
          "../xml"
          "github.com/mbenkmann/golib/util"
          "../config"
+         "../security"
        )
 
 // Sends a new_server message to all known peer servers.
@@ -57,13 +58,16 @@ func Send_new_server(header string, target string) {
   msg.Add("loaded_modules", "server_server_com")
   msg.Add("loaded_modules", "clMessages")
   msg.Add("loaded_modules", "goSusi")
+  security.AnnounceSealing(msg)
   msg.Add("key", keys[0])
   msg.Add("target", target)
   
-  serverpackageskey := config.ModuleKey["[ServerPackages]"]
+  serverpackageskey := config.ModuleKey()["[ServerPackages]"]
 
   util.Log(2, "DEBUG! Sending %v to %v encrypted with key %v", header, target, serverpackageskey)
-  Peer(target).Tell(msg.String(), serverpackageskey)
+  // Always use the old encryption for the capability exchange, so that
+  // a gosa-si that has replaced a go-susi peer can still understand us.
+  Peer(target).tell(msg.String(), serverpackageskey, false)
 }
 
 
@@ -111,11 +111,19 @@ func (conn *PeerConnection) stopDowntime() {
 
 // Encrypts msg with key and sends it to the peer without waiting for a reply.
 // If key == "" the first key from db.ServerKeys(peer) is used.
+// If the peer has announced support for security.GosaSeal() (see
+// db.ServerSealing()), it is used instead of security.GosaEncrypt().
 func (conn *PeerConnection) Tell(msg, key string) {
+  conn.tell(msg, key, db.ServerSealing(conn.addr))
+}
+
+// Like Tell() but uses security.GosaSeal() if seal and security.GosaEncrypt()
+// if !seal.
+func (conn *PeerConnection) tell(msg, key string, seal bool) {
   if conn.err != nil { return }
   keys := db.ServerKeys(conn.addr)
   // If we use TLS and the target does, too
-  if config.TLSClientConfig != nil && len(keys) > 0 && keys[0] == "" {
+  if config.TLSClientConfig() != nil && len(keys) > 0 && keys[0] == "" {
     key = ""
   } else if key == "" {
    if len(keys) == 0 {
@@ -128,12 +136,15 @@ func (conn *PeerConnection) Tell(msg, key string) {
   // If key == "" at this point, we're using TLS
   if key == "" {
     conn.queue.Push(msg)
+  } else if seal {
+    conn.queue.Push(security.GosaSeal(security.Stamp(msg), key))
   } else {
-    conn.queue.Push(security.GosaEncrypt(msg, key))
+    conn.queue.Push(security.GosaEncrypt(security.Stamp(msg), key))
   }
 }
 
-// Encrypts request with key, sends it to the peer and returns a channel 
+// Encrypts request with key (see Tell() for the encryption used), sends it
+// to the peer and returns a channel 
 // from which the peer's reply can be received (already decrypted with
 // the same key). It is guaranteed that a reply will
 // be available from this channel even if the peer connection breaks
@@ -155,7 +166,7 @@ func (conn *PeerConnection) Ask(request, key string) <-chan string {
 
   keys := db.ServerKeys(conn.addr)  
   // If we use TLS and the target does, too
-  if config.TLSClientConfig != nil && len(keys) > 0 && keys[0] == "" {
+  if config.TLSClientConfig() != nil && len(keys) > 0 && keys[0] == "" {
     key = ""
   } else if key == "" {
    if len(keys) == 0 {
@@ -192,12 +203,16 @@ func (conn *PeerConnection) Ask(request, key string) <-chan string {
       util.Log(1, "INFO! Asking %v: %v", conn.addr, request)
       encrypted := request
       if key != "" {
-        encrypted = security.GosaEncrypt(request, key)
+        if db.ServerSealing(conn.addr) {
+          encrypted = security.GosaSeal(security.Stamp(request), key)
+        } else {
+          encrypted = security.GosaEncrypt(security.Stamp(request), key)
+        }
       }
-      err = util.SendLn(tcpconn, encrypted, config.Timeout)
+      err = util.SendLn(tcpconn, encrypted, config.Timeout())
       // make sure handleConnection()/monitorConnection() notice that the peer is unreachable
       if err != nil && conn.tcpConn != nil { conn.tcpConn.Close() }
-      reply, err := util.ReadLn(tcpconn, config.Timeout)
+      reply, err := util.ReadLn(tcpconn, config.Timeout())
       if err != nil && err != io.EOF {
         util.Log(0, "ERROR! ReadLn(): %v", err)
       }
@@ -261,7 +276,7 @@ func (conn *PeerConnection) SyncAll() {
       clause.Add("phrase").Add("siserver",conn.addr)
       clause.Add("phrase").Add("siserver",config.ServerSourceAddress)
       
-      jobs_str := <- conn.Ask(query.String(), config.ModuleKey["[GOsaPackages]"])
+      jobs_str := <- conn.Ask(query.String(), config.ModuleKey()["[GOsaPackages]"])
       jobs, err := xml.StringToHash(jobs_str)
       if err != nil {
         util.Log(0, "ERROR! gosa_query_jobdb: Error decoding reply from peer %v: %v", conn.addr, err)
@@ -342,7 +357,7 @@ func (conn *PeerConnection) handleConnection() {
     
     message := conn.queue.Next().(string)
     if conn.tcpConn != nil {
-      err = util.SendLn(conn.tcpConn, message, config.Timeout) 
+      err = util.SendLn(conn.tcpConn, message, config.Timeout()) 
     } else {
       err = peerDownError
     }
@@ -354,7 +369,7 @@ func (conn *PeerConnection) handleConnection() {
       // try to re-establish connection
       keys := db.ServerKeys(conn.addr)
       // If we use TLS and the peer does, too, or we don't know => use TLS
-      if config.TLSClientConfig != nil && ( len(keys) == 0 || keys[0] == "" ) {
+      if config.TLSClientConfig() != nil && ( len(keys) == 0 || keys[0] == "" ) {
         // We just use security.SendLnTo() to establish the TLS connection
         // The empty line that is sent is ignored by the receiving go-susi.
         conn.tcpConn, _ = security.SendLnTo(conn.addr, "", "", true)
@@ -379,7 +394,7 @@ func (conn *PeerConnection) handleConnection() {
         conn.stopDowntime() 
         go monitorConnection(conn.tcpConn, &conn.queue)  
         // try to re-send message
-        err = util.SendLn(conn.tcpConn, message, config.Timeout)
+        err = util.SendLn(conn.tcpConn, message, config.Timeout())
         if err != nil { 
           util.Log(2, "DEBUG! handleConnection() SendLn #2 to %v failed: %v", conn.addr,err)
           conn.tcpConn.Close() // if resending failed, make sure connection is closed
@@ -481,7 +496,7 @@ func Peer(addr string) *PeerConnection {
     return &PeerConnection{err:err}
   }
   
-  addr = host + ":" + port
+  addr = net.JoinHostPort(host, port)
   
   if addr == config.ServerSourceAddress { 
     panic("Peer() called with my own address. This is a bug!") 
@@ -22,9 +22,11 @@ MA  02110-1301, USA.
 package message
 
 import ( 
+         "os"
+         "net"
          "sync"
          "time"
-         "strings"
+         "syscall"
          
          "../db"
          "../xml"
@@ -71,6 +73,26 @@ func handleServerMessage(bit bool, name string) bool {
   return true
 }
 
+// Returns true if the certificate from context may be used by the peer server
+// that sent xmlmsg (see db.ServerCertificateCheck()). The <source> of xmlmsg
+// must be the address the message was received from, because otherwise a
+// peer could claim to be a different peer whose certificate is not pinned.
+// new_peer must only be true for messages that introduce a peer not yet
+// known (i.e. new_server).
+func peerCertificateOK(xmlmsg *xml.Hash, context *security.Context, new_peer bool) bool {
+  server, err := util.Resolve(xmlmsg.Text("source"), config.IP)
+  if err != nil {
+    util.Log(0, "ERROR! [SECURITY] Cannot resolve peer \"%v\": %v", xmlmsg.Text("source"), err)
+    return false
+  }
+  host, _, err := net.SplitHostPort(server)
+  if err != nil || !context.PeerID.IP.Equal(net.ParseIP(host)) {
+    util.Log(0, "ERROR! [SECURITY] Message from %v claims to come from peer %v => Rejecting message", context.PeerID.IP, xmlmsg.Text("source"))
+    return false
+  }
+  return db.ServerCertificateCheck(server, context.Fingerprint, new_peer)
+}
+
 // Takes a possibly encrypted message in buf and processes it, returning a reply.
 // context is the security context.
 // Returns: 
@@ -85,8 +107,10 @@ func ProcessEncryptedMessage(buf *bytes.Buffer, context *security.Context) (repl
     util.Log(2, "DEBUG! Processing message: %v", buf.String())
   }
 
+  context.Sealed = security.IsSealedBuffer(buf)
+
   for attempt := 0 ; attempt < 4; attempt++ {
-    if attempt != 0 && config.TLSRequired {
+    if attempt != 0 && config.TLSRequired() {
       util.Log(1, "INFO! [SECURITY] TLS-only mode => Decryption with old protocol will not be attempted")
       //NOTE: This prevents the last ditch attempt to decrypt with all known
       //      server and client keys. This attempt might still have produced a
@@ -101,7 +125,7 @@ func ProcessEncryptedMessage(buf *bytes.Buffer, context *security.Context) (repl
     var keys_to_try []string
     
     switch attempt {
-      case 0: keys_to_try = config.ModuleKeys
+      case 0: keys_to_try = config.ModuleKeys()
       case 1: host := context.PeerID.IP.String()
               {
                 keys_to_try = append(db.ServerKeys(host), db.ClientKeys(host)...)
@@ -123,8 +147,18 @@ func ProcessEncryptedMessage(buf *bytes.Buffer, context *security.Context) (repl
           util.Log(2, "DEBUG! Decrypted message from %v with key %v: %v", context.PeerID.IP, key, buf.String())
         }
         
+        // A party that has announced GosaSeal() support must not fall back
+        // to the old encryption with its own key. Only the module keys are
+        // permitted, because they are used to renegotiate.
+        if !context.Sealed && attempt > 0 && announcedSealing(context.PeerID.IP.String()) {
+          util.Log(0, "ERROR! [SECURITY] Rejecting message from %v with old encryption, because it has announced %v", context.PeerID.IP, security.SealEncryption)
+          return ErrorReplyBuffer("Encryption downgrade rejected"), true
+        }
+        
         // special case for CLMSG_save_fai_log because this kind of message
         // is so large and parsing it to XML doesn't really gain us anything.
+        // NOTE: This means that replay protection does not apply to it. A
+        // replayed log only overwrites the same log files.
         if buf.Contains("<CLMSG_save_fai_log>") {
           if handleServerMessage(true,"") {
             clmsg_save_fai_log(buf, context)
@@ -138,6 +172,13 @@ func ProcessEncryptedMessage(buf *bytes.Buffer, context *security.Context) (repl
           return ErrorReplyBuffer(err), true
         } 
         
+        if !context.TLS {
+          if err := checkFreshness(xml, key); err != nil {
+            util.Log(0, "ERROR! [SECURITY] Rejecting message from %v: %v", context.PeerID.IP, err)
+            return ErrorReplyBuffer(err), true
+          }
+        }
+        
         // At this point we have successfully decrypted and parsed the message
         return ProcessXMLMessage(xml, context, key)
       }
@@ -149,16 +190,21 @@ func ProcessEncryptedMessage(buf *bytes.Buffer, context *security.Context) (repl
   
   // Maybe we got out of sync with the sender's encryption key 
   // (e.g. by missing a new_key message). Try to re-establish communcation.
-  ip := context.PeerID.IP.To4()
-  if ip == nil {
-    util.Log(0, "ERROR! Cannot convert sender address to IPv4 address: %v", context.PeerID.IP)
-  } else {
-    go tryToReestablishCommunicationWith(ip.String())
-  }
+  ip := context.PeerID.IP
+  if ip4 := ip.To4(); ip4 != nil { ip = ip4 }
+  go tryToReestablishCommunicationWith(ip.String())
   
   return ErrorReplyBuffer("Could not decrypt message"), true
 }
 
+// Returns true if the server or client at ip has announced support for
+// security.GosaSeal() (and config.Encryption() permits its use).
+func announcedSealing(ip string) bool {
+  if db.ServerSealing(ip) { return true }
+  client := db.ClientWithAddress(ip)
+  return client != nil && security.SupportsSealing(client)
+}
+
 var mapIP2ReestablishDelay = map[string]time.Duration{}
 var mapIP2ReestablishDelay_mutex sync.Mutex
 
@@ -212,7 +258,7 @@ func tryToReestablishCommunicationWith(ip string) {
   if config.RunServer { // 2)
     sendmuell := true
     for _, server := range db.ServerAddresses() {
-      if strings.HasPrefix(server, ip) {
+      if host, _, _ := net.SplitHostPort(server); host == ip {
         sendmuell = false
         srv := server
         go util.WithPanicHandler(func(){ Send_new_server("new_server", srv) })
@@ -221,7 +267,7 @@ func tryToReestablishCommunicationWith(ip string) {
     
     if sendmuell {
       for _, port := range config.ClientPorts {
-        addr := ip + ":" + port
+        addr := net.JoinHostPort(ip, port)
         if addr != config.ServerSourceAddress { // never send "deregistered" to our own server
           dereg :=  "<xml><header>deregistered</header><source>"+config.ServerSourceAddress+"</source><target>"+addr+"</target></xml>"
           go security.SendLnTo(addr, dereg, "", false)
@@ -255,8 +301,8 @@ func ProcessXMLMessage(xml *xml.Hash, context *security.Context, key string) (re
     case "usr_msg":             usr_msg(xml)
     case "set_activated_for_installation": set_activated_for_installation(xml)
     case "detect_hardware":     detect_hardware(xml)
-    case "sistats":             if !context.Access.Query.QueryAll {
-                                  util.Log(0, "WARNING! [SECURITY] Ignoring \"sistats\" query because access control bit \"queryAll\" is not set in certificate")
+    case "sistats":             if !(context.Access.Query.QueryStats || context.Access.Query.QueryAll) {
+                                  util.Log(0, "WARNING! [SECURITY] Ignoring \"sistats\" query because access control bit \"queryStats\" is not set in certificate")
                                 } else {
                                   sistats().WriteTo(reply)
                                 }
@@ -265,6 +311,13 @@ func ProcessXMLMessage(xml *xml.Hash, context *security.Context, key string) (re
                                 } else {
                                   go func(){panic("Panic by user request")}()
                                 }
+    case "reload":              if !context.Access.Misc.Debug {
+                                  util.Log(0, "WARNING! [SECURITY] Ignoring \"reload\" command because access control bit \"debug\" is not set in certificate")
+                                } else {
+                                  // Same as SIGHUP, so that the reload is serialized with
+                                  // the other signals by the main event loop.
+                                  syscall.Kill(os.Getpid(), syscall.SIGHUP)
+                                }
     case "trigger_action_halt",      // "Anhalten"
          "trigger_action_localboot", // "Erzwinge lokalen Start"
          "trigger_action_reboot",    // "Neustarten"
@@ -278,16 +331,21 @@ func ProcessXMLMessage(xml *xml.Hash, context *security.Context, key string) (re
   }
   
   is_server_message := !is_client_message
+  audit := auditInfo{allowed: true}
+  permit := func(bit bool, name string) bool {
+    audit.allowed = handleServerMessage(bit, name)
+    return audit.allowed
+  }
   if is_server_message {
     switch xml.Text("header") {
-      case "gosa_ping":                if handleServerMessage(context.Access.Query.QueryAll, "queryAll") {
+      case "gosa_ping":                if permit(context.Access.Query.QueryAll, "queryAll") {
                                          reply.WriteString(gosa_ping(xml))
                                          disconnect = true
                                        }
-      case "gosa_query_jobdb":         if handleServerMessage(context.Access.Query.QueryJobs||context.Access.Query.QueryAll,"queryJobs") { gosa_query_jobdb(xml, context).WriteTo(reply) }
-      case "gosa_query_fai_server":    if handleServerMessage(context.Access.Query.QueryAll,"queryAll") { gosa_query_fai_server(xml, context).WriteTo(reply) }
-      case "gosa_query_fai_release":   if handleServerMessage(context.Access.Query.QueryAll,"queryAll") { gosa_query_fai_release(xml, context).WriteTo(reply) }
-      case "gosa_query_packages_list": if handleServerMessage(context.Access.Query.QueryAll,"queryAll") { 
+      case "gosa_query_jobdb":         if permit(context.Access.Query.QueryJobs||context.Access.Query.QueryAll,"queryJobs") { gosa_query_jobdb(xml, context).WriteTo(reply) }
+      case "gosa_query_fai_server":    if permit(context.Access.Query.QueryFAI||context.Access.Query.QueryAll,"queryFAI") { gosa_query_fai_server(xml, context).WriteTo(reply) }
+      case "gosa_query_fai_release":   if permit(context.Access.Query.QueryFAI||context.Access.Query.QueryAll,"queryFAI") { gosa_query_fai_release(xml, context).WriteTo(reply) }
+      case "gosa_query_packages_list": if permit(context.Access.Query.QueryPackages||context.Access.Query.QueryAll,"queryPackages") { 
                                          // result can be very large, so make sure
                                          // memory is free'd immediately instead of
                                          // waiting for GC
@@ -295,7 +353,7 @@ func ProcessXMLMessage(xml *xml.Hash, context *security.Context, key string) (re
                                          pkg.WriteTo(reply)
                                          pkg.Destroy()
                                        }
-      case "gosa_query_audit":         if handleServerMessage(context.Access.Query.QueryAll,"queryAll") { 
+      case "gosa_query_audit":         if permit(context.Access.Query.QueryAudit||context.Access.Query.QueryAll,"queryAudit") { 
                                          // result can be very large, so make sure
                                          // memory is free'd immediately instead of
                                          // waiting for GC
@@ -303,7 +361,7 @@ func ProcessXMLMessage(xml *xml.Hash, context *security.Context, key string) (re
                                          audit.WriteTo(reply)
                                          audit.Destroy()
                                        }
-      case "gosa_query_audit_aggregate":if handleServerMessage(context.Access.Query.QueryAll,"queryAll") { 
+      case "gosa_query_audit_aggregate":if permit(context.Access.Query.QueryAudit||context.Access.Query.QueryAll,"queryAudit") { 
                                          // result can be very large, so make sure
                                          // memory is free'd immediately instead of
                                          // waiting for GC
@@ -311,33 +369,49 @@ func ProcessXMLMessage(xml *xml.Hash, context *security.Context, key string) (re
                                          audit.WriteTo(reply)
                                          audit.Destroy()
                                        }
-      case "gosa_show_log_by_mac":     if handleServerMessage(context.Access.Query.QueryAll,"queryAll") { gosa_show_log_by_mac(xml).WriteTo(reply) }
+      case "gosa_query_audit_trail":   if permit(context.Access.Query.QueryAudit||context.Access.Query.QueryAll,"queryAudit") { gosa_query_audit_trail(xml, context).WriteTo(reply) }
+      case "gosa_add_audit_trail_entry":
+                                       if permit(context.Access.Jobs.ModifyJobs,"modifyJobs") { audit.result = gosa_add_audit_trail_entry(xml, context); audit.result.WriteTo(reply) }
+      case "gosa_query_connection_limits":
+                                       if permit(context.Access.Query.QueryStats||context.Access.Query.QueryAll,"queryStats") {
+                                         gosa_query_connection_limits(xml).WriteTo(reply)
+                                       }
+      case "gosa_lift_ban":            if permit(context.Access.Misc.Debug,"debug") { audit.result = gosa_lift_ban(xml); audit.result.WriteTo(reply) }
+      case "gosa_show_log_by_mac":     if permit(context.Access.Query.QueryLogs||context.Access.Query.QueryAll,"queryLogs") { gosa_show_log_by_mac(xml).WriteTo(reply) }
       case "gosa_show_log_files_by_date_and_mac": 
-                                       if handleServerMessage(context.Access.Query.QueryAll,"queryAll") { 
+                                       if permit(context.Access.Query.QueryLogs||context.Access.Query.QueryAll,"queryLogs") { 
                                          gosa_show_log_files_by_date_and_mac(xml).WriteTo(reply)
                                        }
       case "gosa_get_log_file_by_date_and_mac":   
-                                       if handleServerMessage(context.Access.Query.QueryAll,"queryAll") { 
+                                       if permit(context.Access.Query.QueryLogs||context.Access.Query.QueryAll,"queryLogs") { 
                                          gosa_get_log_file_by_date_and_mac(xml).WriteTo(reply)
                                        }
       case "gosa_get_available_kernel":   
-                                       if handleServerMessage(context.Access.Query.QueryAll,"queryAll") {
+                                       if permit(context.Access.Query.QueryPackages||context.Access.Query.QueryAll,"queryPackages") {
                                          gosa_get_available_kernel(xml,context).WriteTo(reply)
                                        }
-      case "new_server":          if handleServerMessage(context.Access.Misc.Peer,"peer") { new_server(xml) }
-      case "confirm_new_server":  if handleServerMessage(context.Access.Misc.Peer,"peer") { confirm_new_server(xml) }
-      case "foreign_job_updates": if handleServerMessage(context.Access.Misc.Peer,"peer") { foreign_job_updates(xml) }
-      case "new_foreign_client":  if handleServerMessage(true,"") { new_foreign_client(xml) }
-      case "information_sharing": if handleServerMessage(true,"") { information_sharing(xml) }
-      case "here_i_am":           if handleServerMessage(true,"") { here_i_am(xml) }
-      case "new_key":             if handleServerMessage(true,"") { new_key(xml) }
-      case "detected_hardware":   if handleServerMessage(true,"") { detected_hardware(xml) }
-      case "CLMSG_CURRENTLY_LOGGED_IN": if handleServerMessage(true,"") { clmsg_currently_logged_in(xml) }
-      case "CLMSG_LOGIN":         if handleServerMessage(true,"") { clmsg_login(xml) }
-      case "CLMSG_LOGOUT":        if handleServerMessage(true,"") {clmsg_logout(xml) }
-      case "CLMSG_PROGRESS":      if handleServerMessage(true,"") {clmsg_progress(xml) }
-      case "CLMSG_TASKDIE":       if handleServerMessage(true,"") {clmsg_taskdie(xml) }
-      case "CLMSG_GOTOACTIVATION":if handleServerMessage(true,"") {clmsg_gotoactivation(xml) }
+      case "new_server":          if permit(context.Access.Misc.Peer,"peer") && peerCertificateOK(xml, context, true) { 
+                                    new_server(xml)
+                                    peerCertificateOK(xml, context, false) // pins the certificate of a new peer
+                                  }
+      case "confirm_new_server":  if permit(context.Access.Misc.Peer,"peer") && peerCertificateOK(xml, context, false) { 
+                                    confirm_new_server(xml)
+                                    peerCertificateOK(xml, context, false) // pins the certificate of a peer contacted for the first time
+                                  }
+      case "foreign_job_updates": if permit(context.Access.Misc.Peer,"peer") && peerCertificateOK(xml, context, false) { foreign_job_updates(xml) }
+      case "gosa_approve_peer_certificate":
+                                  if permit(context.Access.Misc.Debug,"debug") { audit.result = gosa_approve_peer_certificate(xml); audit.result.WriteTo(reply) }
+      case "new_foreign_client":  if permit(true,"") { new_foreign_client(xml) }
+      case "information_sharing": if permit(true,"") { information_sharing(xml) }
+      case "here_i_am":           if permit(true,"") { here_i_am(xml) }
+      case "new_key":             if permit(true,"") { new_key(xml) }
+      case "detected_hardware":   if permit(true,"") { detected_hardware(xml) }
+      case "CLMSG_CURRENTLY_LOGGED_IN": if permit(true,"") { clmsg_currently_logged_in(xml) }
+      case "CLMSG_LOGIN":         if permit(true,"") { clmsg_login(xml) }
+      case "CLMSG_LOGOUT":        if permit(true,"") {clmsg_logout(xml) }
+      case "CLMSG_PROGRESS":      if permit(true,"") {clmsg_progress(xml) }
+      case "CLMSG_TASKDIE":       if permit(true,"") {clmsg_taskdie(xml) }
+      case "CLMSG_GOTOACTIVATION":if permit(true,"") {clmsg_gotoactivation(xml) }
       case "CLMSG_HOOK",
            "CLMSG_TASKBEGIN",
            "CLMSG_check",
@@ -345,90 +419,90 @@ func ProcessXMLMessage(xml *xml.Hash, context *security.Context, key string) (re
                                   util.Log(2, "DEBUG! ProcessXMLMessage: '%v'\n=======start FAI message=======\n%v\n=======end FAI message=======", xml.Text("header"), xml.String())
       case "job_set_activated_for_installation",
            "gosa_set_activated_for_installation":
-                                  if handleServerMessage(context.Access.Jobs.Unlock||context.Access.Jobs.JobsAll,"unlock") { gosa_set_activated_for_installation(xml) }
+                                  if permit(context.Access.Jobs.Unlock||context.Access.Jobs.JobsAll,"unlock") { audit.result = gosa_set_activated_for_installation(xml, context) } // no reply
       case "gosa_trigger_action_lock":      // "Sperre"
-                                  if handleServerMessage(context.Access.Jobs.Lock||context.Access.Jobs.JobsAll,"lock") {
-                                    gosa_trigger_action(xml).WriteTo(reply)
+                                  if permit(context.Access.Jobs.Lock||context.Access.Jobs.JobsAll,"lock") {
+                                    audit.result = gosa_trigger_action(xml, context); audit.result.WriteTo(reply)
                                   }
       case "gosa_trigger_action_reboot",    // "Neustarten"
            "gosa_trigger_action_halt":      // "Anhalten"
-                                  if handleServerMessage(context.Access.Jobs.Shutdown||context.Access.Jobs.JobsAll,"shutdown") {
-                                    gosa_trigger_action(xml).WriteTo(reply)
+                                  if permit(context.Access.Jobs.Shutdown||context.Access.Jobs.JobsAll,"shutdown") {
+                                    audit.result = gosa_trigger_action(xml, context); audit.result.WriteTo(reply)
                                   }
       case "gosa_trigger_action_localboot", // "Erzwinge lokalen Start"
            "gosa_trigger_action_faireboot": // "Job abbrechen"
-                                  if handleServerMessage(context.Access.Jobs.Abort||context.Access.Jobs.JobsAll,"abort") {
-                                    gosa_trigger_action(xml).WriteTo(reply)
+                                  if permit(context.Access.Jobs.Abort||context.Access.Jobs.JobsAll,"abort") {
+                                    audit.result = gosa_trigger_action(xml, context); audit.result.WriteTo(reply)
                                   }
       case "gosa_trigger_action_activate":  // "Sperre aufheben"
-                                  if handleServerMessage(context.Access.Jobs.Unlock||context.Access.Jobs.JobsAll,"unlock") {
-                                    gosa_trigger_action(xml).WriteTo(reply)
+                                  if permit(context.Access.Jobs.Unlock||context.Access.Jobs.JobsAll,"unlock") {
+                                    audit.result = gosa_trigger_action(xml, context); audit.result.WriteTo(reply)
                                   }
       case "gosa_trigger_action_update":    // "Aktualisieren"
-                                  if handleServerMessage(context.Access.Jobs.Update||context.Access.Jobs.JobsAll,"update") {
-                                    gosa_trigger_action(xml).WriteTo(reply)
+                                  if permit(context.Access.Jobs.Update||context.Access.Jobs.JobsAll,"update") {
+                                    audit.result = gosa_trigger_action(xml, context); audit.result.WriteTo(reply)
                                   }
       case "gosa_trigger_action_reinstall": // "Neuinstallation"
-                                  if handleServerMessage(context.Access.Jobs.Install||context.Access.Jobs.JobsAll,"install") {
-                                    gosa_trigger_action(xml).WriteTo(reply)
+                                  if permit(context.Access.Jobs.Install||context.Access.Jobs.JobsAll,"install") {
+                                    audit.result = gosa_trigger_action(xml, context); audit.result.WriteTo(reply)
                                   }
       case "gosa_trigger_action_wake":      // "Aufwecken"
-                                  if handleServerMessage(context.Access.Jobs.Wake||context.Access.Jobs.JobsAll,"wake") {
-                                    gosa_trigger_action(xml).WriteTo(reply)
+                                  if permit(context.Access.Jobs.Wake||context.Access.Jobs.JobsAll,"wake") {
+                                    audit.result = gosa_trigger_action(xml, context); audit.result.WriteTo(reply)
                                   }
       case "gosa_trigger_action_audit":      // "Auditieren"
-                                  if handleServerMessage(context.Access.Jobs.Audit||context.Access.Jobs.JobsAll,"audit") {
-                                    gosa_trigger_action(xml).WriteTo(reply)
+                                  if permit(context.Access.Jobs.Audit||context.Access.Jobs.JobsAll,"audit") {
+                                    audit.result = gosa_trigger_action(xml, context); audit.result.WriteTo(reply)
                                   }
       case "job_trigger_action_lock":      // "Sperre"
-                                  if handleServerMessage(context.Access.Jobs.Lock||context.Access.Jobs.JobsAll,"lock") {
-                                    job_trigger_action(xml).WriteTo(reply)
+                                  if permit(context.Access.Jobs.Lock||context.Access.Jobs.JobsAll,"lock") {
+                                    audit.result = job_trigger_action(xml, context); audit.result.WriteTo(reply)
                                   }
       case "job_trigger_action_halt",      // "Anhalten"
            "job_trigger_action_reboot":    // "Neustarten"
-                                  if handleServerMessage(context.Access.Jobs.Shutdown||context.Access.Jobs.JobsAll,"shutdown") {
-                                    job_trigger_action(xml).WriteTo(reply)
+                                  if permit(context.Access.Jobs.Shutdown||context.Access.Jobs.JobsAll,"shutdown") {
+                                    audit.result = job_trigger_action(xml, context); audit.result.WriteTo(reply)
                                   }
       case "job_trigger_action_localboot", // "Erzwinge lokalen Start"
            "job_trigger_action_faireboot": // "Job abbrechen"
-                                  if handleServerMessage(context.Access.Jobs.Abort||context.Access.Jobs.JobsAll,"abort") {
-                                    job_trigger_action(xml).WriteTo(reply)
+                                  if permit(context.Access.Jobs.Abort||context.Access.Jobs.JobsAll,"abort") {
+                                    audit.result = job_trigger_action(xml, context); audit.result.WriteTo(reply)
                                   }
       case "job_trigger_action_activate":  // "Sperre aufheben"
-                                  if handleServerMessage(context.Access.Jobs.Unlock||context.Access.Jobs.JobsAll,"unlock") {
-                                    job_trigger_action(xml).WriteTo(reply)
+                                  if permit(context.Access.Jobs.Unlock||context.Access.Jobs.JobsAll,"unlock") {
+                                    audit.result = job_trigger_action(xml, context); audit.result.WriteTo(reply)
                                   }
       case "job_trigger_action_update":    // "Aktualisieren"
-                                  if handleServerMessage(context.Access.Jobs.Update||context.Access.Jobs.JobsAll,"update") {
-                                    job_trigger_action(xml).WriteTo(reply)
+                                  if permit(context.Access.Jobs.Update||context.Access.Jobs.JobsAll,"update") {
+                                    audit.result = job_trigger_action(xml, context); audit.result.WriteTo(reply)
                                   }
       case "job_trigger_action_reinstall": // "Neuinstallation"
-                                  if handleServerMessage(context.Access.Jobs.Install||context.Access.Jobs.JobsAll,"install") {
-                                    job_trigger_action(xml).WriteTo(reply)
+                                  if permit(context.Access.Jobs.Install||context.Access.Jobs.JobsAll,"install") {
+                                    audit.result = job_trigger_action(xml, context); audit.result.WriteTo(reply)
                                   }
       case "job_trigger_action_wake":      // "Aufwecken"
-                                  if handleServerMessage(context.Access.Jobs.Wake||context.Access.Jobs.JobsAll,"wake") {
-                                    job_trigger_action(xml).WriteTo(reply)
+                                  if permit(context.Access.Jobs.Wake||context.Access.Jobs.JobsAll,"wake") {
+                                    audit.result = job_trigger_action(xml, context); audit.result.WriteTo(reply)
                                   }
       case "job_trigger_action_audit":      // "Auditieren"
-                                  if handleServerMessage(context.Access.Jobs.Audit||context.Access.Jobs.JobsAll,"audit") {
-                                    job_trigger_action(xml).WriteTo(reply)
+                                  if permit(context.Access.Jobs.Audit||context.Access.Jobs.JobsAll,"audit") {
+                                    audit.result = job_trigger_action(xml, context); audit.result.WriteTo(reply)
                                   }
       case "gosa_trigger_activate_new",
            "job_trigger_activate_new":
-                                  if handleServerMessage(context.Access.Jobs.NewSys||context.Access.Jobs.JobsAll,"newSys") {
-                                    job_trigger_activate_new(xml).WriteTo(reply)
+                                  if permit(context.Access.Jobs.NewSys||context.Access.Jobs.JobsAll,"newSys") {
+                                    audit.result = job_trigger_activate_new(xml, context); audit.result.WriteTo(reply)
                                   }
       case "gosa_send_user_msg",
-           "job_send_user_msg":   if handleServerMessage(context.Access.Jobs.UserMsg||context.Access.Jobs.JobsAll,"userMsg") { job_send_user_msg(xml).WriteTo(reply) }
-      case "trigger_wake":        if handleServerMessage(context.Access.Misc.Wake,"wake") {
+           "job_send_user_msg":   if permit(context.Access.Jobs.UserMsg||context.Access.Jobs.JobsAll,"userMsg") { job_send_user_msg(xml).WriteTo(reply) }
+      case "trigger_wake":        if permit(context.Access.Misc.Wake,"wake") {
                                     trigger_wake(xml)
                                   }
       
       case "gosa_delete_jobdb_entry":
-                                  if handleServerMessage(context.Access.Jobs.ModifyJobs,"modifyJobs") { gosa_delete_jobdb_entry(xml).WriteTo(reply) }
+                                  if permit(context.Access.Jobs.ModifyJobs,"modifyJobs") { audit.result = gosa_delete_jobdb_entry(xml, context); audit.result.WriteTo(reply) }
       case "gosa_update_status_jobdb_entry":
-                                  if handleServerMessage(context.Access.Jobs.ModifyJobs,"modifyJobs") { gosa_update_status_jobdb_entry(xml).WriteTo(reply) }
+                                  if permit(context.Access.Jobs.ModifyJobs,"modifyJobs") { audit.result = gosa_update_status_jobdb_entry(xml, context); audit.result.WriteTo(reply) }
     default:
           is_server_message = false
     }
@@ -440,9 +514,17 @@ func ProcessXMLMessage(xml *xml.Hash, context *security.Context, key string) (re
     ErrorReplyXML("Unknown message type").WriteTo(reply)
   }
   
+  if is_server_message && isAuditedMessage(xml.Text("header")) {
+    auditTrail(xml, context, &audit)
+  }
+  
   disconnect = disconnect || reply.Contains("<error_string>")
   if key != "dummy-key" {
-    security.GosaEncryptBuffer(reply, key)
+    if context.Sealed {
+      security.GosaSealBuffer(reply, key)
+    } else {
+      security.GosaEncryptBuffer(reply, key)
+    }
   }
   return
 }
@@ -22,10 +22,12 @@ import (
          "os/exec"
          "math/rand"
          
+         "../db"
          "../xml"
          "github.com/mbenkmann/golib/util"
          "github.com/mbenkmann/golib/deque"
          "../config"
+         "../security"
        )
 
 
@@ -49,7 +51,10 @@ var timeout_for_confirmation = 60*time.Second
 //  xmlmsg: the decrypted and parsed message
 func registered(xmlmsg *xml.Hash) {
   server := xmlmsg.Text("source")
-  if server != "" { registrationQueue.Push(xmlmsg.Clone()) }
+  if server != "" {
+    security.SetSealing(server, security.SupportsSealing(xmlmsg))
+    registrationQueue.Push(xmlmsg.Clone())
+  }
 }
 
 // Handles the message "deregistered".
@@ -180,13 +185,13 @@ func CallRegisteredHook(xmlmsg *xml.Hash) {
   for _, tag := range xmlmsg.Subtags() {
     env = append(env, tag+"="+strings.Join(xmlmsg.Get(tag),"\n"))
   }
-  cmd := exec.Command(config.RegisteredHookPath)
+  cmd := exec.Command(config.RegisteredHookPath())
   env = append(env, "xml="+xmlmsg.String())
   cmd.Env = append(env, os.Environ()...)
-  util.Log(1, "INFO! Running registered-hook %v with parameters %v", config.RegisteredHookPath, env)
-  out, err := cmd.CombinedOutput()
+  util.Log(1, "INFO! Running registered-hook %v with parameters %v", config.RegisteredHookPath(), env)
+  out, err := db.HookCombinedOutput("registered-hook", cmd)
   if err != nil {
-    util.Log(0, "ERROR! registered-hook %v: %v (%v)", config.RegisteredHookPath, err, string(out))
+    util.Log(0, "ERROR! registered-hook %v: %v (%v)", config.RegisteredHookPath(), err, out)
     return
   }
   util.Log(1, "INFO! Finished registered-hook. Running time: %v", time.Since(start))
@@ -0,0 +1,102 @@
+/*
+Copyright (c) 2026 go-susi contributors
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package message
+
+import (
+         "fmt"
+         "sync"
+         "time"
+         "strconv"
+         "sync/atomic"
+
+         "../xml"
+         "../config"
+       )
+
+// Maximum number of nonces remembered by the replay cache. If more
+// messages arrive within config.ReplayWindow(), the oldest nonces are
+// forgotten.
+const replayCacheSize = 65536
+
+// Number of messages rejected because their <msgnonce> had been seen before.
+var ReplayedMessages int32
+
+// Number of messages rejected because their <msgtime> was outside of
+// config.ReplayWindow() or because they lacked <msgtime> and <msgnonce>
+// although replay protection is "require".
+var StaleMessages int32
+
+// The nonces of recently received messages.
+var replayCache = map[string]bool{}
+// The nonces from replayCache in the order they were added. Used as a ring
+// buffer with replayCacheNext being the index of the oldest entry.
+var replayCacheOrder = make([]string, 0, replayCacheSize)
+var replayCacheNext = 0
+var replayCacheMutex sync.Mutex
+
+// Returns the replay protection mode for messages decrypted with key.
+// See config.ReplayProtection().
+func replayProtection(key string) string {
+  if mode, ok := config.ReplayProtection()[key]; ok { return mode }
+  return config.ReplayProtectionDefault()
+}
+
+// Removes <msgtime> and <msgnonce> (see security.Stamp()) from xmlmsg and,
+// unless the replay protection mode for key is "off", checks them.
+// Returns an error if xmlmsg is stale or a replay or if it lacks the
+// elements but the mode is "require".
+func checkFreshness(xmlmsg *xml.Hash, key string) error {
+  msgtime := xmlmsg.RemoveFirst("msgtime")
+  msgnonce := xmlmsg.RemoveFirst("msgnonce")
+  mode := replayProtection(key)
+  if mode == "off" { return nil }
+
+  if msgtime == nil || msgnonce == nil || msgnonce.Text() == "" {
+    if mode == "require" {
+      atomic.AddInt32(&StaleMessages, 1)
+      return fmt.Errorf("Message without <msgtime> and <msgnonce>")
+    }
+    return nil
+  }
+
+  secs, err := strconv.ParseInt(msgtime.Text(), 10, 64)
+  if err != nil {
+    atomic.AddInt32(&StaleMessages, 1)
+    return fmt.Errorf("Illegal <msgtime>: %v", msgtime.Text())
+  }
+  sent := time.Unix(secs, 0)
+  now := time.Now()
+  if sent.Before(now.Add(-config.ReplayWindow())) || sent.After(now.Add(config.ReplayWindow())) {
+    atomic.AddInt32(&StaleMessages, 1)
+    return fmt.Errorf("Stale message (<msgtime> %v)", sent.Format("2006-01-02 15:04:05"))
+  }
+
+  nonce := msgnonce.Text()
+  replayCacheMutex.Lock()
+  defer replayCacheMutex.Unlock()
+  if replayCache[nonce] {
+    atomic.AddInt32(&ReplayedMessages, 1)
+    return fmt.Errorf("Replayed message (<msgnonce> %v)", nonce)
+  }
+  if len(replayCacheOrder) < replayCacheSize {
+    replayCacheOrder = append(replayCacheOrder, nonce)
+  } else {
+    delete(replayCache, replayCacheOrder[replayCacheNext])
+    replayCacheOrder[replayCacheNext] = nonce
+    replayCacheNext = (replayCacheNext + 1) % replayCacheSize
+  }
+  replayCache[nonce] = true
+  return nil
+}
@@ -26,6 +26,7 @@ import (
          "os"
          "os/exec"
          
+         "../db"
          "../xml"
          "github.com/mbenkmann/golib/util"
          "../config"
@@ -39,14 +40,14 @@ func set_activated_for_installation(xmlmsg *xml.Hash) {
   for _, tag := range xmlmsg.Subtags() {
     env = append(env, tag+"="+strings.Join(xmlmsg.Get(tag),"\n"))
   }
-  cmd := exec.Command(config.ActivatedHookPath)
+  cmd := exec.Command(config.ActivatedHookPath())
   env = append(env, "xml="+xmlmsg.String())
   env = append(env, "faistate="+xmlmsg.Text("faistate"))
   cmd.Env = append(env, os.Environ()...)
-  util.Log(1, "INFO! Running activated-hook %v with parameters %v", config.ActivatedHookPath, env)
-  out, err := cmd.CombinedOutput()
+  util.Log(1, "INFO! Running activated-hook %v with parameters %v", config.ActivatedHookPath(), env)
+  out, err := db.HookCombinedOutput("activated-hook", cmd)
   if err != nil {
-    util.Log(0, "ERROR! activated-hook %v: %v (%v)", config.ActivatedHookPath, err, string(out))
+    util.Log(0, "ERROR! activated-hook %v: %v (%v)", config.ActivatedHookPath(), err, out)
     return
   }
   util.Log(1, "INFO! Finished activated-hook. Running time: %v", time.Since(start))
@@ -99,6 +99,24 @@ func sistats() *xml.Hash {
   answer.Add("SusiPeersDown", susipeersdown)
   answer.Add("NonSusiPeersUp", nonsusipeers)
   answer.Add("NonSusiPeersDown", nonsusipeersdown)
+  answer.Add("PeerCertificateMismatches", atomic.LoadInt32(&db.ServerCertificateMismatches))
+  answer.Add("PeerCertificatesRejected", db.ServerCertificatesRejected())
+  answer.Add("ReplayedMessages", atomic.LoadInt32(&ReplayedMessages))
+  answer.Add("StaleMessages", atomic.LoadInt32(&StaleMessages))
+  running, waiting := db.HooksRunning()
+  answer.Add("HooksRunning", running)
+  answer.Add("HooksWaiting", waiting)
+  var hookstat db.HookStat
+  for _, stat := range db.HookStats() {
+    hookstat.Count += stat.Count
+    hookstat.Failures += stat.Failures
+    hookstat.Timeouts += stat.Timeouts
+    hookstat.OutputExceeded += stat.OutputExceeded
+  }
+  answer.Add("HookExecutions", hookstat.Count)
+  answer.Add("HookFailures", hookstat.Failures)
+  answer.Add("HookTimeouts", hookstat.Timeouts)
+  answer.Add("HookOutputExceeded", hookstat.OutputExceeded)
   var clistats ClientStats
   db.ClientsQuery(&clistats)
   time.Sleep(2*time.Second) // give Up checks time to succeed
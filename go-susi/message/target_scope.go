@@ -0,0 +1,86 @@
+/*
+Copyright (c) 2026 go-susi contributors
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package message
+
+import (
+         "../db"
+         "../xml"
+         "github.com/mbenkmann/golib/util"
+         "../security"
+       )
+
+// Maps MAC addresses to the result of db.SystemInScope() for the context
+// of a single request, so that LDAP is accessed only once per machine even
+// if the request affects several jobs of the same machine or checks the
+// same machine more than once.
+type scopeCache map[string]bool
+
+// Returns true if the machine with the given macaddress is within the
+// target scope of context. Only the first call for a given macaddress
+// accesses LDAP.
+func (cache scopeCache) inScope(macaddress string, context *security.Context) bool {
+  in_scope, ok := cache[macaddress]
+  if !ok {
+    in_scope = db.SystemInScope(macaddress, &context.Scope)
+    cache[macaddress] = in_scope
+  }
+  return in_scope
+}
+
+// Returns true if the peer described by context may create or modify jobs
+// for the machine with the given macaddress (see security.GosaTargetScope).
+// If not, a security warning is logged.
+//
+// ATTENTION! This function accesses LDAP if the scope is restricted and
+// the result for macaddress is not in cache.
+func targetInScope(macaddress string, context *security.Context, cache scopeCache) bool {
+  if cache.inScope(macaddress, context) { return true }
+  util.Log(0, "WARNING! [SECURITY] %v (%v) is not permitted to target %v because of the certificate's GosaTargetScope", context.PeerID.IP, context.Subject, macaddress)
+  return false
+}
+
+// Returns a filter that accepts those jobs accepted by filter whose
+// macaddress is within the target scope of context. If the scope is
+// unrestricted, filter itself is returned.
+// If modify is true, the filter is used to select jobs to be modified or
+// removed and a security warning is logged for each machine that is
+// excluded. Otherwise the filter is used for a query and excluded machines
+// are only logged at debug level.
+// Because HashFilters are evaluated by the jobdb goroutine, LDAP can not
+// be accessed from within the filter. Therefore this function queries
+// the jobdb for the jobs matching filter and restricts the returned filter
+// to the MAC addresses of those that are in scope. Jobs added for other
+// machines in the meantime are not accepted.
+func scopeFilter(filter xml.HashFilter, context *security.Context, cache scopeCache, modify bool) xml.HashFilter {
+  if context.Scope.Unrestricted() { return filter }
+  
+  in_scope := []xml.HashFilter{}
+  checked := map[string]bool{}
+  jobs := db.JobsQuery(filter)
+  for job := jobs.FirstChild(); job != nil; job = job.Next() {
+    macaddress := job.Element().Text("macaddress")
+    if checked[macaddress] { continue }
+    checked[macaddress] = true
+    if modify {
+      if !targetInScope(macaddress, context, cache) { continue }
+    } else if !cache.inScope(macaddress, context) {
+      util.Log(2, "DEBUG! Hiding jobs for %v from %v (%v) because of the certificate's GosaTargetScope", macaddress, context.PeerID.IP, context.Subject)
+      continue
+    }
+    in_scope = append(in_scope, xml.FilterSimple("macaddress", macaddress))
+  }
+  
+  return xml.FilterAnd([]xml.HashFilter{filter, xml.FilterOr(in_scope)})
+}
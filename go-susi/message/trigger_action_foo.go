@@ -21,6 +21,7 @@ import (
          "os/exec"
          "strings"
          
+         "../db"
          "../xml"
          "github.com/mbenkmann/golib/util"
          "../config"
@@ -34,13 +35,13 @@ func trigger_action_foo(xmlmsg *xml.Hash) {
   for _, tag := range xmlmsg.Subtags() {
     env = append(env, tag+"="+strings.Join(xmlmsg.Get(tag),"\n"))
   }
-  cmd := exec.Command(config.TriggerActionHookPath)
+  cmd := exec.Command(config.TriggerActionHookPath())
   env = append(env, "xml="+xmlmsg.String())
   cmd.Env = append(env, os.Environ()...)
-  util.Log(1, "INFO! Running trigger-action-hook %v with parameters %v", config.TriggerActionHookPath, env)
-  out, err := cmd.CombinedOutput()
+  util.Log(1, "INFO! Running trigger-action-hook %v with parameters %v", config.TriggerActionHookPath(), env)
+  out, err := db.HookCombinedOutput("trigger-action-hook", cmd)
   if err != nil {
-    util.Log(0, "ERROR! trigger-action-hook %v: %v (%v)", config.TriggerActionHookPath, err, string(out))
+    util.Log(0, "ERROR! trigger-action-hook %v: %v (%v)", config.TriggerActionHookPath(), err, out)
     return
   }
   util.Log(1, "INFO! Finished trigger-action-hook. Running time: %v", time.Since(start))
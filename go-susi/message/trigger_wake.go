@@ -21,6 +21,8 @@ MA  02110-1301, USA.
 package message
 
 import (
+         "net"
+         "bytes"
          "strings"
          
          "../db"
@@ -41,10 +43,14 @@ func trigger_wake(xmlmsg *xml.Hash) {
 func TriggerWake(macaddress string) bool {
   wake_target := []string{}
   if system := db.ServerWithMAC(macaddress); system != nil {
-    wake_target = append(wake_target, strings.Split(system.Text("source"),":")[0])
+    if host, _, err := net.SplitHostPort(system.Text("source")); err == nil {
+      wake_target = append(wake_target, host)
+    }
   }
   if system := db.ClientWithMAC(macaddress); system != nil {
-    wake_target = append(wake_target, strings.Split(system.Text("client"),":")[0])
+    if host, _, err := net.SplitHostPort(system.Text("client")); err == nil {
+      wake_target = append(wake_target, host)
+    }
   }
   if system := db.SystemFullyQualifiedNameForMAC(macaddress); system != "none" {
     wake_target = append(wake_target, system)
@@ -52,12 +58,12 @@ func TriggerWake(macaddress string) bool {
   
   woken := false
   for i := range wake_target {
-    if err := util.Wake(macaddress, wake_target[i]); err == nil { 
+    if err := WakeOnLAN(macaddress, wake_target[i]); err == nil { 
       util.Log(1, "INFO! Sent Wake-On-LAN for MAC %v to %v", macaddress, wake_target[i])
       woken = true
       // We do not break here, because the data in the serverDB or clientDB may
       // be stale and since we're sending UDP packets, there's no guarantee
-      // that util.Wake() will fail even if the system is no longer there.
+      // that WakeOnLAN() will fail even if the system is no longer there.
       // Since the WOL packets include the MAC address it can't hurt to
       // send more than necessary.
     } else {
@@ -67,3 +73,24 @@ func TriggerWake(macaddress string) bool {
   
   return woken
 }
+
+// Sends a Wake-On-LAN packet for macaddress to target, which may be a host name,
+// an IP address or a broadcast address. IPv6 addresses (optionally with a zone
+// such as "ff02::1%eth0") are handled here because util.Wake() only supports IPv4.
+func WakeOnLAN(macaddress string, target string) error {
+  host := target
+  if i := strings.Index(host, "%"); i >= 0 { host = host[0:i] }
+  ip := net.ParseIP(host)
+  if ip == nil || ip.To4() != nil {
+    return util.Wake(macaddress, target)
+  }
+  
+  mac, err := net.ParseMAC(macaddress)
+  if err != nil { return err }
+  packet := append(bytes.Repeat([]byte{0xff}, 6), bytes.Repeat(mac, 16)...)
+  conn, err := net.Dial("udp6", net.JoinHostPort(target, "9"))
+  if err != nil { return err }
+  defer conn.Close()
+  _, err = conn.Write(packet)
+  return err
+}
@@ -0,0 +1,186 @@
+/*
+Copyright (c) 2026 go-susi contributors
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+
+// Access controls, TLS, encryption, connection limits,...
+package security
+
+import (
+         "sync"
+         "strings"
+         "crypto/aes"
+         "crypto/hmac"
+         "crypto/rand"
+         "crypto/cipher"
+         "crypto/sha256"
+         "encoding/base64"
+
+         "github.com/mbenkmann/golib/bytes"
+         "../xml"
+         "../config"
+       )
+
+// The value of the <encryption> element with which go-susi announces
+// support for GosaSeal() in here_i_am, registered, new_server and
+// confirm_new_server.
+const SealEncryption = "aes-256-gcm"
+
+// Prefix of messages encrypted with GosaSeal(). It contains a character that
+// does not occur in base64, so that sealed messages can not be confused with
+// messages encrypted with GosaEncrypt().
+const sealPrefix = "GCM1:"
+
+// Salt and info for deriving the AES key from a key word with HKDF.
+const kdfSalt = "go-susi GosaSeal salt"
+const kdfInfo = "go-susi GosaSeal aes-256-gcm v1"
+
+// Maps a key word to the AEAD derived from it. Cleared when it grows
+// beyond maxAEADs entries.
+const maxAEADs = 1000
+var aeads = map[string]cipher.AEAD{}
+var aeadsMutex sync.Mutex
+
+// Addresses (IP:PORT) of parties that have announced support for GosaSeal()
+// in a message that does not end up in one of the databases, i.e. the
+// servers a go-susi client has registered at. See SetSealing().
+var sealTargets = map[string]bool{}
+var sealTargetsMutex sync.Mutex
+
+// Returns the AES-256-GCM AEAD for the key word key. The AES key is derived
+// from key with HKDF-SHA256 (RFC 5869).
+// HKDF does no key stretching, so with a single captured sealed message
+// guesses for key can be tested as fast as HMAC-SHA256 can be computed.
+// This is acceptable only because module keys must be long random strings
+// (see config.MinModuleKeyLength). A password-based KDF (PBKDF2, scrypt)
+// with a per-message salt would have to run for every message sent and
+// received, which busy servers can not afford.
+func aeadFor(key string) cipher.AEAD {
+  aeadsMutex.Lock()
+  defer aeadsMutex.Unlock()
+  if aead, ok := aeads[key]; ok { return aead }
+  if len(aeads) >= maxAEADs { aeads = map[string]cipher.AEAD{} }
+
+  extract := hmac.New(sha256.New, []byte(kdfSalt))
+  extract.Write([]byte(key))
+  expand := hmac.New(sha256.New, extract.Sum(nil))
+  expand.Write([]byte(kdfInfo))
+  expand.Write([]byte{1})
+  block, _ := aes.NewCipher(expand.Sum(nil)) // 32 bytes => AES-256
+  aead, _ := cipher.NewGCM(block)
+  aeads[key] = aead
+  return aead
+}
+
+// Returns msg encrypted and authenticated with AES-256-GCM under a random
+// nonce. The AES key is derived from key (a word as used in gosa-si.conf).
+// The result is sealPrefix followed by the base64 encoding of nonce and
+// ciphertext. If msg == "", "" will be returned.
+// Only use this for parties that have announced SealEncryption. gosa-si
+// does not understand it.
+func GosaSeal(msg string, key string) string {
+  if msg == "" { return "" }
+  aead := aeadFor(key)
+  nonce := make([]byte, aead.NonceSize(), aead.NonceSize() + len(msg) + aead.Overhead())
+  if _, err := rand.Read(nonce); err != nil { panic(err) }
+  sealed := aead.Seal(nonce, nonce, []byte(msg), []byte(sealPrefix))
+  return sealPrefix + base64.StdEncoding.EncodeToString(sealed)
+}
+
+// Returns true if msg (after trimming whitespace) has been encrypted
+// with GosaSeal().
+func IsSealed(msg string) bool {
+  return strings.HasPrefix(strings.TrimSpace(msg), sealPrefix)
+}
+
+// Like IsSealed() but for a buffer. Trims whitespace from buf.
+func IsSealedBuffer(buf *bytes.Buffer) bool {
+  buf.TrimSpace()
+  return buf.Len() >= len(sealPrefix) && string(buf.Bytes()[0:len(sealPrefix)]) == sealPrefix
+}
+
+// The inverse of GosaSeal(). Returns "" if msg is not a message sealed with
+// key or if it has been tampered with or if the decrypted message does not
+// start with "<xml>". Whitespace is trimmed from the start and end of msg
+// and the result.
+func GosaOpen(msg string, key string) string {
+  msg = strings.TrimSpace(msg)
+  if !strings.HasPrefix(msg, sealPrefix) { return "" }
+  sealed, err := base64.StdEncoding.DecodeString(msg[len(sealPrefix):])
+  if err != nil { return "" }
+  aead := aeadFor(key)
+  if len(sealed) < aead.NonceSize() { return "" }
+  plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(sealPrefix))
+  if err != nil { return "" }
+  trimmed := strings.TrimSpace(string(plain))
+  if !strings.HasPrefix(trimmed, "<xml>") { return "" }
+  return trimmed
+}
+
+// Like GosaSeal() but replaces the contents of buf with the result.
+func GosaSealBuffer(buf *bytes.Buffer, key string) {
+  if buf.Len() == 0 { return }
+  sealed := GosaSeal(buf.String(), key)
+  buf.Reset()
+  buf.WriteString(sealed)
+}
+
+// Like GosaOpen() but operates on buf. Returns true if buf has been
+// opened successfully. Otherwise buf remains unchanged.
+func GosaOpenBuffer(buf *bytes.Buffer, key string) bool {
+  plain := GosaOpen(buf.String(), key)
+  if plain == "" { return false }
+  buf.Reset()
+  buf.WriteString(plain)
+  return true
+}
+
+// Returns true if the message x (a here_i_am, registered, new_server or
+// confirm_new_server message or a database entry made from one) announces
+// support for GosaSeal() and config.Encryption() permits its use.
+func SupportsSealing(x *xml.Hash) bool {
+  if config.Encryption() != SealEncryption { return false }
+  for _, encryption := range x.Get("encryption") {
+    if encryption == SealEncryption { return true }
+  }
+  return false
+}
+
+// Adds the <encryption> element that announces support for GosaSeal() to x,
+// unless config.Encryption() disables it.
+func AnnounceSealing(x *xml.Hash) {
+  if config.Encryption() == SealEncryption {
+    x.Add("encryption", SealEncryption)
+  }
+}
+
+// Records whether the party at target (IP:PORT) supports GosaSeal().
+// SendLnTo() uses GosaSeal() instead of GosaEncrypt() for such targets.
+func SetSealing(target string, supported bool) {
+  sealTargetsMutex.Lock()
+  defer sealTargetsMutex.Unlock()
+  if supported {
+    sealTargets[target] = true
+  } else {
+    delete(sealTargets, target)
+  }
+}
+
+// Returns true if SetSealing(target, true) has been called and
+// config.Encryption() permits GosaSeal().
+func sealing(target string) bool {
+  if config.Encryption() != SealEncryption { return false }
+  sealTargetsMutex.Lock()
+  defer sealTargetsMutex.Unlock()
+  return sealTargets[target]
+}
@@ -0,0 +1,215 @@
+/*
+Copyright (c) 2026 go-susi contributors
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+
+// Access controls, TLS, encryption, connection limits,...
+package security
+
+import (
+         "net"
+         "sort"
+         "sync"
+         "time"
+         "strconv"
+
+         "../xml"
+         "github.com/mbenkmann/golib/util"
+         "../config"
+       )
+
+// The persistent ban list. nil until BansInit() has been called. As long as
+// it is nil, no addresses are banned. Format:
+//   <bandb>
+//     <ban>
+//       <ip>172.16.2.3</ip>  (for IPv6 the /64 prefix, e.g. 2001:db8:1:2::)
+//       <since>20131016120000</since>
+//       <until>20131017120000</until>
+//       <reason>200 connections refused within 1h (exceeded ConnPerHour 60)</reason>
+//     </ban>
+//     ...
+//   </bandb>
+var banDB *xml.DB
+
+// Maps a key as returned by limitsKey() to the time the ban expires.
+// Mirrors banDB for fast lookups by ConnectionLimitsRegister().
+var bans = map[string]time.Time{}
+var bansMutex sync.Mutex
+
+// Makes bandb the ban list and activates banning. bandb must contain the
+// data read from disk (if any). Expired bans are removed.
+// Not an init() because the database is created by db.BansInit().
+func BansInit(bandb *xml.DB) {
+  now := time.Now()
+  all := bandb.Query(xml.FilterAll)
+
+  bansMutex.Lock()
+  defer bansMutex.Unlock()
+  banDB = bandb
+  bans = map[string]time.Time{}
+  for ban := all.First("ban"); ban != nil; ban = ban.Next() {
+    ip := net.ParseIP(ban.Text("ip"))
+    until := util.ParseTimestamp(ban.Text("until"))
+    if ip == nil || !until.After(now) {
+      banDB.Remove(xml.FilterSimple("ip", ban.Text("ip")))
+      continue
+    }
+    _, key := limitsKey(ip)
+    bans[key] = until
+  }
+  util.Log(1, "INFO! [SECURITY] %v address(es) banned", len(bans))
+}
+
+// Bans ip (for IPv6 the /64 containing it) for the given duration.
+// reason is recorded in the ban list. Does nothing if BansInit() has not
+// been called or if ip is exempt from bans (see BanExempt()).
+func Ban(ip net.IP, duration time.Duration, reason string) {
+  if BanExempt(ip) { return }
+  _, key := limitsKey(ip)
+  ban(key, duration, reason)
+}
+
+// Like Ban() but takes a key as returned by limitsKey() and does not check
+// for exemption.
+func ban(key string, duration time.Duration, reason string) {
+  now := time.Now()
+  until := now.Add(duration)
+  ipstr := net.IP(key).String()
+
+  bansMutex.Lock()
+  defer bansMutex.Unlock()
+  if banDB == nil { return }
+  bans[key] = until
+
+  entry := xml.NewHash("ban", "ip", ipstr)
+  entry.Add("since", util.MakeTimestamp(now))
+  entry.Add("until", util.MakeTimestamp(until))
+  entry.Add("reason", reason)
+  banDB.Replace(xml.FilterSimple("ip", ipstr), false, entry)
+  util.Log(0, "WARNING! [SECURITY] Banning %v until %v: %v", ipstr, until.Format("2006-01-02 15:04:05"), reason)
+}
+
+// Removes the ban on ip (for IPv6 the /64 containing it).
+// Returns false if ip was not banned.
+func BanLift(ip net.IP) bool {
+  _, key := limitsKey(ip)
+  ipstr := net.IP(key).String()
+
+  bansMutex.Lock()
+  defer bansMutex.Unlock()
+  if _, banned := bans[key]; !banned { return false }
+  delete(bans, key)
+  banDB.Remove(xml.FilterSimple("ip", ipstr))
+  util.Log(0, "WARNING! [SECURITY] Ban on %v lifted", ipstr)
+  return true
+}
+
+// Returns true if connections from the address with the given key (as
+// returned by limitsKey()) are currently banned. Expired bans are removed.
+func banned(key string) bool {
+  bansMutex.Lock()
+  defer bansMutex.Unlock()
+  until, banned := bans[key]
+  if !banned { return false }
+  if until.After(time.Now()) { return true }
+  delete(bans, key)
+  ipstr := net.IP(key).String()
+  banDB.Remove(xml.FilterSimple("ip", ipstr))
+  util.Log(1, "INFO! [SECURITY] Ban on %v has expired", ipstr)
+  return false
+}
+
+// Returns true if ip must never be banned. This is the case for
+// loopback addresses, our own IP, the servers from the config file and
+// all addresses from config.BanAllowlist().
+func BanExempt(ip net.IP) bool {
+  if ip.IsLoopback() || ip.Equal(net.ParseIP(config.IP)) { return true }
+  for _, server := range config.ServerIPsFromConfigFile {
+    if ip.Equal(server) { return true }
+  }
+  for _, network := range config.BanAllowlist() {
+    if network.Contains(ip) { return true }
+  }
+  return false
+}
+
+/*
+  Returns the current state of the connection limits and the ban list
+  in the following format:
+    <connectionlimits>
+      <entry>
+        <ip>172.16.2.3</ip>  (for IPv6 the /64 prefix, e.g. 2001:db8:1:2::)
+        <active>2</active>         (currently open connections)
+        <connparallel>10</connparallel>  (0 means unlimited)
+        <attempts>17</attempts>    (connection attempts within the last hour)
+        <connperhour>60</connperhour>    (0 means unlimited)
+        <refused>0</refused>       (refused connections within the last hour)
+        <last>20131016120000</last>  (last connection attempt)
+        <banned>20131017120000</banned>  (only if banned: end of the ban)
+        <reason>...</reason>             (only if banned)
+      </entry>
+      ...
+    </connectionlimits>
+  Addresses whose last connection attempt is more than 1h ago are only
+  listed if they are banned. The entries are sorted by address.
+*/
+func ConnectionLimitsQuery() *xml.Hash {
+  entries := map[string]*xml.Hash{}
+  ago1h := time.Now().Add(-1*time.Hour)
+
+  for bin := range limiters {
+    limiters[bin].mutex.Lock()
+    for key, lim := range limiters[bin].limits {
+      if lim.active == 0 && lim.last.Before(ago1h) { continue }
+      entry := xml.NewHash("entry", "ip", net.IP(key).String())
+      entry.Add("active", strconv.FormatInt(lim.active, 10))
+      entry.Add("connparallel", strconv.FormatInt(lim.maxactive, 10))
+      entry.Add("attempts", strconv.FormatInt(lim.attempts, 10))
+      entry.Add("connperhour", strconv.FormatInt(lim.maxPerHour, 10))
+      entry.Add("refused", strconv.FormatInt(lim.refused, 10))
+      entry.Add("last", util.MakeTimestamp(lim.last))
+      entries[key] = entry
+    }
+    limiters[bin].mutex.Unlock()
+  }
+
+  var all *xml.Hash
+  bansMutex.Lock()
+  if banDB != nil { all = banDB.Query(xml.FilterAll) }
+  bansMutex.Unlock()
+  if all != nil {
+    for ban := all.First("ban"); ban != nil; ban = ban.Next() {
+      ip := net.ParseIP(ban.Text("ip"))
+      if ip == nil { continue }
+      _, key := limitsKey(ip)
+      if !banned(key) { continue } // removes expired ban
+      entry := entries[key]
+      if entry == nil {
+        entry = xml.NewHash("entry", "ip", ban.Text("ip"))
+        entries[key] = entry
+      }
+      entry.Add("banned", ban.Text("until"))
+      entry.Add("reason", ban.Text("reason"))
+    }
+  }
+
+  keys := make([]string, 0, len(entries))
+  for key := range entries { keys = append(keys, key) }
+  sort.Strings(keys)
+
+  result := xml.NewHash("connectionlimits")
+  for _, key := range keys {
+    result.AddWithOwnership(entries[key])
+  }
+  return result
+}
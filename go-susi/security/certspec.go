@@ -0,0 +1,366 @@
+/*
+Copyright (c) 2026 go-susi contributors
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+
+// Access controls, TLS, encryption, connection limits,...
+package security
+
+import (
+         "fmt"
+         "net"
+         "time"
+         "errors"
+         "reflect"
+         "strconv"
+         "strings"
+         "unicode"
+         "crypto/x509"
+         "crypto/x509/pkix"
+         "encoding/asn1"
+       )
+
+var oidSubjectAltName = asn1.ObjectIdentifier{2,5,29,17}
+var oidGosaConnectionLimits = asn1.ObjectIdentifier{1,3,6,1,4,1,45753,1,5}
+var oidGosaAccessControl = asn1.ObjectIdentifier{1,3,6,1,4,1,45753,1,6}
+var oidGosaTargetScope = asn1.ObjectIdentifier{1,3,6,1,4,1,45753,1,7}
+
+// Returns true if id is the OID of subjectAltName or of one of the GOsa
+// certificate extensions.
+func IsGosaExtension(id asn1.ObjectIdentifier) bool {
+  return id.Equal(oidSubjectAltName) || id.Equal(oidGosaConnectionLimits) ||
+         id.Equal(oidGosaAccessControl) || id.Equal(oidGosaTargetScope)
+}
+
+// The sections of a certificate spec and the keys permitted in each.
+// All keys are lower case. The order of the keys within a section
+// corresponds to the ASN.1 tags where applicable.
+var specKeys = map[string][]string{
+  "certificate":    {"subject", "type", "days"},
+  "subjectaltname": {"ip", "name", "special"},
+  "limits":         {"totaltime", "totalbytes", "messagebytes", "connperhour", "connparallel", "maxlogfiles", "maxanswers", "communicatewith"},
+  "access":         {"misc", "query", "jobs", "incoming", "ldapupdate", "detectedhw"},
+  "scope":          {"dnsuffix", "unittag", "objectgroup"},
+}
+
+// The structs whose fields name the bits of the BIT STRINGs in
+// GosaAccessControl. The index is the ASN.1 tag. nil means not a BIT STRING.
+var accessBits = []interface{}{GosaAccessMisc{}, GosaAccessQuery{}, GosaAccessJobs{}, nil, GosaAccessLDAPUpdate{}, GosaAccessLDAPDetectedHardware{}}
+
+// Maps the names permitted for [subjectAltName]/special to the
+// registeredID they stand for.
+var gosaGNNames = map[string]string{"myserver":gosaGNMyServer, "configfile":gosaGNConfigFile, "srvrecord":gosaGNSRVRecord, "mypeer":gosaGNMyPeer}
+
+// A section of a certificate spec. Maps a (lower case) key to all
+// values given for it in the order in which they appear.
+type specSection map[string][]string
+
+// Returns the last value given for key or "" if there is none.
+func (section specSection) last(key string) string {
+  values := section[key]
+  if len(values) == 0 { return "" }
+  return values[len(values)-1]
+}
+
+/*
+  Parses a certificate spec and returns a template for x509.CreateCertificate()
+  with subject, validity, key usages and the subjectAltName and GOsa extensions
+  filled in. The caller has to fill in SerialNumber. Format of a spec:
+
+    [certificate]
+    subject = CN=gosa.example.com,O=Example      (CN, O, OU, L, ST, C)
+    type = peer                           server, client or peer (=both)
+    days = 365
+
+    [subjectAltName]
+    ip = 10.1.0.0                         trailing 0 bytes are wildcards
+    name = *.example.com
+    special = myserver                    myserver, configfile, srvrecord, mypeer
+
+    [limits]                              GosaConnectionLimits
+    totalTime = 10m                       a duration
+    totalBytes = 1000000                  also: messageBytes, connPerHour,
+                                          connParallel, maxLogFiles, maxAnswers
+    communicateWith = *.example.com:20081
+
+    [access]                              GosaAccessControl
+    misc = wake
+    query = queryJobs queryAudit
+    jobs = wake lock unlock
+    incoming = ldap://ldap.example.com/ou=incoming,o=example
+    ldapUpdate = cn ip
+    detectedHw = template
+
+    [scope]                               GosaTargetScope
+    dnSuffix = ou=school1,o=example
+    unitTag = school1
+    objectGroup = kiosk
+
+  Section names and keys are case-insensitive. Lines starting with "#" are
+  comments. Keys that take lists may be repeated to add more values. The bit
+  lists in [access] contain the names of the fields of the corresponding
+  GosaAccess* struct, separated by spaces and/or commas. Sections and keys that
+  are missing are omitted from the certificate, so that the defaults apply.
+*/
+func CertificateTemplate(spec []byte) (*x509.Certificate, error) {
+  sections, err := parseSpec(spec)
+  if err != nil { return nil, err }
+
+  cert := sections["certificate"]
+  if cert == nil || cert.last("subject") == "" {
+    return nil, errors.New("[certificate]/subject is required")
+  }
+
+  template := &x509.Certificate{KeyUsage:x509.KeyUsageDigitalSignature, BasicConstraintsValid:true}
+  template.Subject, err = ParseSubject(cert.last("subject"))
+  if err != nil { return nil, err }
+
+  switch strings.ToLower(cert.last("type")) {
+    case "server":     template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+    case "client":     template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+    case "peer", "":   template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+    default:           return nil, fmt.Errorf("[certificate]/type must be \"server\", \"client\" or \"peer\", not \"%v\"", cert.last("type"))
+  }
+
+  days := 365
+  if d := cert.last("days"); d != "" {
+    days, err = strconv.Atoi(d)
+    if err != nil || days <= 0 {
+      return nil, fmt.Errorf("[certificate]/days must be a positive number, not \"%v\"", d)
+    }
+  }
+  // backdate a little to allow for clocks that are not perfectly in sync
+  template.NotBefore = time.Now().Add(-5*time.Minute)
+  template.NotAfter = template.NotBefore.AddDate(0, 0, days)
+
+  extensions := []struct{
+    section string
+    oid asn1.ObjectIdentifier
+    marshal func(specSection) ([]byte, error)
+  }{
+    {"subjectaltname", oidSubjectAltName, marshalSubjectAltName},
+    {"limits", oidGosaConnectionLimits, marshalConnectionLimits},
+    {"access", oidGosaAccessControl, marshalAccessControl},
+    {"scope", oidGosaTargetScope, marshalTargetScope},
+  }
+
+  for _, ext := range extensions {
+    section := sections[ext.section]
+    if section == nil { continue }
+    value, err := ext.marshal(section)
+    if err != nil {
+      return nil, fmt.Errorf("[%v]: %v", ext.section, err)
+    }
+    template.ExtraExtensions = append(template.ExtraExtensions, pkix.Extension{Id:ext.oid, Value:value})
+  }
+
+  return template, nil
+}
+
+// Parses a subject like "CN=gosa.example.com,O=Example". The supported
+// attributes are CN, O, OU, L, ST and C. Escaping is not supported, so values
+// can not contain ",".
+func ParseSubject(subject string) (pkix.Name, error) {
+  var name pkix.Name
+  for _, part := range strings.Split(subject, ",") {
+    kv := strings.SplitN(part, "=", 2)
+    if len(kv) != 2 {
+      return name, fmt.Errorf("Malformed subject component \"%v\"", part)
+    }
+    value := strings.TrimSpace(kv[1])
+    switch strings.ToUpper(strings.TrimSpace(kv[0])) {
+      case "CN": name.CommonName = value
+      case "O":  name.Organization = append(name.Organization, value)
+      case "OU": name.OrganizationalUnit = append(name.OrganizationalUnit, value)
+      case "L":  name.Locality = append(name.Locality, value)
+      case "ST": name.Province = append(name.Province, value)
+      case "C":  name.Country = append(name.Country, value)
+      default:   return name, fmt.Errorf("Unsupported subject attribute \"%v\"", kv[0])
+    }
+  }
+  if name.CommonName == "" {
+    return name, fmt.Errorf("Subject \"%v\" has no CN", subject)
+  }
+  return name, nil
+}
+
+// Splits spec into sections (see CertificateTemplate()) and checks that
+// only known sections and keys are used.
+func parseSpec(spec []byte) (map[string]specSection, error) {
+  sections := map[string]specSection{}
+  var section specSection
+  var keys []string
+  for i, line := range strings.Split(string(spec), "\n") {
+    line = strings.TrimSpace(line)
+    if line == "" || line[0] == '#' { continue }
+
+    if line[0] == '[' {
+      if line[len(line)-1] != ']' {
+        return nil, fmt.Errorf("Line %v: Malformed section header \"%v\"", i+1, line)
+      }
+      name := strings.ToLower(strings.TrimSpace(line[1:len(line)-1]))
+      var ok bool
+      if keys, ok = specKeys[name]; !ok {
+        return nil, fmt.Errorf("Line %v: Unknown section \"%v\"", i+1, line)
+      }
+      if section = sections[name]; section == nil {
+        section = specSection{}
+        sections[name] = section
+      }
+      continue
+    }
+
+    if section == nil {
+      return nil, fmt.Errorf("Line %v: Data outside of a section", i+1)
+    }
+    idx := strings.Index(line, "=")
+    if idx < 0 {
+      return nil, fmt.Errorf("Line %v: Missing \"=\"", i+1)
+    }
+    key := strings.ToLower(strings.TrimSpace(line[:idx]))
+    known := false
+    for _, k := range keys {
+      if k == key { known = true }
+    }
+    if !known {
+      return nil, fmt.Errorf("Line %v: Unknown key \"%v\"", i+1, strings.TrimSpace(line[:idx]))
+    }
+    section[key] = append(section[key], strings.TrimSpace(line[idx+1:]))
+  }
+  return sections, nil
+}
+
+func marshalSubjectAltName(section specSection) ([]byte, error) {
+  names := []asn1.RawValue{}
+  for _, s := range section["ip"] {
+    ip := net.ParseIP(s)
+    if ip == nil {
+      return nil, fmt.Errorf("Not an IP address: \"%v\"", s)
+    }
+    if ip4 := ip.To4(); ip4 != nil { ip = ip4 }
+    names = append(names, asn1.RawValue{Class:context_specific, Tag:7, Bytes:ip})
+  }
+  for _, s := range section["name"] {
+    names = append(names, asn1.RawValue{Class:context_specific, Tag:2, Bytes:[]byte(s)})
+  }
+  for _, s := range section["special"] {
+    oid, ok := gosaGNNames[strings.ToLower(s)]
+    if !ok {
+      return nil, fmt.Errorf("Unknown special name \"%v\"", s)
+    }
+    names = append(names, asn1.RawValue{Class:context_specific, Tag:8, Bytes:[]byte(oid)})
+  }
+  if len(names) == 0 {
+    return nil, errors.New("No entries")
+  }
+  return asn1.Marshal(names)
+}
+
+func marshalConnectionLimits(section specSection) ([]byte, error) {
+  fields := []asn1.RawValue{}
+  keys := specKeys["limits"]
+  for tag, key := range keys[:len(keys)-1] { // all but communicateWith
+    s := section.last(key)
+    if s == "" { continue }
+    var n int64
+    var err error
+    if key == "totaltime" {
+      var d time.Duration
+      d, err = time.ParseDuration(s)
+      n = int64(d / time.Millisecond)
+    } else {
+      n, err = strconv.ParseInt(s, 10, 64)
+    }
+    if err != nil || n < 0 || n >= tooBig.Int64() {
+      return nil, fmt.Errorf("Illegal value for %v: \"%v\"", key, s)
+    }
+    data, err := asn1.MarshalWithParams(n, fmt.Sprintf("tag:%d", tag))
+    if err != nil { return nil, err }
+    fields = append(fields, asn1.RawValue{FullBytes:data})
+  }
+  if comm := section["communicatewith"]; len(comm) > 0 {
+    data, err := asn1MarshalSeqUtf8(7, comm)
+    if err != nil { return nil, err }
+    fields = append(fields, asn1.RawValue{FullBytes:data})
+  }
+  return asn1.Marshal(fields)
+}
+
+func marshalAccessControl(section specSection) ([]byte, error) {
+  fields := []asn1.RawValue{}
+  for tag, key := range specKeys["access"] {
+    values := section[key]
+    if len(values) == 0 { continue }
+    var data []byte
+    var err error
+    if accessBits[tag] == nil {
+      data, err = asn1MarshalSeqUtf8(tag, values)
+    } else {
+      data, err = asn1MarshalBitString(tag, values, accessBits[tag])
+      if err != nil { err = fmt.Errorf("%v: %v", key, err) }
+    }
+    if err != nil { return nil, err }
+    fields = append(fields, asn1.RawValue{FullBytes:data})
+  }
+  return asn1.Marshal(fields)
+}
+
+func marshalTargetScope(section specSection) ([]byte, error) {
+  fields := []asn1.RawValue{}
+  for tag, key := range specKeys["scope"] {
+    if len(section[key]) == 0 { continue }
+    data, err := asn1MarshalSeqUtf8(tag, section[key])
+    if err != nil { return nil, err }
+    fields = append(fields, asn1.RawValue{FullBytes:data})
+  }
+  if len(fields) == 0 {
+    return nil, errors.New("No entries")
+  }
+  return asn1.Marshal(fields)
+}
+
+// Returns the DER encoding of strs as a SEQUENCE OF UTF8String with
+// the context-specific tag.
+func asn1MarshalSeqUtf8(tag int, strs []string) ([]byte, error) {
+  elements := make([]asn1.RawValue, len(strs))
+  for i, s := range strs {
+    elements[i] = asn1.RawValue{Tag:asn1.TagUTF8String, Bytes:[]byte(s)}
+  }
+  return asn1.MarshalWithParams(elements, fmt.Sprintf("tag:%d", tag))
+}
+
+// Returns the DER encoding of a BIT STRING with the context-specific tag
+// in which the bits named in words are set. The names of the bits are the
+// names of the fields of the struct bitnames (case-insensitive), i.e. the
+// reverse of asn1BitString(). Each entry of words may contain multiple names
+// separated by spaces and/or commas.
+func asn1MarshalBitString(tag int, words []string, bitnames interface{}) ([]byte, error) {
+  t := reflect.TypeOf(bitnames)
+  n := t.NumField()
+  bits := asn1.BitString{Bytes:make([]byte, (n+7)/8), BitLength:n}
+  for _, w := range words {
+    for _, name := range strings.FieldsFunc(w, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+      i := 0
+      for ; i < n; i++ {
+        if strings.EqualFold(t.Field(i).Name, name) { break }
+      }
+      if i == n {
+        names := make([]string, n)
+        for i := range names { names[i] = t.Field(i).Name }
+        return nil, fmt.Errorf("Unknown bit \"%v\" (known: %v)", name, strings.Join(names, " "))
+      }
+      bits.Bytes[i/8] |= 0x80 >> uint(i%8)
+    }
+  }
+  return asn1.MarshalWithParams(bits, fmt.Sprintf("tag:%d", tag))
+}
@@ -18,12 +18,14 @@ GNU General Public License for more details.
 package security
 
 import (
+         "fmt"
          "net"
          "sync"
          "time"
          "strings"
 
          "github.com/mbenkmann/golib/util"
+         "../config"
        )
 
 /*
@@ -35,21 +37,26 @@ import (
   the caller should close the connection immediately. In this case
   the ConnectionLimitsDeregister() MUST NOT be called.
   
+  Connections from banned addresses (see Ban()) are always refused.
+  An address that has been refused config.BanThreshold() connections within
+  an hour is banned for config.BanDuration().
+  
   addr must be an IP address or this function will return false.
 */
 func ConnectionLimitsRegister(addr net.Addr) bool {
-  ip := net.ParseIP(strings.Split(addr.String(),":")[0])
+  ip := addrIP(addr)
   if ip == nil {
     util.Log(0, "ERROR! [SECURITY] ConnectionLimitsRegister() called with invalid address: %v", addr)
     return false
   }
   
-  // We manage 256 bins that can be individually locked to
-  // avoid creating a bottleneck. The bin is chosen based on the
-  // least significant byte in the IP address.
-  bin := int(ip[len(ip)-1])
+  bin, ipstr := limitsKey(ip)
+  if banned(ipstr) {
+    // do not log unless debugging to avoid logspam in case of an attack
+    util.Log(2, "DEBUG! [SECURITY] %v is banned", ip)
+    return false
+  }
   
-  ipstr := string(ip.To16()) // To16 for normalization of IPv4 addresses
   now := time.Now()
   ago1h := now.Add(-1*time.Hour)
   ago30min := now.Add(-30*time.Minute)
@@ -72,12 +79,14 @@ func ConnectionLimitsRegister(addr net.Addr) bool {
     lim.last = now
     lim.first = now
     lim.attempts = 0
+    lim.refused = 0
   }
   
   // if first connection attempt is more than 1h ago, adjust
   // first and count (based on average) so that first is only 30min ago.
   if lim.first.Before(ago1h) {
     lim.attempts = int64((30*time.Minute*time.Duration(lim.attempts))/now.Sub(lim.first)) 
+    lim.refused = int64((30*time.Minute*time.Duration(lim.refused))/now.Sub(lim.first)) 
     lim.first = ago30min
   }
   
@@ -87,12 +96,14 @@ func ConnectionLimitsRegister(addr net.Addr) bool {
   if lim.maxactive > 0 && lim.active >= lim.maxactive {
     // do not log unless debugging to avoid logspam in case of an attack
     util.Log(2, "DEBUG! [SECURITY] %v exceeded ConnParallel %v", ip, lim.active)
+    refuse(ip, ipstr, lim, fmt.Sprintf("exceeded ConnParallel %v", lim.maxactive))
     return false
   }
   
   if lim.maxPerHour > 0 && lim.attempts > lim.maxPerHour {
     // do not log unless debugging to avoid logspam in case of an attack
     util.Log(2, "DEBUG! [SECURITY] %v exceeded ConnPerHour: %v > %v", ip, lim.attempts, lim.maxPerHour)
+    refuse(ip, ipstr, lim, fmt.Sprintf("exceeded ConnPerHour %v", lim.maxPerHour))
     return false
   }
   
@@ -100,6 +111,18 @@ func ConnectionLimitsRegister(addr net.Addr) bool {
   return true
 }
 
+// Counts a refused connection from ip (whose key as returned by limitsKey()
+// is ipstr) and bans ip if the count reaches config.BanThreshold().
+// why is the reason for refusing the connection.
+// REQUIRES HOLDING THE LOCK OF ip's LIMITER BIN!
+func refuse(ip net.IP, ipstr string, lim *limits, why string) {
+  lim.refused++
+  if config.BanThreshold() > 0 && lim.refused >= int64(config.BanThreshold()) && !BanExempt(ip) {
+    ban(ipstr, config.BanDuration(), fmt.Sprintf("%v connections refused within 1h (%v)", lim.refused, why))
+    lim.refused = 0
+  }
+}
+
 /*
   Call this function AFTER closing the connection to addr to
   decrement the counter of parallel connections for that address.
@@ -109,13 +132,12 @@ func ConnectionLimitsRegister(addr net.Addr) bool {
   addr must be an IP address.
 */
 func ConnectionLimitsDeregister(addr net.Addr) {
-  ip := net.ParseIP(strings.Split(addr.String(),":")[0])
+  ip := addrIP(addr)
   if ip == nil {
     util.Log(0, "ERROR! [SECURITY] ConnectionLimitsDeregister() called with invalid address: %v", addr)
     return
   }
-  bin := int(ip[len(ip)-1])
-  ipstr := string(ip.To16()) // To16 for normalization of IPv4 addresses
+  bin, ipstr := limitsKey(ip)
   
   limiters[bin].mutex.Lock()
   defer limiters[bin].mutex.Unlock()
@@ -140,8 +162,7 @@ func ConnectionLimitsDeregister(addr net.Addr) {
 */
 func ConnectionLimitsUpdate(context *Context) {
   ip := context.PeerID.IP
-  bin := int(ip[len(ip)-1])
-  ipstr := string(ip.To16()) // To16 for normalization of IPv4 addresses
+  bin, ipstr := limitsKey(ip)
   limiters[bin].mutex.Lock()
   defer limiters[bin].mutex.Unlock()
   
@@ -159,10 +180,34 @@ func ConnectionLimitsUpdate(context *Context) {
   lim.maxPerHour = int64(context.Limits.ConnPerHour)
 }
 
+// Returns the IP address of addr or nil if addr does not contain one.
+func addrIP(addr net.Addr) net.IP {
+  if tcpaddr, ok := addr.(*net.TCPAddr); ok { return tcpaddr.IP }
+  host, _, err := net.SplitHostPort(addr.String())
+  if err != nil { return nil }
+  return net.ParseIP(strings.SplitN(host, "%", 2)[0]) // strip IPv6 zone
+}
+
+// Returns the limiter bin and the key within that bin for ip.
+// We manage 256 bins that can be individually locked to
+// avoid creating a bottleneck. For IPv4 the bin is chosen based on the
+// least significant byte in the IP address.
+// Because a single IPv6 host usually has a whole /64 at its disposal,
+// IPv6 addresses are limited per /64 and the bin is chosen based on the
+// least significant byte of the /64 prefix.
+func limitsKey(ip net.IP) (int, string) {
+  if ip4 := ip.To4(); ip4 != nil {
+    return int(ip4[3]), string(ip.To16()) // To16 for normalization of IPv4 addresses
+  }
+  prefix := ip.Mask(net.CIDRMask(64, 8*net.IPv6len))
+  return int(prefix[7]), string(prefix)
+}
+
 type limits struct {
   first time.Time
   last time.Time
   attempts int64
+  refused int64
   active int64
   maxactive int64
   maxPerHour int64
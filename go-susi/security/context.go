@@ -33,6 +33,8 @@ import (
          "strings"
          "crypto/tls"
          "crypto/x509"
+         "crypto/sha256"
+         "encoding/hex"
          "encoding/asn1"
          
          "github.com/mbenkmann/golib/util"
@@ -43,9 +45,18 @@ import (
 type Context struct {
   // true if the connection uses TLS
   TLS bool
+  // The subject of the peer's certificate ("" if the connection does not use TLS).
+  Subject string
+  // The SHA-256 fingerprint of the peer's certificate as lowercase hex
+  // digits ("" if the connection does not use TLS).
+  Fingerprint string
+  // true if the message currently being processed was encrypted with
+  // GosaSeal(). The reply is encrypted the same way.
+  Sealed bool
   PeerID SubjectAltName
   Limits GosaConnectionLimits
   Access GosaAccessControl
+  Scope GosaTargetScope
 }
 
 // Information about a peer's identity. The name of the structure is
@@ -103,6 +114,11 @@ type GosaAccessMisc struct {
 type GosaAccessQuery struct {
   QueryAll bool
   QueryJobs bool
+  QueryAudit bool
+  QueryLogs bool
+  QueryPackages bool
+  QueryStats bool
+  QueryFAI bool
 }
 
 type GosaAccessJobs struct {
@@ -138,13 +154,33 @@ type GosaAccessLDAPDetectedHardware struct {
   MACAddress bool
 }
 
+// Corresponds to the GosaTargetScope certificate extension. Restricts the
+// machines the peer may target with jobs. A machine is in scope if it
+// matches at least one entry from any of the lists. If all lists are
+// empty (i.e. the certificate does not have the extension), there is
+// no restriction.
+type GosaTargetScope struct {
+  // The machine's LDAP DN must end in one of these DNs.
+  DNSuffix []string
+  // The machine's gosaUnitTag must be one of these.
+  UnitTag []string
+  // The machine must be member of an object group (gosaGroupOfNames) whose
+  // cn or DN is one of these.
+  ObjectGroup []string
+}
+
+// Returns true if scope does not restrict the target machines.
+func (scope *GosaTargetScope) Unrestricted() bool {
+  return len(scope.DNSuffix) == 0 && len(scope.UnitTag) == 0 && len(scope.ObjectGroup) == 0
+}
+
 func SetLegacyDefaults(context *Context) {
   if len(context.PeerID.IP) == 0 {
     context.PeerID.IP = net.IPv4(0,0,0,0)
   }
   
   // everybody may connect
-  context.PeerID.AllowedIPs = []net.IP{net.IPv4(0,0,0,0)}
+  context.PeerID.AllowedIPs = []net.IP{net.IPv4(0,0,0,0), net.IPv6unspecified}
   // no need for names, since AllowedIPs already allows everybody
   context.PeerID.AllowedNames = []string{}
   
@@ -183,6 +219,11 @@ func SetLegacyDefaults(context *Context) {
   }*/
   context.Access.Query.QueryAll = true
   context.Access.Query.QueryJobs = true
+  context.Access.Query.QueryAudit = true
+  context.Access.Query.QueryLogs = true
+  context.Access.Query.QueryPackages = true
+  context.Access.Query.QueryStats = true
+  context.Access.Query.QueryFAI = true
   
   context.Access.Jobs.JobsAll = true
   context.Access.Jobs.Lock = true
@@ -195,7 +236,7 @@ func SetLegacyDefaults(context *Context) {
   context.Access.Jobs.ModifyJobs = true
   context.Access.Jobs.NewSys = true
 
-  context.Access.Incoming = []string{config.LDAPURI+"/"+config.IncomingOU}
+  context.Access.Incoming = []string{config.LDAPURI+"/"+config.IncomingOU()}
   
   context.Access.LDAPUpdate.CN = true
   context.Access.LDAPUpdate.IP = true
@@ -208,6 +249,8 @@ func SetLegacyDefaults(context *Context) {
   context.Access.DetectedHW.CN = true
   context.Access.DetectedHW.IPHostNumber = true
   context.Access.DetectedHW.MACAddress = true
+  
+  context.Scope = GosaTargetScope{}
 }
 
 func SetTLSDefaults(context *Context) {
@@ -229,6 +272,11 @@ func SetTLSDefaults(context *Context) {
   
   context.Access.Query.QueryAll = false
   context.Access.Query.QueryJobs = false
+  context.Access.Query.QueryAudit = false
+  context.Access.Query.QueryLogs = false
+  context.Access.Query.QueryPackages = false
+  context.Access.Query.QueryStats = false
+  context.Access.Query.QueryFAI = false
   
   context.Access.Jobs.JobsAll = false
   context.Access.Jobs.Lock = false
@@ -254,6 +302,8 @@ func SetTLSDefaults(context *Context) {
   context.Access.DetectedHW.CN = false
   context.Access.DetectedHW.IPHostNumber = false
   context.Access.DetectedHW.MACAddress = false
+  
+  context.Scope = GosaTargetScope{}
 }
 
 // Returns a *security.Context for the provided connection.
@@ -291,8 +341,41 @@ func ContextFor(conn net.Conn) *Context {
   return nil
 }
 
+// Returns cert followed by the certificates from config.CACert() that
+// issued it, its issuer and so on up to a self-signed certificate or one
+// whose issuer is not in config.CACert(). Returns an error if cert has
+// not been issued by one of config.CACert().
+func certificateChain(cert *x509.Certificate) ([]*x509.Certificate, error) {
+  chain := []*x509.Certificate{cert}
+  cacerts := config.CACert()
+  for {
+    last := chain[len(chain)-1]
+    var issuer *x509.Certificate
+    err := fmt.Errorf("No matching CA certificate")
+    for _, cacert := range cacerts {
+      err = last.CheckSignatureFrom(cacert)
+      if err == nil {
+        if string(cacert.RawSubject) != string(last.RawIssuer) {
+          err = fmt.Errorf("Certificate was issued by wrong CA: \"%v\" instead of \"%v\"", cacert.Subject, last.Issuer)
+        } else {
+          issuer = cacert
+          break // stop checking if we found a match for a CA. err == nil here!
+        }
+      }
+    }
+    if issuer == nil {
+      if len(chain) == 1 { return nil, err }
+      return chain, nil // the top of the chain need not be self-signed
+    }
+    // Stop at a self-signed certificate. The length check guards against
+    // CA certificates that have signed each other.
+    if issuer == last || len(chain) > len(cacerts) { return chain, nil }
+    chain = append(chain, issuer)
+  }
+}
+
 func handle_tlsconn(conn *tls.Conn, context *Context) bool {
-  conn.SetDeadline(time.Now().Add(config.TimeoutTLS))
+  conn.SetDeadline(time.Now().Add(config.TimeoutTLS()))
   err := conn.Handshake()
   if err != nil {
     util.Log(0, "ERROR! [SECURITY] TLS Handshake: %v", err)
@@ -313,24 +396,60 @@ func handle_tlsconn(conn *tls.Conn, context *Context) bool {
     util.Log(2, "DEBUG! [SECURITY] Peer certificate presented by %v:\n%v", conn.RemoteAddr(), CertificateInfo(cert))
   }
   
-  for _, cacert := range config.CACert {
-    err = cert.CheckSignatureFrom(cacert)
-    if err == nil {
-      if string(cacert.RawSubject) != string(cert.RawIssuer) {
-        err = fmt.Errorf("Certificate was issued by wrong CA: \"%v\" instead of \"%v\"", cacert.Subject, cert.Issuer)
-      } else {
-        break // stop checking if we found a match for a CA. err == nil here!
-      }
+  chain, err := certificateChain(cert)
+  if err != nil {
+    util.Log(0, "ERROR! [SECURITY] TLS peer presented certificate not signed by trusted CA: %v", err)
+    return false
+  }
+  
+  // A revoked intermediate CA revokes all certificates it has issued.
+  for _, c := range chain {
+    if CertificateRevoked(c) {
+      util.Log(0, "ERROR! [SECURITY] TLS peer %v presented certificate with revoked certificate in its chain: Serial no. %v, Subject \"%v\"", conn.RemoteAddr(), c.SerialNumber, c.Subject)
+      return false
     }
   }
   
+  err = parseCertificate(cert, context)
   if err != nil {
-    util.Log(0, "ERROR! [SECURITY] TLS peer presented certificate not signed by trusted CA: %v", err)
+    // Ignoring a broken scope would grant access to all machines.
+    util.Log(0, "ERROR! [SECURITY] %v => Rejecting certificate", err)
     return false
   }
   
+  context.TLS = true
+  
+  return true
+}
+
+// Returns the context that a TLS peer presenting cert would get. The checks
+// that require a connection (CA signature, revocation, peer IP) are not
+// performed. Returns an error if cert would be rejected because of a broken
+// GosaTargetScope extension.
+func CertificateContext(cert *x509.Certificate) (*Context, error) {
+  var context Context
+  err := parseCertificate(cert, &context)
+  if err != nil { return nil, err }
+  context.TLS = true
+  return &context, nil
+}
+
+// Returns the SHA-256 fingerprint of cert as lowercase hex digits.
+func CertificateFingerprint(cert *x509.Certificate) string {
+  sum := sha256.Sum256(cert.Raw)
+  return hex.EncodeToString(sum[:])
+}
+
+// Sets context to the TLS defaults and then fills it in from cert's
+// subject and extensions. Problems with extensions whose data can safely be
+// ignored are logged. A broken GosaTargetScope is returned as error.
+func parseCertificate(cert *x509.Certificate, context *Context) error {
   SetTLSDefaults(context)
   
+  context.Subject = cert.Subject.String()
+  context.Fingerprint = CertificateFingerprint(cert)
+  
+  var err error
   for _, e := range cert.Extensions {
     if len(e.Id) == 4 && e.Id[0] == 2 && e.Id[1] == 5 && e.Id[2] == 29 && e.Id[3] == 17 {
       parseSANExtension(e.Value, context)
@@ -340,14 +459,14 @@ func handle_tlsconn(conn *tls.Conn, context *Context) bool {
                 if err != nil { util.Log(0, "ERROR! [SECURITY] GosaConnectionLimits: %v", err) }
         case 6: err = parseAccessControl(e.Value, context)
                 if err != nil { util.Log(0, "ERROR! [SECURITY] GosaAccessControl: %v", err) }
+        case 7: err = parseTargetScope(e.Value, context)
+                if err != nil { return fmt.Errorf("GosaTargetScope: %v", err) }
       }
       
     }
   }
   
-  context.TLS = true
-  
-  return true
+  return nil
 }
 
 var gosaGNMyServer = string([]byte{0x2B,0x06,0x01,0x04,0x01,0x82,0xE5,0x39,0x01,0x01})
@@ -567,6 +686,53 @@ func parseAccessControl(value []byte, context *Context) error {
   return nil
 }
 
+func parseTargetScope(value []byte, context *Context) error {
+  var seq asn1.RawValue
+  var rest []byte
+  var err error
+  if rest, err = asn1.Unmarshal(value, &seq); err != nil {
+    return err
+  } else if len(rest) != 0 {
+    return errors.New("Garbage after GosaTargetScope")
+  }
+  if !seq.IsCompound || seq.Tag != 16 || seq.Class != universal {
+    return errors.New("GosaTargetScope has incorrect ASN.1 type")
+  }
+
+  rest = seq.Bytes
+  for len(rest) > 0 {
+    var v asn1.RawValue
+    rest, err = asn1.Unmarshal(rest, &v)
+    if err != nil {
+      return err
+    }
+    if v.Class != context_specific {
+      return errors.New("GosaTargetScope contains data with strange tag (class not CONTEXT-SPECIFIC)")
+    }
+    
+    names, err := asn1SeqUtf8(&v)
+    if err != nil {
+      return err
+    }
+    switch v.Tag {
+      case 0: // dnSuffix    [0] SEQUENCE OF UTF8String OPTIONAL
+              context.Scope.DNSuffix = names
+      case 1: // unitTag     [1] SEQUENCE OF UTF8String OPTIONAL
+              context.Scope.UnitTag = names
+      case 2: // objectGroup [2] SEQUENCE OF UTF8String OPTIONAL
+              context.Scope.ObjectGroup = names
+      default:
+              return fmt.Errorf("GosaTargetScope contains data with unknown tag %v", v.Tag)
+    }
+  }
+  
+  if context.Scope.Unrestricted() {
+    return errors.New("GosaTargetScope contains no entries")
+  }
+  
+  return nil
+}
+
 // Parses a BIT STRING in v and stores the bits in targetstruct which has to be
 // a pointer to a struct containing only bool public fields.
 // If targetstruct has an incorrect type this function will panic().
@@ -617,6 +783,25 @@ func asn1SeqUtf8(v *asn1.RawValue) ([]string, error) {
 }
 
 
+// Returns true if peer matches the address allowed from a certificate's
+// SubjectAltName. Trailing 0 bytes in allowed are wildcards, so
+// 10.0.0.0 matches all of 10.*.*.* and 2001:db8:: matches 2001:db8::/32.
+// 0.0.0.0 matches all IPv4 addresses and :: matches all IPv6 addresses.
+// IPv4 addresses never match IPv6 addresses and vice versa.
+func ipMatches(allowed, peer net.IP) bool {
+  if a4, p4 := allowed.To4(), peer.To4(); a4 != nil || p4 != nil {
+    if a4 == nil || p4 == nil { return false }
+    allowed, peer = a4, p4
+  } else {
+    allowed, peer = allowed.To16(), peer.To16()
+    if allowed == nil || peer == nil { return false }
+  }
+  
+  i := len(allowed)
+  for i > 0 && allowed[i-1] == 0 { i-- } // skip wildcard bytes
+  return string(allowed[:i]) == string(peer[:i])
+}
+
 // Performs security checks on the context, in particular whether
 // the 2 endpoints are allowed to communicate with each other.
 // If a security check fails, an ERROR is logged and false is returned.
@@ -629,26 +814,10 @@ func (context *Context) Verify() bool {
     if ip.IsLoopback() {
       ip = net.ParseIP(config.IP)
     }
-    if ip.Equal(peerIP) {
+    if ipMatches(ip, peerIP) {
       ok = true
       break
     }
-    if ip[len(ip)-1] == 0 { // if it is a wildcard address
-      wildPeer := make(net.IP, len(peerIP))
-      copy(wildPeer, peerIP)
-      k := len(wildPeer)-1
-      i := len(ip)-1
-      for k >= 0 && i >= 0 && ip[i] == 0 {
-        wildPeer[k] = 0
-        i--
-        k--
-      }
-      
-      if ip.Equal(wildPeer) {
-        ok = true
-        break
-      }
-    }
   }
   
   if !ok { // peer not in AllowedIPs? Check AllowedNames (forward DNS)
@@ -705,18 +874,21 @@ func (context *Context) Verify() bool {
   ok = false
   fqname := config.Hostname + "." + config.Domain
   for _, comm := range context.Limits.CommunicateWith {
-    idx := strings.Index(comm,":") // is there a port?
-    if idx >= 0 { // if yes, make sure it's the same as ours
-      if !strings.HasSuffix(config.ServerSourceAddress, comm[idx:]) {
+    // is there a port? (a bare IPv6 address is not mistaken for one)
+    if host, port, err := net.SplitHostPort(comm); err == nil {
+      // if yes, make sure it's the same as ours
+      if port != config.ServerPort() {
         continue
       }
-      comm = comm[0:idx] // cut off port
+      comm = host // cut off port
     }
+    comm = strings.Trim(comm, "[]")
     
     // At this point, comm does not contain a port
     
     // Check for exact match
-    if comm == config.Hostname || comm == fqname || comm == config.IP {
+    if comm == config.Hostname || comm == fqname || comm == config.IP ||
+       (net.ParseIP(comm) != nil && net.ParseIP(comm).Equal(net.ParseIP(config.IP))) {
       ok = true
       break
     }
@@ -816,8 +988,8 @@ func CertificateInfo(cert *x509.Certificate) string {
         }
         if v.Tag == 8 { // registeredID
           var oid asn1.ObjectIdentifier
-          _, err = asn1.Unmarshal(v.FullBytes, &oid)
-          if err != nil {
+          _, err = asn1.UnmarshalWithParams(v.FullBytes, &oid, "tag:8")
+          if err == nil {
             oids = append(oids, oid.String())
           }
         }
@@ -0,0 +1,114 @@
+/*
+Copyright (c) 2026 go-susi contributors
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+
+// Access controls, TLS, encryption, connection limits,...
+package security
+
+import (
+         "fmt"
+         "sync"
+         "time"
+         "io/ioutil"
+         "crypto/x509"
+
+         "github.com/mbenkmann/golib/util"
+         "../config"
+       )
+
+// The revoked certificates from one CRL file.
+type revocationList struct {
+  // RawSubject of the CA that signed the CRL.
+  issuer string
+  // Serial numbers (in decimal) of the revoked certificates.
+  serials map[string]bool
+}
+
+// Maps a path from config.CRLPath() to the data read from it.
+var revocationLists = map[string]*revocationList{}
+var revocationListsMutex sync.RWMutex
+
+// Reads the CRLs from config.CRLPath(). If a CRL can not be read or
+// verified, the data read from the same file previously (if any) remains
+// in effect, so that a broken update can not un-revoke certificates.
+func ReadCRLs() {
+  lists := map[string]*revocationList{}
+  for _, path := range config.CRLPath() {
+    list, err := readCRL(path)
+    if err != nil {
+      util.Log(0, "ERROR! [SECURITY] CRL %v: %v", path, err)
+      revocationListsMutex.RLock()
+      list = revocationLists[path]
+      revocationListsMutex.RUnlock()
+      if list == nil { continue }
+    }
+    lists[path] = list
+  }
+
+  revocationListsMutex.Lock()
+  revocationLists = lists
+  revocationListsMutex.Unlock()
+}
+
+func readCRL(path string) (*revocationList, error) {
+  data, err := ioutil.ReadFile(path)
+  if err != nil { return nil, err }
+  crl, err := x509.ParseCRL(data)
+  if err != nil { return nil, err }
+
+  for _, cacert := range config.CACert() {
+    if cacert.CheckCRLSignature(crl) != nil { continue }
+
+    if crl.HasExpired(time.Now()) {
+      util.Log(0, "WARNING! [SECURITY] CRL %v has expired at %v", path, crl.TBSCertList.NextUpdate)
+    }
+    list := &revocationList{issuer:string(cacert.RawSubject), serials:map[string]bool{}}
+    for _, revoked := range crl.TBSCertList.RevokedCertificates {
+      list.serials[revoked.SerialNumber.String()] = true
+    }
+    util.Log(1, "INFO! [SECURITY] Read CRL %v with %v revoked certificate(s) from \"%v\"", path, len(list.serials), cacert.Subject)
+    return list, nil
+  }
+
+  return nil, fmt.Errorf("CRL is not signed by a trusted CA")
+}
+
+// Returns true if cert is listed in one of the CRLs read by ReadCRLs().
+func CertificateRevoked(cert *x509.Certificate) bool {
+  revocationListsMutex.RLock()
+  defer revocationListsMutex.RUnlock()
+  for _, list := range revocationLists {
+    if list.issuer == string(cert.RawIssuer) && list.serials[cert.SerialNumber.String()] {
+      return true
+    }
+  }
+  return false
+}
+
+// Calls ReadCRLs() every config.CRLReloadInterval(). Never returns.
+func CRLUpdater() {
+  for {
+    time.Sleep(config.CRLReloadInterval())
+    ReadCRLs()
+  }
+}
+
+var crlUpdaterOnce sync.Once
+
+// Starts CRLUpdater() in a new goroutine unless it has been started before.
+// Called at program start and after reloading the configuration, because
+// CRLs may be added by a reload.
+func StartCRLUpdater() {
+  crlUpdaterOnce.Do(func() { go util.WithPanicHandler(CRLUpdater) })
+}
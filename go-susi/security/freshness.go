@@ -0,0 +1,38 @@
+/*
+Copyright (c) 2026 go-susi contributors
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+
+// Access controls, TLS, encryption, connection limits,...
+package security
+
+import (
+         "fmt"
+         "time"
+         "strings"
+         "crypto/rand"
+       )
+
+// Returns msg with <msgtime> (the current time in seconds since the epoch)
+// and <msgnonce> (128 random bits as hex digits) inserted before the final
+// "</xml>". The receiving go-susi uses them to reject stale and replayed
+// messages (see config.ReplayProtection()). msg is returned unchanged if it
+// does not end in "</xml>" (after trimming whitespace).
+func Stamp(msg string) string {
+  trimmed := strings.TrimSpace(msg)
+  if !strings.HasSuffix(trimmed, "</xml>") { return msg }
+  nonce := make([]byte, 16)
+  if _, err := rand.Read(nonce); err != nil { panic(err) }
+  end := len(trimmed) - len("</xml>")
+  return fmt.Sprintf("%v<msgtime>%d</msgtime><msgnonce>%x</msgnonce></xml>", trimmed[0:end], time.Now().Unix(), nonce)
+}
@@ -82,6 +82,8 @@ func GosaEncryptBuffer(buf *bytes.Buffer, key string) {
 //
 // * a base64 string as returned by GosaEncrypt when used with the same key.
 // The unencrypted message will be returned.
+//
+// * a message as returned by GosaSeal when used with the same key. See GosaOpen.
 // 
 // The key is a word as used in gosa-si.conf whose md5sum will
 // be used as the actual AES key.
@@ -92,6 +94,10 @@ func GosaDecrypt(msg string, key string) string {
     return trimmed 
   }
   
+  if strings.HasPrefix(trimmed, sealPrefix) {
+    return GosaOpen(trimmed, key)
+  }
+  
   // Fixes the following:
   // * gosa-si bug in the following line:
   //     if( $client_answer =~ s/session_id=(\d+)$// ) {
@@ -136,6 +142,7 @@ func GosaDecryptBuffer(buf *bytes.Buffer, key string) bool {
   
   data := buf.Bytes()
   if string(data[0:5]) == "<xml>" { return true }
+  if string(data[0:len(sealPrefix)]) == sealPrefix { return GosaOpenBuffer(buf, key) }
   
   // Fixes the following:
   // * gosa-si bug in the following line:
@@ -36,7 +36,8 @@ var starttls = []byte{'S','T','A','R','T','T','L','S','\n'}
 // the config settings. If a certificate is configured, the connection
 // will use TLS (and the key argument will be ignored). Otherwise, key
 // will be used to GosaEncrypt() the message before sending it over
-// a non-TLS connection.
+// a non-TLS connection (or to GosaSeal() it, if target has been recorded
+// with SetSealing()). Non-TLS messages are Stamp()ed first.
 // If an error occurs, it is logged and nil is returned even if keep_open.
 func SendLnTo(target, msg, key string, keep_open bool) (net.Conn, *Context) {
   conn, err := net.Dial("tcp", target)
@@ -55,8 +56,8 @@ func SendLnTo(target, msg, key string, keep_open bool) (net.Conn, *Context) {
     // This is not fatal => Don't abort send attempt
   }
   
-  if config.TLSClientConfig != nil {
-    conn.SetDeadline(time.Now().Add(config.TimeoutTLS)) // don't allow stalling on STARTTLS
+  if config.TLSClientConfig() != nil {
+    conn.SetDeadline(time.Now().Add(config.TimeoutTLS())) // don't allow stalling on STARTTLS
     
     _, err = util.WriteAll(conn, starttls)
     if err != nil {
@@ -68,10 +69,15 @@ func SendLnTo(target, msg, key string, keep_open bool) (net.Conn, *Context) {
     var no_deadline time.Time
     conn.SetDeadline(no_deadline)
     
-    conn = tls.Client(conn, config.TLSClientConfig)
+    conn = tls.Client(conn, config.TLSClientConfig())
 
   } else {
-    msg = GosaEncrypt(msg, key)
+    msg = Stamp(msg)
+    if sealing(target) {
+      msg = GosaSeal(msg, key)
+    } else {
+      msg = GosaEncrypt(msg, key)
+    }
   }
   
   context := ContextFor(conn)
@@ -80,7 +86,7 @@ func SendLnTo(target, msg, key string, keep_open bool) (net.Conn, *Context) {
     return nil, nil
   }
 
-  err = util.SendLn(conn, msg, config.Timeout)
+  err = util.SendLn(conn, msg, config.Timeout())
   if err != nil {
     util.Log(0, "ERROR! [SECURITY] While sending message to %v: %v\n", target, err)
     conn.Close() // even if keep_open
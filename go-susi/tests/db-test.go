@@ -23,16 +23,22 @@ package tests
 import (
          "os"
          "fmt"
+         "net"
          "sort"
          "time"
          "bytes"
          "strings"
          "io/ioutil"
+         "os/exec"
+         "sync"
+         "sync/atomic"
          
          "../db"
          "../xml"
+         "../ldap"
          "github.com/mbenkmann/golib/util"
          "../config"
+         "../security"
        )
 
 // Unit tests for the package go-susi/db.
@@ -42,8 +48,14 @@ func DB_test() {
   serverdb_test()
   clientdb_test()
   systemdb_test()
+  systemdb_scope_test()
+  ldap_modify_retry_test()
   jobdb_test()
   faidb_test()
+  maintenance_test()
+  periodic_test()
+  audittrail_test()
+  hookrun_test()
   
   check(db.LDAPFilterEscape(""), "")
   check(db.LDAPFilterEscape(" "), " ")
@@ -204,6 +216,20 @@ func clientdb_test() {
   check(db.ClientWithAddress(addr0), db.ClientWithMAC(mac1))
   check(db.ClientWithAddress(ip0), db.ClientWithMAC(mac1))
   check(len(db.ClientKeysForAllClients()), 2*(len(client)-1))
+  
+  // IPv6 clients use bracketed addresses
+  addr6 := "[2001:db8::1]:20083"
+  mac6 := "00:00:00:00:aa:07"
+  db.ClientUpdate(hash("xml(key(key_for_ipv6)header(new_foreign_client)new_foreign_client()source(%v)target(%v)client(%v)macaddress(%v))", listen_address, config.ServerSourceAddress, addr6, mac6))
+  if c := db.ClientWithMAC(mac6); check(c!=nil, true) {
+    check(c.Text("client"), addr6)
+    check(db.ClientWithAddress(addr6), c)
+    check(db.ClientWithAddress("2001:db8::1"), c)
+    check(db.ClientWithAddress("[2001:db8::1]"), c)
+    check(db.ClientKeys("2001:db8::1"), []string{"key_for_ipv6"})
+  }
+  check(db.ClientWithAddress("2001:db8::"), nil)
+  check(db.ClientWithAddress("[2001:db8::1]:20084"), nil)
 }
 
 func serverdb_test() {  
@@ -221,6 +247,59 @@ func serverdb_test() {
   
   check(db.ServerWithMAC("00:17:31:a1:f8:19"),server1)
   check(db.ServerWithMAC("00:ff:cc:aa:ff:11"),nil)
+  
+  // certificate pinning
+  fp1 := strings.Repeat("1f", 32)
+  fp2 := strings.Repeat("2e", 32)
+  check(db.ServerCertificateCheck("172.99.9.98:20081", fp1, false), false) // unknown peer
+  check(db.ServerCertificateCheck("172.99.9.98:20081", fp1, true), true) // new peer => not pinned
+  check(db.ServerCertificateCheck("172.99.9.98:20081", fp2, true), true)
+  check(db.ServerCertificateCheck("172.99.9.99:20081", "", false), true) // legacy peer
+  check(db.ServerCertificateCheck("172.99.9.99:20081", fp1, false), true) // first contact => pinned
+  check(db.ServerCertificateCheck("172.99.9.99:20081", fp1, false), true)
+  mismatches := atomic.LoadInt32(&db.ServerCertificateMismatches)
+  check(db.ServerCertificateCheck("172.99.9.99:20081", fp2, false), false)
+  check(db.ServerCertificateCheck("172.99.9.99:20081", "", false), false)
+  check(atomic.LoadInt32(&db.ServerCertificateMismatches), mismatches+2)
+  check(db.ServerCertificatesRejected(), 1)
+  // the peer can not change its pinned certificate with new_server
+  db.ServerUpdate(hash("xml(key(foobar2)source(172.99.9.99:20081)fingerprint(%v))", fp2))
+  check(db.ServerKeys("172.99.9.99:20081"), []string{"foobar2", "foobar"})
+  check(db.ServerCertificateCheck("172.99.9.99:20081", fp2, false), false)
+  check(db.ServerCertificateCheck("172.99.9.99:20081", fp1, false), true)
+  check(db.ServerCertificateApprove("172.99.9.99:20081"), nil)
+  check(db.ServerCertificateApprove("172.99.9.99:20081") != nil, true)
+  check(db.ServerCertificatesRejected(), 0)
+  check(db.ServerCertificateCheck("172.99.9.99:20081", fp2, false), true)
+  check(db.ServerCertificateCheck("172.99.9.99:20081", fp1, false), false)
+  check(db.ServerCertificateApprove("172.99.9.98:20081") != nil, true)
+  
+  // configured certificates take precedence and can not be approved
+  config.Modify(func(r *config.Reloadable) { r.PeerFingerprints = map[string]string{"172.16.2.52:20081": fp2} })
+  check(db.ServerCertificateCheck("172.16.2.52:20081", fp1, false), false)
+  check(db.ServerCertificateCheck("172.16.2.52:20081", fp2, false), true)
+  check(db.ServerCertificateApprove("172.16.2.52:20081") != nil, true)
+  check(db.ServerCertificateCheck("172.99.9.98:20081", fp1, false), false)
+  config.Modify(func(r *config.Reloadable) { r.PeerFingerprints = map[string]string{"172.99.9.98:20081": fp1} })
+  check(db.ServerCertificateCheck("172.99.9.98:20081", fp1, false), true) // configured but not in serverdb
+  config.Modify(func(r *config.Reloadable) { r.PeerFingerprints = map[string]string{} })
+  
+  // Of several concurrent first contacts with different certificates only
+  // one may be pinned and accepted.
+  db.ServerUpdate(hash("xml(key(foobar)source(172.99.9.97:20081))"))
+  var accepted int32
+  var wg sync.WaitGroup
+  for i := 0; i < 16; i++ {
+    wg.Add(1)
+    go func(i int) {
+      defer wg.Done()
+      if db.ServerCertificateCheck("172.99.9.97:20081", fmt.Sprintf("%064x", i), false) {
+        atomic.AddInt32(&accepted, 1)
+      }
+    }(i)
+  }
+  wg.Wait()
+  check(accepted, int32(1))
 }
 
 func systemdb_test() {
@@ -300,6 +379,9 @@ func systemdb_test() {
   check(err, "Could not parse LDAP URI(s)=broken (3)\n")
   _, ok = err.(db.SystemNotFoundError)
   check(ok, false)
+  // The expected error is the one from ldapsearch.
+  ldapClient := config.LDAPClient
+  config.LDAPClient = "cli"
   config.LDAPURI = "ldap://localhost:1"
   data, err = db.SystemGetAllDataForMAC(db.SystemMACForName("systest1"), true)
   check(data, nil)
@@ -307,6 +389,7 @@ func systemdb_test() {
   _, ok = err.(db.SystemNotFoundError)
   check(ok, false)
   config.LDAPURI = ldapUri
+  config.LDAPClient = ldapClient
   
   data, err = db.SystemGetAllDataForMAC(db.SystemMACForName("systest1"), true)
   check(err, nil)
@@ -515,10 +598,152 @@ func systemdb_test() {
   check(hasWords(err,"Could not find","KeineAhnungWieDieHeisst"), "")
 }
 
+func systemdb_scope_test() {
+  sys := xml.NewHash("xml","dn","cn=foo,ou=workstations,ou=systems,ou=Dept1,o=go-susi,c=de")
+  sys.Add("gosaunittag", "1234")
+  groups := xml.NewHash("systemdb")
+  group := xml.NewHash("xml","dn","cn=kiosk,ou=groups,o=go-susi,c=de")
+  group.Add("cn", "kiosk")
+  groups.AddWithOwnership(group)
+  
+  scope := &security.GosaTargetScope{}
+  check(scope.Unrestricted(), true)
+  check(db.SystemMatchesScope(sys, nil, scope), true)
+  check(db.SystemInScope("01:02:03:04:05:06", scope), true) // no LDAP access
+  
+  scope.DNSuffix = []string{"ou=dept2,o=go-susi,c=de"}
+  check(scope.Unrestricted(), false)
+  check(db.SystemMatchesScope(sys, groups, scope), false)
+  scope.DNSuffix = []string{"ou=dept2,o=go-susi,c=de", "OU=dept1, o=go-susi,c=de"}
+  check(db.SystemMatchesScope(sys, groups, scope), true)
+  scope.DNSuffix = []string{"pt1,o=go-susi,c=de"} // not a complete RDN
+  check(db.SystemMatchesScope(sys, groups, scope), false)
+  
+  scope.DNSuffix = nil
+  scope.UnitTag = []string{"123"}
+  check(db.SystemMatchesScope(sys, groups, scope), false)
+  scope.UnitTag = []string{"123", "1234"}
+  check(db.SystemMatchesScope(sys, groups, scope), true)
+  
+  scope.UnitTag = nil
+  scope.ObjectGroup = []string{"kiosk2"}
+  check(db.SystemMatchesScope(sys, groups, scope), false)
+  scope.ObjectGroup = []string{"kiosk"}
+  check(db.SystemMatchesScope(sys, groups, scope), true)
+  check(db.SystemMatchesScope(sys, nil, scope), false)
+  scope.ObjectGroup = []string{"cn=kiosk,ou=groups,o=go-susi,c=de"}
+  check(db.SystemMatchesScope(sys, groups, scope), true)
+  
+  // unknown systems are not in a restricted scope
+  check(db.SystemInScope("01:02:03:04:05:06", scope), false)
+}
+
+// Checks that the native LDAP client neither applies nor reports a change
+// twice when the connection pool retries a modification.
+func ldap_modify_retry_test() {
+  // A proxy in front of the test slapd. Forwards a request that contains
+  // "cut-here" to slapd but drops the connection instead of forwarding the
+  // response, as if the network failed after the change was sent.
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if !check(err, nil) { return }
+  defer listener.Close()
+  upstream := strings.TrimPrefix(config.LDAPURI, "ldap://")
+  var proxied []net.Conn
+  var proxied_mutex sync.Mutex
+  go func() {
+    for {
+      client, err := listener.Accept()
+      if err != nil { return }
+      server, err := net.Dial("tcp", upstream)
+      if err != nil { client.Close(); continue }
+      proxied_mutex.Lock()
+      proxied = append(proxied, client, server)
+      proxied_mutex.Unlock()
+      var cutting int32
+      go func() {
+        buf := make([]byte, 65536)
+        for {
+          n, err := server.Read(buf)
+          if err != nil || atomic.LoadInt32(&cutting) != 0 { client.Close(); return }
+          client.Write(buf[:n])
+        }
+      }()
+      go func() {
+        buf := make([]byte, 65536)
+        for {
+          n, err := client.Read(buf)
+          if err != nil { server.Close(); return }
+          if bytes.Contains(buf[:n], []byte("cut-here")) {
+            atomic.StoreInt32(&cutting, 1)
+            server.Write(buf[:n])
+            time.Sleep(500*time.Millisecond) // give slapd time to apply the change
+            client.Close()
+            server.Close()
+            return
+          }
+          server.Write(buf[:n])
+        }
+      }()
+    }
+  }()
+  // Closes all proxied connections, as if the server had closed them.
+  close_proxied := func() {
+    proxied_mutex.Lock()
+    defer proxied_mutex.Unlock()
+    for _, conn := range proxied { conn.Close() }
+    proxied = nil
+  }
+  
+  defer func(uri, client string) {
+    config.LDAPURI = uri
+    config.LDAPClient = client
+    db.LDAPClosePools()
+  }(config.LDAPURI, config.LDAPClient)
+  config.LDAPURI = "ldap://" + listener.Addr().String()
+  config.LDAPClient = "native"
+  db.LDAPClosePools()
+  
+  dn := "cn=modify-retry-test,"+config.LDAPBase
+  out, err := db.LDAPModify("dn: "+dn+"\nobjectClass: organizationalRole\ncn: modify-retry-test\n")
+  check(err, nil)
+  check(string(out), "adding new entry \""+dn+"\"\n\n")
+  
+  // The idle connection in the pool is dead. The retry must apply the
+  // change exactly once.
+  close_proxied()
+  out, err = db.LDAPModify("dn: "+dn+"\nchangetype: modify\nadd: description\ndescription: first\n")
+  check(err, nil)
+  check(string(out), "modifying entry \""+dn+"\"\n\n")
+  
+  // The connection breaks after the 1st change has been sent. It must not
+  // be sent again and the 2nd change must not be applied.
+  out, err = db.LDAPModify("dn: "+dn+"\nchangetype: modify\nadd: description\ndescription: cut-here\n\ndn: "+dn+"\nchangetype: modify\nadd: description\ndescription: never\n")
+  if check(err != nil, true) {
+    _, is_ldap_error := err.(*ldap.Error)
+    check(is_ldap_error, false)
+  }
+  check(string(out), "modifying entry \""+dn+"\"\n")
+  
+  conn, err := ldap.Dial("ldap://"+upstream, nil, false, 5*time.Second)
+  if !check(err, nil) { return }
+  defer conn.Close()
+  check(conn.Bind(config.LDAPAdmin, "password"), nil)
+  entries, err := conn.Search(dn, ldap.ScopeBase, "", []string{"description"}, 0)
+  check(err, nil)
+  if check(len(entries), 1) && check(len(entries[0].Attributes), 1) {
+    check(entries[0].Attributes[0].Values, [][]byte{[]byte("first"), []byte("cut-here")})
+  }
+  check(conn.Delete(dn), nil)
+}
+
 func jobdb_test() {
   check(db.JobGUID("0.0.0.0:0", 0), "00")
   check(db.JobGUID("255.255.255.255:65535", 18446744073709551615), "18446744073709551615281474976710655")
   check(db.JobGUID("1.2.3.4:20081", 18446744073709551615), "1844674407370955161586247305576961")
+  check(db.JobGUID("[::1]:20081", 0), "06833211539367361069723898395644397734592512")
+  check(db.JobGUID("[2001:db8::1]:20081", 7), "76833211539367361069723898395644400822452512")
+  check(db.JobGUID("[0:1::]:20081", 0) != db.JobGUID("[::1]:20081", 0), true)
+  check(db.JobGUID("[::ffff:1.2.3.4]:20081", 1), db.JobGUID("1.2.3.4:20081", 1))
 
   data, err := ioutil.ReadFile("testdata/jobdb-test.xml")
   if err != nil { panic(err) }
@@ -531,18 +756,27 @@ func jobdb_test() {
   // wait a little for jobs with timestamp in the past to go to status "processing"
   time.Sleep(1*time.Second)
   
+  // job 3 depends on a job that does not exist and must have been cancelled
+  // instead of launched
   jobs := db.JobsQuery(xml.FilterAll)
   check(len(jobs.Get("job")),1)
   check(jobs.First("job").Text("siserver"), config.ServerSourceAddress)
+  check(jobs.First("job").Text("id"), "4")
   check(jobs.First("job").Text("status"), "processing")
   fju := getFJU()
-  if check(len(fju),1) {
-    check(fju[0].First("answer1").Text("status"), "processing")
-    check(fju[0].First("answer1").Text("id"), "4")
+  if check(len(fju),2) {
+    if fju[0].First("answer1").Text("id") != "3" { fju[0],fju[1] = fju[1],fju[0] }
+    check(fju[0].First("answer1").Text("status"), "done")
+    check(fju[0].First("answer1").Text("id"), "3")
+    check(fju[1].First("answer1").Text("status"), "processing")
+    check(fju[1].First("answer1").Text("id"), "4")
   }
   
-  if check(db.PendingActions.Count(), 1) {
-    check(db.PendingActions.Next().(*xml.Hash).Text("headertag"), "trigger_action_lock")
+  if check(db.PendingActions.Count(), 2) {
+    actions := []string{db.PendingActions.Next().(*xml.Hash).Text("headertag","status"),
+                        db.PendingActions.Next().(*xml.Hash).Text("headertag","status")}
+    sort.Strings(actions)
+    check(actions, []string{"trigger_action_lock\u241eprocessing", "trigger_action_reboot\u241edone"})
   }
   
   db.JobsAddOrModifyForeign(xml.FilterNone, hash("xml(progress(none)status(waiting)siserver(1.2.3.4:20081)macaddress(11:22:33:44:55:6F)targettag(11:22:33:44:55:6F)timestamp(11110102030405)id(2)headertag(trigger_action_halt))"))
@@ -693,6 +927,401 @@ func jobdb_test() {
   check(job.Text("status"), "processing")
   check(job.Text("headertag"), "trigger_action_lock")
   
+  jobdb_dependencies_test()
+  jobdb_maintenance_test()
+  jobdb_throttle_test()
+  jobdb_events_test()
 }
 
+func jobdb_dependencies_test() {
+  db.JobsModifyLocal(xml.FilterAll, hash("job(status(done)periodic(none))"))
+  time.Sleep(200*time.Millisecond)
+  getFJU()
+  for db.PendingActions.Count() > 0 { db.PendingActions.Next() }
+  
+  // a is in the future, b is overdue but must wait for a because of the <sequence>
+  a := hash("job(progress(none)status(waiting)siserver(%v)macaddress(01:02:03:04:05:06)targettag(01:02:03:04:05:06)timestamp(91110102030405)headertag(trigger_action_lock)sequence(seq))",config.ServerSourceAddress)
+  b := hash("job(progress(none)status(waiting)siserver(%v)macaddress(01:02:03:04:05:06)targettag(01:02:03:04:05:06)timestamp(10001011000000)headertag(trigger_action_reboot)sequence(seq))",config.ServerSourceAddress)
+  db.JobAddLocal(a)
+  db.JobAddLocal(b)
+  time.Sleep(200*time.Millisecond)
+  jobs := db.JobsQuery(xml.FilterSimple("id", b.Text("id")))
+  check(jobs.First("job").Text("depends_on"), a.Text("id"))
+  check(jobs.First("job").Text("status"), "waiting")
+  check(db.PendingActions.Count(), 0)
+  
+  // c depends explicitly on b
+  c := hash("job(progress(none)status(waiting)siserver(%v)macaddress(01:02:03:04:05:06)targettag(01:02:03:04:05:06)timestamp(10001011000000)headertag(trigger_action_halt)depends_on(%v))",config.ServerSourceAddress,b.Text("id"))
+  db.JobAddLocal(c)
+  time.Sleep(200*time.Millisecond)
+  check(db.JobsQuery(xml.FilterSimple("id", c.Text("id"))).First("job").Text("status"), "waiting")
+  
+  // completion of a releases b
+  db.JobsModifyLocal(xml.FilterSimple("id", a.Text("id")), hash("job(status(launch))"))
+  db.JobsCompleteLocal(xml.FilterSimple("id", a.Text("id")), false)
+  time.Sleep(200*time.Millisecond)
+  jobs = db.JobsQuery(xml.FilterSimple("id", b.Text("id")))
+  check(jobs.First("job").Text("depends_on"), "")
+  check(jobs.First("job").Text("status"), "processing")
+  check(db.JobsQuery(xml.FilterSimple("id", c.Text("id"))).First("job").Text("status"), "waiting")
+  
+  // failure of b cancels c
+  db.JobsModifyLocal(xml.FilterSimple("id", b.Text("id")), hash("job(status(error)result(failed))"))
+  time.Sleep(200*time.Millisecond)
+  check(db.JobsQuery(xml.FilterSimple("id", c.Text("id"))), hash("jobdb()"))
+  check(db.JobsQuery(xml.FilterSimple("id", b.Text("id"))).First("job").Text("status"), "error")
+  
+  // a new job in the same sequence as the failed b is cancelled immediately
+  d := hash("job(progress(none)status(waiting)siserver(%v)macaddress(01:02:03:04:05:06)targettag(01:02:03:04:05:06)timestamp(91110102030405)headertag(trigger_action_halt)sequence(seq))",config.ServerSourceAddress)
+  db.JobAddLocal(d)
+  time.Sleep(200*time.Millisecond)
+  check(db.JobsQuery(xml.FilterSimple("id", d.Text("id"))), hash("jobdb()"))
+  
+  // a job whose predecessor does not exist (anymore) is cancelled rather
+  // than launched, because we can not tell if the predecessor has completed
+  e := hash("job(progress(none)status(waiting)siserver(%v)macaddress(01:02:03:04:05:06)targettag(01:02:03:04:05:06)timestamp(91110102030405)headertag(trigger_action_halt)depends_on(%v,99999))",config.ServerSourceAddress,a.Text("id"))
+  db.JobAddLocal(e)
+  time.Sleep(200*time.Millisecond)
+  check(db.JobsQuery(xml.FilterSimple("id", e.Text("id"))), hash("jobdb()"))
+  check(db.PendingActions.Count(), 0)
+  
+  db.JobsModifyLocal(xml.FilterAll, hash("job(status(done)periodic(none))"))
+  time.Sleep(200*time.Millisecond)
+  getFJU()
+  for db.PendingActions.Count() > 0 { db.PendingActions.Next() }
+}
+
+
+
+func jobdb_maintenance_test() {
+  // the window opens tomorrow at midnight
+  tomorrow := time.Now().AddDate(0,0,1)
+  defer modifyConfig(func(r *config.Reloadable) {
+    r.MaintenanceJobs = []string{"trigger_action_reboot"}
+    r.MaintenanceWindows = map[string]string{"default":tomorrow.Weekday().String()}
+  })()
+  
+  a := hash("job(progress(none)status(waiting)siserver(%v)macaddress(01:02:03:04:05:06)targettag(01:02:03:04:05:06)timestamp(10001011000000)headertag(trigger_action_reboot))",config.ServerSourceAddress)
+  b := hash("job(progress(none)status(waiting)siserver(%v)macaddress(01:02:03:04:05:06)targettag(01:02:03:04:05:06)timestamp(10001011000000)headertag(trigger_action_lock))",config.ServerSourceAddress)
+  db.JobAddLocal(a)
+  db.JobAddLocal(b)
+  time.Sleep(500*time.Millisecond)
+  job := db.JobsQuery(xml.FilterSimple("id", a.Text("id"))).First("job")
+  check(job.Text("status"), "deferred")
+  y, m, d := tomorrow.Date()
+  check(job.Text("deferred_until"), util.MakeTimestamp(time.Date(y, m, d, 0, 0, 0, 0, time.Local)))
+  check(strings.HasPrefix(job.Text("result"), "Outside maintenance window (default: "+tomorrow.Weekday().String()+")"), true)
+  // jobs not listed in config.MaintenanceJobs() are not affected
+  check(db.JobsQuery(xml.FilterSimple("id", b.Text("id"))).First("job").Text("status"), "processing")
+  
+  // the job is released when its <deferred_until> has come and the window is open
+  config.Modify(func(r *config.Reloadable) { r.MaintenanceWindows = map[string]string{"default":"*"} })
+  db.JobsModifyLocal(xml.FilterSimple("id", a.Text("id")), hash("job(deferred_until(10001011000000))"))
+  time.Sleep(500*time.Millisecond)
+  job = db.JobsQuery(xml.FilterSimple("id", a.Text("id"))).First("job")
+  check(job.Text("status"), "processing")
+  check(job.Text("deferred_until"), "")
+  check(job.Text("result"), "none")
+  
+  db.JobsModifyLocal(xml.FilterAll, hash("job(status(done)periodic(none))"))
+  time.Sleep(200*time.Millisecond)
+  getFJU()
+  for db.PendingActions.Count() > 0 { db.PendingActions.Next() }
+}
+
+func jobdb_throttle_test() {
+  defer modifyConfig(func(r *config.Reloadable) { r.ThrottleLimits = map[string]int{"trigger_action_lock":2} })()
+  
+  jobs := []*xml.Hash{}
+  for i := 1; i <= 4; i++ {
+    job := hash("job(progress(none)status(waiting)siserver(%v)macaddress(01:02:03:04:05:0%v)targettag(01:02:03:04:05:0%v)timestamp(1000101100000%v)headertag(trigger_action_lock))",config.ServerSourceAddress,i,i,i)
+    db.JobAddLocal(job)
+    jobs = append(jobs, job)
+  }
+  time.Sleep(500*time.Millisecond)
+  status := func(i int) string {
+    return db.JobsQuery(xml.FilterSimple("id", jobs[i].Text("id"))).First("job").Text("status","result")
+  }
+  position := func(i int) int {
+    return db.JobsQueuePositions("trigger_action_lock")[jobs[i].Text("id")]
+  }
+  check(status(0), "processing\u241enone")
+  check(status(1), "processing\u241enone")
+  // The position in the queue is not stored in the job.
+  check(status(2), "queued\u241enone")
+  check(status(3), "queued\u241enone")
+  check(position(0), 0)
+  check(position(2), 1)
+  check(position(3), 2)
+  
+  // a job that reaches progress 100 makes room
+  db.JobsModifyLocal(xml.FilterSimple("id", jobs[0].Text("id")), hash("job(progress(100))"))
+  time.Sleep(500*time.Millisecond)
+  check(status(2), "processing\u241enone")
+  check(status(3), "queued\u241enone")
+  check(position(2), 0)
+  check(position(3), 1)
+  
+  // so does a job that is done
+  db.JobsRemoveLocal(xml.FilterSimple("id", jobs[1].Text("id")), true)
+  time.Sleep(500*time.Millisecond)
+  check(status(3), "processing\u241enone")
+  
+  db.JobsModifyLocal(xml.FilterAll, hash("job(status(done)periodic(none))"))
+  time.Sleep(200*time.Millisecond)
+  getFJU()
+  for db.PendingActions.Count() > 0 { db.PendingActions.Next() }
+}
 
+func jobdb_events_test() {
+  defer modifyConfig(func(r *config.Reloadable) { r.JobEventLogPath = config.TempDir + "/job-events.log" })()
+  
+  job := hash("job(progress(none)status(waiting)siserver(%v)macaddress(01:02:03:04:05:06)targettag(01:02:03:04:05:06)timestamp(91110102030405)headertag(trigger_action_lock)result(two\nlines))",config.ServerSourceAddress)
+  db.JobAddLocal(job)
+  db.JobsModifyLocal(xml.FilterSimple("id", job.Text("id")), hash("job(status(launch))"))
+  db.JobsModifyLocal(xml.FilterSimple("id", job.Text("id")), hash("job(progress(42))"))
+  db.JobsModifyLocal(xml.FilterSimple("id", job.Text("id")), hash("job(progress(forward))"))
+  db.JobsRemoveLocal(xml.FilterSimple("id", job.Text("id")), true)
+  time.Sleep(500*time.Millisecond)
+  getFJU()
+  for db.PendingActions.Count() > 0 { db.PendingActions.Next() }
+  
+  data, err := ioutil.ReadFile(config.JobEventLogPath())
+  check(err, nil)
+  lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+  if check(len(lines), 5) {
+    events := []*xml.Hash{}
+    for _, line := range lines {
+      event, err := xml.StringToHash(line)
+      check(err, nil)
+      events = append(events, event)
+    }
+    check(events[0].Text("type"), "added")
+    check(events[0].First("job").Text("id"), job.Text("id"))
+    check(events[0].First("job").Text("result"), "two\nlines")
+    check(events[1].Text("type","old_status","old_progress"), "changed\u241ewaiting\u241enone")
+    check(events[1].First("job").Text("status"), "processing")
+    check(events[2].Text("type","old_status","old_progress"), "changed\u241eprocessing\u241enone")
+    check(events[2].First("job").Text("progress"), "42")
+    check(events[3].Text("type"), "forwarded")
+    check(events[4].Text("type"), "removed")
+    check(events[4].First("job").Text("status"), "done")
+  }
+  
+  // If the hook can not keep up, events beyond config.JobEventQueueMax
+  // are dropped and counted instead of piling up.
+  os.Remove(config.JobEventLogPath())
+  hook := config.TempDir + "/slow-job-event-hook"
+  check(ioutil.WriteFile(hook, []byte("#!/bin/sh\nsleep 1\n"), 0755), nil)
+  config.Modify(func(r *config.Reloadable) { r.JobEventHookPath = hook })
+  defer func(max int) { config.JobEventQueueMax = max }(config.JobEventQueueMax)
+  config.JobEventQueueMax = 2
+  dropped := atomic.LoadInt64(&db.JobEventsDropped)
+  
+  job = hash("job(progress(none)status(waiting)siserver(%v)macaddress(01:02:03:04:05:06)targettag(01:02:03:04:05:06)timestamp(91110102030405)headertag(trigger_action_lock))",config.ServerSourceAddress)
+  db.JobAddLocal(job)
+  db.JobsModifyLocal(xml.FilterSimple("id", job.Text("id")), hash("job(status(launch))"))
+  db.JobsModifyLocal(xml.FilterSimple("id", job.Text("id")), hash("job(progress(42))"))
+  db.JobsModifyLocal(xml.FilterSimple("id", job.Text("id")), hash("job(progress(43))"))
+  db.JobsRemoveLocal(xml.FilterSimple("id", job.Text("id")), true)
+  time.Sleep(500*time.Millisecond)
+  getFJU()
+  for db.PendingActions.Count() > 0 { db.PendingActions.Next() }
+  
+  // At most 1 event is being processed and 2 are queued.
+  dropped = atomic.LoadInt64(&db.JobEventsDropped) - dropped
+  check(dropped >= 2, true)
+  time.Sleep(4*time.Second) // let the hook work off the backlog
+  data, err = ioutil.ReadFile(config.JobEventLogPath())
+  check(err, nil)
+  lines = strings.Split(strings.TrimSpace(string(data)), "\n")
+  check(int64(len(lines)) + dropped, 5)
+}
+
+func maintenance_test() {
+  windows, err := db.ParseMaintenanceWindows("Mon-Fri 18:00-07:00; Sat,sunday")
+  check(err, nil)
+  check(len(windows), 2)
+  check(windows[0].Spec, "Mon-Fri 18:00-07:00")
+  check(windows[0].Days, [7]bool{false,true,true,true,true,true,false})
+  check(windows[0].Start, 18*60)
+  check(windows[0].End, 7*60)
+  check(windows[1].Days, [7]bool{true,false,false,false,false,false,true})
+  check(windows[1].Start, 0)
+  check(windows[1].End, 24*60)
+  
+  fri_sat, err := db.ParseMaintenanceWindows("Fri-Mon 22:30-24:00")
+  check(err, nil)
+  check(fri_sat[0].Days, [7]bool{true,true,false,false,false,true,true})
+  
+  every_day, err := db.ParseMaintenanceWindows("02:00-03:00")
+  check(err, nil)
+  check(every_day[0].Days, [7]bool{true,true,true,true,true,true,true})
+  
+  _, err = db.ParseMaintenanceWindows("Mon-Fri 18:00")
+  check(err != nil, true)
+  _, err = db.ParseMaintenanceWindows("Mon-Fri 18:00-25:00")
+  check(err != nil, true)
+  _, err = db.ParseMaintenanceWindows("Montag-Freitag")
+  check(err != nil, true)
+  
+  // 2013-10-14 is a Monday
+  at := func(day, hour, min int) time.Time { return time.Date(2013, 10, day, hour, min, 0, 0, time.Local) }
+  check(db.MaintenanceWindowOpen(windows, at(14, 12, 0)), false)
+  check(db.MaintenanceWindowOpen(windows, at(14, 18, 0)), true)
+  check(db.MaintenanceWindowOpen(windows, at(15, 6, 59)), true)
+  check(db.MaintenanceWindowOpen(windows, at(15, 7, 0)), false)
+  check(db.MaintenanceWindowOpen(windows, at(14, 6, 0)), false) // Sunday ends at midnight
+  check(db.MaintenanceWindowOpen(windows, at(19, 6, 0)), true) // Friday night
+  check(db.MaintenanceWindowOpen(windows, at(20, 23, 59)), true)
+  
+  check(db.MaintenanceWindowNext(windows, at(14, 12, 0)), at(14, 18, 0))
+  check(db.MaintenanceWindowNext(windows, at(14, 20, 0)), at(14, 20, 0))
+  check(db.MaintenanceWindowNext(every_day, at(14, 3, 0)), at(15, 2, 0))
+  check(db.MaintenanceWindowNext(fri_sat, at(15, 12, 0)), at(18, 22, 30))
+  check(db.MaintenanceWindowNext([]db.MaintenanceWindow{}, at(15, 12, 0)).IsZero(), true)
+}
+
+func periodic_test() {
+  // 2013-10-18 is a Friday
+  at := func(day, hour, min int) time.Time { return time.Date(2013, 10, day, hour, min, 0, 0, time.Local) }
+  next := func(periodic string) interface{} {
+    t, err := db.PeriodicNext(periodic, at(18, 12, 0))
+    if err != nil { return err.Error() }
+    return t
+  }
+  check(next("7_days"), at(25, 12, 0))
+  check(next("1_months"), time.Date(2013, 11, 18, 12, 0, 0, 0, time.Local))
+  check(next("0 3 * * mon-fri"), at(21, 3, 0))
+  check(next("30 2 * * sun#1"), time.Date(2013, 11, 3, 2, 30, 0, 0, time.Local))
+  check(next("*/15 * * * *"), at(18, 12, 15))
+  check(next("5/20 * * * *"), at(18, 12, 5))
+  check(next("@daily"), at(19, 0, 0))
+  check(next("0 0 * * 7"), at(20, 0, 0))
+  check(next("0 3 * * 1-5/2"), at(21, 3, 0))
+  check(next("0 12 13 * fri"), at(25, 12, 0)) // day of month OR day of week
+  check(next("0 12 * dec *"), time.Date(2013, 12, 1, 12, 0, 0, 0, time.Local))
+  check(next("0 0 31 2 *"), "<periodic> \"0 0 31 2 *\" never matches")
+  check(next("61 * * * *"), "<periodic> \"61 * * * *\": minute: illegal value \"61\"")
+  check(next("0 3 * *"), "<periodic> \"0 3 * *\": cron expression must have 5 fields")
+  check(next("0 0 * * sun#6"), "<periodic> \"0 0 * * sun#6\": day of week: illegal value \"sun#6\"")
+  check(next("1_fortnights"), "Unknown periodic unit: fortnights")
+  
+  berlin, err := time.LoadLocation("Europe/Berlin")
+  if check(err, nil) {
+    t, err := db.PeriodicNext("TZ=Europe/Berlin 0 3 * * *", time.Date(2013, 10, 18, 12, 0, 0, 0, berlin).In(time.UTC))
+    check(err, nil)
+    check(t.Location(), time.UTC)
+    check(t.Equal(time.Date(2013, 10, 19, 3, 0, 0, 0, berlin)), true)
+  }
+  
+  check(db.PeriodicValid(""), nil)
+  check(db.PeriodicValid("none"), nil)
+  check(db.PeriodicValid("TZ=Europe/Berlin @weekly"), nil)
+  check(db.PeriodicValid("TZ=Nowhere/Special @weekly") != nil, true)
+}
+
+func audittrail_test() {
+  defer modifyConfig(func(r *config.Reloadable) { r.AuditTrailPath = config.TempDir + "/audit-trail.log" })()
+  
+  check(db.AuditTrailQuery(xml.FilterAll), hash("audittrail()"))
+  
+  entry := db.NewAuditTrailEntry(net.ParseIP("1.2.3.4"), "CN=gosa", "job_trigger_action_reinstall")
+  check(entry.Text("peer","subject","header"), "1.2.3.4\u241eCN=gosa\u241ejob_trigger_action_reinstall")
+  check(len(entry.Text("timestamp")), 14)
+  entry.Add("target", "01:02:03:04:05:06")
+  entry.Add("outcome", "ok")
+  db.AuditTrailAdd(entry)
+  
+  entry = db.NewAuditTrailEntry(nil, "", ".release")
+  entry.Add("target", "01:02:03:04:05:07")
+  entry.Add("argument", "plophos/4.1.0\nwith a line break")
+  entry.Add("outcome", "denied")
+  db.AuditTrailAdd(entry)
+  
+  data, err := ioutil.ReadFile(config.AuditTrailPath())
+  check(err, nil)
+  check(strings.Count(string(data), "\n"), 2)
+  
+  trail := db.AuditTrailQuery(xml.FilterAll)
+  check(len(trail.Get("entry")), 2)
+  check(trail.First("entry").Text("header"), "job_trigger_action_reinstall")
+  check(trail.First("entry").Next().Text("argument"), "plophos/4.1.0\nwith a line break")
+  check(trail.First("entry").Next().Text("peer"), "")
+  
+  trail = db.AuditTrailQuery(xml.FilterSimple("target", "01:02:03:04:05:07"))
+  check(trail.First("entry").Text("header"), ".release")
+  check(trail.First("entry").Text("outcome"), "denied")
+  
+  trail = db.AuditTrailQuery(xml.FilterSimple("outcome", "error"))
+  check(trail, hash("audittrail()"))
+  
+  config.Modify(func(r *config.Reloadable) { r.AuditTrailPath = "" })
+  db.AuditTrailAdd(entry)
+  check(db.AuditTrailQuery(xml.FilterAll), hash("audittrail()"))
+}
+
+func hookrun_test() {
+  defer modifyConfig(func(r *config.Reloadable) {
+    r.HookTimeout = 5*time.Second
+    r.HookTimeouts = map[string]time.Duration{"slow-hook": 500*time.Millisecond}
+    r.HookMaxOutput = 1000
+  })()
+  
+  out, err := db.HookCombinedOutput("test-hook", exec.Command("/bin/sh", "-c", "echo foo; echo bar >&2"))
+  check(err, nil)
+  check(out, "foo\nbar\n")
+  
+  // The hook's background child must be killed, too. Otherwise it would
+  // keep stdout open and HookRun() would not return before it exits.
+  pidfile := config.TempDir + "/hookrun_test.pid"
+  start := time.Now()
+  out, err = db.HookCombinedOutput("slow-hook", exec.Command("/bin/sh", "-c", "sleep 30 & echo $! >"+pidfile+"; sleep 30"))
+  check(err != nil && strings.Contains(err.Error(), "timeout"), true)
+  check(time.Since(start) < 5*time.Second, true)
+  pid, _ := ioutil.ReadFile(pidfile)
+  time.Sleep(100*time.Millisecond)
+  // If go-susi does not run as PID 1, the killed child may linger as a zombie
+  stat, err := ioutil.ReadFile("/proc/"+strings.TrimSpace(string(pid))+"/stat")
+  check(err != nil || strings.Contains(string(stat), ") Z "), true)
+  
+  start = time.Now()
+  _, err = db.HookCombinedOutput("test-hook", exec.Command("/bin/sh", "-c", "while true; do echo 0123456789; done"))
+  check(err != nil && strings.Contains(err.Error(), "output"), true)
+  check(time.Since(start) < 5*time.Second, true)
+  
+  // The same limit applies to a separate stderr.
+  start = time.Now()
+  _, err = db.HookLdif("test-hook", exec.Command("/bin/sh", "-c", "while true; do echo 0123456789 >&2; done"), "item", false)
+  check(err != nil && strings.Contains(err.Error(), "output"), true)
+  check(time.Since(start) < 5*time.Second, true)
+  
+  _, err = db.HookCombinedOutput("test-hook", exec.Command("/bin/false"))
+  check(err != nil, true)
+  
+  stats := db.HookStats()
+  check(stats["/bin/sh"].Count >= 3, true)
+  check(stats["/bin/sh"].Timeouts >= 1, true)
+  check(stats["/bin/sh"].OutputExceeded >= 1, true)
+  check(stats["/bin/false"].Failures >= 1, true)
+  
+  // With HookMaxParallel 1, 3 hooks that sleep 0.3s need at least 0.9s.
+  config.Modify(func(r *config.Reloadable) { r.HookMaxParallel = 1 })
+  start = time.Now()
+  done := make(chan bool)
+  for i := 0; i < 3; i++ {
+    go func() {
+      db.HookRun("test-hook", exec.Command("/bin/sleep", "0.3"))
+      done <- true
+    }()
+  }
+  time.Sleep(100*time.Millisecond)
+  running, waiting := db.HooksRunning()
+  check(running, 1)
+  check(waiting, 2)
+  for i := 0; i < 3; i++ { <-done }
+  check(time.Since(start) >= 900*time.Millisecond, true)
+  running, waiting = db.HooksRunning()
+  check(running, 0)
+  check(waiting, 0)
+}
@@ -0,0 +1,235 @@
+/*
+Copyright (c) 2026 go-susi contributors
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+
+// Unit tests run by run-tests.go.
+package tests
+
+import (
+         "fmt"
+         "net"
+         "time"
+         "bytes"
+         "strings"
+         
+         "../ldap"
+         "../config"
+       )
+
+// Unit tests for the package go-susi/ldap.
+// The live tests require the test slapd started by UnitTests().
+func Ldap_test() {
+  fmt.Printf("\n=== ldap ===\n\n")
+
+  testLdapFilter()
+  testLdapLDIF()
+  testLdapOversized()
+  testLdapLive()
+}
+
+// A server that announces a huge BER length must not make the client
+// allocate the memory. Lengths that do not fit into a 32-bit int and
+// nested lengths that run past the end of the data must be rejected, too.
+func testLdapOversized() {
+  for _, test := range []struct{ reply []byte; err string }{
+    {[]byte{0x30, 0x84, 0x7f, 0xff, 0xff, 0xff}, "too large"},
+    {[]byte{0x30, 0x84, 0xff, 0xff, 0xff, 0xff}, "too large"},
+    {[]byte{0x30, 0x06, 0x02, 0x84, 0xff, 0xff, 0xff, 0xff}, "truncated"},
+  } {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if !check(err, nil) { return }
+    reply := test.reply
+    go func() {
+      conn, err := listener.Accept()
+      if err != nil { return }
+      defer conn.Close()
+      buf := make([]byte, 1024)
+      conn.Read(buf)
+      conn.Write(reply)
+      time.Sleep(1*time.Second)
+    }()
+
+    conn, err := ldap.Dial("ldap://"+listener.Addr().String(), nil, false, 5*time.Second)
+    if check(err, nil) {
+      err = conn.Bind("cn=admin", "password")
+      check(err != nil && strings.Contains(err.Error(), test.err), true)
+      conn.Close()
+    }
+    listener.Close()
+  }
+}
+
+func testLdapFilter() {
+  // examples from RFC 4511/4515
+  filter, err := ldap.CompileFilter("(cn=Babs Jensen)")
+  check(err, nil)
+  check(fmt.Sprintf("% x", filter), "a3 11 04 02 63 6e 04 0b 42 61 62 73 20 4a 65 6e 73 65 6e")
+  filter, err = ldap.CompileFilter("(!(cn=Tim Howes))")
+  check(err, nil)
+  check(fmt.Sprintf("% x", filter), "a2 11 a3 0f 04 02 63 6e 04 09 54 69 6d 20 48 6f 77 65 73")
+  filter, err = ldap.CompileFilter("(o=univ*of*mich*)")
+  check(err, nil)
+  check(fmt.Sprintf("% x", filter), "a4 15 04 01 6f 30 10 80 04 75 6e 69 76 81 02 6f 66 81 04 6d 69 63 68")
+  filter, err = ldap.CompileFilter("(cn:1.2.3.4.5:=Fred Flintstone)")
+  check(err, nil)
+  check(fmt.Sprintf("% x", filter), "a9 20 81 09 31 2e 32 2e 33 2e 34 2e 35 82 02 63 6e 83 0f 46 72 65 64 20 46 6c 69 6e 74 73 74 6f 6e 65")
+
+  // like ldapsearch, accept filters without parentheses
+  filter, err = ldap.CompileFilter("objectClass=*")
+  check(err, nil)
+  check(fmt.Sprintf("% x", filter), "87 0b 6f 62 6a 65 63 74 43 6c 61 73 73")
+
+  // escapes
+  filter, err = ldap.CompileFilter("(cn=a\\2ab)")
+  check(err, nil)
+  check(fmt.Sprintf("% x", filter), "a3 09 04 02 63 6e 04 03 61 2a 62")
+
+  _, err = ldap.CompileFilter("(cn=x")
+  check(err != nil, true)
+  _, err = ldap.CompileFilter("(cn=x\\2)")
+  check(err != nil, true)
+  _, err = ldap.CompileFilter("(&(cn=x))(cn=y)")
+  check(err != nil, true)
+}
+
+func testLdapLDIF() {
+  changes, err := ldap.ParseChanges(`version: 1
+
+dn:: Y249Zm9vLGRjPWRl
+changetype: modify
+replace: member
+member: a
+member:: w6Q=
+-
+add: x
+x: y
+
+# comment
+dn: cn=x
+changetype: modrdn
+newrdn: cn=y
+deleteoldrdn: 1
+newsuperior:: b3U9eA==
+
+dn: cn=n
+objectClass: to
+ p
+objectClass: bar
+
+dn: cn=d
+changetype: delete
+`)
+  check(err, nil)
+  if check(len(changes), 4) {
+    check(changes[0].DN, "cn=foo,dc=de")
+    check(changes[0].Type, "modify")
+    if check(len(changes[0].Modifications), 2) {
+      check(changes[0].Modifications[0].Op, ldap.ModReplace)
+      check(changes[0].Modifications[0].Name, "member")
+      check(changes[0].Modifications[0].Values, [][]byte{[]byte("a"), []byte("ä")})
+      check(changes[0].Modifications[1].Op, ldap.ModAdd)
+      check(changes[0].Modifications[1].Name, "x")
+    }
+    check(changes[1].Type, "modrdn")
+    check(changes[1].NewRDN, "cn=y")
+    check(changes[1].DeleteOldRDN, true)
+    check(changes[1].NewSuperior, "ou=x")
+    check(changes[2].Type, "add")
+    if check(len(changes[2].Attributes), 1) {
+      check(changes[2].Attributes[0].Values, [][]byte{[]byte("top"), []byte("bar")})
+    }
+    check(changes[3].Type, "delete")
+  }
+
+  _, err = ldap.ParseChanges("dn: cn=x\nchangetype: modify\nadd: a\nb: c\n")
+  check(err != nil, true)
+  _, err = ldap.ParseChanges("dn: cn=x\nchangetype: foo\n")
+  check(err != nil, true)
+
+  var buf bytes.Buffer
+  ldap.WriteLDIF(&buf, []*ldap.Entry{
+    &ldap.Entry{DN:"cn=ä", Attributes:[]*ldap.Attribute{&ldap.Attribute{Name:"cn", Values:[][]byte{[]byte("x"), []byte(" y")}}}},
+    &ldap.Entry{DN:"cn=b"},
+  })
+  check(buf.String(), "dn:: Y249w6Q=\ncn: x\ncn:: IHk=\n\ndn: cn=b\n")
+}
+
+func testLdapLive() {
+  conn, err := ldap.Dial(config.LDAPURI, nil, false, 5*time.Second)
+  if !check(err, nil) { return }
+  defer conn.Close()
+
+  err = conn.Bind(config.LDAPAdmin, "wrong password")
+  if check(err != nil, true) {
+    lerr, ok := err.(*ldap.Error)
+    if check(ok, true) { check(lerr.Code, ldap.InvalidCredentials) }
+  }
+  check(conn.Bind(config.LDAPAdmin, "password"), nil)
+
+  entries, err := conn.Search(config.LDAPBase, ldap.ScopeBase, "objectClass=*", []string{"dn"}, 0)
+  check(err, nil)
+  if check(len(entries), 1) { check(entries[0].DN, config.LDAPBase) }
+
+  // paged and unpaged searches must return the same entries
+  all, err := conn.Search(config.LDAPBase, ldap.ScopeSub, "(objectClass=*)", []string{"dn"}, 0)
+  check(err, nil)
+  paged, err := conn.Search(config.LDAPBase, ldap.ScopeSub, "(objectClass=*)", []string{"dn"}, 3)
+  check(err, nil)
+  check(len(all) > 3, true)
+  check(len(paged), len(all))
+
+  _, err = conn.Search("ou=does not exist,"+config.LDAPBase, ldap.ScopeSub, "", nil, 0)
+  if check(err != nil, true) {
+    lerr, ok := err.(*ldap.Error)
+    if check(ok, true) { check(lerr.Code, ldap.NoSuchObject) }
+  }
+
+  dn := "cn=ldap-test,"+config.LDAPBase
+  change, err := ldap.ParseChanges("dn: "+dn+"\nobjectClass: organizationalRole\ncn: ldap-test\n\ndn: "+dn+"\nchangetype: modify\nadd: description\ndescription: foo\n")
+  check(err, nil)
+  for _, ch := range change { check(conn.Apply(ch), nil) }
+  entries, err = conn.Search(dn, ldap.ScopeBase, "", []string{"description"}, 0)
+  check(err, nil)
+  if check(len(entries), 1) && check(len(entries[0].Attributes), 1) {
+    check(entries[0].Attributes[0].Values, [][]byte{[]byte("foo")})
+  }
+  err = conn.Add(dn, []*ldap.Attribute{&ldap.Attribute{Name:"objectClass", Values:[][]byte{[]byte("organizationalRole")}}})
+  if lerr, ok := err.(*ldap.Error); check(ok, true) { check(lerr.Code, ldap.EntryAlreadyExists) }
+  check(conn.Delete(dn), nil)
+
+  // a pool must replace connections that have been closed
+  pool := ldap.NewPool(1, func() (*ldap.Conn, error) { return ldap.Dial(config.LDAPURI, nil, false, 5*time.Second) })
+  var c1 *ldap.Conn
+  check(pool.Do(func(c *ldap.Conn) error { c1 = c; return nil }), nil)
+  c1.Close()
+  check(pool.Do(func(c *ldap.Conn) error { _, err := c.Search(config.LDAPBase, ldap.ScopeBase, "", nil, 0); return err }), nil)
+  
+  // If the connection breaks in the middle of a batch, the retry must be
+  // able to continue where the first attempt stopped.
+  change, err = ldap.ParseChanges("dn: "+dn+"\nobjectClass: organizationalRole\ncn: ldap-test\n\ndn: "+dn+"\nchangetype: delete\n")
+  check(err, nil)
+  done := 0
+  calls := 0
+  check(pool.Do(func(c *ldap.Conn) error {
+    calls++
+    for ; done < len(change); done++ {
+      if calls == 1 && done == 1 { c.Close() }
+      if err := c.Apply(change[done]); err != nil { return err }
+    }
+    return nil
+  }), nil)
+  check(calls, 2)
+  check(done, 2)
+  pool.Close()
+}
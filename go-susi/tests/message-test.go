@@ -23,9 +23,14 @@ package tests
 
 import (
          "fmt"
+         "io"
          "time"
          "bytes"
+         "regexp"
+         "strconv"
          "strings"
+         "net/http"
+         "crypto/tls"
          
          "../db"
          "../xml"
@@ -84,7 +89,9 @@ func Message_test() {
   check(message.Peer(listen_address).Downtime(), time.Duration(0))
   t0 := time.Now()
   message.Peer(listen_address).Tell("<xml><header>Hallo</header></xml>", keys[0])
-  check(wait(t0, "Hallo").XML.Text("header"), "Hallo")
+  hallo := wait(t0, "Hallo").XML
+  check(hallo.Text("header"), "Hallo")
+  check(hallo.Text("msgnonce") != "", true)
   t0 = time.Now()
   message.Peer(listen_address).Tell("<xml><header>Aloha</header></xml>", "")
   check(wait(t0, "Aloha").XML.Text("header"), "Aloha")
@@ -93,8 +100,8 @@ func Message_test() {
   oldlevel := util.LogLevel
   util.LogLevel = -1
   
-  check(error_string(<-message.Peer(listen_address).Ask("<xml><header>gosa_query_jobdb</header></xml>", config.ModuleKey["[GOsaPackages]"])),"")
-  check(error_string(<-message.Peer(listen_address).Ask("<xml><header>whatever</header></xml>", config.ModuleKey["[GOsaPackages]"])),"Communication error in Ask()")
+  check(error_string(<-message.Peer(listen_address).Ask("<xml><header>gosa_query_jobdb</header></xml>", config.ModuleKey()["[GOsaPackages]"])),"")
+  check(error_string(<-message.Peer(listen_address).Ask("<xml><header>whatever</header></xml>", config.ModuleKey()["[GOsaPackages]"])),"Communication error in Ask()")
 
   // Some voodoo to make sure the downtime counter is at 0
   listen_stop()
@@ -220,6 +227,113 @@ func Message_test() {
   check(hasWords(buffy.String(),"Successfully sent message"),"")
   
   listen_stop()
+  
+  json_api_test()
+  
+  metrics_test()
+}
 
+// Drives the HTTPS/JSON API with an HTTP client.
+func json_api_test() {
+  defer modifyConfig(nil)()
+  
+  tlsConfig := func(name string) *tls.Config {
+    useTestCertificate(name)
+    return config.TLSClientConfig()
+  }
+  good := tlsConfig("limits") // has QueryJobs
+  bad := tlsConfig("signedbywrongca")
+  tlsConfig("2") // config.TLSServerConfig() is used by the API
+  config.Modify(func(r *config.Reloadable) { r.Timeout = 2*time.Second })
+  
+  go message.JSONAPIListenAndServe("127.0.0.1:18748")
+  time.Sleep(1*time.Second)
+  
+  post := func(conf *tls.Config, path, body string) (int, *xml.Hash) {
+    client := &http.Client{Transport:&http.Transport{TLSClientConfig:conf}, Timeout:10*time.Second}
+    resp, err := client.Post("https://127.0.0.1:18748"+path, "application/json", strings.NewReader(body))
+    if err != nil { return 0, xml.NewHash("error", err.Error()) }
+    defer resp.Body.Close()
+    x, err := xml.JSONToHash("xml", resp.Body)
+    if err != nil { x = xml.NewHash("error", err.Error()) }
+    return resp.StatusCode, x
+  }
+  
+  status, x := post(bad, "/gosa_query_jobdb", `{"where":{}}`)
+  check(status, http.StatusForbidden)
+  check(x.Text("error_string") != "", true)
+  
+  status, x = post(good, "/gosa_query_jobdb", `{"where":{}}`)
+  check(status, http.StatusOK)
+  check(x.Text("header"), "query_jobdb")
+  check(x.First("error_string"), nil)
+  
+  status, x = post(good, "/gosa_query_jobdb", `{"where":`)
+  check(status, http.StatusBadRequest)
+  check(x.Text("error_string") != "", true)
+  
+  status, x = post(good, "/gosa/query_jobdb", `{}`)
+  check(status, http.StatusNotFound)
+  
+  // A client that stalls while sending the body must not be able to hold
+  // on to the connection beyond config.Timeout().
+  body, stall := io.Pipe()
+  go stall.Write([]byte(`{"where":`))
+  t0 := time.Now()
+  client := &http.Client{Transport:&http.Transport{TLSClientConfig:good}, Timeout:10*time.Second}
+  resp, err := client.Post("https://127.0.0.1:18748/gosa_query_jobdb", "application/json", body)
+  if err == nil {
+    check(resp.StatusCode != http.StatusOK, true)
+    resp.Body.Close()
+  }
+  check(time.Since(t0) < 5*time.Second, true)
+  stall.Close()
 }
 
+// Parses the output of message.WriteMetrics() like a Prometheus server would.
+func metrics_test() {
+  hook := "/hooks/we\"ird\\hook\nwith\ttab"
+  db.HookExecuted(hook, 1*time.Second, nil)
+  db.HookExecuted(hook, 3*time.Second, fmt.Errorf("failed"))
+  
+  var buf bytes.Buffer
+  message.WriteMetrics(&buf, 7, 2*time.Second)
+  
+  typ := map[string]string{}
+  samples := map[string]string{}
+  sample := regexp.MustCompile(`^([a-z_]+)(\{([a-z_]+="([^"\\]|\\[\\"n])*",?)*\})? (\S+)$`)
+  for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+    if strings.HasPrefix(line, "# HELP ") { continue }
+    if strings.HasPrefix(line, "# TYPE ") {
+      f := strings.Fields(line)
+      if check(len(f), 4) {
+        check(f[3] == "counter" || f[3] == "gauge", true)
+        typ[f[2]] = f[3]
+      }
+      continue
+    }
+    m := sample.FindStringSubmatch(line)
+    if !check(m != nil, true) { 
+      fmt.Printf("Unparsable line: %q\n", line)
+      continue
+    }
+    if !check(typ[m[1]] != "", true) {
+      fmt.Printf("No # TYPE before: %q\n", line)
+    }
+    _, err := strconv.ParseFloat(m[5], 64)
+    check(err, nil)
+    samples[m[1]+m[2]] = m[5]
+  }
+  
+  for name, t := range typ {
+    check(strings.HasSuffix(name, "_total"), t == "counter")
+  }
+  
+  check(samples["gosusi_active_connections"], "7")
+  check(samples["gosusi_request_processing_seconds_max"], "2")
+  label := `{hook="/hooks/we\"ird\\hook\nwith` + "\t" + `tab"}`
+  check(samples["gosusi_hook_executions_total"+label], "2")
+  check(samples["gosusi_hook_failures_total"+label], "1")
+  check(samples["gosusi_hook_seconds_total"+label], "4")
+  check(samples["gosusi_hook_seconds_max"+label], "3")
+}
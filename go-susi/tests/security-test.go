@@ -21,12 +21,27 @@ import (
          "fmt"
          "net"
          "time"
+         "strings"
+         "strconv"
+         "math/big"
+         "io/ioutil"
          "crypto/tls"
+         "crypto/rand"
+         "crypto/x509"
+         "crypto/ecdsa"
+         "crypto/elliptic"
+         "crypto/x509/pkix"
+         "encoding/pem"
+         "encoding/asn1"
+         "reflect"
 
+         "../xml"
          "../security"
          "../config"
+         "../message"
          
          "github.com/mbenkmann/golib/util"
+         "github.com/mbenkmann/golib/bytes"
        )
 
 
@@ -34,7 +49,7 @@ import (
 func Security_test() {
   fmt.Printf("\n==== security ===\n\n")
 
-  config.CACertPath = []string{"testdata/certs/ca.cert"}
+  config.Modify(func(r *config.Reloadable) { r.CACertPath = []string{"testdata/certs/ca.cert"} })
   
   // do not spam console with expected errors but do
   // store them in the log file (if any is configured)
@@ -44,6 +59,10 @@ func Security_test() {
   cli, srv := tlsTest("1", "1")
   check(cli!=nil, true)
   check(srv!=nil, true)
+  if srv != nil {
+    check(len(srv.Fingerprint), 64)
+    check(srv.Fingerprint, security.CertificateFingerprint(readTestCertificate("1")))
+  }
   
   cli, srv = tlsTest("1", "2")
   check(cli!=nil, true)
@@ -166,26 +185,584 @@ func Security_test() {
     check(srv.Access.DetectedHW.IPHostNumber, false)
     check(srv.Access.DetectedHW.MACAddress, true)
   }
+  
+  crl_test()
+  query_access_test()
+  target_scope_test()
+  ipv6_test()
+  certspec_test()
+  bans_test()
+  aead_test()
+  stamp_test()
 }
 
-func tlsTest(client, server string) (*security.Context, *security.Context) {
-  config.CertPath = "testdata/certs/" + server + ".cert"
-  config.CertKeyPath = "testdata/certs/" + server + ".key"
-  config.TLSServerConfig = nil
-  config.TLSClientConfig = nil
+// Revokes certificate "1" and checks that it is rejected.
+func crl_test() {
+  defer security.ReadCRLs()
+  defer modifyConfig(nil)()
+  
+  cacert := readTestCertificate("ca")
+  keypem, err := ioutil.ReadFile("testdata/certs/ca.key")
+  if !check(err, nil) { return }
+  blk, _ := pem.Decode(keypem)
+  if blk == nil { blk = &pem.Block{} }
+  key, err := x509.ParseECPrivateKey(blk.Bytes)
+  if !check(err, nil) { return }
+  
+  revoked := []pkix.RevokedCertificate{{SerialNumber:readTestCertificate("1").SerialNumber, RevocationTime:time.Now()}}
+  crl, err := cacert.CreateCRL(rand.Reader, key, revoked, time.Now(), time.Now().Add(time.Hour))
+  if !check(err, nil) { return }
+  crlpath := config.TempDir + "/ca.crl"
+  check(ioutil.WriteFile(crlpath, crl, 0644), nil)
+  config.Modify(func(r *config.Reloadable) { r.CRLPath = []string{crlpath} })
+  security.ReadCRLs()
+  
+  _, srv := tlsTest("1", "2")
+  check(srv, nil)
+  cli, _ := tlsTest("2", "1")
+  check(cli, nil)
+  cli, srv = tlsTest("2", "2")
+  check(cli!=nil, true)
+  check(srv!=nil, true)
+  
+  // A broken update must not un-revoke the certificate.
+  check(ioutil.WriteFile(crlpath, []byte("broken"), 0644), nil)
+  security.ReadCRLs()
+  _, srv = tlsTest("1", "2")
+  check(srv, nil)
+  
+  config.Modify(func(r *config.Reloadable) { r.CRLPath = []string{} })
+  security.ReadCRLs()
+  _, srv = tlsTest("1", "2")
+  check(srv!=nil, true)
+  
+  // A certificate issued by an intermediate CA must be rejected if the
+  // intermediate CA has been revoked, even though the certificate itself
+  // has not.
+  template := readTestCertificate("ca")
+  template.Subject = pkix.Name{CommonName:"Intermediate Test CA"}
+  template.SubjectKeyId = nil
+  intermediate := signTestCertificate("intermediate", template)
+  leaf := signTestCertificateWith("intermediate-1", readTestCertificate("1"), intermediate)
+  config.Modify(func(r *config.Reloadable) { r.CACertPath = append(r.CACertPath, intermediate + ".cert") })
+  
+  _, srv = tlsTest(leaf, "2")
+  check(srv!=nil, true)
+  
+  revoked = []pkix.RevokedCertificate{{SerialNumber:readTestCertificate(intermediate).SerialNumber, RevocationTime:time.Now()}}
+  crl, err = cacert.CreateCRL(rand.Reader, key, revoked, time.Now(), time.Now().Add(time.Hour))
+  if !check(err, nil) { return }
+  check(ioutil.WriteFile(crlpath, crl, 0644), nil)
+  config.Modify(func(r *config.Reloadable) { r.CRLPath = []string{crlpath} })
+  security.ReadCRLs()
+  
+  _, srv = tlsTest(leaf, "2")
+  check(srv, nil)
+  cli, _ = tlsTest("2", leaf)
+  check(cli, nil)
+  cli, srv = tlsTest("2", "2")
+  check(cli!=nil, true)
+  check(srv!=nil, true)
+}
+
+// Checks that config.Reload() applies changed settings except for those
+// that require a restart.
+// Checks the GosaAccessQuery bits that enable individual kinds of queries.
+func query_access_test() {
+  // queryAudit(2), queryStats(5)
+  query := asn1.BitString{Bytes:[]byte{0x24}, BitLength:6}
+  acl, err := asn1.Marshal(struct{ Query asn1.BitString `asn1:"optional,tag:1"` }{query})
+  if !check(err, nil) { return }
+  name := createTestCertificate("query", []pkix.Extension{{Id:asn1.ObjectIdentifier{1,3,6,1,4,1,45753,1,6}, Value:acl}})
+  
+  cli, srv := tlsTest(name, "2")
+  check(cli!=nil, true)
+  if check(srv!=nil, true) {
+    check(srv.Access.Query.QueryAll, false)
+    check(srv.Access.Query.QueryJobs, false)
+    check(srv.Access.Query.QueryAudit, true)
+    check(srv.Access.Query.QueryLogs, false)
+    check(srv.Access.Query.QueryPackages, false)
+    check(srv.Access.Query.QueryStats, true)
+    check(srv.Access.Query.QueryFAI, false)
+  }
+  
+  // ProcessXMLMessage() must accept each query only if the bit that enables
+  // it or queryAll is set.
+  defer func(run_server bool){ config.RunServer = run_server }(config.RunServer)
+  config.RunServer = true
+  queries := []struct{ header, bit string }{
+    {"gosa_query_audit_trail", "QueryAudit"},
+    {"gosa_show_log_by_mac", "QueryLogs"},
+    {"gosa_query_connection_limits", "QueryStats"},
+    {"gosa_query_fai_server", "QueryFAI"},
+    {"gosa_query_fai_release", "QueryFAI"},
+  }
+  bits := reflect.TypeOf(security.GosaAccessQuery{})
+  for i := 0; i < bits.NumField(); i++ {
+    context := &security.Context{TLS:true, PeerID:security.SubjectAltName{IP:net.ParseIP("127.0.0.1")}}
+    security.SetTLSDefaults(context)
+    reflect.ValueOf(&context.Access.Query).Elem().Field(i).SetBool(true)
+    bit := bits.Field(i).Name
+    for _, q := range queries {
+      msg := xml.NewHash("xml", "header", q.header)
+      msg.Add("source", "GOSA")
+      msg.Add("target", "GOSA")
+      reply, _ := message.ProcessXMLMessage(msg, context, "dummy-key")
+      check(fmt.Sprintf("%v with %v accepted: %v", q.header, bit, reply.Len() > 0),
+            fmt.Sprintf("%v with %v accepted: %v", q.header, bit, bit == q.bit || bit == "QueryAll"))
+    }
+  }
+}
+
+// Checks parsing of the GosaTargetScope certificate extension.
+func target_scope_test() {
+  type targetScope struct {
+    DNSuffix []string `asn1:"optional,tag:0"`
+    UnitTag []string `asn1:"optional,tag:1"`
+    ObjectGroup []string `asn1:"optional,tag:2"`
+  }
+  oid := asn1.ObjectIdentifier{1,3,6,1,4,1,45753,1,7}
+  
+  cli, srv := tlsTest("1", "2")
+  check(cli!=nil, true)
+  if check(srv!=nil, true) {
+    check(srv.Scope.Unrestricted(), true)
+  }
+  
+  value, err := asn1.Marshal(targetScope{DNSuffix:[]string{"ou=dept1,o=go-susi,c=de"}, ObjectGroup:[]string{"kiosk","cn=lab,ou=groups,o=go-susi,c=de"}})
+  if !check(err, nil) { return }
+  name := createTestCertificate("scope", []pkix.Extension{{Id:oid, Value:value}})
+  cli, srv = tlsTest(name, "2")
+  check(cli!=nil, true)
+  if check(srv!=nil, true) {
+    check(srv.Scope.Unrestricted(), false)
+    check(srv.Scope.DNSuffix, []string{"ou=dept1,o=go-susi,c=de"})
+    check(len(srv.Scope.UnitTag), 0)
+    check(srv.Scope.ObjectGroup, []string{"kiosk","cn=lab,ou=groups,o=go-susi,c=de"})
+  }
+  
+  // An empty scope must not be mistaken for an unrestricted one.
+  value, err = asn1.Marshal(targetScope{})
+  if !check(err, nil) { return }
+  name = createTestCertificate("emptyscope", []pkix.Extension{{Id:oid, Value:value}})
+  _, srv = tlsTest(name, "2")
+  check(srv, nil)
+}
+
+// Creates a certificate and key like testdata/certs/2 but with the given
+// extensions, signed by testdata/certs/ca. Returns a name for tlsTest().
+func createTestCertificate(name string, extensions []pkix.Extension) string {
+  template := readTestCertificate("2")
+  template.ExtraExtensions = extensions
+  return signTestCertificate(name, template)
+}
+
+// Creates a certificate and key from the certificate spec (see
+// security.CertificateTemplate()), signed by testdata/certs/ca.
+// Returns a name for tlsTest().
+func createSpecCertificate(name string, spec string) string {
+  template, err := security.CertificateTemplate([]byte(spec))
+  if err != nil { panic(err) }
+  return signTestCertificate(name, template)
+}
+
+// Signs template with testdata/certs/ca and stores the certificate and a
+// new key in config.TempDir. Returns a name for tlsTest().
+func signTestCertificate(name string, template *x509.Certificate) string {
+  return signTestCertificateWith(name, template, "ca")
+}
+
+// Like signTestCertificate() but signs with the test certificate issuer
+// (see testCertPath()).
+func signTestCertificateWith(name string, template *x509.Certificate, issuer string) string {
+  cacert := readTestCertificate(issuer)
+  keypem, err := ioutil.ReadFile(testCertPath(issuer) + ".key")
+  if err != nil { panic(err) }
+  blk, _ := pem.Decode(keypem)
+  if blk == nil { panic("No PEM data in " + issuer + ".key") }
+  cakey, err := x509.ParseECPrivateKey(blk.Bytes)
+  if err != nil { panic(err) }
+  
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil { panic(err) }
+  template.SerialNumber = big.NewInt(time.Now().UnixNano())
+  der, err := x509.CreateCertificate(rand.Reader, template, cacert, &key.PublicKey, cakey)
+  if err != nil { panic(err) }
+  keyder, err := x509.MarshalECPrivateKey(key)
+  if err != nil { panic(err) }
+  
+  path := config.TempDir + "/" + name
+  err = ioutil.WriteFile(path + ".cert", pem.EncodeToMemory(&pem.Block{Type:"CERTIFICATE", Bytes:der}), 0644)
+  if err != nil { panic(err) }
+  err = ioutil.WriteFile(path + ".key", pem.EncodeToMemory(&pem.Block{Type:"EC PRIVATE KEY", Bytes:keyder}), 0600)
+  if err != nil { panic(err) }
+  return path
+}
+
+// Returns the path (without ".cert"/".key") of the certificate called name
+// (see tlsTest()).
+func testCertPath(name string) string {
+  if strings.HasPrefix(name, "/") { return name }
+  return "testdata/certs/" + name
+}
+
+// Makes the test certificate name (see testCertPath()) our own certificate
+// with config.ReadCertificates(). If that fails, config.TLSServerConfig()
+// and config.TLSClientConfig() are nil.
+func useTestCertificate(name string) {
+  config.Modify(func(r *config.Reloadable) {
+    r.CertPath = testCertPath(name) + ".cert"
+    r.CertKeyPath = testCertPath(name) + ".key"
+    r.TLSServerConfig = nil
+    r.TLSClientConfig = nil
+  })
   config.ReadCertificates()
-  server_conf := config.TLSServerConfig
+}
+
+func readTestCertificate(name string) *x509.Certificate {
+  data, err := ioutil.ReadFile(testCertPath(name) + ".cert")
+  if err != nil { panic(err) }
+  blk, _ := pem.Decode(data)
+  if blk == nil { panic("No PEM data in " + name + ".cert") }
+  cert, err := x509.ParseCertificate(blk.Bytes)
+  if err != nil { panic(err) }
+  return cert
+}
+
+// Checks that certificates made from a spec by security.CertificateTemplate()
+// produce the expected context.
+func certspec_test() {
+  spec := `
+# comment
+[certificate]
+subject = CN=spec.example.com, O=Example
+type = client
+days = 10
+
+[subjectAltName]
+ip = 10.1.0.0
+ip = 2001:db8::
+name = *.example.com
+
+[Limits]
+totalTime = 10s
+maxAnswers = 5
+communicateWith = *.example.com:20081
+communicateWith = 1.2.3.4
+
+[access]
+misc = wake
+query = queryJobs, queryAudit
+jobs = Wake lock
+incoming = ldap://ldap.example.com/ou=incoming,o=example
+detectedHw = template
+
+[scope]
+dnSuffix = ou=school1,o=example
+objectGroup = kiosk
+`
+  template, err := security.CertificateTemplate([]byte(spec))
+  if check(err, nil) {
+    check(template.Subject.CommonName, "spec.example.com")
+    check(template.Subject.Organization, []string{"Example"})
+    check(template.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth})
+    check(template.NotAfter.Sub(template.NotBefore), 10*24*time.Hour)
+    check(len(template.ExtraExtensions), 4)
+    
+    template.SerialNumber = big.NewInt(1)
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil { panic(err) }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil { panic(err) }
+    cert, err := x509.ParseCertificate(der)
+    if err != nil { panic(err) }
+    context, err := security.CertificateContext(cert)
+    if check(err, nil) {
+      check(context.TLS, true)
+      check(context.Subject, "CN=spec.example.com,O=Example")
+      check(context.PeerID.AllowedIPs, []net.IP{net.IP{10,1,0,0}, net.ParseIP("2001:db8::")})
+      check(context.PeerID.AllowedNames, []string{"*.example.com"})
+      check(context.Limits.TotalTime, 10*time.Second)
+      check(context.Limits.MaxAnswers, 5)
+      check(context.Limits.ConnParallel, 32) // default
+      check(context.Limits.CommunicateWith, []string{"*.example.com:20081", "1.2.3.4"})
+      check(context.Access.Misc, security.GosaAccessMisc{Wake:true})
+      check(context.Access.Query, security.GosaAccessQuery{QueryJobs:true, QueryAudit:true})
+      check(context.Access.Jobs, security.GosaAccessJobs{Wake:true, Lock:true})
+      check(context.Access.Incoming, []string{"ldap://ldap.example.com/ou=incoming,o=example"})
+      check(context.Access.LDAPUpdate, security.GosaAccessLDAPUpdate{})
+      check(context.Access.DetectedHW, security.GosaAccessLDAPDetectedHardware{Template:true})
+      check(context.Scope.DNSuffix, []string{"ou=school1,o=example"})
+      check(context.Scope.UnitTag, []string{})
+      check(context.Scope.ObjectGroup, []string{"kiosk"})
+    }
+  }
+  
+  // registeredIDs in subjectAltName
+  template, err = security.CertificateTemplate([]byte("[certificate]\nsubject=CN=x\n[subjectAltName]\nspecial=configfile\nspecial=SRVRecord"))
+  if check(err, nil) {
+    template.SerialNumber = big.NewInt(2)
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil { panic(err) }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil { panic(err) }
+    cert, err := x509.ParseCertificate(der)
+    if err != nil { panic(err) }
+    check(strings.Contains(security.CertificateInfo(cert), "RegisteredIDs: [1.3.6.1.4.1.45753.1.2 1.3.6.1.4.1.45753.1.3]"), true)
+  }
+  
+  for _, bad := range []string{
+    "[certificate]\nsubject=O=Example",             // no CN
+    "[certificate]\nsubject=CN=x\ntype=router",
+    "[certificate]\nsubject=CN=x\ndays=-1",
+    "[certificate]\nsubject=CN=x\n[unknown]",
+    "[certificate]\nsubject=CN=x\nfoo=bar",
+    "subject=CN=x",                                  // outside of section
+    "[certificate]\nsubject=CN=x\n[subjectAltName]\nip=1.2.3",
+    "[certificate]\nsubject=CN=x\n[subjectAltName]\nspecial=everybody",
+    "[certificate]\nsubject=CN=x\n[limits]\nmaxAnswers=-5",
+    "[certificate]\nsubject=CN=x\n[limits]\ntotalTime=forever",
+    "[certificate]\nsubject=CN=x\n[access]\njobs=wake fly",
+    "[certificate]\nsubject=CN=x\n[scope]",          // empty scope would be rejected
+  } {
+    _, err = security.CertificateTemplate([]byte(bad))
+    check(err != nil, true)
+  }
+}
+
+// Checks AllowedIPs matching with IPv4 and IPv6 wildcard addresses.
+func ipv6_test() {
+  verify := func(peer string, allowed ...string) bool {
+    context := &security.Context{}
+    context.PeerID.IP = net.ParseIP(peer)
+    for _, ip := range allowed {
+      context.PeerID.AllowedIPs = append(context.PeerID.AllowedIPs, net.ParseIP(ip))
+    }
+    context.Limits.CommunicateWith = []string{"*"}
+    return context.Verify()
+  }
+  
+  check(verify("2001:db8:1::5", "2001:db8:1::5"), true)
+  check(verify("2001:db8:1::5", "2001:db8:1::"), true)
+  check(verify("2001:db8:2::5", "2001:db8:1::"), false)
+  check(verify("2001:db8:2::5", "2001:db8::"), true)
+  check(verify("2001:db8:2::5", "::"), true)
+  check(verify("2001:db8:2::5", "0.0.0.0"), false)
+  check(verify("10.1.2.3", "::"), false)
+  check(verify("10.1.2.3", "10.1.0.0"), true)
+  check(verify("10.1.2.3", "10.2.0.0"), false)
+  check(verify("10.1.2.3", "::ffff:10.1.2.3"), true)
+  
+  // the legacy defaults accept everybody
+  context := &security.Context{}
+  context.PeerID.IP = net.ParseIP("2001:db8::1")
+  security.SetLegacyDefaults(context)
+  context.Limits.CommunicateWith = []string{"*"}
+  check(context.Verify(), true)
+  context.PeerID.IP = net.ParseIP("10.1.2.3")
+  check(context.Verify(), true)
+  
+  // communicateWith with bracketed IPv6 address and port
+  oldIP, oldListen := config.IP, config.ServerListenAddress
+  config.IP = "2001:db8::7"
+  config.ServerListenAddress = "[::]:20081"
+  context.Limits.CommunicateWith = []string{"[2001:db8::7]:20081"}
+  check(context.Verify(), true)
+  context.Limits.CommunicateWith = []string{"2001:db8::7"}
+  check(context.Verify(), true)
+  context.Limits.CommunicateWith = []string{"[2001:db8::7]:20082"}
+  check(context.Verify(), false)
+  config.IP, config.ServerListenAddress = oldIP, oldListen
+  
+  // IPv6 has no broadcast => link-local all-nodes multicast with zone
+  check(config.MakeBroadcast(net.ParseIP("2001:db8::7"), net.CIDRMask(64, 128), "eth0"), "ff02::1%eth0")
+  check(config.MakeBroadcast(net.ParseIP("10.1.2.3"), net.CIDRMask(16, 32), "eth0"), "10.1.255.255")
+}
+
+func bans_test() {
+  register := func(ip string) bool {
+    addr := &net.TCPAddr{IP:net.ParseIP(ip), Port:12345}
+    if !security.ConnectionLimitsRegister(addr) { return false }
+    security.ConnectionLimitsDeregister(addr)
+    return true
+  }
+  query := func(ip string) *xml.Hash {
+    limits := security.ConnectionLimitsQuery()
+    for entry := limits.First("entry"); entry != nil; entry = entry.Next() {
+      if entry.Text("ip") == ip { return entry }
+    }
+    return nil
+  }
+  
+  defer modifyConfig(nil)()
+  
+  // without BansInit() nobody is banned
+  security.Ban(net.ParseIP("192.0.2.1"), time.Hour, "test")
+  check(register("192.0.2.1"), true)
+  
+  bandb := xml.NewDB("bandb", nil, 0)
+  expired := xml.NewHash("ban", "ip", "192.0.2.2")
+  expired.Add("until", util.MakeTimestamp(time.Now().Add(-time.Hour)))
+  restored := xml.NewHash("ban", "ip", "192.0.2.3")
+  restored.Add("until", util.MakeTimestamp(time.Now().Add(time.Hour)))
+  bandb.AddClone(expired, restored)
+  security.BansInit(bandb)
+  check(bandb.Query(xml.FilterSimple("ip","192.0.2.2")).First("ban"), nil)
+  check(register("192.0.2.3"), false)
+  check(security.BanLift(net.ParseIP("192.0.2.3")), true)
+  check(register("192.0.2.3"), true)
+  check(bandb.Query(xml.FilterAll).First("ban"), nil)
+  
+  security.Ban(net.ParseIP("192.0.2.1"), time.Hour, "test")
+  check(register("192.0.2.1"), false)
+  entry := query("192.0.2.1")
+  check(entry != nil, true)
+  if entry != nil {
+    check(entry.Text("reason"), "test")
+    check(entry.Text("refused"), "0")
+  }
+  check(bandb.Query(xml.FilterSimple("ip","192.0.2.1")).First("ban").Text("reason"), "test")
+  check(security.BanLift(net.ParseIP("192.0.2.1")), true)
+  check(security.BanLift(net.ParseIP("192.0.2.1")), false)
+  check(register("192.0.2.1"), true)
+  entry = query("192.0.2.1")
+  check(entry != nil && entry.First("banned") == nil, true)
+  
+  // IPv6 addresses are banned per /64
+  security.Ban(net.ParseIP("2001:db8:5::1"), time.Hour, "test")
+  check(register("2001:db8:5::ffff"), false)
+  check(register("2001:db8:6::1"), true)
+  check(query("2001:db8:5::") != nil, true)
+  check(security.BanLift(net.ParseIP("2001:db8:5::2")), true)
+  check(register("2001:db8:5::1"), true)
+  
+  // bans expire
+  security.Ban(net.ParseIP("192.0.2.4"), 50*time.Millisecond, "test")
+  check(register("192.0.2.4"), false)
+  time.Sleep(100*time.Millisecond)
+  check(register("192.0.2.4"), true)
+  check(bandb.Query(xml.FilterSimple("ip","192.0.2.4")).First("ban"), nil)
+  
+  // exemptions
+  _, network, _ := net.ParseCIDR("192.0.2.16/28")
+  config.Modify(func(r *config.Reloadable) { r.BanAllowlist = []*net.IPNet{network} })
+  check(security.BanExempt(net.ParseIP("192.0.2.20")), true)
+  check(security.BanExempt(net.ParseIP("192.0.2.32")), false)
+  check(security.BanExempt(net.ParseIP("127.0.0.1")), true)
+  check(security.BanExempt(net.ParseIP("::1")), true)
+  security.Ban(net.ParseIP("192.0.2.20"), time.Hour, "test")
+  check(register("192.0.2.20"), true)
+  
+  // escalation of repeatedly refused connections
+  config.Modify(func(r *config.Reloadable) {
+    r.BanThreshold = 3
+    r.BanDuration = time.Hour
+  })
+  for _, ip := range []string{"198.51.100.7", "192.0.2.21"} {
+    addr := &net.TCPAddr{IP:net.ParseIP(ip), Port:12345}
+    check(security.ConnectionLimitsRegister(addr), true)
+    context := &security.Context{}
+    context.PeerID.IP = addr.IP
+    context.Limits.ConnPerHour = 1
+    security.ConnectionLimitsUpdate(context)
+    security.ConnectionLimitsDeregister(addr)
+    check(register(ip), false)
+    check(register(ip), false)
+    entry = query(ip)
+    check(entry != nil && entry.Text("refused") == "2" && entry.Text("connperhour") == "1", true)
+    check(register(ip), false)
+    entry = query(ip)
+    if ip == "192.0.2.21" { // exempt via BanAllowlist
+      check(entry != nil && entry.First("banned") == nil, true)
+    } else {
+      check(entry != nil && entry.First("banned") != nil, true)
+      check(entry != nil && strings.Contains(entry.Text("reason"), "ConnPerHour"), true)
+      check(entry != nil && entry.Text("refused") == "0", true)
+    }
+  }
+  check(security.BanLift(net.ParseIP("198.51.100.7")), true)
+  check(security.BanLift(net.ParseIP("192.0.2.21")), false)
+}
+
+// Checks GosaSeal()/GosaOpen() and the capability announcement.
+func aead_test() {
+  msg := "<xml><header>gosa_ping</header><source>GOSA</source><target>GOSA</target></xml>"
+  sealed := security.GosaSeal(msg, "foo")
+  check(security.IsSealed(sealed), true)
+  check(security.IsSealed(security.GosaEncrypt(msg, "foo")), false)
+  check(security.GosaOpen(sealed, "foo"), msg)
+  check(security.GosaOpen("  "+sealed+"\r\n", "foo"), msg)
+  check(security.GosaOpen(sealed, "bar"), "")
+  check(security.GosaSeal(msg, "foo") != sealed, true) // random nonce
+  check(security.GosaSeal("", "foo"), "")
+  
+  // GosaDecrypt() handles both formats
+  check(security.GosaDecrypt(sealed, "foo"), msg)
+  check(security.GosaDecrypt(security.GosaEncrypt(msg, "foo"), "foo"), msg)
+  
+  // any modification is detected
+  tampered := []byte(sealed)
+  tampered[len(tampered)/2] ^= 1
+  check(security.GosaOpen(string(tampered), "foo"), "")
+  check(security.GosaOpen(sealed[:len(sealed)-4], "foo"), "")
+  check(security.GosaOpen(strings.Replace(sealed, "GCM1:", "", 1), "foo"), "")
+  
+  // only messages starting with <xml> are accepted
+  check(security.GosaOpen(security.GosaSeal("foo", "foo"), "foo"), "")
+  
+  var buf bytes.Buffer
+  defer buf.Reset()
+  buf.WriteString(msg)
+  security.GosaSealBuffer(&buf, "foo")
+  check(security.IsSealedBuffer(&buf), true)
+  check(security.GosaOpen(buf.String(), "foo"), msg)
+  check(security.GosaOpenBuffer(&buf, "bar"), false)
+  check(security.GosaDecryptBuffer(&buf, "foo"), true)
+  check(buf.String(), msg)
+  
+  defer modifyConfig(nil)()
+  hia := xml.NewHash("xml", "header", "here_i_am")
+  security.AnnounceSealing(hia)
+  check(hia.Text("encryption"), "aes-256-gcm")
+  check(security.SupportsSealing(hia), true)
+  config.Modify(func(r *config.Reloadable) { r.Encryption = "legacy" })
+  check(security.SupportsSealing(hia), false)
+  hia = xml.NewHash("xml", "header", "here_i_am")
+  security.AnnounceSealing(hia)
+  check(hia.First("encryption") == nil, true)
+}
+
+// Checks the <msgtime> and <msgnonce> added by security.Stamp().
+func stamp_test() {
+  msg := "<xml><header>foo</header></xml>"
+  x, err := xml.StringToHash(security.Stamp(msg))
+  check(err, nil)
+  if x != nil {
+    check(x.Text("header"), "foo")
+    secs, err := strconv.ParseInt(x.Text("msgtime"), 10, 64)
+    check(err, nil)
+    check(time.Since(time.Unix(secs, 0)) < time.Minute, true)
+    check(len(x.Text("msgnonce")), 32)
+  }
+  check(security.Stamp(msg) != security.Stamp(msg), true)
+  check(security.Stamp("foo"), "foo")
+  check(security.Stamp(""), "")
+}
+
+func tlsTest(client, server string) (*security.Context, *security.Context) {
+  useTestCertificate(server)
+  server_conf := config.TLSServerConfig()
   
-  client_conf := config.TLSClientConfig
+  client_conf := config.TLSClientConfig()
   if client == "nocert" {
-    client_conf.Certificates = nil
+    if client_conf != nil {
+      client_conf = client_conf.Clone()
+      client_conf.Certificates = nil
+    }
   } else { 
-    config.CertPath = "testdata/certs/" + client + ".cert"
-    config.CertKeyPath = "testdata/certs/" + client + ".key"
-    config.TLSServerConfig = nil
-    config.TLSClientConfig = nil
-    config.ReadCertificates()
-    client_conf = config.TLSClientConfig
+    useTestCertificate(client)
+    client_conf = config.TLSClientConfig()
   }
   
   if server_conf == nil || client_conf == nil {
@@ -14,6 +14,9 @@ import (
          "strconv"
          "os"
          "os/exec"
+         "net/http"
+         "bytes"
+         "crypto/tls"
          "encoding/base64"
          
          "../db"
@@ -21,6 +24,7 @@ import (
          "github.com/mbenkmann/golib/util"
          "../config"
          "../security"
+         "../tftp"
        )
 
 
@@ -91,7 +95,7 @@ func SystemTest(daemon string, is_gosasi bool) {
   config.ReadConfig()
   defer config.Shutdown()
   
-  config.Timeout = reply_timeout
+  config.Modify(func(r *config.Reloadable) { r.Timeout = reply_timeout })
   
   if !launched_daemon {
     config.ServerSourceAddress = daemon
@@ -214,6 +218,16 @@ func SystemTest(daemon string, is_gosasi bool) {
     
     check_answer(a2, Jobs[2].Plainname, "none", "waiting", listen_address, Jobs[2].MAC, Jobs[2].Timestamp, Jobs[2].Periodic, Jobs[2].Trigger())
   }
+  
+  // A foreign_job_updates whose <source> is not the address it comes from
+  // must be rejected, even if that address is not a known peer.
+  spoofed := "10.11.12.13:20081"
+  x = hash("xml(header(foreign_job_updates)source(%v)target(%v))",spoofed,config.ServerSourceAddress)
+  x.AddClone(new_job)
+  send("", x)
+  time.Sleep(reply_timeout)
+  x = gosa("query_jobdb", hash("xml(where(clause(phrase(siserver(%v)))))",spoofed))
+  siFail(checkTags(x, "header,source,target,session_id?"),"")
 
   // Shut down our test server and active connections
   listen_stop()
@@ -295,11 +309,11 @@ func SystemTest(daemon string, is_gosasi bool) {
   // Test if server understands messages with ";IP:PORT" attached (gosa-si 2.7 protocol)
   conn, err := net.Dial("tcp", config.ServerSourceAddress)
   check(err, nil)
-  encrypted_msg := security.GosaEncrypt("<xml><header>gosa_query_jobdb</header><where></where><source>GOSA</source><target>GOSA</target></xml>", config.ModuleKey["[GOsaPackages]"])
-  util.SendLn(conn, encrypted_msg + ";"+listen_address , config.Timeout)
-  reply, err := util.ReadLn(conn, config.Timeout)
+  encrypted_msg := security.GosaEncrypt("<xml><header>gosa_query_jobdb</header><where></where><source>GOSA</source><target>GOSA</target></xml>", config.ModuleKey()["[GOsaPackages]"])
+  util.SendLn(conn, encrypted_msg + ";"+listen_address , config.Timeout())
+  reply, err := util.ReadLn(conn, config.Timeout())
   if err == nil {
-    reply = security.GosaDecrypt(reply, config.ModuleKey["[GOsaPackages]"])
+    reply = security.GosaDecrypt(reply, config.ModuleKey()["[GOsaPackages]"])
     x, err = xml.StringToHash(reply)
   }
   if err != nil { x = xml.NewHash("error") }
@@ -312,13 +326,29 @@ func SystemTest(daemon string, is_gosasi bool) {
     check(err, nil)
     encrypted_msg := "<xml><header>gosa_query_jobdb</header><where></where><source>GOSA</source><target>GOSA</target></xml>"
     if repcount == 1 { encrypted_msg = security.GosaEncrypt(encrypted_msg, "dummy-key") }
-    util.SendLn(conn, encrypted_msg, config.Timeout)
-    reply, err := util.ReadLn(conn, config.Timeout)
+    util.SendLn(conn, encrypted_msg, config.Timeout())
+    reply, err := util.ReadLn(conn, config.Timeout())
     reply = security.GosaDecrypt(reply, "dummy-key")
     check(strings.Contains(reply,"<error_string>"), true)
     if conn != nil { conn.Close() }
   }
   
+  if !gosasi {
+    // Test that the server rejects replayed and stale messages
+    query := "<xml><header>gosa_query_jobdb</header><where></where><source>GOSA</source><target>GOSA</target></xml>"
+    stamped := security.Stamp(query)
+    stale := strings.Replace(security.Stamp(query), "<msgtime>", "<msgtime>1", 1) // far future
+    for i, msg := range []string{stamped, stamped, stale} {
+      conn, err := net.Dial("tcp", config.ServerSourceAddress)
+      check(err, nil)
+      util.SendLn(conn, security.GosaEncrypt(msg, config.ModuleKey()["[GOsaPackages]"]), config.Timeout())
+      reply, _ := util.ReadLn(conn, config.Timeout())
+      reply = security.GosaDecrypt(reply, config.ModuleKey()["[GOsaPackages]"])
+      check(strings.Contains(reply,"<error_string>"), i > 0)
+      if conn != nil { conn.Close() }
+    }
+  }
+  
   if gosasi {
     // The job processing tests require the following go-susi extensions:
     // * multiple jobs with the same headertag+macaddress combination
@@ -374,6 +404,10 @@ func SystemTest(daemon string, is_gosasi bool) {
     run_tftp_tests()
     run_new_foo_config_tests()
     run_audit_tests()
+    if launched_daemon {
+      run_reload_tests()
+      run_sibridge_scope_tests(path.Join(path.Dir(daemon), "sibridge"))
+    }
   }
   
   run_activate_new_client_test()
@@ -487,6 +521,174 @@ func run_audit_tests() {
     check(checkTags(a,"key"), "")
     check(a.Text("key"),"2")
   }
+  
+  // The job_trigger_action_audit from above must have been recorded.
+  x = gosa("query_audit_trail", hash("xml(where(clause(phrase(header(job_trigger_action_audit)))))"))
+  a = x.First("answer1")
+  if check(a != nil, true) {
+    check(a.Text("target"), config.MAC)
+    check(a.Text("outcome"), "ok")
+  }
+  
+  // job_set_activated_for_installation produces no reply but must be audited
+  // with the outcome of its processing.
+  gosa_noreply("job_set_activated_for_installation", hash("xml(target(%v)macaddress(no-mac))", config.ServerSourceAddress))
+  time.Sleep(1*time.Second)
+  x = gosa("query_audit_trail", hash("xml(where(clause(phrase(target(no-mac)))))"))
+  a = x.First("answer1")
+  if check(a != nil, true) {
+    check(a.Text("header"), "job_set_activated_for_installation")
+    check(a.Text("outcome"), "error: job_trigger_action* with invalid or missing MAC address")
+  }
+  
+  // audit trail entry relayed by sibridge. Timestamp, peer and subject
+  // are determined by the server. Those from the message are only kept
+  // within <claimed>.
+  before := util.MakeTimestamp(time.Now())
+  x = gosa("add_audit_trail_entry", hash("xml(entry(timestamp(20131016120000)peer(10.9.8.7)subject(CN=forged)header(kill)target(00:0c:29:aa:bb:cc)outcome(ok)))"))
+  check(x.Text("answer1"), "0")
+  x = gosa("query_audit_trail", hash("xml(where(clause(phrase(target(00:0c:29:aa:bb:cc)))))"))
+  a = x.First("answer1")
+  if check(a != nil, true) {
+    check(a.Text("header"), "gosa_add_audit_trail_entry")
+    check(a.Text("argument"), "kill")
+    check(a.Text("outcome"), "ok")
+    check(len(a.Get("timestamp")), 1)
+    check(a.Text("timestamp") >= before, true)
+    check(len(a.Get("peer")), 1)
+    check(a.Text("peer") != "10.9.8.7" && a.Text("peer") != "", true)
+    check(len(a.Get("subject")), 1)
+    check(a.Text("subject") != "CN=forged", true)
+    claimed := a.First("claimed")
+    if check(claimed != nil, true) {
+      check(claimed.Text("timestamp"), "20131016120000")
+      check(claimed.Text("peer"), "10.9.8.7")
+      check(claimed.Text("subject"), "CN=forged")
+      check(claimed.Text("header"), "kill")
+    }
+  }
+  check(x.First("answer2"), nil)
+  
+  // A query for the claimed peer must not find the entry.
+  x = gosa("query_audit_trail", hash("xml(where(clause(phrase(peer(10.9.8.7)))))"))
+  check(x.First("answer1"), nil)
+}
+
+func run_reload_tests() {
+  conf, err := ioutil.ReadFile(config.ServerConfigPath)
+  if !check(err, nil) { return }
+  
+  changed := string(conf) + `
+[server]
+port = 20123
+
+[tftp]
+port = 20123
+/^reload-test$ = ` + path.Join(confdir,"pxelinux.txt") + `
+`
+  check(ioutil.WriteFile(config.ServerConfigPath, []byte(changed), 0644), nil)
+  daemonProcess.Signal(syscall.SIGHUP)
+  time.Sleep(2*time.Second)
+  
+  // New mapping must be active, server and TFTP ports must be unchanged.
+  cmp,_ := ioutil.ReadFile(path.Join(confdir,"pxelinux.txt"))
+  var data bytes.Buffer
+  err = tftp.Get("localhost:"+config.TFTPPort, "reload-test", &data, 5*time.Second)
+  if check(err, nil) {
+    check(data.String(), string(cmp))
+  }
+  x := gosa("query_jobdb", hash("xml(where())"))
+  check(x.Text("header"), "query_jobdb")
+  logdata, _ := ioutil.ReadFile(path.Join(confdir,"go-susi.log"))
+  check(strings.Contains(string(logdata), "Changing [server]/port requires a restart"), true)
+  check(strings.Contains(string(logdata), "Changing [tftp]/port requires a restart"), true)
+  
+  check(ioutil.WriteFile(config.ServerConfigPath, conf, 0644), nil)
+  daemonProcess.Signal(syscall.SIGHUP)
+  time.Sleep(2*time.Second)
+  
+  data.Reset()
+  err = tftp.Get("localhost:"+config.TFTPPort, "reload-test", &data, 5*time.Second)
+  check(err != nil, true)
+}
+
+// Checks that sibridge does not let a certificate with a restricted
+// GosaTargetScope touch jobs outside of its scope.
+func run_sibridge_scope_tests(sibridge string) {
+  if !path.IsAbs(sibridge) { sibridge = "./" + sibridge }
+  if _, err := os.Stat(sibridge); !check(err, nil) { return }
+  
+  abs := func(name string) string {
+    wd, _ := os.Getwd()
+    return path.Join(wd, testCertPath(name))
+  }
+  gosaconf := path.Join(confdir, "gosa.conf")
+  err := ioutil.WriteFile(gosaconf, []byte(`<?xml version="1.0"?>
+<conf>
+  <main>
+    <location name="systest">
+      <gosaSupportURI>`+config.ModuleKey()["[GOsaPackages]"]+`@`+config.ServerSourceAddress+`</gosaSupportURI>
+      <referral URI="ldap://127.0.0.1:20088/o=go-susi,c=de" adminDn="cn=admin,o=go-susi,c=de" adminPassword="password" />
+      <caCertificate>`+abs("ca")+`.cert</caCertificate>
+      <certificate>`+abs("1")+`.cert</certificate>
+      <keyfile>`+abs("1")+`.key</keyfile>
+    </location>
+  </main>
+</conf>
+`), 0644)
+  if !check(err, nil) { return }
+  
+  cmd := exec.Command(sibridge, "-c", gosaconf, "-l", "20089", config.ServerSourceAddress)
+  cmd.Stderr,_ = os.Create(path.Join(confdir, "sibridge.log"))
+  if !check(cmd.Start(), nil) { return }
+  defer cmd.Process.Signal(syscall.SIGTERM)
+  time.Sleep(2*time.Second) // give sibridge time to start up
+  
+  // systest1 is not below ou=nowhere
+  certpath := createSpecCertificate("sibridgescope", `
+[certificate]
+subject = CN=sibridge-scope-test
+type = client
+
+[subjectAltName]
+ip = 127.0.0.1
+
+[access]
+query = queryJobs
+jobs = modifyJobs
+
+[scope]
+dnSuffix = ou=nowhere,o=go-susi,c=de
+`)
+  cert, err := tls.LoadX509KeyPair(certpath + ".cert", certpath + ".key")
+  if !check(err, nil) { return }
+  
+  x := gosa("job_trigger_action_lock", hash("xml(target(%v)timestamp(%v)macaddress(%v))", Jobs[0].MAC, Jobs[0].Timestamp, Jobs[0].MAC))
+  check(x.Text("answer1"), "0")
+  time.Sleep(config.GosaQueryJobdbMaxDelay)
+  before := gosa("query_jobdb", hash("xml(where())"))
+  
+  conn, err := tls.Dial("tcp", "127.0.0.1:20089", &tls.Config{Certificates:[]tls.Certificate{cert}, InsecureSkipVerify:true})
+  if !check(err, nil) { return }
+  conn.SetDeadline(time.Now().Add(reply_timeout))
+  _, err = conn.Write([]byte("delete systest1\nquery\n"))
+  check(err, nil)
+  conn.CloseWrite()
+  reply, _ := ioutil.ReadAll(conn)
+  conn.Close()
+  check(strings.Contains(string(reply), "outside of your certificate's target scope"), true)
+  check(strings.Count(string(reply), "PERMISSION DENIED"), 2)
+  
+  // The jobdb must be unchanged.
+  after := gosa("query_jobdb", hash("xml(where())"))
+  for _, x := range []*xml.Hash{before, after} {
+    x.RemoveFirst("session_id")
+  }
+  check(after.String(), before.String())
+  x = gosa("query_jobdb", hash("xml(where(clause(phrase(macaddress(%v)))))", Jobs[0].MAC))
+  check(x.First("answer1") != nil, true)
+  
+  gosa("delete_jobdb_entry", hash("xml(where(clause(phrase(macaddress(%v)))))", Jobs[0].MAC))
 }
 
 func run_gosa_ping_tests() {
@@ -500,9 +702,9 @@ func run_gosa_ping_tests() {
   if err != nil {
     reply = err.Error()
   } else {
-    util.SendLn(conn, security.GosaEncrypt("<xml><header>gosa_ping</header><source>GOSA</source><target>"+mac+"</target></xml>", config.ModuleKey["[GOsaPackages]"]), config.Timeout)
-    reply, _ = util.ReadLn(conn, config.Timeout)
-    reply = security.GosaDecrypt(reply, config.ModuleKey["[GOsaPackages]"])
+    util.SendLn(conn, security.GosaEncrypt("<xml><header>gosa_ping</header><source>GOSA</source><target>"+mac+"</target></xml>", config.ModuleKey()["[GOsaPackages]"]), config.Timeout())
+    reply, _ = util.ReadLn(conn, config.Timeout())
+    reply = security.GosaDecrypt(reply, config.ModuleKey()["[GOsaPackages]"])
     if reply != "" { reply = "" } else { reply = "error" }
     conn.Close()
   }
@@ -513,9 +715,9 @@ func run_gosa_ping_tests() {
   if err != nil {
     reply = err.Error()
   } else {
-    util.SendLn(conn, security.GosaEncrypt("<xml><header>gosa_ping</header><source>GOSA</source><target>0f:C3:d2:Aa:11:22</target></xml>", config.ModuleKey["[GOsaPackages]"]), config.Timeout)
-    reply,_ = util.ReadLn(conn, config.Timeout)
-    reply = security.GosaDecrypt(reply, config.ModuleKey["[GOsaPackages]"])
+    util.SendLn(conn, security.GosaEncrypt("<xml><header>gosa_ping</header><source>GOSA</source><target>0f:C3:d2:Aa:11:22</target></xml>", config.ModuleKey()["[GOsaPackages]"]), config.Timeout())
+    reply,_ = util.ReadLn(conn, config.Timeout())
+    reply = security.GosaDecrypt(reply, config.ModuleKey()["[GOsaPackages]"])
     conn.Close()
   }
   
@@ -568,7 +770,7 @@ func run_activate_new_client_test() {
   dh2 := "<detected_hardware ghMemSize='12345' gotoLdapServer='1:ldap01.tvc.example.com:ldap://ldap01.tvc.example.com/o=go-susi,c=de' gotoSndModule=\"snd_noisemaster\"><gotoMODULES>m3</gotoMODULES><GOTOModulES>m4</GOTOModulES></detected_hardware>"
   dh_string := strings.Replace(detected_hardware.String(),"<detected_hardware>",dh2+"<detected_hardware>",-1)
   t0 = time.Now()
-  util.SendLnTo(config.ServerSourceAddress, security.GosaEncrypt(dh_string, keys[len(keys)-1]), config.Timeout)
+  util.SendLnTo(config.ServerSourceAddress, security.GosaEncrypt(dh_string, keys[len(keys)-1]), config.Timeout())
   check(waitlong(t0, "set_activated_for_installation").XML,"<xml></xml>") //check that we do NOT received safi
   check(waitlong(t0, "new_ldap_config").XML.Text("ldap_uri"), "ldap://ldap01.tvc.example.com")
   sys,err := db.SystemGetAllDataForMAC(mac, false)
@@ -822,7 +1024,211 @@ func run_tftp_tests() {
       // send ACK to avoid error log entry
       conn.WriteToUDP([]byte{0,4,0,1}, remote_addr)
     }
+    
+    _,err = conn.WriteToUDP([]byte("\000\001tmpl-wAfFel\000octet\000"),tftp_addr)
+    check(err,nil)
+    conn.SetReadDeadline(time.Now().Add(3*time.Second))
+    n, remote_addr, err = conn.ReadFromUDP(buf)
+    check(err,nil)
+    if check(n >= 4, true) {
+      check(buf[0:4], []byte{0,3,0,1})
+      faierror := base64.StdEncoding.EncodeToString([]byte("pxelinux:-1:crit:Unknown error or no error."))
+      check(string(buf[4:n]), "00:00:00:00:af:fe\nwAfFel\nfalse \nlocalboot default "+faierror+"\ntmpl-wAfFel\n")
+      // send ACK to avoid error log entry
+      conn.WriteToUDP([]byte{0,4,0,1}, remote_addr)
+    }
+    
+    _,err = conn.WriteToUDP([]byte("\000\001tmpl-33000011110000\000octet\000"),tftp_addr)
+    check(err,nil)
+    conn.SetReadDeadline(time.Now().Add(3*time.Second))
+    n, remote_addr, err = conn.ReadFromUDP(buf)
+    check(err,nil)
+    if check(n >= 4, true) {
+      check(buf[0:4], []byte{0,3,0,1})
+      check(strings.HasPrefix(string(buf[4:n]), "00:00:11:11:00:00\n33000011110000\ntrue foxnotebook-template\n"), true)
+      // send ACK to avoid error log entry
+      conn.WriteToUDP([]byte{0,4,0,1}, remote_addr)
+    }
+    
+    _, err = conn.WriteToUDP([]byte("\000\001tmpl-missing\000octet\000"), tftp_addr)
+    check(err,nil)
+    conn.SetReadDeadline(time.Now().Add(3*time.Second))
+    n, _, err = conn.ReadFromUDP(buf)
+    check(err,nil)
+    if check(n >= 4, true) {
+      check(buf[0:4], []byte{0,5,0,1})
+    }
+  }
+  
+  // tftp.GetWithOptions() with various blksize/windowsize combinations,
+  // including a file size that is a multiple of blksize.
+  cmp,_ := ioutil.ReadFile(path.Join(confdir,"pxelinux.txt"))
+  for _, opts := range [][2]int{{0,0},{7,0},{7,2},{6,3},{3,64},{512,16}} {
+    var data bytes.Buffer
+    tsize, err := tftp.GetWithOptions("localhost:"+config.TFTPPort, "pxelinux.0", &data, 5*time.Second, opts[0], opts[1])
+    if check(err, nil) {
+      check(tsize, int64(len(cmp)))
+      check(data.String(), string(cmp))
+    }
   }
+  
+  var data bytes.Buffer
+  _, err = tftp.GetWithOptions("localhost:"+config.TFTPPort, "doesntexist", &data, 5*time.Second, 7, 4)
+  check(err != nil && strings.HasPrefix(err.Error(), "TFTP error 1:"), true)
+  
+  // HTTP boot server with the same mappings
+  httpboot := "http://localhost:"+config.HTTPBootPort+"/"
+  resp, err := http.Get(httpboot+"pxelinux.0")
+  if check(err, nil) {
+    body, _ := ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    check(resp.StatusCode, 200)
+    check(string(body), string(cmp))
+  }
+  
+  req, _ := http.NewRequest("GET", httpboot+"pxelinux.0", nil)
+  req.Header.Set("Range", "bytes=2-6")
+  resp, err = http.DefaultClient.Do(req)
+  if check(err, nil) {
+    body, _ := ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    check(resp.StatusCode, 206)
+    check(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes 2-6/%v", len(cmp)))
+    check(string(body), string(cmp[2:7]))
+  }
+  
+  resp, err = http.Get(httpboot+"foo-wAfFel")
+  if check(err, nil) {
+    body, _ := ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    check(resp.StatusCode, 200)
+    check(string(body), "00:00:00:00:af:fe\nwAfFel\n2\nfox\nhound\nfoo-wAfFel\n")
+  }
+  
+  for _, notfound := range []string{"doesntexist", "blarg", "../pxelinux.0/../doesntexist"} {
+    resp, err = http.Get(httpboot+notfound)
+    if check(err, nil) {
+      resp.Body.Close()
+      check(resp.StatusCode, 404)
+    }
+  }
+  
+  // A failing hook is an error on the server's side, not a missing file.
+  resp, err = http.Get(httpboot+"false")
+  if check(err, nil) {
+    resp.Body.Close()
+    check(resp.StatusCode, 500)
+  }
+  
+  resp, err = http.Post(httpboot+"pxelinux.0", "text/plain", strings.NewReader("foo"))
+  if check(err, nil) {
+    resp.Body.Close()
+    check(resp.StatusCode, 405)
+  }
+  
+  // ProxyDHCP server
+  proxydhcp_addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:"+config.ProxyDHCPPort)
+  if !check(err, nil) { return }
+  proxydhcp_bcast_addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:"+config.ProxyDHCPBroadcastPort)
+  if !check(err, nil) { return }
+  dhcp_conn, err := net.ListenUDP("udp", nil)
+  if !check(err, nil) { return }
+  defer dhcp_conn.Close()
+  
+  pxe_request := func(msgtype byte, mac []byte, arch int, vendor string) []byte {
+    req := make([]byte, 240)
+    req[0] = 1 // BOOTREQUEST
+    req[1] = 1 // ethernet
+    req[2] = 6 // MAC address length
+    copy(req[4:8], []byte{0xde, 0xad, 0xbe, 0xef}) // xid
+    copy(req[12:16], []byte{127,0,0,1}) // ciaddr
+    copy(req[28:34], mac)
+    copy(req[236:240], []byte{99, 130, 83, 99})
+    req = append(req, 53, 1, msgtype)
+    req = append(req, 60, byte(len(vendor)))
+    req = append(req, vendor...)
+    req = append(req, 93, 2, byte(arch >> 8), byte(arch))
+    req = append(req, 97, 17, 0, 1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16)
+    return append(req, 255)
+  }
+  
+  // adds option 54 (server identifier) to req
+  with_server_id := func(req []byte, ip []byte) []byte {
+    req = append(req[0:len(req)-1], 54, 4)
+    req = append(req, ip...)
+    return append(req, 255)
+  }
+  
+  pxe_reply := func(addr *net.UDPAddr, req []byte) []byte {
+    _, err := dhcp_conn.WriteToUDP(req, addr)
+    if !check(err, nil) { return nil }
+    buf := make([]byte, 2048)
+    dhcp_conn.SetReadDeadline(time.Now().Add(2*time.Second))
+    n, _, err := dhcp_conn.ReadFromUDP(buf)
+    if err != nil { return nil }
+    return buf[0:n]
+  }
+  
+  boot_file := func(reply []byte) string {
+    return strings.TrimRight(string(reply[108:236]), "\000")
+  }
+  
+  reply := pxe_reply(proxydhcp_addr, pxe_request(3, []byte{0,0,0x11,0x11,0,0}, 7, "PXEClient:Arch:00007:UNDI:003016"))
+  if check(len(reply) >= 300, true) {
+    check(reply[0], byte(2))
+    check(reply[4:8], []byte{0xde, 0xad, 0xbe, 0xef})
+    check(reply[20:24], []byte{127,0,0,1})
+    check(reply[28:34], []byte{0,0,0x11,0x11,0,0})
+    check(boot_file(reply), "efi64/foxnotebook-template")
+    check(reply[240:243], []byte{53, 1, 5}) // DHCPACK
+    check(strings.Contains(string(reply[240:]), "PXEClient"), true)
+    check(strings.Contains(string(reply[240:]), string([]byte{97, 17, 0, 1,2,3})), true)
+  }
+  
+  reply = pxe_reply(proxydhcp_addr, pxe_request(1, []byte{0,0,0,0,0xaf,0xfe}, 0, "PXEClient:Arch:00000:UNDI:002001"))
+  if check(len(reply) >= 300, true) {
+    check(boot_file(reply), "bios/unknown")
+    check(reply[240:243], []byte{53, 1, 2}) // DHCPOFFER
+  }
+  
+  // empty boot file name => no answer
+  check(pxe_reply(proxydhcp_addr, pxe_request(3, []byte{0,0,0,0,0,1}, 0, "PXEClient")), []byte(nil))
+  // not a PXE client => no answer
+  check(pxe_reply(proxydhcp_addr, pxe_request(1, []byte{0,0,0,0,0xaf,0xfe}, 0, "MSFT 5.0")), []byte(nil))
+  
+  // broadcast port answers DHCPDISCOVER
+  reply = pxe_reply(proxydhcp_bcast_addr, pxe_request(1, []byte{0,0,0,0,0xaf,0xfe}, 0, "PXEClient:Arch:00000:UNDI:002001"))
+  if check(len(reply) >= 300, true) {
+    check(boot_file(reply), "bios/unknown")
+    check(reply[240:243], []byte{53, 1, 2}) // DHCPOFFER
+  }
+  // DHCPREQUEST for the main DHCP server on broadcast port => no answer
+  check(pxe_reply(proxydhcp_bcast_addr, with_server_id(pxe_request(3, []byte{0,0,0x11,0x11,0,0}, 7, "PXEClient:Arch:00007:UNDI:003016"), []byte{10,9,8,7})), []byte(nil))
+  // same DHCPREQUEST on the ProxyDHCP port => DHCPACK
+  reply = pxe_reply(proxydhcp_addr, with_server_id(pxe_request(3, []byte{0,0,0x11,0x11,0,0}, 7, "PXEClient:Arch:00007:UNDI:003016"), []byte{10,9,8,7}))
+  if check(len(reply) >= 300, true) {
+    check(reply[240:243], []byte{53, 1, 5}) // DHCPACK
+  }
+  // DHCPREQUEST naming us on broadcast port => DHCPACK
+  reply = pxe_reply(proxydhcp_bcast_addr, with_server_id(pxe_request(3, []byte{0,0,0x11,0x11,0,0}, 7, "PXEClient:Arch:00007:UNDI:003016"), []byte{127,0,0,1}))
+  if check(len(reply) >= 300, true) {
+    check(boot_file(reply), "efi64/foxnotebook-template")
+    check(reply[240:243], []byte{53, 1, 5}) // DHCPACK
+  }
+  
+  // A real DHCPDISCOVER on port 67 has ciaddr=0 and giaddr=0 and must be
+  // answered by broadcast because the client has no IP address, yet.
+  // All requests above have ciaddr set, so check the choice of address
+  // separately.
+  client := &net.UDPAddr{IP:net.IPv4(10,1,2,3), Port:68}
+  discover := pxe_request(1, []byte{0,0,0,0,0xaf,0xfe}, 0, "PXEClient:Arch:00000:UNDI:002001")
+  copy(discover[12:16], []byte{0,0,0,0})
+  check(tftp.ProxyDHCPReplyAddress(discover, client), &net.UDPAddr{IP:net.IPv4bcast, Port:68})
+  relayed := append([]byte{}, discover...)
+  copy(relayed[24:28], []byte{10,1,0,1}) // giaddr
+  relay := &net.UDPAddr{IP:net.IPv4(10,1,0,1), Port:67}
+  check(tftp.ProxyDHCPReplyAddress(relayed, relay), relay)
+  check(tftp.ProxyDHCPReplyAddress(pxe_request(1, []byte{0,0,0,0,0xaf,0xfe}, 0, "PXEClient"), client), client)
 }
 
 func run_trigger_activate_new_tests() {
@@ -1510,7 +1916,7 @@ func run_detected_hardware_tests() {
   dh2 := "<detected_hardware ghMemSize='12345' gotoLdapServer='1:ldap01.tvc.example.com:ldap://ldap01.tvc.example.com/o=go-susi,c=de' gotoSndModule=\"snd_noisemaster\"><gotoMODULES>m3</gotoMODULES><GOTOModulES>m4</GOTOModulES></detected_hardware>"
   dh_string := strings.Replace(detected_hardware.String(),"<detected_hardware>",dh2+"<detected_hardware>",-1)
   t0 = time.Now()
-  util.SendLnTo(config.ServerSourceAddress, security.GosaEncrypt(dh_string, keys[len(keys)-1]), config.Timeout)
+  util.SendLnTo(config.ServerSourceAddress, security.GosaEncrypt(dh_string, keys[len(keys)-1]), config.Timeout())
   check(waitlong(t0, "set_activated_for_installation").XML,"<xml></xml>")
   check(waitlong(t0, "new_ldap_config").XML.Text("ldap_uri"), "ldap://ldap01.tvc.example.com")
   sys,err := db.SystemGetAllDataForMAC(mac, false)
@@ -1658,7 +2064,7 @@ func run_detected_hardware_tests() {
   
   t0 = time.Now()
   dh_string = "<xml><header>detected_hardware</header><detected_hardware macAddress='"+mac+"' ipHostNumber='"+config.IP+"'><cn>mrhyde</cn></detected_hardware></xml>"
-  util.SendLnTo(config.ServerSourceAddress, security.GosaEncrypt(dh_string, config.ModuleKey["[GOsaPackages]"]), config.Timeout)
+  util.SendLnTo(config.ServerSourceAddress, security.GosaEncrypt(dh_string, config.ModuleKey()["[GOsaPackages]"]), config.Timeout())
   check(waitlong(t0, "set_activated_for_installation").XML,"<xml></xml>")
 
   sys, err = db.SystemGetAllDataForMAC(mac, false)
@@ -1683,7 +2089,7 @@ func run_detected_hardware_tests() {
   
   t0 = time.Now()
   dh_string = "<xml><header>detected_hardware</header><detected_hardware><macAddress>"+mac+"</macAddress><dn>cn=drjekyll,ou=systems,o=go-susi,c=de</dn></detected_hardware></xml>"
-  util.SendLnTo(config.ServerSourceAddress, security.GosaEncrypt(dh_string, config.ModuleKey["[GOsaPackages]"]), config.Timeout)
+  util.SendLnTo(config.ServerSourceAddress, security.GosaEncrypt(dh_string, config.ModuleKey()["[GOsaPackages]"]), config.Timeout())
   check(waitlong(t0, "set_activated_for_installation").XML,"<xml></xml>")
 
   sys, err = db.SystemGetAllDataForMAC(mac, false)
@@ -1704,7 +2110,7 @@ func run_detected_hardware_tests() {
   
   t0 = time.Now()
   dh_string = "<xml><header>detected_hardware</header><detected_hardware><macAddress>"+mac+"</macAddress><dn>cn=drjekyll,c=de</dn></detected_hardware></xml>"
-  util.SendLnTo(config.ServerSourceAddress, security.GosaEncrypt(dh_string, config.ModuleKey["[GOsaPackages]"]), config.Timeout)
+  util.SendLnTo(config.ServerSourceAddress, security.GosaEncrypt(dh_string, config.ModuleKey()["[GOsaPackages]"]), config.Timeout())
   check(waitlong(t0, "set_activated_for_installation").XML,"<xml></xml>")
 
   sys, err = db.SystemGetAllDataForMAC(mac, false)
@@ -1909,8 +2315,8 @@ func run_here_i_am_tests() {
   conn, err := net.Dial("tcp", config.ServerSourceAddress)
   check(err,nil)
   defer conn.Close()
-  util.SendLn(conn, security.GosaEncrypt("<xml><header>gosa_query_jobdb</header></xml>", keys[len(keys)-1]), config.Timeout)
-  reply, err := util.ReadLn(conn, config.Timeout)
+  util.SendLn(conn, security.GosaEncrypt("<xml><header>gosa_query_jobdb</header></xml>", keys[len(keys)-1]), config.Timeout())
+  reply, err := util.ReadLn(conn, config.Timeout())
   var x *xml.Hash
   if err == nil {
     reply = security.GosaDecrypt(reply, keys[len(keys)-1])
@@ -1929,6 +2335,13 @@ func run_job_processing_tests() {
   gosa("delete_jobdb_entry", hash("xml(where())"))  
   time.Sleep(reply_timeout)
   
+  // A <depends_on> that is not the id of a local job must be rejected
+  // instead of being treated as completed.
+  x := gosa("job_trigger_action_lock", hash("xml(target(%v)timestamp(%v)macaddress(%v)depends_on(99999999))", Jobs[0].MAC, Jobs[0].Timestamp, Jobs[0].MAC))
+  check(len(x.Text("error_string")) > 0, true)
+  x = gosa("query_jobdb", hash("xml(where())"))
+  check(x.First("answer1"), nil)
+  
   var t0 time.Time
 
   gotoMode := func(name string) string {
@@ -2305,7 +2718,7 @@ func run_startup_tests() {
   send("[ServerPackages]", hash("xml(header(new_server)new_server()key(%v)loaded_modules(goSusi)macaddress(00:00:00:00:00:00))", keys[0]))
   msg := wait(t0, "confirm_new_server")
   check(checkTags(msg.XML,"header,confirm_new_server,source,target,key,loaded_modules*,client*,macaddress"), "")
-  check(msg.Key, config.ModuleKey["[ServerPackages]"])
+  check(msg.Key, config.ModuleKey()["[ServerPackages]"])
   check(strings.Split(msg.XML.Text("source"),":")[0], msg.SenderIP)
   check(msg.XML.Text("source"), config.ServerSourceAddress)
   check(msg.XML.Text("target"), listen_address)
@@ -2362,7 +2775,7 @@ func run_foreign_job_updates_tests() {
       if siserver == "missing" { job.Remove(xml.FilterSimple("siserver")) }
       job.FirstOrAdd("xmlmessage").SetText(base64.StdEncoding.EncodeToString([]byte(hash("xml(header(%v)source(%v)target(%v)timestamp(%v)macaddress(%v))",Jobs[0].Type,"GOSA",job.Text("macaddress"),Jobs[0].Timestamp,job.Text("macaddress")).String())))
       x.AddClone(job)
-      util.SendLnTo(config.ServerSourceAddress, security.GosaEncrypt(x.String(), keys[0]), config.Timeout)
+      util.SendLnTo(config.ServerSourceAddress, security.GosaEncrypt(x.String(), keys[0]), config.Timeout())
     }  
   }
   
@@ -2449,6 +2862,10 @@ func run_foreign_job_updates_tests() {
   x.Add("sync", "ordered")
   msg = &queueElement{XML:x,Key:keys[0]}
   check_foreign_job_updates(msg, keys[0], listen_address, Jobs[0].Plainname, Jobs[0].Periodic, "waiting", "none", Jobs[0].MAC, Jobs[0].Trigger(), Jobs[0].Timestamp)
+  // The target of a job can not be changed.
+  x = gosa("update_status_jobdb_entry", hash("xml(where()update(macaddress(%v)))", Jobs[1].MAC))
+  check(len(x.Text("error_string")) > 0, true)
+  
   t0 = time.Now()
   gosa("update_status_jobdb_entry", hash("xml(where()update(progress(20)))"))
   msg = wait(t0, "foreign_job_updates")
@@ -2608,12 +3025,12 @@ func check_multiple_requests_over_one_connection() {
   defer conn.Close()
   
   for i :=0 ; i < 3; i++ {
-    util.SendLn(conn, "\n\n\r\r\r\n\r\r\n", config.Timeout) // test that empty lines don't hurt
-    util.SendLn(conn, security.GosaEncrypt(get_all_jobs.String(), config.ModuleKey["[GOsaPackages]"]), config.Timeout)
+    util.SendLn(conn, "\n\n\r\r\r\n\r\r\n", config.Timeout()) // test that empty lines don't hurt
+    util.SendLn(conn, security.GosaEncrypt(get_all_jobs.String(), config.ModuleKey()["[GOsaPackages]"]), config.Timeout())
     var x *xml.Hash
-    reply, err := util.ReadLn(conn, config.Timeout)
+    reply, err := util.ReadLn(conn, config.Timeout())
     if err == nil {
-      reply = security.GosaDecrypt(reply, config.ModuleKey["[GOsaPackages]"])
+      reply = security.GosaDecrypt(reply, config.ModuleKey()["[GOsaPackages]"])
       x, err = xml.StringToHash(reply)
     }
     check(err, nil)
@@ -2632,10 +3049,10 @@ func check_connection_drop_on_error1() {
   if err != nil { return }
   defer conn.Close()
   
-  util.SendLn(conn, security.GosaEncrypt(x.String(), config.ModuleKey["[GOsaPackages]"]), config.Timeout)
-  reply, err := util.ReadLn(conn, config.Timeout)
+  util.SendLn(conn, security.GosaEncrypt(x.String(), config.ModuleKey()["[GOsaPackages]"]), config.Timeout())
+  reply, err := util.ReadLn(conn, config.Timeout())
   if err == nil {
-    reply = security.GosaDecrypt(reply, config.ModuleKey["[GOsaPackages]"])
+    reply = security.GosaDecrypt(reply, config.ModuleKey()["[GOsaPackages]"])
     x, err = xml.StringToHash(reply)
   }
   check(err, nil)
@@ -2663,8 +3080,8 @@ func check_connection_drop_on_error2() {
   if err != nil { return }
   defer conn.Close()
   
-  util.SendLn(conn, security.GosaEncrypt(x.String(), "wuseldusel"), config.Timeout)
-  reply,_ := util.ReadLn(conn, config.Timeout)
+  util.SendLn(conn, security.GosaEncrypt(x.String(), "wuseldusel"), config.Timeout())
+  reply,_ := util.ReadLn(conn, config.Timeout())
   x, err = xml.StringToHash(reply)
   check(err, nil)
   
@@ -2697,7 +3114,7 @@ func check_new_server_on_startup(job Job) {
 
     // Verify that new_server message is according to spec
     check(checkTags(msg.XML,"header,new_server,source,target,key,loaded_modules*,client*,macaddress"), "")
-    check(msg.Key, config.ModuleKey["[ServerPackages]"])
+    check(msg.Key, config.ModuleKey()["[ServerPackages]"])
 
     siFail(strings.Split(msg.XML.Text("source"),":")[0], msg.SenderIP)
     siFail(msg.XML.Text("source"), config.ServerSourceAddress)
@@ -163,7 +163,7 @@ var active_connections = deque.New()
 
 // keys[0] is the key of the test server started by listen(). 
 // keys[len(keys)-1] is the key of the test client started by listen()
-// The other elements are copies of config.ModuleKeys
+// The other elements are copies of config.ModuleKeys()
 // ATTENTION! You must call init_keys() to initialize this.
 var keys []string
 
@@ -232,7 +232,7 @@ func send(keyid string, x *xml.Hash) {
   if keyid == "" { key = keys[0] } else 
   if keyid == "CLIENT" { key = keys[len(keys)-1] } else
   { 
-    key = config.ModuleKey[keyid] 
+    key = config.ModuleKey()[keyid] 
   }
   if x.First("source") == nil {
     x.Add("source", listen_address)
@@ -240,7 +240,7 @@ func send(keyid string, x *xml.Hash) {
   if x.First("target") == nil {
     x.Add("target", config.ServerSourceAddress)
   }
-  util.SendLnTo(config.ServerSourceAddress, security.GosaEncrypt(x.String(), key), config.Timeout)
+  util.SendLnTo(config.ServerSourceAddress, security.GosaEncrypt(x.String(), key), config.Timeout())
 }
 
 // Sends a GOSA message to the server being tested and
@@ -279,10 +279,10 @@ func gosa2(typ string, x *xml.Hash, read_reply bool) *xml.Hash {
     return xml.NewHash("error")
   }
   defer conn.Close()
-  util.SendLn(conn, security.GosaEncrypt(x.String(), config.ModuleKey["[GOsaPackages]"]), config.Timeout)
+  util.SendLn(conn, security.GosaEncrypt(x.String(), config.ModuleKey()["[GOsaPackages]"]), config.Timeout())
   if read_reply {
-    reply,err := util.ReadLn(conn, config.Timeout)
-    reply = security.GosaDecrypt(reply, config.ModuleKey["[GOsaPackages]"])
+    reply,err := util.ReadLn(conn, config.Timeout())
+    reply = security.GosaDecrypt(reply, config.ModuleKey()["[GOsaPackages]"])
     if err == nil {
       x, err = xml.StringToHash(reply)
     }
@@ -366,6 +366,14 @@ echo $2
 echo $tftp_request
 `), 0755)
 
+  foo_tmpl := tempdir+"/foo.tmpl"
+  ioutil.WriteFile(foo_tmpl, []byte(`{{.MAC}}
+{{.Vars.mac}}
+{{.Found}} {{.Attr "CN"}}
+{{bootaction .FAIState}} {{.Kernel}} {{.FAIError}}
+{{.Request}}
+`), 0644)
+
   send_user_msg := tempdir+"/send_user_msg"
   ioutil.WriteFile(send_user_msg, []byte(`#!/bin/bash
 set >"$0.env"
@@ -463,10 +471,17 @@ port = 20997, 20998  20999
 
 [tftp]
 port = 20069
+http-port = 20070
+proxydhcp-port = 20071
+proxydhcp-broadcast-port = 20072
+proxydhcp-server = 127.0.0.1
+proxydhcp-filename = {{if ne .MAC "00:00:00:00:00:01"}}{{.Firmware}}/{{if .Found}}{{.Attr "cn"}}{{else}}unknown{{end}}{{end}}
 /pxelinux.0 = `+tempdir+`/pxelinux.txt
 /^foo-(?P<mac>(?P<macaddress>.*)) = |`+tempdir+`/foo.sh fox hound
 /^blarg =  
 /false = |/bin/false
+/^tmpl-(?P<mac>(?P<macaddress>.*)) = <`+tempdir+`/foo.tmpl
+/tmpl-missing = <`+tempdir+`/doesntexist.tmpl
 
 [faimon]
 port = 24711
@@ -620,6 +635,14 @@ func checkTags(x *xml.Hash, taglist string) string {
 
 
 
+// Calls config.Modify(f) (unless f is nil) and returns a function that
+// restores the previous settings. Use like this: defer modifyConfig(...)()
+func modifyConfig(f func(r *config.Reloadable)) func() {
+  old := config.Current()
+  if f != nil { config.Modify(f) }
+  return func() { config.Modify(func(r *config.Reloadable) { *r = *old }) }
+}
+
 // Waits until all pending changes to jobdb are processed, then returns all
 // messages from db.ForeignJobUpdates.
 func getFJU() []*xml.Hash {
@@ -636,8 +659,8 @@ func getFJU() []*xml.Hash {
 
 //initializes var keys. ATTENTION! Must be called after config.* is initialized
 func init_keys() {
-  keys = make([]string, len(config.ModuleKeys)+2)
-  for i := range config.ModuleKeys { keys[i+1] = config.ModuleKeys[i] }
+  keys = make([]string, len(config.ModuleKeys())+2)
+  for i := range config.ModuleKeys() { keys[i+1] = config.ModuleKeys()[i] }
   keys[0] = "none"
   keys[len(keys)-1] = "client_key"
 }  
@@ -828,7 +851,7 @@ func processMessage(str string, senderIP string, is_client bool) string {
   // it may ask as for our database, so we need to be able to respond
   if header == "gosa_query_jobdb" {
     emptydb := fmt.Sprintf("<xml><header>query_jobdb</header><source>%v</source><target>GOSA</target></xml>",listen_address)
-    return security.GosaEncrypt(emptydb, config.ModuleKey["[GOsaPackages]"])
+    return security.GosaEncrypt(emptydb, config.ModuleKey()["[GOsaPackages]"])
   }
   
   return ""
@@ -40,7 +40,7 @@ func UnitTests() {
   defer config.Shutdown()
   config.ReadConfig()
   util.LogLevel = config.LogLevel
-  config.Timeout = 5*time.Second
+  config.Modify(func(r *config.Reloadable) { r.Timeout = 5*time.Second })
   
   os.MkdirAll(path.Dir(config.JobDBPath), 0750)
   
@@ -66,6 +66,7 @@ func UnitTests() {
   Bytes_test()
   Util_test()
   Xml_test()
+  Ldap_test()
   DB_test() // Must run before Message_test()
   Message_test() // DB_test() must run before this to init db.*
 }
@@ -40,12 +40,14 @@ func Xml_test() {
   testHash()
   testSetText()
   testIterator()
+  testJSON()
   
   fmt.Printf("\n=== xml.HashFilter ===\n\n")
   testFilter()
   
   fmt.Printf("\n=== xml.DB ===\n\n")
   testDB()
+  testJournal()
 }
 
 // "&" starts a new <clause>  (the 1st clause is implicit)
@@ -236,6 +238,96 @@ func (*FilterAllButC) Accepts(x *xml.Hash) bool {
   return true
 }
 
+func testJournal() {
+  tempdir, _ := ioutil.TempDir("", "xml-test-")
+  defer os.RemoveAll(tempdir)
+  dbpath := tempdir + "/db.xml"
+  
+  jstor := &xml.JournalStorer{Path:dbpath}
+  _, err := jstor.Load("fruits")
+  check(os.IsNotExist(err), true)
+  
+  db := xml.NewDB("fruits", jstor, 1*time.Hour)
+  a, _ := xml.StringToHash("<fruit><name>apple</name></fruit>")
+  b, _ := xml.StringToHash("<fruit><name>banana</name><color>yellow\ngreen</color></fruit>")
+  c, _ := xml.StringToHash("<fruit><name>cherry</name></fruit>")
+  db.AddClone(a, b)
+  db.Replace(xml.FilterSimple("name","apple"), true, c)
+  db.Replace(xml.FilterSimple("name","kiwi"), true, a) // no match => no change
+  db.AddClone(a)
+  db.Remove(xml.FilterSimple("name","apple"))
+  
+  journal, err := ioutil.ReadFile(jstor.JournalPath())
+  check(err, nil)
+  check(string(journal), `<snapshot></snapshot>
+<insert><fruit><name>apple</name></fruit><fruit><color>yellow&#10;green</color><name>banana</name></fruit></insert>
+<replace><remove><fruit><name>apple</name></fruit></remove><insert><fruit><name>cherry</name></fruit></insert></replace>
+<insert><fruit><name>apple</name></fruit></insert>
+<remove><fruit><name>apple</name></fruit></remove>
+`)
+  
+  // a partial entry from a crash must be ignored
+  f, _ := os.OpenFile(jstor.JournalPath(), os.O_WRONLY|os.O_APPEND, 0)
+  f.WriteString("<insert><fruit><name>kiw")
+  f.Close()
+  
+  jstor = &xml.JournalStorer{Path:dbpath}
+  data, err := jstor.Load("fruits")
+  check(err, nil)
+  check(data, "<fruits><fruit><color>yellow\ngreen</color><name>banana</name></fruit><fruit><name>cherry</name></fruit></fruits>")
+  journal2, _ := ioutil.ReadFile(jstor.JournalPath())
+  check(string(journal2), string(journal))
+  
+  // a journal that belongs to an older snapshot (crash between writing
+  // the new snapshot and truncating the journal) must not be replayed
+  check(jstor.Compact(data), nil)
+  ioutil.WriteFile(jstor.JournalPath(), journal, 0640)
+  jstor = &xml.JournalStorer{Path:dbpath}
+  data, err = jstor.Load("fruits")
+  check(err, nil)
+  check(data, "<fruits><fruit><color>yellow\ngreen</color><name>banana</name></fruit><fruit><name>cherry</name></fruit></fruits>")
+  
+  db = xml.NewDB("fruits", jstor, 1*time.Hour)
+  db.Init(data)
+  db.AddClone(a)
+  db.Shutdown()
+  snapshot, err := xml.FileToHash(dbpath)
+  check(err, nil)
+  check(snapshot, "<fruits><fruit><color>yellow\ngreen</color><name>banana</name></fruit><fruit><name>cherry</name></fruit><fruit><name>apple</name></fruit></fruits>")
+  fi, err := os.Stat(jstor.JournalPath())
+  check(err, nil)
+  check(fi.Size(), 0)
+  
+  // identical items must be kept as separate items, both when replaying
+  // and when a stale journal is found next to a snapshot containing
+  // the same items as the journal's entries
+  jstor = &xml.JournalStorer{Path:dbpath}
+  data, err = jstor.Load("fruits")
+  check(err, nil)
+  db = xml.NewDB("fruits", jstor, 1*time.Hour)
+  db.Init(data)
+  db.Replace(xml.FilterSimple("name","apple"), true, c)
+  db.AddClone(a)
+  journal, _ = ioutil.ReadFile(jstor.JournalPath())
+  check(strings.HasPrefix(string(journal), "<snapshot></snapshot>"), false)
+  
+  fruits := "<fruits><fruit><color>yellow\ngreen</color><name>banana</name></fruit><fruit><name>cherry</name></fruit><fruit><name>cherry</name></fruit><fruit><name>apple</name></fruit></fruits>"
+  jstor = &xml.JournalStorer{Path:dbpath}
+  data, err = jstor.Load("fruits")
+  check(err, nil)
+  check(data, fruits)
+  
+  check(jstor.Compact(data), nil)
+  ioutil.WriteFile(jstor.JournalPath(), journal, 0640)
+  jstor = &xml.JournalStorer{Path:dbpath}
+  data, err = jstor.Load("fruits")
+  check(err, nil)
+  check(data, fruits)
+  fi, err = os.Stat(jstor.JournalPath())
+  check(err, nil)
+  check(fi.Size(), 0)
+}
+
 func testDB() {
   tempfile, _ := ioutil.TempFile("", "xml-test-")
   tempname := tempfile.Name()
@@ -809,6 +901,43 @@ func testSetText() {
   check(x, "<foo></foo>")
 }
 
+func testJSON() {
+  x := xml.NewHash("xml","header","answer")
+  check(string(x.JSON()), `{"header":"answer"}`)
+  
+  x.Add("answer1").Add("id","1")
+  x.Add("answer2").Add("id","2")
+  x.First("answer2").Add("macaddress","00:0c:29:50:a3:52")
+  x.Add("dup","a<b")
+  x.Add("dup","")
+  check(string(x.JSON()), `{"answer1":{"id":"1"},"answer2":{"id":"2","macaddress":"00:0c:29:50:a3:52"},"dup":["a\u003cb",""],"header":"answer"}`)
+  check(string(xml.NewHash("empty").JSON()), `""`)
+  
+  y, err := xml.JSONToHash("xml", strings.NewReader(`{"header":"gosa_query_jobdb","where":{"clause":{"phrase":[{"macaddress":"00:0c:29:50:a3:52"},{"status":"done"}]}},"limit":{"from":0,"to":true},"empty":null}`))
+  check(err, nil)
+  check(y, "<xml><empty></empty><header>gosa_query_jobdb</header><limit><from>0</from><to>true</to></limit><where><clause><phrase><macaddress>00:0c:29:50:a3:52</macaddress></phrase><phrase><status>done</status></phrase></clause></where></xml>")
+  
+  y, err = xml.JSONToHash("xml", strings.NewReader(x.String()))
+  check(y, nil)
+  check(err != nil, true)
+  
+  y, err = xml.JSONToHash("xml", strings.NewReader(`["foo"]`))
+  check(y, nil)
+  check(err != nil, true)
+  
+  y, err = xml.JSONToHash("xml", strings.NewReader(`{"a b":"foo"}`))
+  check(y, nil)
+  check(err != nil, true)
+  
+  y, err = xml.JSONToHash("xml", strings.NewReader(`{"a":[["foo"]]}`))
+  check(y, nil)
+  check(err != nil, true)
+  
+  y, err = xml.JSONToHash("xml", strings.NewReader(string(x.JSON())))
+  check(err, nil)
+  check(y, x)
+}
+
 func testIterator() {
   check(xml.NewHash("foo").FirstChild() == nil, true)
   check(xml.NewHash("foo","bar").FirstChild() == nil, true)
@@ -21,6 +21,7 @@ import (
          "math/rand"
          "net"
          "time"
+         "strconv"
          "strings"
          
          "github.com/mbenkmann/golib/util"
@@ -78,71 +79,165 @@ func writeReadUDP(udp_conn *net.UDPConn, remote_addr *net.UDPAddr, to_write, rea
   return 0, nil, err
 }
 
+// Reads from udp_conn into read_buf and returns the number of bytes read.
+// Packets from a port other than remote_addr's are ignored.
+// Each time nothing has been received for a random time between min_wait_retry
+// and max_wait_retry, to_resend is sent to remote_addr again. If timeout is
+// non-0 and nothing has been received within that duration, an error is
+// returned.
+func readUDP(udp_conn *net.UDPConn, remote_addr *net.UDPAddr, to_resend, read_buf []byte, timeout time.Duration) (int, error) {
+  if timeout == 0 { timeout = 365*86400*time.Second }
+  endtime := time.Now().Add(timeout)
+  
+  for {
+    timo := time.Duration(rand.Int63n(int64(max_wait_retry-min_wait_retry))) + min_wait_retry
+    endtime2 := time.Now().Add(timo)
+    if endtime2.After(endtime) { endtime2 = endtime }
+    
+    udp_conn.SetReadDeadline(endtime2)
+    n, raddr, err := udp_conn.ReadFromUDP(read_buf)
+    if err == nil {
+      if raddr.Port != remote_addr.Port { continue } // verify sender
+      if n < 4 { return 0, too_short }
+      return n, nil
+    }
+    
+    if e,ok := err.(*net.OpError); !ok || !e.Timeout() { return 0, err }
+    if time.Now().After(endtime) { return 0, err }
+    
+    _, err = udp_conn.WriteToUDP(to_resend, remote_addr)
+    if err != nil { return 0, err }
+  }
+}
+
 // Performs a TFTP get for path at host (which may optionally include a port;
 // if it doesn't, port 69 is used). If timeout != 0 and any individual read
 // operation (not the whole get()!) takes longer than that time, get() will
 // return an error. All the read data is written into w. w is NOT closed!
 // NOTE: path is usually a relative path that does not start with "/".
 func Get(host, path string, w io.Writer, timeout time.Duration) error {
+  _, err := get(host, path, w, timeout, nil)
+  return err
+}
+
+// Like Get() but requests the options tsize (RFC 2349) and, if non-0,
+// blksize (RFC 2348) and windowsize (RFC 7440) from the server.
+// Returns the transfer size announced by the server or -1 if the server
+// did not announce it.
+func GetWithOptions(host, path string, w io.Writer, timeout time.Duration, blocksize, windowsize int) (int64, error) {
+  options := []string{"tsize", "0"}
+  if blocksize > 0 { options = append(options, "blksize", strconv.Itoa(blocksize)) }
+  if windowsize > 0 { options = append(options, "windowsize", strconv.Itoa(windowsize)) }
+  return get(host, path, w, timeout, options)
+}
+
+// Performs the get for Get() and GetWithOptions(). options is a list of
+// alternating option names and values to be sent with the request.
+func get(host, path string, w io.Writer, timeout time.Duration, options []string) (int64, error) {
   blocksize := 512
-  buf := make([]byte,blocksize)
+  windowsize := 1
+  tsize := int64(-1)
+  buf := make([]byte,65536+4)
   
-  if strings.Index(host,":") < 0 { host = host+":69" }
+  if _, _, err := net.SplitHostPort(host); err != nil {
+    host = net.JoinHostPort(strings.Trim(host, "[]"), "69")
+  }
   
-  remote_addr, err := net.ResolveUDPAddr("udp4", host)
-  if err != nil { return err }
+  remote_addr, err := net.ResolveUDPAddr("udp", host)
+  if err != nil { return tsize, err }
   
-  local_addr, err := net.ResolveUDPAddr("udp4", ":0")
-  if err != nil { return err }
+  local_addr, err := net.ResolveUDPAddr("udp", ":0")
+  if err != nil { return tsize, err }
   
-  udp_conn, err := net.ListenUDP("udp4", local_addr)
-  if err != nil { return err }
+  udp_conn, err := net.ListenUDP("udp", local_addr)
+  if err != nil { return tsize, err }
   defer udp_conn.Close()
   local_addr = udp_conn.LocalAddr().(*net.UDPAddr)
   
-  n, remote_addr, err := writeReadUDP(udp_conn,remote_addr,[]byte("\000\001"+path+"\000octet\000"),buf,min_wait_retry, max_wait_retry,timeout)
-  if err != nil { return err }
+  request := "\000\001"+path+"\000octet\000"
+  for _, opt := range options { request += opt + "\000" }
   
-  raddr := remote_addr
+  n, remote_addr, err := writeReadUDP(udp_conn,remote_addr,[]byte(request),buf,min_wait_retry, max_wait_retry,timeout)
+  if err != nil { return tsize, err }
   
   ack := []byte{0,4,0,0}
   
-  blockid := 1
+  if buf[0] == 0 && buf[1] == 6 { // OACK
+    oack := strings.Split(string(buf[2:n]), "\000")
+    for i := 0; i+1 < len(oack); i += 2 {
+      value, err := strconv.ParseInt(oack[i+1], 10, 64)
+      if err != nil || value < 0 {
+        return tsize, fmt.Errorf("TFTP OACK with illegal value for %v: %v", oack[i], oack[i+1])
+      }
+      switch strings.ToLower(oack[i]) {
+        case "blksize":    blocksize = int(value)
+        case "windowsize": windowsize = int(value)
+        case "tsize":      tsize = value
+      }
+    }
+    if blocksize < 1 || blocksize > 65536 || windowsize < 1 || windowsize > 65535 {
+      return tsize, fmt.Errorf("TFTP OACK with illegal blksize %v or windowsize %v", blocksize, windowsize)
+    }
+    
+    _, err = udp_conn.WriteToUDP(ack, remote_addr)
+    if err != nil { return tsize, err }
+    n, err = readUDP(udp_conn, remote_addr, ack, buf, timeout)
+    if err != nil { return tsize, err }
+  }
+  
+  blockid := 1     // the next block we expect
+  inwindow := 0    // number of blocks received since the last ACK
+  gap := false     // true if we have ACKed a gap and wait for the retransmission
   
   for {
-    if buf[0] == 0 && buf[1] == 3 { // DATA
-      if buf[2] != byte(blockid >> 8) || buf[3] != byte(blockid & 0xff) {
-        if buf[2] == byte((blockid-1) >> 8) && buf[3] == byte((blockid-1) & 0xff) {
-          // DATA is retransmission. Probably because ACK has been lost. => Ignore. We'll resend ACK further below
-        } else {
-          return fmt.Errorf("TFTP packet with incorrect sequence number")
-        }
-      } else { // correct blockid => Next packet
-        
+    if buf[0] == 0 && buf[1] == 5 { // ERROR
+      return tsize, fmt.Errorf("TFTP error %v: %v", int(buf[2]) << 8 | int(buf[3]), strings.TrimRight(string(buf[4:n]), "\000"))
+    }
+    if buf[0] == 0 && buf[1] == 6 && blockid == 1 && options != nil {
+      // OACK retransmission. Probably because ACK 0 has been lost. => Resend it
+      _, err = udp_conn.WriteToUDP(ack, remote_addr)
+      if err != nil { return tsize, err }
+    } else if buf[0] != 0 || buf[1] != 3 { // not a DATA packet
+      return tsize, fmt.Errorf("Unexpected TFTP packet. Expected DATA, got %#v...",string(buf[0:n]))
+    } else {
+      received := int(buf[2]) << 8 | int(buf[3])
+      if received == blockid & 0xffff { // correct blockid => Next packet
         _, err = util.WriteAll(w,buf[4:n])
-        if err != nil { return err }
-        
-        ack[2] = byte(blockid >> 8)
-        ack[3] = byte(blockid & 0xff)
-
-        if n < blocksize { // was the received packet the last one?
-          _, err = udp_conn.WriteToUDP(ack, remote_addr) // send ACK and ...
-          break //... stop
-        }
-        
+        if err != nil { return tsize, err }
+      
+        ack[2] = buf[2]
+        ack[3] = buf[3]
         blockid++
-      }
+        inwindow++
+        gap = false
       
-      for {
-        n, raddr, err = writeReadUDP(udp_conn,remote_addr,ack,buf,min_wait_retry, max_wait_retry,timeout)
-        if raddr != nil && raddr.Port != remote_addr.Port { continue } // verify sender
-        if err != nil { return err }
-        break
+        last := n-4 < blocksize
+        if last || inwindow >= windowsize {
+          _, err = udp_conn.WriteToUDP(ack, remote_addr)
+          if err != nil { return tsize, err }
+          inwindow = 0
+          if last { break }
+        }
+      } else if received == (blockid-1) & 0xffff {
+        // The server did not get our ACK for the last block and retransmits
+        // the window that ends with it. => Resend ACK
+        _, err = udp_conn.WriteToUDP(ack, remote_addr)
+        if err != nil { return tsize, err }
+        inwindow = 0
+      } else if ahead := (received - blockid) & 0xffff; ahead < 0x8000 && !gap {
+        // A block within the window has been lost. Tell the server from
+        // where to resend by ACKing the last block we received in order.
+        // Further blocks of the same window are ignored.
+        _, err = udp_conn.WriteToUDP(ack, remote_addr)
+        if err != nil { return tsize, err }
+        inwindow = 0
+        gap = true
       }
-    } else { // not a DATA packet
-      return fmt.Errorf("Unexpected TFTP packet. Expected DATA, got %#v...",string(buf[0:n]))
     }
+    
+    n, err = readUDP(udp_conn, remote_addr, ack, buf, timeout)
+    if err != nil { return tsize, err }
   }
   
-  return nil
+  return tsize, nil
 }
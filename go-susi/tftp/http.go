@@ -0,0 +1,89 @@
+/*
+Copyright (c) 2026 go-susi contributors
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package tftp
+
+import (
+         "os"
+         "path"
+         "time"
+         "net/http"
+         "sync/atomic"
+         stdbytes "bytes"
+
+         "github.com/mbenkmann/golib/util"
+         "../config"
+       )
+
+// Number of HTTP boot requests received (including failed ones).
+// Must be accessed atomically.
+var HTTPRequestsTotal int64
+
+// Number of HTTP boot requests that have been served successfully.
+// Must be accessed atomically.
+var HTTPRequestsServed int64
+
+// Accepts HTTP GET and HEAD requests on listen_address and serves them
+// from the same mappings as the TFTP server (see ListenAndServe() and
+// SetMappings()). The URL path without the leading "/" is the path P that
+// is matched against the mappings, so that http://server/pxelinux.0
+// returns the same data as a TFTP request for "pxelinux.0". Hooks get the
+// same environment as for TFTP requests and the data is shared with the
+// TFTP server's cache. Range requests are supported.
+func HTTPListenAndServe(listen_address string) {
+  // Slow or idle clients must not hold on to connections (and goroutines)
+  // forever. A negative config.Timeout() means no limit.
+  server := &http.Server{Addr:listen_address, Handler:http.HandlerFunc(serveHTTP),
+                         ReadHeaderTimeout:config.Timeout(), ReadTimeout:config.Timeout(),
+                         WriteTimeout:config.Timeout(), IdleTimeout:config.Timeout()}
+  err := server.ListenAndServe()
+  util.Log(0, "ERROR! Cannot serve HTTP boot requests: %v", err)
+}
+
+func serveHTTP(w http.ResponseWriter, r *http.Request) {
+  atomic.AddInt64(&HTTPRequestsTotal, 1)
+
+  if r.Method != "GET" && r.Method != "HEAD" {
+    w.Header().Set("Allow", "GET, HEAD")
+    http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+
+  // path.Clean() removes "..", so that a mapping can not be tricked into
+  // serving a file outside of the intended directory.
+  request := path.Clean("/"+r.URL.Path)[1:]
+  util.Log(1, "INFO! HTTP boot: %v requests %v", r.RemoteAddr, request)
+
+  request_re, reply := getMappings()
+  filedata, err := getFile(request, request_re, reply)
+  if filedata == nil {
+    util.Log(1, "INFO! HTTP boot: Returning \"File not found\" as configured for \"%v\"", request)
+    http.NotFound(w, r)
+    return
+  }
+
+  defer filedata.Release()
+  if err != nil {
+    util.Log(0, "ERROR! HTTP boot read error: %v", err)
+    if os.IsNotExist(err) {
+      http.NotFound(w, r)
+    } else {
+      http.Error(w, "Error reading file", http.StatusInternalServerError)
+    }
+    return
+  }
+
+  http.ServeContent(w, r, request, time.Time{}, stdbytes.NewReader(filedata.Bytes()))
+  atomic.AddInt64(&HTTPRequestsServed, 1)
+}
@@ -0,0 +1,316 @@
+/*
+Copyright (c) 2026 go-susi contributors
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package tftp
+
+import (
+         "fmt"
+         "net"
+         "strings"
+         "sync"
+         "sync/atomic"
+         "text/template"
+         stdbytes "bytes"
+
+         "github.com/mbenkmann/golib/util"
+         "../config"
+       )
+
+// Number of PXE requests received by the ProxyDHCP server (not counting
+// ordinary DHCP traffic that is ignored). Must be accessed atomically.
+var ProxyDHCPRequestsTotal int64
+
+// Number of PXE requests the ProxyDHCP server has answered.
+// Must be accessed atomically.
+var ProxyDHCPRequestsServed int64
+
+// Number of PXE requests dropped because config.ProxyDHCPQueueMax requests
+// were already waiting. Must be accessed atomically.
+var ProxyDHCPRequestsDropped int64
+
+// A PXE request waiting to be answered by a ProxyDHCP worker.
+type proxyDHCPRequest struct {
+  // The address the request was received from.
+  raddr *net.UDPAddr
+  // The complete DHCP packet.
+  packet []byte
+  // The parsed options of packet (see dhcpOptions()).
+  options map[byte][]byte
+}
+
+// DHCP message types (option 53) relevant for ProxyDHCP.
+const (
+  dhcpDiscover = 1
+  dhcpOffer    = 2
+  dhcpRequest  = 3
+  dhcpAck      = 5
+)
+
+// The magic cookie that starts the options field of a DHCP packet.
+var dhcpMagicCookie = []byte{99, 130, 83, 99}
+
+// The parsed [tftp]/proxydhcp-filename template and the source it was parsed
+// from. Only reparsed when config.ProxyDHCPFilename() changes (SIGHUP).
+// Access protected by filenameTemplateMutex. See filenameTemplate().
+var filenameTemplate_src string
+var filenameTemplate_tmpl *template.Template
+var filenameTemplate_err error
+var filenameTemplateMutex sync.Mutex
+
+// Returns the parsed template config.ProxyDHCPFilename().
+func filenameTemplate() (*template.Template, error) {
+  filenameTemplateMutex.Lock()
+  defer filenameTemplateMutex.Unlock()
+  src := config.ProxyDHCPFilename()
+  if src != filenameTemplate_src || (filenameTemplate_tmpl == nil && filenameTemplate_err == nil) {
+    filenameTemplate_src = src
+    filenameTemplate_tmpl, filenameTemplate_err = template.New("proxydhcp-filename").Funcs(templateFuncs).Parse(src)
+  }
+  return filenameTemplate_tmpl, filenameTemplate_err
+}
+
+// The data passed to the [tftp]/proxydhcp-filename template.
+// In addition to the fields and methods of templateData, the template can
+// access {{.Arch}} and {{.Firmware}}.
+type proxyDHCPData struct {
+  *templateData
+  // The client system architecture from DHCP option 93 (RFC 4578),
+  // e.g. 0 for x86 BIOS, 7 for x64 UEFI. 0 if the client did not send it.
+  Arch int
+  // Arch as a name suitable for directory names: "bios", "efi32", "efi64",
+  // "arm32", "arm64" or "arch<n>" for other architectures.
+  Firmware string
+}
+
+// Returns the name for the client system architecture arch (see proxyDHCPData).
+func firmwareName(arch int) string {
+  switch arch {
+    case 0:    return "bios"
+    case 6:    return "efi32"
+    case 7, 9: return "efi64"
+    case 10:   return "arm32"
+    case 11:   return "arm64"
+  }
+  return fmt.Sprintf("arch%d", arch)
+}
+
+// Accepts DHCPDISCOVER and DHCPREQUEST packets from PXE clients on
+// listen_address and answers them as a ProxyDHCP server (see the PXE
+// specification), i.e. without assigning an IP address. This allows PXE
+// booting from go-susi without configuring boot server and boot file in
+// the main DHCP server. Packets that do not come from a PXE client
+// (vendor class identifier "PXEClient...") are ignored.
+//
+// The answer tells the client to load the boot file from the TFTP server
+// config.ProxyDHCPServer() (config.IP if empty). The name of the boot file
+// is the result of the text/template config.ProxyDHCPFilename() which gets
+// the same data as a TFTP template for the client's MAC address (see
+// renderTemplate()) plus the client's architecture (see proxyDHCPData).
+// Leading and trailing whitespace is removed from the result. If it is
+// empty, the client gets no answer.
+//
+// The ProxyDHCP server listens on 2 ports. Port 67 receives the broadcast
+// DHCPDISCOVER that is also answered by the main DHCP server. Port 4011
+// receives the DHCPREQUEST that some PXE clients send to the ProxyDHCP
+// server after they have obtained an IP address. Call this function once
+// for each port with broadcast==true for port 67. A DHCPREQUEST received
+// on port 67 is usually meant for the main DHCP server and is only answered
+// if it does not name a server (option 54) or names config.ProxyDHCPServer().
+//
+// PXE requests are answered by config.ProxyDHCPWorkers goroutines. If
+// config.ProxyDHCPQueueMax requests are waiting for them, further requests
+// are dropped, so that a flood of packets can not flood LDAP with lookups.
+func ProxyDHCPListenAndServe(listen_address string, broadcast bool) {
+  udp_addr, err := net.ResolveUDPAddr("udp", listen_address)
+  if err != nil {
+    util.Log(0, "ERROR! ProxyDHCP: %v", err)
+    return
+  }
+
+  udp_conn, err := net.ListenUDP("udp", udp_addr)
+  if err != nil {
+    util.Log(0, "ERROR! ProxyDHCP: ListenUDP(%v): %v", udp_addr, err)
+    return
+  }
+  defer udp_conn.Close()
+
+  queue := make(chan *proxyDHCPRequest, config.ProxyDHCPQueueMax)
+  defer close(queue)
+  for i := 0; i < config.ProxyDHCPWorkers; i++ {
+    go func() {
+      for request := range queue {
+        util.WithPanicHandler(func(){ handleProxyDHCP(udp_conn, request, broadcast) })
+      }
+    }()
+  }
+
+  readbuf := make([]byte, 2048)
+  for {
+    n, raddr, err := udp_conn.ReadFromUDP(readbuf)
+    if err != nil {
+      util.Log(0, "ERROR! ProxyDHCP: ReadFromUDP: %v", err)
+      continue
+    }
+
+    packet := make([]byte, n)
+    copy(packet, readbuf)
+    options := pxeOptions(packet)
+    if options == nil { continue }
+
+    atomic.AddInt64(&ProxyDHCPRequestsTotal, 1)
+
+    select {
+      case queue <- &proxyDHCPRequest{raddr:raddr, packet:packet, options:options}:
+      default:
+        // Log only now and then. Whoever floods us must not flood the log.
+        if dropped := atomic.AddInt64(&ProxyDHCPRequestsDropped, 1); dropped == 1 || dropped % 1000 == 0 {
+          util.Log(0, "ERROR! ProxyDHCP: Request queue full (%v requests) => Dropping PXE requests (%v so far)", config.ProxyDHCPQueueMax, dropped)
+        }
+    }
+  }
+}
+
+// Returns the options of the DHCP packet p (see dhcpOptions()) if p is a
+// BOOTREQUEST from a PXE client. Returns nil for all other packets.
+func pxeOptions(p []byte) map[byte][]byte {
+  // Only BOOTREQUESTs from ethernet hardware are relevant.
+  if len(p) < 240 || p[0] != 1 || p[1] != 1 || p[2] != 6 { return nil }
+  options := dhcpOptions(p)
+  if options == nil { return nil }
+  if !strings.HasPrefix(string(options[60]), "PXEClient") { return nil }
+  return options
+}
+
+// Parses the options of the DHCP packet p. Returns nil if p is not a
+// DHCP packet. Options that occur multiple times are concatenated (RFC 3396).
+func dhcpOptions(p []byte) map[byte][]byte {
+  if len(p) < 240 || !stdbytes.Equal(p[236:240], dhcpMagicCookie) { return nil }
+  options := map[byte][]byte{}
+  for i := 240; i < len(p); {
+    code := p[i]
+    if code == 255 { break }
+    if code == 0 { i++; continue }
+    if i+1 >= len(p) || i+2+int(p[i+1]) > len(p) { return nil }
+    options[code] = append(options[code], p[i+2:i+2+int(p[i+1])]...)
+    i += 2+int(p[i+1])
+  }
+  return options
+}
+
+// Returns the address to send the reply to the DHCP packet request
+// received from raddr to. A client that has no IP address yet can only
+// receive broadcasts. Packets from relays (giaddr) and clients with an
+// IP address (ciaddr) are answered directly.
+func ProxyDHCPReplyAddress(request []byte, raddr *net.UDPAddr) *net.UDPAddr {
+  if len(request) >= 28 && stdbytes.Equal(request[12:16], []byte{0,0,0,0}) && stdbytes.Equal(request[24:28], []byte{0,0,0,0}) {
+    return &net.UDPAddr{IP:net.IPv4bcast, Port:raddr.Port}
+  }
+  return raddr
+}
+
+// Answers the PXE request pxe received via udp_conn. broadcast is true if
+// udp_conn is the port 67 listener. See ProxyDHCPListenAndServe().
+func handleProxyDHCP(udp_conn *net.UDPConn, pxe *proxyDHCPRequest, broadcast bool) {
+  raddr := pxe.raddr
+  request := pxe.packet
+  options := pxe.options
+
+  var reply_type byte
+  msgtype := options[53]
+  switch {
+    case len(msgtype) == 1 && msgtype[0] == dhcpDiscover: reply_type = dhcpOffer
+    case len(msgtype) == 1 && msgtype[0] == dhcpRequest:  reply_type = dhcpAck
+    default: return
+  }
+
+  mac := formatMAC(fmt.Sprintf("%x", request[28:34]))
+
+  server := config.ProxyDHCPServer()
+  if server == "" { server = config.IP }
+  server_ip := net.ParseIP(server).To4()
+  if server_ip == nil {
+    util.Log(0, "ERROR! ProxyDHCP: Not an IPv4 address: \"%v\"", server)
+    return
+  }
+
+  // A DHCPREQUEST broadcast on port 67 that names another server is the
+  // client accepting the main DHCP server's offer. ACKing it would
+  // interfere with the main DHCP server.
+  if broadcast && reply_type == dhcpAck && len(options[54]) > 0 && !stdbytes.Equal(options[54], server_ip) {
+    util.Log(2, "DEBUG! ProxyDHCP: Ignoring DHCPREQUEST from %v (MAC %v) for server %v", raddr, mac, net.IP(options[54]))
+    return
+  }
+
+  arch := 0
+  if len(options[93]) >= 2 { arch = int(options[93][0]) << 8 | int(options[93][1]) }
+  util.Log(1, "INFO! ProxyDHCP: PXE request (type %v) from %v (MAC %v, architecture %v)", msgtype[0], raddr, mac, arch)
+
+  tmpl, err := filenameTemplate()
+  if err != nil {
+    util.Log(0, "ERROR! ProxyDHCP: [tftp]/proxydhcp-filename: %v", err)
+    return
+  }
+  data := &proxyDHCPData{templateData:newTemplateData("", map[string]string{"macaddress":mac}), Arch:arch, Firmware:firmwareName(arch)}
+  var buf stdbytes.Buffer
+  err = tmpl.Execute(&buf, data)
+  if err != nil {
+    util.Log(0, "ERROR! ProxyDHCP: [tftp]/proxydhcp-filename: %v", err)
+    return
+  }
+  filename := strings.TrimSpace(buf.String())
+  if filename == "" {
+    util.Log(1, "INFO! ProxyDHCP: Not answering %v because boot file name is empty", mac)
+    return
+  }
+  if len(filename) > 127 {
+    util.Log(0, "ERROR! ProxyDHCP: Boot file name too long: \"%v\"", filename)
+    return
+  }
+
+  reply := make([]byte, 240, 300)
+  reply[0] = 2 // BOOTREPLY
+  reply[1] = 1 // ethernet
+  reply[2] = 6 // MAC address length
+  copy(reply[4:8], request[4:8])     // xid
+  copy(reply[10:12], request[10:12]) // flags
+  copy(reply[12:16], request[12:16]) // ciaddr
+  copy(reply[20:24], server_ip)      // siaddr = TFTP server
+  copy(reply[24:28], request[24:28]) // giaddr
+  copy(reply[28:44], request[28:44]) // chaddr
+  copy(reply[108:236], filename)
+  copy(reply[236:240], dhcpMagicCookie)
+  reply = append(reply, 53, 1, reply_type)
+  reply = append(reply, 54, 4)
+  reply = append(reply, server_ip...)
+  reply = append(reply, 60, 9)
+  reply = append(reply, "PXEClient"...)
+  if uuid := options[97]; len(uuid) > 0 && len(uuid) < 256 {
+    reply = append(reply, 97, byte(len(uuid)))
+    reply = append(reply, uuid...)
+  }
+  // PXE vendor options: PXE_DISCOVERY_CONTROL (6) = 8, i.e. do not perform
+  // boot server discovery but load the boot file from siaddr directly.
+  reply = append(reply, 43, 4, 6, 1, 8, 255)
+  reply = append(reply, 255)
+  for len(reply) < 300 { reply = append(reply, 0) } // minimum BOOTP packet size
+
+  dest := ProxyDHCPReplyAddress(request, raddr)
+  _, err = udp_conn.WriteToUDP(reply, dest)
+  if err != nil {
+    util.Log(0, "ERROR! ProxyDHCP: WriteToUDP(%v): %v", dest, err)
+    return
+  }
+  util.Log(1, "INFO! ProxyDHCP: Sent boot file \"%v\" on %v to %v", filename, server, dest)
+  atomic.AddInt64(&ProxyDHCPRequestsServed, 1)
+}
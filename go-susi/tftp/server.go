@@ -30,6 +30,7 @@ import (
          "net"
          "math/rand"
          "sync"
+         "sync/atomic"
          "time"
          "strconv"
          "strings"
@@ -41,6 +42,14 @@ import (
          "../config"
        )
 
+// Number of TFTP requests received (including malformed and failed ones).
+// Must be accessed atomically.
+var RequestsTotal int64
+
+// Number of TFTP read requests that have been served successfully.
+// Must be accessed atomically.
+var RequestsServed int64
+
 // Accepts UDP connections for TFTP requests on listen_address, serves read requests
 // for path P based on request_re and reply as follows:
 //
@@ -50,6 +59,10 @@ import (
 // If reply[i] == "", then a file not found error is returned to the requestor.
 // If reply[i] starts with the character '|', the remainder is taken as the path
 // of a hook to execute and its stdout is returned to the requestor.
+// If reply[i] starts with the character '<', the remainder is taken as the path
+// of a Go text/template file that is rendered with the system's LDAP data
+// (see renderTemplate()) and the result is returned to the requestor. No
+// process is spawned for this.
 // Otherwise reply[i] is taken as the path of the file whose contents to send to
 // the requestor.
 //
@@ -65,10 +78,10 @@ import (
 //
 // Named subexpressions in request_re[i] other than "macaddress" will be
 // exported to the hook verbatim in like-named environment variables.
+//
+// The mapping can be replaced while the server is running with SetMappings().
 func ListenAndServe(listen_address string, request_re []*regexp.Regexp, reply []string) {
-  for i := range request_re {
-    util.Log(1, "INFO! TFTP: %v -> %v", request_re[i], reply[i])
-  }
+  SetMappings(request_re, reply)
   
   udp_addr,err := net.ResolveUDPAddr("udp", listen_address)
   if err != nil {
@@ -95,11 +108,36 @@ func ListenAndServe(listen_address string, request_re []*regexp.Regexp, reply []
     // overwriting the buffer.
     payload := string(readbuf[:n])
     
+    request_re, reply := getMappings()
     go util.WithPanicHandler(func(){handleConnection(return_addr, payload, request_re, reply)})
     
   }
 }
 
+// The request_re and reply lists currently used by ListenAndServe().
+var mappingsRequestRE []*regexp.Regexp
+var mappingsReply []string
+var mappingsMutex sync.Mutex
+
+// Replaces the request_re and reply lists (see ListenAndServe()) used for
+// subsequent TFTP and HTTP requests. Requests already in progress are not
+// affected.
+func SetMappings(request_re []*regexp.Regexp, reply []string) {
+  for i := range request_re {
+    util.Log(1, "INFO! TFTP: %v -> %v", request_re[i], reply[i])
+  }
+  mappingsMutex.Lock()
+  defer mappingsMutex.Unlock()
+  mappingsRequestRE = request_re
+  mappingsReply = reply
+}
+
+func getMappings() ([]*regexp.Regexp, []string) {
+  mappingsMutex.Lock()
+  defer mappingsMutex.Unlock()
+  return mappingsRequestRE, mappingsReply
+}
+
 type cacheEntry interface {
   Bytes() []byte
   Release()
@@ -158,7 +196,9 @@ func getCacheEntry(key string, afterlife time.Duration) *bufCacheEntry {
 // data to return for the request. If reply[i] == "",
 // then this function returns (nil,nil). If reply[i] starts with the
 // character '|', the remainder is taken as the path of a hook to execute
-// to generate the data. Otherwise reply[i] is taken as the path of the
+// to generate the data. If reply[i] starts with the character '<', the
+// remainder is taken as the path of a text/template to render (see
+// renderTemplate()). Otherwise reply[i] is taken as the path of the
 // file whose contents to return as data.
 //
 // When executing a hook, an environment variable called "tftp_request"
@@ -182,7 +222,7 @@ func getFile(request string, request_re []*regexp.Regexp, reply []string) (cache
     if subs := request_re[i].FindStringSubmatch(request); subs != nil {
       if reply[i] == "" { return nil, nil }
       
-      if reply[i][0] != '|' { // plain file
+      if reply[i][0] != '|' && reply[i][0] != '<' { // plain file
         subsidx := request_re[i].FindStringSubmatchIndex(request)
         fpath := string(request_re[i].ExpandString(nil, reply[i], request, subsidx))
         util.Log(1, "INFO! TFTP mapping \"%v\" => \"%v\"", request, fpath)
@@ -224,6 +264,45 @@ func getFile(request string, request_re []*regexp.Regexp, reply []string) (cache
         
         return entry, entry.Err
         
+      } else if reply[i][0] == '<' { // template
+        tmpl := strings.TrimSpace(reply[i][1:]) // cut off '<'
+        
+        // Same afterlife as for hooks, for the same reason.
+        entry := getCacheEntry(request, 5*time.Second)
+        
+        entry.Mutex.Lock()
+        defer entry.Mutex.Unlock()
+        
+        if entry.LoadCount == 0 {
+          util.Log(1, "INFO! TFTP: Rendering %v to generate %v", tmpl, request)
+          
+          vars := map[string]string{}
+          for k, varname := range request_re[i].SubexpNames() {
+            if varname == "" { continue }
+            vars[varname] = subs[k]
+            if varname == "macaddress" { vars[varname] = formatMAC(subs[k]) }
+          }
+          
+          err := renderTemplate(tmpl, request, vars, &entry.Data)
+          if err != nil {
+            util.Log(0, "ERROR! TFTP: error rendering %v: %v", tmpl, err)
+            entry.Data.Reset()
+            entry.Err = err
+          } else {
+            if entry.Data.Len() > 512 {
+              util.Log(1, "INFO! TFTP: Generated %v: %v bytes", request, entry.Data.Len())
+            } else {
+              util.Log(1, "INFO! TFTP: Generated %v:\n%v", request, entry.Data.String())
+            }
+          }
+        } else {
+          util.Log(1, "INFO! TFTP: Serving %v from cache", request)
+        }
+        
+        entry.LoadCount++
+        
+        return entry, entry.Err
+        
       } else { // hook
         hook := reply[i][1:] // cut off '|'
         
@@ -246,18 +325,7 @@ func getFile(request string, request_re []*regexp.Regexp, reply []string) (cache
             value := subs[k]
             
             if varname == "macaddress" {
-              format_mac := func(r rune) rune {
-                switch {
-                case r >= 'a' && r <= 'f': return r
-                case r >= '0' && r <= '9': return r
-                case r >= 'A' && r <= 'F': return 'a'+(r-'A')
-                }
-                return -1
-              }
-              
-              value = "000000000000" + strings.Map(format_mac, value)
-              value = value[len(value)-12:]
-              value = value[0:2] + ":" + value[2:4] + ":" + value[4:6] + ":" + value[6:8] + ":" + value[8:10] + ":" + value[10:12]
+              value = formatMAC(value)
               
               sys, err := db.SystemGetAllDataForMAC(value, true)
               
@@ -286,7 +354,7 @@ func getFile(request string, request_re []*regexp.Regexp, reply []string) (cache
           defer errbuf.Reset()
           cmd.Stdout = &entry.Data
           cmd.Stderr = &errbuf
-          err := cmd.Run()
+          err := db.HookRun("tftp-hook", cmd)
           if err != nil {
             util.Log(0, "ERROR! TFTP: error executing %v: %v (%v)", hook, err, errbuf.String())
             entry.Err = err
@@ -308,10 +376,30 @@ func getFile(request string, request_re []*regexp.Regexp, reply []string) (cache
     }
   }
   
-  errentry := &bufCacheEntry{LoadCount:1000, Err:fmt.Errorf("TFTP not configured to serve file \"%v\"", request)}
+  // A PathError, so that os.IsNotExist() can tell it apart from read errors.
+  err := &os.PathError{Op:"TFTP not configured to serve file", Path:request, Err:os.ErrNotExist}
+  errentry := &bufCacheEntry{LoadCount:1000, Err:err}
   return errentry, errentry.Err
 }
 
+// Converts mac to a MAC address by converting to lowercase, removing all
+// characters except 0-9a-f, left-padding to length 12 with 0s or truncating
+// to length 12 and inserting ":"s.
+func formatMAC(mac string) string {
+  format_mac := func(r rune) rune {
+    switch {
+    case r >= 'a' && r <= 'f': return r
+    case r >= '0' && r <= '9': return r
+    case r >= 'A' && r <= 'F': return 'a'+(r-'A')
+    }
+    return -1
+  }
+  
+  mac = "000000000000" + strings.Map(format_mac, mac)
+  mac = mac[len(mac)-12:]
+  return mac[0:2] + ":" + mac[2:4] + ":" + mac[4:6] + ":" + mac[6:8] + ":" + mac[8:10] + ":" + mac[10:12]
+}
+
 // Sends a TFTP ERROR to addr with the given error code and error message emsg.
 func sendError(udp_conn *net.UDPConn, addr *net.UDPAddr, code byte, emsg string) {
   util.Log(0, emsg)
@@ -331,6 +419,10 @@ func sendErrorWithoutLogging(udp_conn *net.UDPConn, addr *net.UDPAddr, code byte
 
 const total_timeout = 3 * time.Second
 
+// Largest windowsize (RFC 7440) the server agrees to. Larger requests
+// are answered with this value in the OACK.
+const max_windowsize = 64
+
 // Sends the data in sendbuf to peer_addr (with possible resends) and waits for
 // an ACK with the correct block id, if sendbuf contains a DATA message.
 // Returns true if the sending was successful and the ACK was received.
@@ -423,7 +515,100 @@ func sendAndWaitForAck(udp_conn *net.UDPConn, peer_addr *net.UDPAddr, sendbuf []
   return false
 }
 
+// Sends count consecutive blocks of data, starting with block number first
+// (counted from 0, so that its block id is first+1), as DATA packets to
+// peer_addr and waits for an ACK for one of them (RFC 7440). Each block is
+// blocksize bytes except for the last block of data, which is shorter
+// (possibly 0 bytes). If no matching ACK arrives, the whole window is resent.
+// Returns the number of blocks acknowledged (1..count) or 0 if the
+// transfer failed.
+func sendWindow(udp_conn *net.UDPConn, peer_addr *net.UDPAddr, data []byte, blocksize, first, count int, retransmissions, dups, strays *int) int {
+  // absolute deadline when this function will return 0
+  deadline := time.Now().Add(total_timeout)
+
+  readbuf := make([]byte, 4096)
+  sendbuf := make([]byte, blocksize+4)
+  sendbuf[0] = 0
+  sendbuf[1] = 3 // 3 => DATA
+  
+  *retransmissions-- // to counter the ++ being done at the start of the loop
+  
+  outer:
+  for {
+    // re/send the whole window
+    *retransmissions++
+    for i := 0; i < count; i++ {
+      blockid := first + i + 1
+      start := (first + i) * blocksize
+      end := start + blocksize
+      if end > len(data) { end = len(data) }
+      sendbuf[2] = byte(blockid >> 8)
+      sendbuf[3] = byte(blockid & 0xff)
+      copy(sendbuf[4:], data[start:end])
+      n,err := udp_conn.Write(sendbuf[0:4+end-start])
+      if err != nil { 
+        util.Log(0, "ERROR! TFTP error in Write(): %v", err)
+        break outer
+      }
+      if n != 4+end-start {
+        util.Log(0, "ERROR! TFTP: Incomplete write")
+        break outer
+      }
+    }
+    
+    for {
+      // check absolute deadline
+      if time.Now().After(deadline) { break outer}
+      
+      // set deadline for next read
+      timo := time.Duration(rand.Int63n(int64(max_wait_retry-min_wait_retry))) + min_wait_retry
+      endtime2 := time.Now().Add(timo)
+      if endtime2.After(deadline) { endtime2 = deadline }
+      udp_conn.SetReadDeadline(endtime2)
+     
+      n, from, err := udp_conn.ReadFromUDP(readbuf)
+      
+      if err != nil { 
+        e,ok := err.(*net.OpError)
+        if !ok || !e.Timeout() {
+          util.Log(0, "ERROR! TFTP ReadFromUDP() failed while waiting for ACK from %v (local address: %v): %v", udp_conn.RemoteAddr(), udp_conn.LocalAddr(), err)
+          break outer // retries make no sense => bail out
+        } else {
+          continue outer // resend
+        }
+      }
+      if from.Port != peer_addr.Port {
+        *strays++
+        emsg := fmt.Sprintf("WARNING! TFTP server got UDP packet from incorrect source: %v instead of %v", from.Port, peer_addr.Port)
+        sendError(udp_conn, from, 5, emsg) // 5 => Unknown transfer ID
+        continue // This error is not fatal since it doesn't affect our peer
+      }
+      if n == 4 && readbuf[0] == 0 && readbuf[1] == 4 { // 4 => ACK
+        // number of blocks from the window acknowledged by the ACK's block id
+        acked := ((int(readbuf[2]) << 8 | int(readbuf[3])) - first) & 0xffff
+        if acked >= 1 && acked <= count { return acked }
+        // An ACK for a block before the window. See sendAndWaitForAck()
+        // for why this DOES NOT CAUSE A RESEND.
+        *dups++
+        continue
+      }
+      if readbuf[0] == 0 && readbuf[1] == 5 { // error
+        util.Log(0, "ERROR! TFTP ERROR received while waiting for ACK from %v: %v", peer_addr, string(readbuf[4:n]))
+        break outer // retries make no sense => bail out
+      }
+      emsg := fmt.Sprintf("ERROR! TFTP server waiting for ACK from %v but got: %#v",peer_addr, string(readbuf[0:n]))
+      sendError(udp_conn, from, 0, emsg) // 0 => Unspecified error
+      break outer // retries make no sense => bail out
+    }
+  }
+  
+  util.Log(0, "ERROR! TFTP send not acknowledged by %v (retransmissions: %v, dups: %v, strays: %v)", peer_addr, *retransmissions, *dups, *strays)
+  
+  return 0
+}
+
 func handleConnection(peer_addr *net.UDPAddr, payload string, request_re []*regexp.Regexp, reply []string) {
+  atomic.AddInt64(&RequestsTotal, 1)
   retransmissions := 0
   dups := 0
   strays := 0
@@ -471,6 +656,7 @@ func handleConnection(peer_addr *net.UDPAddr, payload string, request_re []*rege
   data := filedata.Bytes()
   
   blocksize := 512
+  windowsize := 1
   
   // Process options in request
   oack := []string{}
@@ -489,6 +675,15 @@ func handleConnection(peer_addr *net.UDPAddr, payload string, request_re []*rege
     if option == "tsize" {
       oack = append(oack, option, strconv.Itoa(len(data)))
     }
+    
+    if option == "windowsize" {
+      new_ws, err := strconv.Atoi(value)
+      if err == nil && new_ws > 0 && new_ws <= 65535 {
+        if new_ws > max_windowsize { new_ws = max_windowsize }
+        windowsize = new_ws
+        oack = append(oack, option, strconv.Itoa(new_ws))
+      }
+    }
   }
 
   // Send OACK if we support any of the requested options
@@ -504,25 +699,18 @@ func handleConnection(peer_addr *net.UDPAddr, payload string, request_re []*rege
   }
   
   
-  blockid := 1
+  // The last block is shorter than blocksize. If len(data) is a multiple
+  // of blocksize, it is empty.
+  blocks := len(data) / blocksize + 1
   
-  sendbuf := make([]byte, blocksize+4)
-  sendbuf[0] = 0
-  sendbuf[1] = 3 // 3 => DATA
-  
-  start := 0
-  
-  for {
-    sz := len(data) - start
-    if sz > blocksize { sz = blocksize }
-    sendbuf[2] = byte(blockid >> 8)
-    sendbuf[3] = byte(blockid & 0xff)
-    copy(sendbuf[4:],data[start:start+sz])
-    if !sendAndWaitForAck(udp_conn, peer_addr, sendbuf[0:sz+4], &retransmissions, &dups, &strays) { return }
-    start += sz
-    blockid++    
-    if sz < blocksize { break }
+  for sent := 0; sent < blocks; {
+    count := blocks - sent
+    if count > windowsize { count = windowsize }
+    acked := sendWindow(udp_conn, peer_addr, data, blocksize, sent, count, &retransmissions, &dups, &strays)
+    if acked == 0 { return }
+    sent += acked
   }
   
+  atomic.AddInt64(&RequestsServed, 1)
   util.Log(1, "INFO! TFTP successfully sent %v to %v (retransmissions: %v, dups: %v, strays:%v)", request[0], peer_addr, retransmissions, dups, strays)
 }
@@ -0,0 +1,146 @@
+/*
+Copyright (c) 2026 go-susi contributors
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+*/
+
+package tftp
+
+import (
+         "io"
+         "path"
+         "strings"
+         "text/template"
+         "encoding/base64"
+
+         "../db"
+         "../xml"
+         "github.com/mbenkmann/golib/util"
+       )
+
+// The error passed to FAI (base64-encoded) if faistate does not contain one.
+const unknownFAIError = "pxelinux:-1:crit:Unknown error or no error."
+
+// The data passed to a template (see renderTemplate()). Templates access
+// the fields as {{.Request}}, {{.MAC}},... and the methods as
+// {{.Attr "gotobootkernel"}}.
+type templateData struct {
+  // The path P of the TFTP or HTTP request.
+  Request string
+  // The MAC address from the "macaddress" capturing group (formatted as
+  // described at ListenAndServe()) or "" if the mapping has no such group.
+  MAC string
+  // All named capturing groups of the mapping's regex. "macaddress" is
+  // formatted like MAC.
+  Vars map[string]string
+  // true if an LDAP object has been found for MAC.
+  Found bool
+  // The system's LDAP object including attributes inherited from object
+  // groups (see db.SystemGetAllDataForMAC()). Attribute names are
+  // lowercase. Empty if not Found.
+  System *xml.Hash
+  // The system's faiState, e.g. "install", "localboot" or "error:...".
+  FAIState string
+  // The system's FAIclass, e.g. "FAIBASE DEBIAN :wheezy".
+  FAIClass string
+  // The release from FAIclass, i.e. the part after the last ":", or ""
+  // if FAIclass contains no release.
+  Release string
+  // The system's gotoBootKernel or "default" if it has none.
+  Kernel string
+  // The system's gotoKernelParameters, i.e. the additional append line.
+  Append string
+  // The base64 encoding of the part of FAIState after the first ":".
+  // If FAIState contains no ":", a generic error is encoded.
+  FAIError string
+}
+
+// Returns the first value of the LDAP attribute name (case-insensitive)
+// or "" if the system does not have the attribute.
+func (d *templateData) Attr(name string) string {
+  values := d.System.Get(strings.ToLower(name))
+  if len(values) == 0 { return "" }
+  return values[0]
+}
+
+// Returns all values of the LDAP attribute name (case-insensitive).
+func (d *templateData) Attrs(name string) []string {
+  return d.System.Get(strings.ToLower(name))
+}
+
+// Functions available to templates in addition to the text/template builtins.
+var templateFuncs = template.FuncMap{
+  "bootaction": bootAction,
+  "join": strings.Join,
+  "base64": func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+}
+
+// Maps faistate to what a booting system should do:
+//   "localboot" if faistate is "" or starts with "localboot" or "softupdate"
+//               (updates are performed by the installed system)
+//   "install"   if faistate starts with "install"
+//   "error"     for all other states (e.g. "error:..."). The usual reaction
+//               is to boot FAI with FAI_ACTION=sysinfo.
+func bootAction(faistate string) string {
+  switch {
+    case faistate == "",
+         strings.HasPrefix(faistate, "localboot"),
+         strings.HasPrefix(faistate, "softupdate"): return "localboot"
+    case strings.HasPrefix(faistate, "install"):    return "install"
+  }
+  return "error"
+}
+
+// Renders the text/template file tmplpath into w for the given request.
+// vars are the named capturing groups of the mapping. See newTemplateData().
+func renderTemplate(tmplpath string, request string, vars map[string]string, w io.Writer) error {
+  tmpl, err := template.New(path.Base(tmplpath)).Funcs(templateFuncs).ParseFiles(tmplpath)
+  if err != nil { return err }
+  return tmpl.Execute(w, newTemplateData(request, vars))
+}
+
+// Returns the data for rendering a template for request. If vars contains
+// "macaddress", the system's data is read from LDAP. A system that is
+// not in LDAP is not an error. The data will have Found==false.
+func newTemplateData(request string, vars map[string]string) *templateData {
+  data := &templateData{Request:request, Vars:vars, System:xml.NewHash("xml")}
+  if mac, ok := vars["macaddress"]; ok {
+    data.MAC = mac
+    sys, err := db.SystemGetAllDataForMAC(mac, true)
+    if err != nil {
+      if _, not_found := err.(db.SystemNotFoundError); not_found {
+        util.Log(1, "INFO! TFTP: %v", err)
+      } else {
+        util.Log(0, "ERROR! TFTP: %v", err)
+      }
+      // Don't abort. The template will generate a default config.
+    } else {
+      data.Found = true
+      data.System = sys
+    }
+  }
+
+  data.FAIState = data.Attr("faistate")
+  data.FAIClass = data.Attr("faiclass")
+  if i := strings.LastIndex(data.FAIClass, ":"); i >= 0 {
+    data.Release = strings.TrimSpace(data.FAIClass[i+1:])
+  }
+  data.Kernel = data.Attr("gotobootkernel")
+  if data.Kernel == "" { data.Kernel = "default" }
+  data.Append = data.Attr("gotokernelparameters")
+  faierror := unknownFAIError
+  if i := strings.Index(data.FAIState, ":"); i >= 0 {
+    faierror = strings.TrimSpace(data.FAIState[i+1:])
+  }
+  data.FAIError = base64.StdEncoding.EncodeToString([]byte(faierror))
+
+  return data
+}
@@ -128,11 +128,16 @@ func (db *DB) Init(data *Hash) {
 
 // Immediately persists the database and then blocks all further access.
 // This call does not return until the database has been persisted.
+// If the database has a JournalingStorer, it is compacted.
 // WARNING! After calling this function all function calls on the database
 // will block forever.
 func (db *DB) Shutdown() {
   db.mutex.Lock()
-  db.persistWithLock()
+  if j, ok := db.persist.(JournalingStorer); ok {
+    j.Compact(db.data)
+  } else {
+    db.persistWithLock()
+  }
   // DO NOT db.mutex.Unlock()! The database has been shut down!
 }
 
@@ -148,6 +153,7 @@ func (db* DB) AddClone(items... *Hash) (*DB) {
     db.data.AddClone(item)
   }
   
+  db.journal(nil, items)
   db.persistJob()
   
   return db
@@ -185,6 +191,7 @@ func (db *DB) Remove(filter HashFilter) *Hash {
   
   result := db.data.Remove(filter)
   
+  db.journal(result, nil)
   db.persistJob()
   
   return result
@@ -206,6 +213,9 @@ func (db *DB) Replace(filter HashFilter, must_match bool, items... *Hash) *Hash
     for _, item := range items {
       db.data.AddClone(item)
     }
+    db.journal(result, items)
+  } else {
+    db.journal(result, nil)
   }
 
   db.persistJob()
@@ -213,6 +223,14 @@ func (db *DB) Replace(filter HashFilter, must_match bool, items... *Hash) *Hash
   return result
 }
 
+// If db.persist is a JournalingStorer, passes the change to its Journal() method.
+// REQUIRES HOLDING THE DB LOCK!
+func (db *DB) journal(removed *Hash, added []*Hash) {
+  if j, ok := db.persist.(JournalingStorer); ok {
+    j.Journal(removed, added)
+  }
+}
+
 // Launches a persist job unless blocked. REQUIRES HOLDING THE DB LOCK!
 func (db *DB) persistJob() {
   if !db.blockPersistJobs {
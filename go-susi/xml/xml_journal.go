@@ -0,0 +1,289 @@
+/* Copyright (C) 2026 go-susi contributors
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this file (originally named xml_journal.go) and associated documentation files
+ * (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package xml
+
+import (
+         "os"
+         "io"
+         "fmt"
+         "sync"
+         "path"
+         "bytes"
+         "bufio"
+         "strings"
+         "io/ioutil"
+         "crypto/sha256"
+         "encoding/hex"
+       )
+
+// A Storer that is told about every individual change to the database.
+// DB calls Journal() for each AddClone(), Remove() and Replace() while
+// holding the write lock, Store() from the persist job and Compact()
+// from Shutdown().
+type JournalingStorer interface {
+  Storer
+  // Records that the children of removed have been removed from the
+  // database and that clones of the added items have been added.
+  // removed may be nil.
+  Journal(removed *Hash, added []*Hash) error
+  // Stores db as a whole so that previously journaled changes are no
+  // longer needed.
+  Compact(db *Hash) error
+}
+
+// Below this size the journal will not be compacted by Store().
+const journalMinCompactSize = 65536
+
+// Stores a database as a snapshot file (in the same format as FileStorer)
+// plus a write-ahead journal (file Path+".journal") to which every change
+// is appended immediately. Store() only syncs the journal to disk and
+// rewrites the snapshot once the journal has grown larger than the snapshot.
+//
+// The first line of the journal is
+//   <snapshot>checksum</snapshot>
+// where checksum is the SHA-256 of the snapshot the journal applies to
+// (empty if there was no snapshot). Each following line is one of
+//   <insert>items</insert>
+//   <remove>items</remove>
+//   <replace><remove>items</remove><insert>items</insert></replace>
+// with newlines in the items encoded as character references.
+//
+// Compact() writes a new snapshot before it truncates the journal. If it is
+// interrupted in between, the checksum no longer matches and Load() discards
+// the journal instead of replaying changes that the snapshot already
+// contains. Replay is not idempotent (the database may contain identical
+// items), so this is the only thing that prevents changes from being applied
+// twice.
+type JournalStorer struct {
+  // Path of the snapshot file.
+  Path string
+
+  mutex sync.Mutex
+  // the journal file, opened on first use
+  journal *os.File
+  // number of bytes in the journal
+  journalSize int64
+  // true if data has been written to the journal since the last Sync()
+  dirty bool
+  // size of the most recent snapshot
+  snapshotSize int64
+  // checksum of the most recent snapshot ("" if there is none)
+  snapshotSum string
+}
+
+// Returns the path of the journal file.
+func (j *JournalStorer) JournalPath() string {
+  return j.Path + ".journal"
+}
+
+// Reads the snapshot (if it exists) and replays the journal (if it exists)
+// on top of it. If there is no snapshot, the returned Hash has the given name.
+// Returns an error with os.IsNotExist() if neither file exists.
+// A partial last journal entry (from a crash while writing it) is
+// discarded. Other errors are returned together with all data read up
+// to that point.
+func (j *JournalStorer) Load(name string) (*Hash, error) {
+  j.mutex.Lock()
+  defer j.mutex.Unlock()
+
+  var db *Hash
+  snapshot, err := ioutil.ReadFile(j.Path)
+  snapshot_missing := false
+  if err != nil {
+    if !os.IsNotExist(err) { return NewHash(name), err }
+    snapshot_missing = true
+    db = NewHash(name)
+  } else
+  {
+    j.snapshotSize = int64(len(snapshot))
+    j.snapshotSum = journalChecksum(snapshot)
+    db, err = ReaderToHash(bytes.NewReader(snapshot))
+    if err != nil { return db, err }
+  }
+
+  file, err := os.Open(j.JournalPath())
+  if err != nil {
+    if os.IsNotExist(err) && !snapshot_missing { err = nil }
+    return db, err
+  }
+  defer file.Close()
+
+  index := map[string][]*Hash{}
+  for child := db.FirstChild(); child != nil; child = child.Next() {
+    s := child.Element().String()
+    index[s] = append(index[s], child.Element())
+  }
+
+  j.journalSize = 0
+  r := bufio.NewReader(file)
+  for {
+    line, err := r.ReadString('\n')
+    if err == io.EOF {
+      if line != "" {
+        // partial record from an interrupted write
+        err = os.Truncate(j.JournalPath(), j.journalSize)
+        if err != nil { return db, err }
+      }
+      return db, nil
+    }
+    if err != nil { return db, err }
+    j.journalSize += int64(len(line))
+
+    rec, err := StringToHash(strings.TrimSpace(line))
+    if err != nil { return db, fmt.Errorf("%v: %v", j.JournalPath(), err) }
+    switch rec.Name() {
+      case "snapshot":
+        // If the journal belongs to an older snapshot, Compact() was
+        // interrupted after writing the new snapshot, which contains
+        // all of the journal's changes.
+        if !snapshot_missing && rec.Text() != j.snapshotSum {
+          err = os.Truncate(j.JournalPath(), 0)
+          j.journalSize = 0
+          return db, err
+        }
+      case "insert": journalInsert(db, index, rec)
+      case "remove": journalRemove(index, rec)
+      case "replace":
+        if rm := rec.First("remove"); rm != nil { journalRemove(index, rm) }
+        if ins := rec.First("insert"); ins != nil { journalInsert(db, index, ins) }
+      default:
+        return db, fmt.Errorf("%v: unknown journal entry <%v>", j.JournalPath(), rec.Name())
+    }
+  }
+}
+
+// Returns the checksum of the snapshot data for the <snapshot> journal entry.
+func journalChecksum(data []byte) string {
+  sum := sha256.Sum256(data)
+  return hex.EncodeToString(sum[:])
+}
+
+func journalInsert(db *Hash, index map[string][]*Hash, rec *Hash) {
+  for child := rec.FirstChild(); child != nil; child = child.Next() {
+    s := child.Element().String()
+    index[s] = append(index[s], db.AddClone(child.Element()))
+  }
+}
+
+func journalRemove(index map[string][]*Hash, rec *Hash) {
+  for child := rec.FirstChild(); child != nil; child = child.Next() {
+    s := child.Element().String()
+    items := index[s]
+    if len(items) == 0 { continue }
+    items[len(items)-1].remove()
+    if len(items) == 1 {
+      delete(index, s)
+    } else {
+      index[s] = items[:len(items)-1]
+    }
+  }
+}
+
+// Appends a record of the change to the journal.
+func (j *JournalStorer) Journal(removed *Hash, added []*Hash) error {
+  var rm, ins []string
+  if removed != nil {
+    for child := removed.FirstChild(); child != nil; child = child.Next() {
+      rm = append(rm, child.Element().String())
+    }
+  }
+  for _, item := range added { ins = append(ins, item.String()) }
+
+  var rec string
+  switch {
+    case len(rm) == 0 && len(ins) == 0: return nil
+    case len(rm) == 0: rec = "<insert>" + strings.Join(ins, "") + "</insert>"
+    case len(ins) == 0: rec = "<remove>" + strings.Join(rm, "") + "</remove>"
+    default: rec = "<replace><remove>" + strings.Join(rm, "") + "</remove><insert>" + strings.Join(ins, "") + "</insert></replace>"
+  }
+  rec = strings.Replace(strings.Replace(rec, "\r", "&#13;", -1), "\n", "&#10;", -1) + "\n"
+
+  j.mutex.Lock()
+  defer j.mutex.Unlock()
+
+  if j.journal == nil {
+    var err error
+    j.journal, err = os.OpenFile(j.JournalPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+    if err != nil { j.journal = nil; return err }
+    if fi, err := j.journal.Stat(); err == nil { j.journalSize = fi.Size() }
+    if j.journalSize == 0 {
+      n, err := io.WriteString(j.journal, "<snapshot>" + j.snapshotSum + "</snapshot>\n")
+      j.journalSize += int64(n)
+      if err != nil { return err }
+    }
+  }
+
+  n, err := io.WriteString(j.journal, rec)
+  j.journalSize += int64(n)
+  j.dirty = true
+  return err
+}
+
+// Syncs the journal to disk. If the journal has grown larger than the most
+// recent snapshot, a new snapshot is written via Compact().
+func (j *JournalStorer) Store(db *Hash) error {
+  j.mutex.Lock()
+  compact := j.journalSize > j.snapshotSize && j.journalSize > journalMinCompactSize
+  var err error
+  if !compact && j.dirty && j.journal != nil {
+    err = j.journal.Sync()
+    j.dirty = false
+  }
+  j.mutex.Unlock()
+
+  if compact { return j.Compact(db) }
+  return err
+}
+
+// Writes db to the snapshot file and truncates the journal.
+func (j *JournalStorer) Compact(db *Hash) error {
+  j.mutex.Lock()
+  defer j.mutex.Unlock()
+
+  temp, err := ioutil.TempFile(path.Dir(j.Path), path.Base(j.Path))
+  if err != nil { return err }
+
+  checksum := sha256.New()
+  n, err := db.WriteTo(io.MultiWriter(temp, checksum))
+  if err == nil { err = temp.Sync() }
+  temp.Close()
+  if err == nil {
+    err = os.Rename(temp.Name(), j.Path)
+  }
+  // WE DON'T os.Remove(temp.Name()) in case of error
+  // because the user may need it for manual data recovery.
+  if err != nil { return err }
+  j.snapshotSize = n
+  j.snapshotSum = hex.EncodeToString(checksum.Sum(nil))
+
+  if j.journal != nil {
+    j.journal.Close()
+    j.journal = nil
+  }
+  err = os.Truncate(j.JournalPath(), 0)
+  if os.IsNotExist(err) { err = nil }
+  if err == nil {
+    j.journalSize = 0
+    j.dirty = false
+  }
+  return err
+}
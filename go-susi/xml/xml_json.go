@@ -0,0 +1,102 @@
+/* Copyright (C) 2026 go-susi contributors
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this file (originally named xml_json.go) and associated documentation files
+ * (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package xml
+
+import (
+         "io"
+         "fmt"
+         "strings"
+         "encoding/json"
+       )
+
+// Converts the children of this Hash into a JSON object. The name of the
+// receiver itself is not part of the result.
+// Child elements without sub-elements become strings. Child elements with
+// sub-elements become objects (their text content is dropped). If there are
+// multiple children with the same name, they are combined into an array.
+// The keys of the result object are sorted.
+func (self *Hash) JSON() []byte {
+  data, err := json.Marshal(hashToJSONValue(self))
+  if err != nil { panic(err) } // can't happen, the value only contains maps, slices and strings
+  return data
+}
+
+func hashToJSONValue(x *Hash) interface{} {
+  if x.FirstChild() == nil { return x.Text() }
+
+  obj := map[string]interface{}{}
+  for _, tag := range x.Subtags() {
+    values := []interface{}{}
+    for child := x.First(tag); child != nil; child = child.Next() {
+      values = append(values, hashToJSONValue(child))
+    }
+    if len(values) == 1 {
+      obj[tag] = values[0]
+    } else {
+      obj[tag] = values
+    }
+  }
+  return obj
+}
+
+// Reads a JSON object from r and converts it to a Hash with the given name.
+// This is the inverse of Hash.JSON(). Arrays produce multiple child elements
+// of the same name, numbers and booleans are converted to their textual
+// representation and null produces an empty element.
+// The top-level JSON value must be an object.
+func JSONToHash(name string, r io.Reader) (xml *Hash, err error) {
+  dec := json.NewDecoder(r)
+  dec.UseNumber()
+  var v interface{}
+  err = dec.Decode(&v)
+  if err != nil { return nil, err }
+
+  obj, ok := v.(map[string]interface{})
+  if !ok { return nil, fmt.Errorf("JSONToHash: Top-level JSON value is not an object") }
+
+  xml = NewHash(name)
+  err = jsonObjectToHash(xml, obj)
+  if err != nil { return nil, err }
+  return xml, nil
+}
+
+func jsonObjectToHash(x *Hash, obj map[string]interface{}) error {
+  for key, value := range obj {
+    if key == "" || strings.ContainsAny(key, "<>&/ \t\r\n\"'") {
+      return fmt.Errorf("JSONToHash: Illegal element name \"%v\"", key)
+    }
+    values, isarray := value.([]interface{})
+    if !isarray { values = []interface{}{value} }
+    for _, val := range values {
+      child := x.Add(key)
+      switch val := val.(type) {
+        case nil:    // empty element
+        case map[string]interface{}:
+                     if err := jsonObjectToHash(child, val); err != nil { return err }
+        case []interface{}:
+                     return fmt.Errorf("JSONToHash: Nested arrays are not supported (element \"%v\")", key)
+        default:     child.SetText(val)
+      }
+    }
+  }
+  return nil
+}